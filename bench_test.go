@@ -2,6 +2,7 @@ package trie
 
 import (
 	"fmt"
+	"math/rand"
 	"testing"
 )
 
@@ -20,3 +21,169 @@ func BenchmarkKvInsert(b *testing.B) {
 		t.Add(s, n)
 	}
 }
+
+// childIndexes are the ways of finding children to compare, ScanChildren
+// being how every node used to work
+var childIndexes = []struct {
+	name  string
+	index ChildIndex
+}{
+	{"Adaptive", AdaptiveChildren},
+	{"Scan", ScanChildren},
+	{"Search", SearchChildren},
+}
+
+// randomKeys returns n random binary keys, which makes for nodes with lots of
+// children near the root
+func randomKeys(n int) [][]byte {
+	rng := rand.New(rand.NewSource(1))
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = make([]byte, 12)
+		rng.Read(keys[i])
+	}
+	return keys
+}
+
+func BenchmarkLookup(b *testing.B) {
+	keys := randomKeys(100000)
+	for _, c := range childIndexes {
+		b.Run(c.name, func(b *testing.B) {
+			t := New(WithChildIndex(c.index))
+			for _, k := range keys {
+				t.Add(k)
+			}
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				t.Exists(keys[n%len(keys)])
+			}
+		})
+	}
+}
+
+func BenchmarkRandomInsert(b *testing.B) {
+	keys := randomKeys(100000)
+	for _, c := range childIndexes {
+		b.Run(c.name, func(b *testing.B) {
+			t := New(WithChildIndex(c.index))
+			for n := 0; n < b.N; n++ {
+				if n%len(keys) == 0 {
+					t = New(WithChildIndex(c.index))
+				}
+				t.Add(keys[n%len(keys)])
+			}
+		})
+	}
+}
+
+// BenchmarkRandomDelete deletes keys and adds them back, which takes children
+// out of and puts them back into the busiest nodes
+func BenchmarkRandomDelete(b *testing.B) {
+	keys := randomKeys(100000)
+	for _, c := range childIndexes {
+		b.Run(c.name, func(b *testing.B) {
+			t := New(WithChildIndex(c.index))
+			for _, k := range keys {
+				t.Add(k)
+			}
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				k := keys[n%len(keys)]
+				t.Del(k)
+				t.Add(k)
+			}
+		})
+	}
+}
+
+func BenchmarkPrefixScan(b *testing.B) {
+	keys := randomKeys(100000)
+	for _, c := range childIndexes {
+		b.Run(c.name, func(b *testing.B) {
+			t := New(WithChildIndex(c.index))
+			for _, k := range keys {
+				t.Add(k)
+			}
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				t.WalkFrom(keys[n%len(keys)][:2], func([]byte, interface{}) bool {
+					return true
+				})
+			}
+		})
+	}
+}
+
+func BenchmarkIterate(b *testing.B) {
+	keys := randomKeys(100000)
+	for _, c := range []struct {
+		name string
+		opts []Option
+	}{
+		{"copied", nil},
+		{"shared", []Option{WithSharedKeys()}},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			t := New(c.opts...)
+			for _, k := range keys {
+				t.Add(k)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				t.Walk(func([]byte, interface{}) bool {
+					return true
+				})
+			}
+		})
+	}
+}
+
+func BenchmarkArenaInsert(b *testing.B) {
+	keys := randomKeys(100000)
+	for _, c := range []struct {
+		name string
+		opts []Option
+	}{
+		{"heap", nil},
+		{"arena", []Option{WithKeyArena(64 << 10)}},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				t := New(c.opts...)
+				for _, k := range keys {
+					t.Add(k)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkConcurrentLookup reads from every core while one goroutine keeps
+// writing, which readers of a ConcurrentTrie never wait for
+func BenchmarkConcurrentLookup(b *testing.B) {
+	keys := randomKeys(100000)
+	t := NewConcurrentKVTrie()
+	for _, k := range keys {
+		t.Add(k, 0)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for n := 0; ; n++ {
+			select {
+			case <-done:
+				return
+			default:
+				t.Set(keys[n%len(keys)], n)
+			}
+		}
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for n := 0; pb.Next(); n++ {
+			t.Exists(keys[n%len(keys)])
+		}
+	})
+}
@@ -1,7 +1,10 @@
 package trie
 
 import (
+	"bytes"
 	"log"
+	"slices"
+	"sort"
 	"strings"
 )
 
@@ -9,129 +12,306 @@ type bwTrie struct {
 	key      []byte
 	children []*bwTrie
 	endpoint uint8
+	// count is the number of keys at or beneath this node
+	count int
+	// index finds children by their first byte, for nodes with lots of them
+	index *childIndex
 }
 
-func (t *bwTrie) set(key []byte, _ ...interface{}) {
-	t.add(key)
+func (t *bwTrie) set(key []byte, l layout, _ ...interface{}) (interface{}, bool) {
+	return t.update(key, l, func(interface{}, bool) (interface{}, bool) {
+		return nil, true
+	})
 }
 
-func (t *bwTrie) add(key []byte, _ ...interface{}) {
-	for k, v := range t.children {
-		if lcp := longestCommonPrefix(t.children[k].key, key); lcp > 0 {
-			if lcp == len(key) && lcp == len(v.key) {
-				// This key exists exactly
-				// eg: have "aa", adding "aa"
-				if v.endpoint == 0 {
-					v.endpoint = 1
-				}
-			} else if lcp == len(key) {
-				// the entire key is a sub-key of the child key
-				// eg: have "aa", adding "aaa"
-				oldChild := v
-				oldChild.key = v.key[lcp:]
-				newChild := &bwTrie{
-					endpoint: 1,
-					key:      key[:lcp],
-					children: []*bwTrie{oldChild},
-				}
-				t.children[k] = newChild
-			} else if lcp == len(v.key) {
-				// the entire child key is a prefix for the key
-				// eg: have "aa", adding "aaa"
-				v.add(key[lcp:])
+func (t *bwTrie) add(key []byte, l layout, _ ...interface{}) bool {
+	_, exists := t.set(key, l)
+	return !exists
+}
+
+// update is the single descent behind add and set, see kvTrie.update.  BW
+// tries have no values, so fn is always passed nil, what it returns is only
+// used to decide whether to add the key
+func (t *bwTrie) update(key []byte, l layout, fn func(interface{}, bool) (interface{}, bool)) (interface{}, bool) {
+	if len(key) == 0 {
+		// The empty key is kept by the root, every other node has a key of
+		// its own and is only ever handed the rest of a key
+		return t.store(fn)
+	}
+	lo, children := t.span(l, key)
+	for i, v := range children {
+		k := lo + i
+		lcp := l.split.commonPrefix(v.key, key)
+		if lcp == 0 {
+			continue
+		}
+		if lcp == len(v.key) {
+			// the key is the child key, or the child key is a prefix of it
+			// eg: have "aa", adding "aa" or "aaa"
+			count := v.count
+			var existed bool
+			if lcp == len(key) {
+				_, existed = v.store(fn)
 			} else {
-				// the key and child key share a common prefix but are both going to
-				// end up as their own children of the common prefix on account of
-				// being larger than said prefix
-				// eg: have "abc", adding "ayz"
-				oldChild := v
-				oldChild.key = oldChild.key[lcp:]
-				newChild := &bwTrie{
-					key: key[:lcp],
-					children: []*bwTrie{
-						oldChild,
-						&bwTrie{
-							endpoint: 1,
-							key:      key[lcp:],
-						},
-					},
-				}
-				t.children[k] = newChild
+				_, existed = v.update(key[lcp:], l, fn)
 			}
-			return
+			t.count += v.count - count
+			return nil, existed
+		}
+		// Whatever happens from here on the key is a new one
+		if _, ok := fn(nil, false); !ok {
+			return nil, false
+		}
+		// the new node's key is cut from the child's, rather than from the
+		// caller's key, so that the trie owns all of its keys
+		oldChild := v
+		prefix := v.key[:lcp:lcp]
+		oldChild.key = v.key[lcp:]
+		if lcp == len(key) {
+			// the entire key is a sub-key of the child key
+			// eg: have "aaa", adding "aa"
+			t.children[k] = &bwTrie{
+				endpoint: 1,
+				key:      prefix,
+				children: []*bwTrie{oldChild},
+				count:    oldChild.count + 1,
+			}
+		} else {
+			// the key and child key share a common prefix but are both going to
+			// end up as their own children of the common prefix on account of
+			// being larger than said prefix
+			// eg: have "abc", adding "ayz"
+			leaf := &bwTrie{
+				endpoint: 1,
+				key:      l.own(key[lcp:]),
+				count:    1,
+			}
+			newChild := &bwTrie{
+				key:      prefix,
+				children: []*bwTrie{oldChild, leaf},
+				count:    oldChild.count + 1,
+			}
+			if bytes.Compare(leaf.key, oldChild.key) < 0 {
+				newChild.children[0], newChild.children[1] = leaf, oldChild
+			}
+			t.children[k] = newChild
+		}
+		t.adopt(k, l)
+		t.count++
+		return nil, false
+	}
+	if _, ok := fn(nil, false); !ok {
+		return nil, false
+	}
+	leaf := &bwTrie{key: l.own(key), endpoint: 1, count: 1}
+	if l.unsorted {
+		t.children = append(t.children, leaf)
+	} else {
+		// Keep the children sorted so that iteration happens in order
+		i := sort.Search(len(t.children), func(i int) bool {
+			return bytes.Compare(t.children[i].key, key) > 0
+		})
+		t.children = insertChild(t.children, i, leaf)
+		if t.index != nil {
+			t.index.inserted(i, len(t.children), key[0])
 		}
 	}
-	t.children = append(t.children, &bwTrie{key: key, endpoint: 1})
+	if t.index == nil {
+		t.reindex(l.indexed())
+	}
+	t.count++
+	return nil, false
+}
+
+// store is update for the key which ends at this node
+func (t *bwTrie) store(fn func(interface{}, bool) (interface{}, bool)) (interface{}, bool) {
+	existed := t.endpoint != 0
+	if _, ok := fn(nil, existed); ok && !existed {
+		t.endpoint = 1
+		t.count++
+	}
+	return nil, existed
 }
 
 func (t *bwTrie) drop(key []byte) {
-	if t.key == nil && key == nil {
+	if len(key) == 0 {
+		// Every key has the empty prefix
 		t.children = []*bwTrie{}
+		t.endpoint = 0
+		t.index = nil
+		t.tally()
 		return
 	}
-	for k, v := range t.children {
+	children := t.children[:0]
+	for _, v := range t.children {
 		if lcp := longestCommonPrefix(key, v.key); lcp > 0 {
 			if lcp == len(key) {
-				if k == 0 {
-					t.children = append(t.children[1:])
-				} else {
-					t.children = append(t.children[:k], t.children[k+1:]...)
-				}
-			} else if lcp < len(v.key) {
-				// The delete key is part of, but less than the entire child key, Cannot be an exact match
-				return
-			} else {
+				// The whole child has the prefix.  So might its siblings, if the
+				// prefix ends part way through a rune
+				continue
+			}
+			if lcp == len(v.key) {
 				// The child key is less than the delete key but it is a prefix of the delete key, recurse
 				v.drop(key[lcp:])
 				if v.endpoint == 0 && len(v.children) == 0 {
-					if k == 0 {
-						t.children = append(t.children[1:])
-					} else {
-						t.children = append(t.children[:k], t.children[k+1:]...)
-					}
+					continue
 				}
 			}
+			// Otherwise the delete key is part of, but less than the entire child key, Cannot be an exact match
 		}
+		children = append(children, v)
 	}
+	clear(t.children[len(children):])
+	t.children = children
+	if t.index != nil {
+		t.index.fill(len(children), func(i int) []byte { return children[i].key })
+	}
+	t.tally()
 }
 
-func (t *bwTrie) del(key []byte) {
-	for k, v := range t.children {
+func (t *bwTrie) del(key []byte) (interface{}, bool) {
+	if len(key) == 0 {
+		existed := t.endpoint != 0
+		t.endpoint = 0
+		t.tally()
+		return nil, existed
+	}
+	lo, children := t.span(layout{}, key)
+	for i, v := range children {
+		k := lo + i
 		if lcp := longestCommonPrefix(key, v.key); lcp > 0 {
 			if lcp < len(v.key) {
-				// Delete key is a prefix of child, but is not child or further, nothing to do
-				return
+				// Delete key is a prefix of child, but is not child or further.
+				// A sibling could still start with the same byte though
+				continue
 			}
 			if lcp == len(key) && lcp == len(v.key) {
 				// This is the key we came for
+				existed := v.endpoint != 0
 				v.endpoint = 0
+				v.tally()
 				if len(v.children) == 0 {
-					if k == 0 {
-						t.children = append(t.children[1:])
-					} else {
-						t.children = append(t.children[:k], t.children[k+1:]...)
-					}
+					t.removeChild(k)
 				}
-				return
+				t.tally()
+				return nil, existed
 			}
 			if lcp == len(v.key) {
-				v.del(key[lcp:])
+				_, existed := v.del(key[lcp:])
+				if !existed {
+					// A sibling which starts with the same byte might hold
+					// it, see get
+					continue
+				}
 				if v.endpoint == 0 && len(v.children) == 0 {
-					if k == 0 {
-						t.children = append(t.children[1:])
-					} else {
-						t.children = append(t.children[:k], t.children[k+1:]...)
-					}
+					t.removeChild(k)
 				}
-				return
+				t.tally()
+				return nil, existed
 			}
 		}
 	}
 	// No such key found in the tree
+	return nil, false
+}
+
+// span returns the children which could lead to key, and where they start,
+// see span
+func (t *bwTrie) span(l layout, key []byte) (int, []*bwTrie) {
+	return span(l, t.index, t.children, (*bwTrie).edge, key)
 }
 
-func (t *bwTrie) get(key []byte) (bool, interface{}) {
+// adopt moves the siblings of the k'th child which begin with its key
+// beneath it.  Siblings only begin with the same byte in tries split on rune
+// boundaries, and then the k'th child only has a key which is a prefix of a
+// sibling when it has just been split in the middle of a rune, for a key
+// which isn't valid UTF-8.  See boundary
+func (t *bwTrie) adopt(k int, l layout) {
+	c := t.children[k]
+	lo, siblings := t.span(l, c.key)
+	if len(siblings) < 2 {
+		return
+	}
+	adopted := false
+	for i := lo + len(siblings) - 1; i >= lo; i-- {
+		s := t.children[i]
+		if s == c || len(s.key) <= len(c.key) || !bytes.HasPrefix(s.key, c.key) {
+			continue
+		}
+		t.removeChild(i)
+		s.key = s.key[len(c.key):]
+		c.children = append(c.children, s)
+		c.count += s.count
+		adopted = true
+	}
+	if !adopted {
+		return
+	}
+	if !l.unsorted {
+		slices.SortFunc(c.children, func(a, b *bwTrie) int { return bytes.Compare(a.key, b.key) })
+	}
+	c.reindex(l.indexed())
+}
+
+// removeChild takes the k'th child away, keeping the index up to date
+func (t *bwTrie) removeChild(k int) {
+	b := t.children[k].key[0]
+	t.children = slices.Delete(t.children, k, k+1)
+	if t.index != nil {
+		t.index.removed(k, b, k < len(t.children) && t.children[k].key[0] == b)
+	}
+}
+
+// reindex gives the node a new index after children have come or gone, for
+// nodes which might share their old one (see childIndex.)  Nodes which have an
+// index get a new one, otherwise they only get one if indexed is set and they
+// have enough children
+func (t *bwTrie) reindex(indexed bool) {
+	if indexed || t.index != nil {
+		t.index = newChildIndex(t.children, (*bwTrie).edge)
+	}
+}
+
+// tally works out count again from the children, for when keys have been
+// removed from beneath the node
+func (t *bwTrie) tally() {
+	t.count = int(t.endpoint)
 	for _, v := range t.children {
+		t.count += v.count
+	}
+}
+
+func (t *bwTrie) thaw(key []byte) node[interface{}] {
+	return t.thawed(key)
+}
+
+// thawed returns a copy of the node which can be changed anywhere along the
+// path to key without changing the node itself, see kvTrie.thawed
+func (t *bwTrie) thawed(key []byte) *bwTrie {
+	n := *t
+	n.children = slices.Clone(t.children)
+	if t.index != nil {
+		n.index = t.index.clone()
+	}
+	for k, v := range n.children {
+		switch lcp := longestCommonPrefix(key, v.key); {
+		case lcp == 0:
+		case lcp == len(v.key) && lcp < len(key):
+			n.children[k] = v.thawed(key[lcp:])
+		default:
+			c := *v
+			n.children[k] = &c
+		}
+	}
+	return &n
+}
+
+func (t *bwTrie) get(key []byte, l layout) (bool, interface{}) {
+	if len(key) == 0 {
+		return t.endpoint != 0, nil
+	}
+	_, children := t.span(l, key)
+	for _, v := range children {
 		if key[0] != v.key[0] {
 			continue
 		}
@@ -142,8 +322,9 @@ func (t *bwTrie) get(key []byte) (bool, interface{}) {
 		if lcp := longestCommonPrefix(key, v.key); lcp > 0 {
 			if lcp < len(v.key) {
 				// if the common prefix less than the entirety of the child
-				// key, it cannot possibly match the child key
-				return false, nil
+				// key, it cannot possibly match the child key, but a sibling
+				// which starts with the same byte might
+				continue
 			}
 			if lcp == len(key) {
 				// the child is exactly the key we're looking for
@@ -152,28 +333,37 @@ func (t *bwTrie) get(key []byte) (bool, interface{}) {
 				}
 				return false, nil
 			}
-			return v.get(key[lcp:])
+			if found, value := v.get(key[lcp:], l); found {
+				return true, value
+			}
+			// In a Unicode trie a sibling which starts with the same byte
+			// can hold the rest of the key, when the keys part ways in the
+			// middle of a rune.  eg: "a" and "a\x80"
 		}
 	}
 	return false, nil
 }
 
-func (t *bwTrie) iterate(key []byte, callback IterFunc) {
-	if t.endpoint != 0 {
-		callback(key, nil)
+func (t *bwTrie) iterate(key []byte, callback func([]byte, interface{}) bool) bool {
+	if t.endpoint != 0 && !callback(key, nil) {
+		return false
 	}
 	for _, v := range t.children {
-		v.iterate(append(key, v.key...), callback)
+		// siblings share the space after key, so a key passed to callback is
+		// only good until callback returns
+		if !v.iterate(extend(key, v.key), callback) {
+			return false
+		}
 	}
+	return true
 }
 
-func (t *bwTrie) iterateFrom(prefix []byte, callback IterFunc) {
-	for _, v := range t.children {
-		if len(prefix) == 0 {
-			v.iterate(v.key, callback)
-			continue
-		}
-
+func (t *bwTrie) iterateFrom(path, prefix []byte, callback func([]byte, interface{}) bool) bool {
+	if len(prefix) == 0 {
+		return t.iterate(path, callback)
+	}
+	_, children := t.span(layout{}, prefix)
+	for _, v := range children {
 		if prefix[0] != v.key[0] {
 			// This child key cannot be prefixed by the prefix argument
 			continue
@@ -183,16 +373,189 @@ func (t *bwTrie) iterateFrom(prefix []byte, callback IterFunc) {
 		lcp := longestCommonPrefix(prefix, v.key)
 
 		if lcp == len(prefix) {
-			// the child key is entirely prefixed by the prefix argument
-			v.iterate(v.key, callback)
+			// the child key is entirely prefixed by the prefix argument, and so
+			// might its siblings be if the prefix ends part way through a rune
+			if !v.iterate(extend(path, v.key), callback) {
+				return false
+			}
 		} else if lcp == len(v.key) {
 			// the entire child key is a shared sub prefix of the prefix argument
-			// time to recurse
-			v.iterateFrom(prefix[lcp:], callback)
+			// time to recurse.  A sibling which starts with the same byte can
+			// be one too, see get, so keep looking afterwards
+			if !v.iterateFrom(extend(path, v.key), prefix[lcp:], callback) {
+				return false
+			}
 		}
+		// otherwise a sibling which starts with the same byte might match
+	}
+	return true
+}
 
-		return
+func (t *bwTrie) min(path []byte) ([]byte, interface{}, bool) {
+	if t.endpoint != 0 {
+		return path, nil, true
+	}
+	for _, v := range t.children {
+		if k, d, ok := v.min(append(path[:len(path):len(path)], v.key...)); ok {
+			return k, d, ok
+		}
+	}
+	return nil, nil, false
+}
+
+func (t *bwTrie) max(path []byte) ([]byte, interface{}, bool) {
+	for i := len(t.children) - 1; i >= 0; i-- {
+		v := t.children[i]
+		if k, d, ok := v.max(append(path[:len(path):len(path)], v.key...)); ok {
+			return k, d, ok
+		}
+	}
+	if t.endpoint != 0 {
+		return path, nil, true
+	}
+	return nil, nil, false
+}
+
+func (t *bwTrie) successor(path, key []byte) ([]byte, interface{}, bool) {
+	for _, v := range t.children {
+		lcp := longestCommonPrefix(key, v.key)
+		if lcp == len(v.key) {
+			// the child key is a prefix of the key, the successor may be beneath
+			// the child, and if it isn't it's in one of the following children
+			k, d, ok := v.successor(append(path[:len(path):len(path)], v.key...), key[lcp:])
+			if ok {
+				return k, d, ok
+			}
+			continue
+		}
+		if lcp == len(key) || v.key[lcp] > key[lcp] {
+			// everything beneath this child sorts after the key
+			return v.min(append(path[:len(path):len(path)], v.key...))
+		}
+	}
+	return nil, nil, false
+}
+
+func (t *bwTrie) predecessor(path, key []byte) ([]byte, interface{}, bool) {
+	if len(key) == 0 {
+		// Nothing beneath this node can sort before it
+		return nil, nil, false
+	}
+	for i := len(t.children) - 1; i >= 0; i-- {
+		v := t.children[i]
+		lcp := longestCommonPrefix(key, v.key)
+		if lcp == len(v.key) {
+			// the child key is a prefix of the key, the predecessor may be
+			// beneath the child, or be the child itself
+			childPath := append(path[:len(path):len(path)], v.key...)
+			if k, d, ok := v.predecessor(childPath, key[lcp:]); ok {
+				return k, d, ok
+			}
+			if v.endpoint != 0 && lcp < len(key) {
+				return childPath, nil, true
+			}
+			continue
+		}
+		if lcp < len(key) && v.key[lcp] < key[lcp] {
+			// everything beneath this child sorts before the key
+			return v.max(append(path[:len(path):len(path)], v.key...))
+		}
 	}
+	if t.endpoint != 0 {
+		return path, nil, true
+	}
+	return nil, nil, false
+}
+
+func (t *bwTrie) rangeScan(path []byte, r keyRange, reverse bool, callback func([]byte, interface{}) bool) bool {
+	if !reverse && t.endpoint != 0 && r.contains(path) && !callback(path, nil) {
+		return false
+	}
+	for i := range t.children {
+		v := t.children[i]
+		if reverse {
+			v = t.children[len(t.children)-1-i]
+		}
+		childPath := extend(path, v.key)
+		if r.below(childPath) {
+			if reverse {
+				// every remaining child sorts even earlier
+				break
+			}
+			continue
+		}
+		if r.above(childPath) {
+			if !reverse {
+				// every remaining child sorts even later
+				break
+			}
+			continue
+		}
+		if !v.rangeScan(childPath, r, reverse, callback) {
+			return false
+		}
+	}
+	if reverse && t.endpoint != 0 && r.contains(path) {
+		return callback(path, nil)
+	}
+	return true
+}
+
+func (t *bwTrie) prefixesOf(key []byte, depth int, callback func([]byte, interface{})) {
+	if depth == 0 && t.endpoint != 0 {
+		// the empty key, at the root, is a prefix of everything
+		callback(key[:0], nil)
+	}
+	_, children := t.span(layout{}, key[depth:])
+	for _, v := range children {
+		if lcp := longestCommonPrefix(key[depth:], v.key); lcp > 0 {
+			if lcp < len(v.key) {
+				// the child key runs past the end of the key, or away from it, so
+				// neither the child nor anything beneath it can be a prefix of key
+				continue
+			}
+			if v.endpoint != 0 {
+				callback(key[:depth+lcp], nil)
+			}
+			// Siblings which start with the same byte can be prefixes too, see
+			// get.  They come in order of length, and only the longest can
+			// have children which lead further along key
+			v.prefixesOf(key, depth+lcp, callback)
+		}
+	}
+}
+
+func (t *bwTrie) edge() []byte {
+	return t.key
+}
+
+func (t *bwTrie) isEndpoint() bool {
+	return t.endpoint != 0
+}
+
+func (t *bwTrie) val() interface{} {
+	return nil
+}
+
+// BW tries have nowhere to keep weights, so every key weighs 0
+func (t *bwTrie) weight() float64 {
+	return 0
+}
+
+func (t *bwTrie) maxWeight() float64 {
+	return 0
+}
+
+func (t *bwTrie) size() int {
+	return t.count
+}
+
+func (t *bwTrie) numChildren() int {
+	return len(t.children)
+}
+
+func (t *bwTrie) child(i int) node[interface{}] {
+	return t.children[i]
 }
 
 func (t *bwTrie) log(indent ...int) {
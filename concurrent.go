@@ -0,0 +1,204 @@
+package trie
+
+import (
+	"iter"
+	"sync"
+	"sync/atomic"
+)
+
+// ConcurrentTrie is a Trie which is safe to use from many goroutines at once.
+// Readers never wait, not for each other and not for writers.  Each change
+// makes a new version of the trie, copying only the nodes along the path to
+// the key it changes and sharing the rest, and then swaps it in for the old
+// version in one atomic step.  Each read works on whichever version was
+// current when it started, so an iteration sees the trie as it was at that
+// moment however long it runs, and never part of a change.  Writers take
+// turns, one change at a time.
+//
+// The callbacks passed to the reading methods (and the bodies of loops over
+// All, WithPrefix and Backward) may use the trie however they like, changes
+// they make are seen by later reads but not by the iteration they are in.
+// The callbacks which are run as part of a change, those of Upsert and
+// DropFunc, run while the writer's lock is held.  They may read from the
+// trie, but changing it from inside one of them deadlocks.
+type ConcurrentTrie struct {
+	// writer is held by whoever is making the next version of the trie
+	writer  sync.Mutex
+	current atomic.Pointer[Trie]
+}
+
+func newConcurrent(t *Trie) *ConcurrentTrie {
+	t.shared = true
+	c := &ConcurrentTrie{}
+	c.current.Store(t)
+	return c
+}
+
+// load returns the current version of the trie, which is never changed
+func (t *ConcurrentTrie) load() *Trie {
+	return t.current.Load()
+}
+
+// write makes fn's changes to a new version of the trie and makes it the
+// current version.  The new version starts out sharing every node with the
+// current one, see Trie.shared
+func (t *ConcurrentTrie) write(fn func(*Trie)) {
+	t.writer.Lock()
+	defer t.writer.Unlock()
+	next := *t.current.Load()
+	fn(&next)
+	t.current.Store(&next)
+}
+
+// NewConcurrentBWTrie returns a new, concurrency safe, "black and white" radix
+// trie.  See NewBWTrie
+func NewConcurrentBWTrie() *ConcurrentTrie {
+	return NewConcurrent()
+}
+
+// NewConcurrentKVTrie returns a new, concurrency safe, Key/Value radix trie.
+// See NewKVTrie
+func NewConcurrentKVTrie() *ConcurrentTrie {
+	return NewConcurrent(WithValues())
+}
+
+// Set is the concurrency safe version of Trie.Set
+func (t *ConcurrentTrie) Set(key interface{}, data ...interface{}) (old interface{}, existed bool) {
+	t.write(func(next *Trie) { old, existed = next.Set(key, data...) })
+	return old, existed
+}
+
+// Add is the concurrency safe version of Trie.Add
+func (t *ConcurrentTrie) Add(key interface{}, data ...interface{}) (added bool) {
+	t.write(func(next *Trie) { added = next.Add(key, data...) })
+	return added
+}
+
+// Drop is the concurrency safe version of Trie.Drop
+func (t *ConcurrentTrie) Drop(key interface{}) (dropped int) {
+	t.write(func(next *Trie) { dropped = next.Drop(key) })
+	return dropped
+}
+
+// DropFunc is the concurrency safe version of Trie.DropFunc.  callback is run
+// while the writer's lock is held, so it must not change the trie
+func (t *ConcurrentTrie) DropFunc(prefix interface{}, callback IterFunc) (dropped int) {
+	t.write(func(next *Trie) { dropped = next.DropFunc(prefix, callback) })
+	return dropped
+}
+
+// Del is the concurrency safe version of Trie.Del
+func (t *ConcurrentTrie) Del(key interface{}) (old interface{}, existed bool) {
+	t.write(func(next *Trie) { old, existed = next.Del(key) })
+	return old, existed
+}
+
+// Exists is the concurrency safe version of Trie.Exists
+func (t *ConcurrentTrie) Exists(key interface{}) bool {
+	return t.load().Exists(key)
+}
+
+// Get is the concurrency safe version of Trie.Get
+func (t *ConcurrentTrie) Get(key interface{}) (bool, interface{}) {
+	return t.load().Get(key)
+}
+
+// GetBranch is the concurrency safe version of Trie.GetBranch
+func (t *ConcurrentTrie) GetBranch(prefix interface{}) [][]byte {
+	return t.load().GetBranch(prefix)
+}
+
+// Iterate is the concurrency safe version of Trie.Iterate
+func (t *ConcurrentTrie) Iterate(callback IterFunc) {
+	t.load().Iterate(callback)
+}
+
+// IterateFrom is the concurrency safe version of Trie.IterateFrom
+func (t *ConcurrentTrie) IterateFrom(prefix interface{}, callback IterFunc) {
+	t.load().IterateFrom(prefix, callback)
+}
+
+// Walk is the concurrency safe version of Trie.Walk
+func (t *ConcurrentTrie) Walk(callback WalkFunc) {
+	t.load().Walk(callback)
+}
+
+// WalkFrom is the concurrency safe version of Trie.WalkFrom
+func (t *ConcurrentTrie) WalkFrom(prefix interface{}, callback WalkFunc) {
+	t.load().WalkFrom(prefix, callback)
+}
+
+// All is the concurrency safe version of Trie.All.  Each loop over it sees
+// the version of the trie which was current when the loop started
+func (t *ConcurrentTrie) All() iter.Seq2[[]byte, interface{}] {
+	return func(yield func([]byte, interface{}) bool) {
+		t.Walk(yield)
+	}
+}
+
+// WithPrefix is the concurrency safe version of Trie.WithPrefix, see All
+func (t *ConcurrentTrie) WithPrefix(prefix interface{}) iter.Seq2[[]byte, interface{}] {
+	return func(yield func([]byte, interface{}) bool) {
+		t.WalkFrom(prefix, yield)
+	}
+}
+
+// Backward is the concurrency safe version of Trie.Backward, see All
+func (t *ConcurrentTrie) Backward() iter.Seq2[[]byte, interface{}] {
+	return func(yield func([]byte, interface{}) bool) {
+		t.load().Backward()(yield)
+	}
+}
+
+// Range is the concurrency safe version of Trie.Range
+func (t *ConcurrentTrie) Range(start, end interface{}, flags RangeFlag, callback IterFunc) {
+	t.load().Range(start, end, flags, callback)
+}
+
+// Min is the concurrency safe version of Trie.Min
+func (t *ConcurrentTrie) Min() (key []byte, value interface{}, ok bool) {
+	return t.load().Min()
+}
+
+// Max is the concurrency safe version of Trie.Max
+func (t *ConcurrentTrie) Max() (key []byte, value interface{}, ok bool) {
+	return t.load().Max()
+}
+
+// Successor is the concurrency safe version of Trie.Successor
+func (t *ConcurrentTrie) Successor(key interface{}) (next []byte, value interface{}, ok bool) {
+	return t.load().Successor(key)
+}
+
+// Predecessor is the concurrency safe version of Trie.Predecessor
+func (t *ConcurrentTrie) Predecessor(key interface{}) (prev []byte, value interface{}, ok bool) {
+	return t.load().Predecessor(key)
+}
+
+// LongestPrefix is the concurrency safe version of Trie.LongestPrefix
+func (t *ConcurrentTrie) LongestPrefix(key interface{}) (matchedKey []byte, value interface{}, ok bool) {
+	return t.load().LongestPrefix(key)
+}
+
+// AllPrefixes is the concurrency safe version of Trie.AllPrefixes
+func (t *ConcurrentTrie) AllPrefixes(key interface{}, callback IterFunc) {
+	t.load().AllPrefixes(key, callback)
+}
+
+// Cursor returns a new Cursor over the version of the trie which is current
+// when Cursor is called.  That version never changes, so unlike the Cursor of
+// a Trie it stays valid however the trie is changed afterwards, it just
+// doesn't see the changes.  See Trie.Cursor
+func (t *ConcurrentTrie) Cursor() *Cursor[[]byte, interface{}] {
+	return t.load().Cursor()
+}
+
+// Log is the concurrency safe version of Trie.Log
+func (t *ConcurrentTrie) Log() {
+	t.load().Log()
+}
+
+// Count is the concurrency safe version of Trie.Count
+func (t *ConcurrentTrie) Count() int {
+	return t.load().Count()
+}
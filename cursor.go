@@ -0,0 +1,227 @@
+package trie
+
+import "bytes"
+
+type cursorFrame[V any] struct {
+	n node[V]
+	// pos is the index of the child of n which the cursor is currently
+	// beneath
+	pos int
+}
+
+// Cursor is a pull style iterator over a trie, much like a database cursor.
+// A Cursor remembers where it is in the trie, so it can be moved forward and
+// backward one key at a time, positioned with Seek, and read from whenever it
+// suits you without any callbacks.
+//
+//	c := trie.Cursor()
+//	for ok := c.Seek("user:"); ok; ok = c.Next() {
+//		fmt.Println(string(c.Key()), c.Value())
+//	}
+//
+// A Cursor must not be used after the trie it came from has been modified.
+// Save the Key and Seek to it again instead.
+type Cursor[K Key, V any] struct {
+	root  node[V]
+	stack []cursorFrame[V]
+	key   []byte
+	// unicode is how the trie stores its keys, for Seek, and spellings how
+	// it hands them back, for Key
+	unicode   *Unicode
+	spellings *PersistentTrie[[]byte, []byte]
+}
+
+func newCursor[K Key, V any](root node[V]) *Cursor[K, V] {
+	return &Cursor[K, V]{root: root}
+}
+
+// Cursor returns a new Cursor for the trie.  The cursor is not positioned on
+// anything until First, Last or Seek is called
+func (t *Trie) Cursor() *Cursor[[]byte, interface{}] {
+	c := newCursor[[]byte](t.root)
+	c.unicode = t.unicode
+	c.spellings = t.spellings
+	return c
+}
+
+// Cursor returns a new Cursor for the trie.  See Trie.Cursor
+func (t *KVTrie[K, V]) Cursor() *Cursor[K, V] {
+	return newCursor[K, V](t.root)
+}
+
+// Valid reports whether the cursor is positioned on a key
+func (c *Cursor[K, V]) Valid() bool {
+	return len(c.stack) > 0
+}
+
+// Key returns the key the cursor is positioned on.  The key belongs to the
+// caller and is not modified by moving the cursor
+func (c *Cursor[K, V]) Key() K {
+	if !c.Valid() {
+		var zero K
+		return zero
+	}
+	if s, ok := spelling(c.spellings, c.key); ok {
+		return K(bytes.Clone(s))
+	}
+	return K(bytes.Clone(c.key))
+}
+
+// Value returns the value of the key the cursor is positioned on.  For BW tries
+// the value is always nil
+func (c *Cursor[K, V]) Value() V {
+	if !c.Valid() {
+		var zero V
+		return zero
+	}
+	return c.top().n.val()
+}
+
+// First positions the cursor on the smallest key in the trie.  It returns
+// false if the trie is empty
+func (c *Cursor[K, V]) First() bool {
+	c.reset()
+	return c.descendFirst()
+}
+
+// Last positions the cursor on the largest key in the trie.  It returns false
+// if the trie is empty
+func (c *Cursor[K, V]) Last() bool {
+	c.reset()
+	return c.descendLast()
+}
+
+// Seek positions the cursor on the smallest key in the trie which is equal to
+// or sorts after key.  It returns false if there is no such key
+func (c *Cursor[K, V]) Seek(key K) bool {
+	c.reset()
+	rem := []byte(key)
+	if c.unicode != nil {
+		rem = c.unicode.key(rem)
+	}
+	for len(rem) > 0 {
+		f := c.top()
+		next, lcp := -1, 0
+		for i := 0; i < f.n.numChildren(); i++ {
+			edge := f.n.child(i).edge()
+			lcp = longestCommonPrefix(rem, edge)
+			if lcp == len(edge) || lcp == len(rem) || edge[lcp] > rem[lcp] {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			// every key beneath this node sorts before the key
+			return c.advance()
+		}
+		c.push(next)
+		if lcp < len(c.top().n.edge()) {
+			// every key beneath this child sorts after the key
+			return c.descendFirst()
+		}
+		// the child key is a prefix of the key, keep descending
+		rem = rem[lcp:]
+	}
+	return c.descendFirst()
+}
+
+// Next moves the cursor to the next key in the trie.  It returns false, and
+// the cursor becomes invalid, if there are no more keys
+func (c *Cursor[K, V]) Next() bool {
+	if !c.Valid() {
+		return false
+	}
+	if c.top().n.numChildren() > 0 {
+		c.push(0)
+		return c.descendFirst()
+	}
+	return c.advance()
+}
+
+// Prev moves the cursor to the previous key in the trie.  It returns false,
+// and the cursor becomes invalid, if there are no more keys
+func (c *Cursor[K, V]) Prev() bool {
+	for len(c.stack) > 1 {
+		c.pop()
+		f := c.top()
+		if f.pos > 0 {
+			c.push(f.pos - 1)
+			return c.descendLast()
+		}
+		if f.n.isEndpoint() {
+			return true
+		}
+	}
+	c.stack = c.stack[:0]
+	return false
+}
+
+func (c *Cursor[K, V]) reset() {
+	c.stack = append(c.stack[:0], cursorFrame[V]{n: c.root})
+	c.key = c.key[:0]
+}
+
+func (c *Cursor[K, V]) top() *cursorFrame[V] {
+	return &c.stack[len(c.stack)-1]
+}
+
+// push descends into the i'th child of the node on top of the stack
+func (c *Cursor[K, V]) push(i int) {
+	f := c.top()
+	f.pos = i
+	child := f.n.child(i)
+	c.stack = append(c.stack, cursorFrame[V]{n: child})
+	c.key = append(c.key, child.edge()...)
+}
+
+func (c *Cursor[K, V]) pop() {
+	c.key = c.key[:len(c.key)-len(c.top().n.edge())]
+	c.stack = c.stack[:len(c.stack)-1]
+}
+
+// descendFirst moves to the first key at or beneath the top of the stack
+func (c *Cursor[K, V]) descendFirst() bool {
+	for {
+		f := c.top()
+		if f.n.isEndpoint() {
+			return true
+		}
+		if f.n.numChildren() == 0 {
+			// Only an empty root can be neither an endpoint nor have children
+			c.stack = c.stack[:0]
+			return false
+		}
+		c.push(0)
+	}
+}
+
+// descendLast moves to the last key at or beneath the top of the stack
+func (c *Cursor[K, V]) descendLast() bool {
+	for {
+		f := c.top()
+		if n := f.n.numChildren(); n > 0 {
+			c.push(n - 1)
+			continue
+		}
+		if f.n.isEndpoint() {
+			return true
+		}
+		c.stack = c.stack[:0]
+		return false
+	}
+}
+
+// advance moves to the first key which sorts after everything beneath the top
+// of the stack
+func (c *Cursor[K, V]) advance() bool {
+	for len(c.stack) > 1 {
+		c.pop()
+		f := c.top()
+		if f.pos+1 < f.n.numChildren() {
+			c.push(f.pos + 1)
+			return c.descendFirst()
+		}
+	}
+	c.stack = c.stack[:0]
+	return false
+}
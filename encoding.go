@@ -0,0 +1,520 @@
+package trie
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"unicode/utf8"
+)
+
+// The serialized form of a trie is
+//
+//	magic    "QTRI"
+//	version  1 byte
+//	kind     1 byte, kindBW or kindKV
+//	root     node
+//	checksum 4 bytes, big endian CRC-32 (IEEE) of everything before it
+//
+// where each node, starting with the root, is
+//
+//	key      uvarint length, then the bytes of the key
+//	endpoint 1 byte, 0 or 1
+//	value    uvarint length, then the encoded value (KV endpoints only)
+//	children uvarint count, then each child node in order
+//
+// Because the nodes are written out exactly as they are in memory, reading a
+// trie back in rebuilds the same radix structure without adding any keys.
+const (
+	encodingMagic   = "QTRI"
+	encodingVersion = 1
+
+	kindBW = 0
+	kindKV = 1
+)
+
+var (
+	// ErrInvalidEncoding is returned when reading something which is not a
+	// serialized trie, or is a damaged one
+	ErrInvalidEncoding = errors.New("trie: invalid encoding")
+	// ErrUnsupportedVersion is returned when reading a serialized trie which
+	// was written by a newer version of this package
+	ErrUnsupportedVersion = errors.New("trie: unsupported encoding version")
+	// ErrChecksum is returned when a serialized trie does not match its
+	// checksum
+	ErrChecksum = errors.New("trie: checksum mismatch")
+)
+
+// Codec turns the values stored in a KV trie into bytes, and back again, when
+// the trie is serialized.  Tries use GobCodec unless told otherwise, see
+// Trie.SetCodec and KVTrie.SetCodec
+type Codec[V any] interface {
+	Encode(value V) ([]byte, error)
+	Decode(data []byte) (V, error)
+}
+
+// GobCodec is a Codec which uses encoding/gob.  When used with a Trie (whose
+// values are interface{}) any types other than the basic ones will need to be
+// registered with gob.Register
+type GobCodec[V any] struct{}
+
+// Encode encodes value with encoding/gob
+func (GobCodec[V]) Encode(value V) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&value)
+	return buf.Bytes(), err
+}
+
+// Decode decodes data with encoding/gob
+func (GobCodec[V]) Decode(data []byte) (V, error) {
+	var value V
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&value)
+	return value, err
+}
+
+// SetCodec changes the Codec used for values when serializing a KV trie.  It
+// has no effect on BW tries, which have no values
+func (t *Trie) SetCodec(codec Codec[interface{}]) {
+	t.codec = codec
+}
+
+// WriteTo writes the trie to w in a compact, versioned and checksummed binary
+// form which can be read back in with ReadFrom.  Values stored in KV tries are
+// encoded with the trie's Codec.  Weights (see SetWeight) are not written, so
+// every key read back in weighs 0.  WriteTo implements io.WriterTo
+func (t *Trie) WriteTo(w io.Writer) (int64, error) {
+	if _, bw := t.root.(*bwTrie); bw {
+		return writeTrie[interface{}](w, kindBW, t.root, nil)
+	}
+	return writeTrie(w, kindKV, t.root, t.valueCodec())
+}
+
+// ReadFrom replaces the contents of the trie with a trie read from r, which
+// must have been written by WriteTo.  The trie becomes a BW or KV trie to match
+// whatever was written.  If anything goes wrong the trie is left unchanged.
+// When r is an io.ByteReader, such as a bufio.Reader or bytes.Reader, ReadFrom
+// reads exactly what WriteTo wrote and leaves anything after it in r.  Other
+// readers are buffered, so they may be read past the end of the trie.
+// ReadFrom implements io.ReaderFrom
+//
+// Keys are read back exactly as they were stored, so a Unicode trie should be
+// read with the same Unicode settings it was written with.  Spellings aren't
+// saved, so a trie which keeps them hands back the stored keys until they are
+// added again.  When the trie was written by one which split its keys between
+// nodes differently (see SetUnicode) they are added again to fit this trie
+func (t *Trie) ReadFrom(r io.Reader) (int64, error) {
+	var root node[interface{}]
+	var resplit bool
+	n, err := readTrie(r, func(d *decoder, kind byte) (err error) {
+		switch kind {
+		case kindBW:
+			root, err = d.readBW(true, t.layout.indexed())
+		case kindKV:
+			root, err = readKV(d, t.valueCodec(), true, t.layout.indexed())
+		default:
+			err = ErrInvalidEncoding
+		}
+		resplit = d.byteSplit && t.layout.split == runeBoundary || d.runeSplit && t.layout.split == byteBoundary
+		return err
+	})
+	if err != nil {
+		return n, err
+	}
+	if resplit {
+		t.root = emptyLike(root)
+		addAll(root, t.root, t.layout)
+	} else {
+		t.root = root
+	}
+	if t.spellings != nil {
+		t.spellings = NewPersistent[[]byte, []byte]()
+	}
+	return n, nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler using WriteTo
+func (t *Trie) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := t.WriteTo(&buf)
+	return buf.Bytes(), err
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler using ReadFrom
+func (t *Trie) UnmarshalBinary(data []byte) error {
+	_, err := t.ReadFrom(bytes.NewReader(data))
+	return err
+}
+
+func (t *Trie) valueCodec() Codec[interface{}] {
+	if t.codec == nil {
+		return GobCodec[interface{}]{}
+	}
+	return t.codec
+}
+
+// SetCodec is the concurrency safe version of Trie.SetCodec
+func (t *ConcurrentTrie) SetCodec(codec Codec[interface{}]) {
+	t.write(func(next *Trie) { next.SetCodec(codec) })
+}
+
+// WriteTo is the concurrency safe version of Trie.WriteTo.  It writes out the
+// version of the trie which is current when it is called, changes made while
+// it is writing don't hold it up and aren't written
+func (t *ConcurrentTrie) WriteTo(w io.Writer) (int64, error) {
+	return t.load().WriteTo(w)
+}
+
+// ReadFrom is the concurrency safe version of Trie.ReadFrom.  Readers see the
+// trie as it was until the whole of the new trie has been read.  r is read
+// while the writer's lock is held, so other changes wait for it to finish
+func (t *ConcurrentTrie) ReadFrom(r io.Reader) (n int64, err error) {
+	t.write(func(next *Trie) { n, err = next.ReadFrom(r) })
+	return n, err
+}
+
+// MarshalBinary is the concurrency safe version of Trie.MarshalBinary
+func (t *ConcurrentTrie) MarshalBinary() ([]byte, error) {
+	return t.load().MarshalBinary()
+}
+
+// UnmarshalBinary is the concurrency safe version of Trie.UnmarshalBinary
+func (t *ConcurrentTrie) UnmarshalBinary(data []byte) (err error) {
+	t.write(func(next *Trie) { err = next.UnmarshalBinary(data) })
+	return err
+}
+
+// SetCodec changes the Codec used for values when serializing the trie
+func (t *KVTrie[K, V]) SetCodec(codec Codec[V]) {
+	t.codec = codec
+}
+
+// WriteTo writes the trie to w, see Trie.WriteTo
+func (t *KVTrie[K, V]) WriteTo(w io.Writer) (int64, error) {
+	return writeTrie[V](w, kindKV, t.root, t.valueCodec())
+}
+
+// ReadFrom replaces the contents of the trie with a KV trie read from r, see
+// Trie.ReadFrom
+func (t *KVTrie[K, V]) ReadFrom(r io.Reader) (int64, error) {
+	var root *kvTrie[V]
+	n, err := readTrie(r, func(d *decoder, kind byte) (err error) {
+		if kind != kindKV {
+			return ErrInvalidEncoding
+		}
+		root, err = readKV(d, t.valueCodec(), true, true)
+		if err == nil && d.runeSplit {
+			// Written by a Unicode trie, which this can't be
+			fresh := &kvTrie[V]{children: []*kvTrie[V]{}}
+			addAll[V](root, fresh, layout{})
+			root = fresh
+		}
+		return err
+	})
+	if err == nil {
+		t.root = root
+	}
+	return n, err
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler using WriteTo
+func (t *KVTrie[K, V]) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := t.WriteTo(&buf)
+	return buf.Bytes(), err
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler using ReadFrom
+func (t *KVTrie[K, V]) UnmarshalBinary(data []byte) error {
+	_, err := t.ReadFrom(bytes.NewReader(data))
+	return err
+}
+
+func (t *KVTrie[K, V]) valueCodec() Codec[V] {
+	if t.codec == nil {
+		return GobCodec[V]{}
+	}
+	return t.codec
+}
+
+type encoder[V any] struct {
+	w     *bufio.Writer
+	codec Codec[V]
+	n     int64
+	err   error
+	buf   [binary.MaxVarintLen64]byte
+}
+
+func (e *encoder[V]) write(p []byte) {
+	if e.err != nil {
+		return
+	}
+	n, err := e.w.Write(p)
+	e.n += int64(n)
+	e.err = err
+}
+
+func (e *encoder[V]) writeUvarint(v uint64) {
+	e.write(e.buf[:binary.PutUvarint(e.buf[:], v)])
+}
+
+func (e *encoder[V]) writeNode(n node[V]) {
+	e.writeUvarint(uint64(len(n.edge())))
+	e.write(n.edge())
+	if !n.isEndpoint() {
+		e.write([]byte{0})
+	} else {
+		e.write([]byte{1})
+		if e.codec != nil {
+			data, err := e.codec.Encode(n.val())
+			if err != nil && e.err == nil {
+				e.err = err
+			}
+			e.writeUvarint(uint64(len(data)))
+			e.write(data)
+		}
+	}
+	e.writeUvarint(uint64(n.numChildren()))
+	child := inOrder(n)
+	for i := 0; i < n.numChildren() && e.err == nil; i++ {
+		e.writeNode(child(i))
+	}
+}
+
+func writeTrie[V any](w io.Writer, kind byte, root node[V], codec Codec[V]) (int64, error) {
+	sum := crc32.NewIEEE()
+	e := &encoder[V]{w: bufio.NewWriter(io.MultiWriter(w, sum)), codec: codec}
+	e.write([]byte(encodingMagic))
+	e.write([]byte{encodingVersion, kind})
+	e.writeNode(root)
+	if e.err == nil {
+		e.err = e.w.Flush()
+	}
+	if e.err != nil {
+		return e.n, e.err
+	}
+	n, err := w.Write(binary.BigEndian.AppendUint32(nil, sum.Sum32()))
+	return e.n + int64(n), err
+}
+
+type decoder struct {
+	r   byteReader
+	sum hash.Hash32
+	n   int64
+	// runeSplit and byteSplit record signs of the trie having split keys
+	// on rune boundaries, or part way through runes, see sibling
+	runeSplit bool
+	byteSplit bool
+}
+
+// byteReader is what the decoder reads from.  Readers which can already be
+// read a byte at a time are read directly, so that nothing after the trie is
+// taken from them, others are buffered
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func (d *decoder) ReadByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err == nil {
+		d.n++
+		d.sum.Write([]byte{b})
+	}
+	return b, err
+}
+
+func (d *decoder) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.n += int64(n)
+	d.sum.Write(p[:n])
+	return n, err
+}
+
+func (d *decoder) readUvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(d)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return v, err
+}
+
+func (d *decoder) readBytes() ([]byte, error) {
+	length, err := d.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	// Don't trust the length enough to allocate it all up front, a damaged
+	// length would have us allocating gigabytes for nothing
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, d, int64(length)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// siblingsInOrder reports whether b may follow a as a sibling.  Siblings must
+// be sorted, and can only have a first byte in common when they begin with
+// different runes which start with that byte
+func siblingsInOrder(a, b []byte) bool {
+	return bytes.Compare(a, b) < 0 && runeBoundary.commonPrefix(a, b) == 0
+}
+
+// sibling checks the key of a child which has just been read against the key
+// of the child before it, if there is one, and reports whether they are in
+// order.  Only tries which split keys on rune boundaries have siblings which
+// start with the same byte, and only those which don't have nodes beneath the
+// root which start part way through a rune
+func (d *decoder) sibling(isRoot bool, prev, key []byte) bool {
+	if prev != nil {
+		if !siblingsInOrder(prev, key) {
+			return false
+		}
+		d.runeSplit = d.runeSplit || prev[0] == key[0]
+	}
+	d.byteSplit = d.byteSplit || !isRoot && !utf8.RuneStart(key[0])
+	return true
+}
+
+// readNode reads the parts of a node common to BW and KV tries.  readValue is
+// called for endpoints
+func (d *decoder) readNode(isRoot bool, readValue func() error) (key []byte, endpoint uint8, children int, err error) {
+	if key, err = d.readBytes(); err != nil {
+		return
+	}
+	if isRoot != (len(key) == 0) {
+		// Only the root has no key
+		err = ErrInvalidEncoding
+		return
+	}
+	if endpoint, err = d.ReadByte(); err != nil {
+		return
+	}
+	if endpoint > 1 {
+		err = ErrInvalidEncoding
+		return
+	}
+	if endpoint == 1 {
+		if err = readValue(); err != nil {
+			return
+		}
+	}
+	// Siblings which split on rune boundaries can share a first byte, so
+	// there is no limit on the count.  A damaged one runs out of input soon
+	// enough
+	count, err := d.readUvarint()
+	if err == nil && count > math.MaxInt32 {
+		err = ErrInvalidEncoding
+	}
+	return key, endpoint, int(count), err
+}
+
+// readBW reads a BW node and everything beneath it.  Nodes get an index if
+// indexed is set, see layout
+func (d *decoder) readBW(isRoot, indexed bool) (*bwTrie, error) {
+	key, endpoint, count, err := d.readNode(isRoot, func() error { return nil })
+	if err != nil {
+		return nil, err
+	}
+	t := &bwTrie{key: key, endpoint: endpoint, children: make([]*bwTrie, 0, min(count, 256))}
+	if isRoot {
+		t.key = nil
+	}
+	for i := 0; i < count; i++ {
+		child, err := d.readBW(false, indexed)
+		if err != nil {
+			return nil, err
+		}
+		var prev []byte
+		if i > 0 {
+			prev = t.children[i-1].key
+		}
+		if !d.sibling(isRoot, prev, child.key) {
+			return nil, ErrInvalidEncoding
+		}
+		t.children = append(t.children, child)
+	}
+	t.reindex(indexed)
+	t.tally()
+	return t, nil
+}
+
+func readKV[V any](d *decoder, codec Codec[V], isRoot, indexed bool) (*kvTrie[V], error) {
+	var value V
+	key, endpoint, count, err := d.readNode(isRoot, func() error {
+		data, err := d.readBytes()
+		if err == nil {
+			value, err = codec.Decode(data)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	t := &kvTrie[V]{key: key, endpoint: endpoint, value: value, children: make([]*kvTrie[V], 0, min(count, 256))}
+	if isRoot {
+		t.key = nil
+	}
+	for i := 0; i < count; i++ {
+		child, err := readKV(d, codec, false, indexed)
+		if err != nil {
+			return nil, err
+		}
+		var prev []byte
+		if i > 0 {
+			prev = t.children[i-1].key
+		}
+		if !d.sibling(isRoot, prev, child.key) {
+			return nil, ErrInvalidEncoding
+		}
+		t.children = append(t.children, child)
+	}
+	t.reindex(indexed)
+	t.tally()
+	return t, nil
+}
+
+// readTrie reads the header and checksum of a serialized trie from r, and
+// leaves reading the nodes in between to readRoot
+func readTrie(r io.Reader, readRoot func(d *decoder, kind byte) error) (int64, error) {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	d := &decoder{r: br, sum: crc32.NewIEEE()}
+	var header [len(encodingMagic) + 2]byte
+	if _, err := io.ReadFull(d, header[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return d.n, err
+	}
+	if string(header[:len(encodingMagic)]) != encodingMagic {
+		return d.n, ErrInvalidEncoding
+	}
+	if header[len(encodingMagic)] != encodingVersion {
+		return d.n, ErrUnsupportedVersion
+	}
+	if err := readRoot(d, header[len(encodingMagic)+1]); err != nil {
+		return d.n, err
+	}
+	expected := d.sum.Sum32()
+	var checksum [4]byte
+	if _, err := io.ReadFull(d, checksum[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return d.n, err
+	}
+	if binary.BigEndian.Uint32(checksum[:]) != expected {
+		return d.n, ErrChecksum
+	}
+	return d.n, nil
+}
@@ -0,0 +1,216 @@
+package trie
+
+import "bytes"
+
+// FuzzyFunc is the callback used by Fuzzy, it is given each key which was
+// found, its value, and its edit distance from the key being searched for
+type FuzzyFunc func(key []byte, value interface{}, distance int)
+
+// fuzzySearch finds keys within an edit distance of key.  It works out the
+// Levenshtein distance one row of the usual dynamic programming table at a
+// time as it descends the trie, adding a row for each byte of each child key.
+// Since every key beneath a node shares the rows above it, a whole branch can
+// be skipped as soon as every entry in its newest row is over the limit.
+type fuzzySearch[V any] struct {
+	key      []byte
+	max      int
+	damerau  bool
+	callback func([]byte, V, int)
+	path     []byte
+	rows     [][]int
+}
+
+func fuzzy[V any](root node[V], key []byte, max int, damerau bool, callback func([]byte, V, int)) {
+	if max < 0 {
+		return
+	}
+	s := &fuzzySearch[V]{
+		key:      key,
+		max:      max,
+		damerau:  damerau,
+		callback: callback,
+		rows:     [][]int{make([]int, len(key)+1)},
+	}
+	for j := range s.rows[0] {
+		s.rows[0][j] = j
+	}
+	if root.isEndpoint() && len(key) <= max {
+		callback([]byte{}, root.val(), len(key))
+	}
+	s.walk(root)
+}
+
+func (s *fuzzySearch[V]) walk(n node[V]) {
+	depth := len(s.path)
+	for i := 0; i < n.numChildren(); i++ {
+		c := n.child(i)
+		s.path = s.path[:depth]
+		viable := true
+		for _, b := range c.edge() {
+			s.path = append(s.path, b)
+			if !s.step() {
+				viable = false
+				break
+			}
+		}
+		if !viable {
+			continue
+		}
+		if d := s.rows[len(s.path)][len(s.key)]; c.isEndpoint() && d <= s.max {
+			s.callback(bytes.Clone(s.path), c.val(), d)
+		}
+		s.walk(c)
+	}
+	s.path = s.path[:depth]
+}
+
+// step works out the row for the last byte of path, and reports whether any
+// key beneath it could still be within the maximum distance
+func (s *fuzzySearch[V]) step() bool {
+	i := len(s.path)
+	if i == len(s.rows) {
+		s.rows = append(s.rows, make([]int, len(s.key)+1))
+	}
+	prev, row, ch := s.rows[i-1], s.rows[i], s.path[i-1]
+	row[0] = i
+	best := row[0]
+	for j := 1; j <= len(s.key); j++ {
+		cost := 1
+		if s.key[j-1] == ch {
+			cost = 0
+		}
+		row[j] = min(prev[j]+1, row[j-1]+1, prev[j-1]+cost)
+		if s.damerau && i > 1 && j > 1 && ch == s.key[j-2] && s.path[i-2] == s.key[j-1] {
+			// the last two bytes are the last two of the key, swapped
+			row[j] = min(row[j], s.rows[i-2][j-2]+1)
+		}
+		best = min(best, row[j])
+	}
+	return best <= s.max
+}
+
+// levenshtein is an automaton which accepts keys within max edits of key,
+// counting the edits in runes.  Its state is the newest row of the usual
+// dynamic programming table, see fuzzySearch, along with the row and rune
+// before it for spotting transpositions
+type levenshtein struct {
+	key     []rune
+	max     int
+	damerau bool
+}
+
+type levenshteinState struct {
+	prev, row []int
+	last      rune
+}
+
+func (l *levenshtein) start() levenshteinState {
+	row := make([]int, len(l.key)+1)
+	for j := range row {
+		row[j] = j
+	}
+	return levenshteinState{row: row, last: -1}
+}
+
+func (l *levenshtein) step(state levenshteinState, r rune) levenshteinState {
+	prev, row := state.row, make([]int, len(l.key)+1)
+	row[0] = prev[0] + 1
+	for j := 1; j <= len(l.key); j++ {
+		cost := 1
+		if l.key[j-1] == r {
+			cost = 0
+		}
+		row[j] = min(prev[j]+1, row[j-1]+1, prev[j-1]+cost)
+		if l.damerau && state.prev != nil && j > 1 && r == l.key[j-2] && state.last == l.key[j-1] {
+			row[j] = min(row[j], state.prev[j-2]+1)
+		}
+	}
+	return levenshteinState{prev: prev, row: row, last: r}
+}
+
+func (l *levenshtein) dead(state levenshteinState) bool {
+	for _, d := range state.row {
+		if d <= l.max {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *levenshtein) accepts(state levenshteinState) bool {
+	return state.row[len(l.key)] <= l.max
+}
+
+func (l *levenshtein) acceptsAll(levenshteinState) bool {
+	return false
+}
+
+// fuzzyRunes is fuzzy for tries in Unicode mode
+func fuzzyRunes[V any](root node[V], key []byte, max int, damerau bool, callback func([]byte, V, int)) {
+	if max < 0 {
+		return
+	}
+	l := &levenshtein{key: []rune(string(key)), max: max, damerau: damerau}
+	automatonWalk[V, levenshteinState](root, l, func(k []byte, v V, state levenshteinState) bool {
+		callback(k, v, state.row[len(l.key)])
+		return true
+	})
+}
+
+// Fuzzy runs callback against every key in the trie which is within
+// maxDistance edits of the key argument, along with its Levenshtein distance
+// from key.  An edit is inserting, deleting or changing a single byte, or a
+// single rune for a trie in Unicode mode (see SetUnicode.)  Branches of the
+// trie which can't contain a close enough key are skipped.  Keys are found in
+// order, sort them by distance if you want the closest first
+func (t *Trie) Fuzzy(key interface{}, maxDistance int, callback FuzzyFunc) {
+	t.fuzzy(key, maxDistance, false, callback)
+}
+
+// FuzzyDamerau works the same as Fuzzy except that swapping two adjacent bytes
+// also counts as a single edit (the optimal string alignment distance) which
+// suits catching typos
+func (t *Trie) FuzzyDamerau(key interface{}, maxDistance int, callback FuzzyFunc) {
+	t.fuzzy(key, maxDistance, true, callback)
+}
+
+func (t *Trie) fuzzy(key interface{}, maxDistance int, damerau bool, callback FuzzyFunc) {
+	k, ok := t.keyOf(key)
+	if !ok {
+		return
+	}
+	spelled := func(k []byte, v interface{}, d int) {
+		callback(t.spell(k), v, d)
+	}
+	if t.unicode != nil {
+		fuzzyRunes(t.root, k, maxDistance, damerau, spelled)
+	} else {
+		fuzzy(t.root, k, maxDistance, damerau, spelled)
+	}
+}
+
+// Fuzzy runs callback against every key in the trie which is within
+// maxDistance edits of the key argument.  See Trie.Fuzzy
+func (t *KVTrie[K, V]) Fuzzy(key K, maxDistance int, callback func(K, V, int)) {
+	fuzzy(t.root, []byte(key), maxDistance, false, func(k []byte, v V, d int) {
+		callback(K(k), v, d)
+	})
+}
+
+// FuzzyDamerau works the same as Fuzzy except that swapping two adjacent bytes
+// also counts as a single edit.  See Trie.FuzzyDamerau
+func (t *KVTrie[K, V]) FuzzyDamerau(key K, maxDistance int, callback func(K, V, int)) {
+	fuzzy(t.root, []byte(key), maxDistance, true, func(k []byte, v V, d int) {
+		callback(K(k), v, d)
+	})
+}
+
+// Fuzzy is the concurrency safe version of Trie.Fuzzy
+func (t *ConcurrentTrie) Fuzzy(key interface{}, maxDistance int, callback FuzzyFunc) {
+	t.load().Fuzzy(key, maxDistance, callback)
+}
+
+// FuzzyDamerau is the concurrency safe version of Trie.FuzzyDamerau
+func (t *ConcurrentTrie) FuzzyDamerau(key interface{}, maxDistance int, callback FuzzyFunc) {
+	t.load().FuzzyDamerau(key, maxDistance, callback)
+}
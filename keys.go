@@ -0,0 +1,73 @@
+package trie
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrKeyType is returned by the strict API for keys of a type the trie
+	// can't use as a key
+	ErrKeyType = errors.New("trie: unsupported key type")
+	// ErrKeyTooLong is returned by the strict API for keys longer than the
+	// trie allows, see WithMaxKeyLength
+	ErrKeyTooLong = errors.New("trie: key too long")
+)
+
+// encodeKey converts a key into the bytes it is stored as.  Keys can be
+//
+//	[]byte and string, which are used as they are
+//	integers, which are fixed width and big endian so that they sort in
+//	  numeric order, with the sign bit flipped for signed integers so that
+//	  negative numbers come first.  int and uint take 8 bytes
+//	encoding.TextMarshaler, which is stored as its text
+//	fmt.Stringer, which is stored as its string
+//
+// in that order of preference.  Anything else is an ErrKeyType
+func encodeKey(key interface{}) ([]byte, error) {
+	switch key := key.(type) {
+	case []byte:
+		return key, nil
+	case string:
+		return []byte(key), nil
+	case int:
+		return binary.BigEndian.AppendUint64(nil, uint64(key)^1<<63), nil
+	case int8:
+		return []byte{uint8(key) ^ 1<<7}, nil
+	case int16:
+		return binary.BigEndian.AppendUint16(nil, uint16(key)^1<<15), nil
+	case int32:
+		return binary.BigEndian.AppendUint32(nil, uint32(key)^1<<31), nil
+	case int64:
+		return binary.BigEndian.AppendUint64(nil, uint64(key)^1<<63), nil
+	case uint:
+		return binary.BigEndian.AppendUint64(nil, uint64(key)), nil
+	case uint8:
+		return []byte{key}, nil
+	case uint16:
+		return binary.BigEndian.AppendUint16(nil, key), nil
+	case uint32:
+		return binary.BigEndian.AppendUint32(nil, key), nil
+	case uint64:
+		return binary.BigEndian.AppendUint64(nil, key), nil
+	case encoding.TextMarshaler:
+		text, err := key.MarshalText()
+		if err != nil {
+			return nil, fmt.Errorf("trie: marshaling key: %w", err)
+		}
+		return text, nil
+	case fmt.Stringer:
+		return []byte(key.String()), nil
+	default:
+		return nil, fmt.Errorf("%w %T", ErrKeyType, key)
+	}
+}
+
+// keyBytes converts the key types accepted by Trie into a byte slice, see
+// encodeKey
+func keyBytes(key interface{}) ([]byte, bool) {
+	k, err := encodeKey(key)
+	return k, err == nil
+}
@@ -1,145 +1,266 @@
 package trie
 
 import (
+	"bytes"
 	"log"
+	"math"
+	"slices"
+	"sort"
 	"strings"
 )
 
-type kvTrie struct {
+type kvTrie[V any] struct {
 	key      []byte
-	value    interface{}
-	children []*kvTrie
+	value    V
+	children []*kvTrie[V]
 	endpoint uint8
+	// score is the weight of this key, and best is the highest weight of any
+	// key at or beneath this node.  See TopK
+	score float64
+	best  float64
+	// count is the number of keys at or beneath this node
+	count int
+	// index finds children by their first byte, for nodes with lots of them
+	index *childIndex
 }
 
-func (t *kvTrie) set(key []byte, vals ...interface{}) {
-	t.del(key)
-	t.add(key, vals...)
+func (t *kvTrie[V]) set(key []byte, l layout, vals ...V) (V, bool) {
+	value := first(vals)
+	return t.update(key, l, func(V, bool) (V, bool) {
+		return value, true
+	})
 }
 
-func (t *kvTrie) add(key []byte, vals ...interface{}) {
-	if len(vals) < 1 {
-		vals = []interface{}{nil}
+func (t *kvTrie[V]) add(key []byte, l layout, vals ...V) bool {
+	value := first(vals)
+	_, exists := t.update(key, l, func(_ V, exists bool) (V, bool) {
+		return value, !exists
+	})
+	return !exists
+}
+
+// update is the single descent behind add, set, and the likes of Upsert.  fn
+// is passed the value of key, and whether key exists, and returns the value to
+// store under key and whether to store it at all.  A key which is stored over
+// keeps its weight.  update returns the value key had, and whether it existed
+func (t *kvTrie[V]) update(key []byte, l layout, fn func(V, bool) (V, bool)) (V, bool) {
+	var zero V
+	if len(key) == 0 {
+		// The empty key is kept by the root, every other node has a key of
+		// its own and is only ever handed the rest of a key
+		return t.store(fn)
 	}
-	for k, v := range t.children {
-		if lcp := longestCommonPrefix(t.children[k].key, key); lcp > 0 {
-			if lcp == len(key) && lcp == len(v.key) {
-				// This key exists exactly
-				// eg: have "aa", adding "aa"
-				if v.endpoint == 0 {
-					v.endpoint = 1
-				}
-			} else if lcp == len(key) {
-				// the entire key is a sub-key of the child key
-				// eg: have "aa", adding "aaa"
-				oldChild := v
-				oldChild.key = v.key[lcp:]
-				newChild := &kvTrie{
-					endpoint: 1,
-					key:      key[:lcp],
-					value:    vals[0],
-					children: []*kvTrie{oldChild},
-				}
-				t.children[k] = newChild
-			} else if lcp == len(v.key) {
-				// the entire child key is a prefix for the key
-				// eg: have "aa", adding "aaa"
-				v.add(key[lcp:], vals...)
+	lo, children := t.span(l, key)
+	for i, v := range children {
+		k := lo + i
+		lcp := l.split.commonPrefix(v.key, key)
+		if lcp == 0 {
+			continue
+		}
+		if lcp == len(v.key) {
+			// the key is the child key, or the child key is a prefix of it
+			// eg: have "aa", adding "aa" or "aaa"
+			count := v.count
+			var old V
+			var existed bool
+			if lcp == len(key) {
+				old, existed = v.store(fn)
 			} else {
-				// the key and child key share a common prefix but are both going to
-				// end up as their own children of the common prefix on account of
-				// being larger than said prefix
-				// eg: have "abc", adding "ayz"
-				oldChild := v
-				oldChild.key = oldChild.key[lcp:]
-				newChild := &kvTrie{
-					key: key[:lcp],
-					children: []*kvTrie{
-						oldChild,
-						&kvTrie{
-							endpoint: 1,
-							value:    vals[0],
-							key:      key[lcp:],
-						},
-					},
-				}
-				t.children[k] = newChild
+				old, existed = v.update(key[lcp:], l, fn)
+			}
+			t.best = max(t.best, v.best)
+			t.count += v.count - count
+			return old, existed
+		}
+		// Whatever happens from here on the key is a new one
+		value, ok := fn(zero, false)
+		if !ok {
+			return zero, false
+		}
+		// the new node's key is cut from the child's, rather than from the
+		// caller's key, so that the trie owns all of its keys
+		oldChild := v
+		prefix := v.key[:lcp:lcp]
+		oldChild.key = v.key[lcp:]
+		if lcp == len(key) {
+			// the entire key is a sub-key of the child key
+			// eg: have "aaa", adding "aa"
+			t.children[k] = &kvTrie[V]{
+				endpoint: 1,
+				key:      prefix,
+				value:    value,
+				children: []*kvTrie[V]{oldChild},
+				best:     max(oldChild.best, 0),
+				count:    oldChild.count + 1,
+			}
+		} else {
+			// the key and child key share a common prefix but are both going to
+			// end up as their own children of the common prefix on account of
+			// being larger than said prefix
+			// eg: have "abc", adding "ayz"
+			leaf := &kvTrie[V]{
+				endpoint: 1,
+				value:    value,
+				key:      l.own(key[lcp:]),
+				count:    1,
+			}
+			newChild := &kvTrie[V]{
+				key:      prefix,
+				children: []*kvTrie[V]{oldChild, leaf},
+				best:     max(oldChild.best, 0),
+				count:    oldChild.count + 1,
 			}
-			return
+			if bytes.Compare(leaf.key, oldChild.key) < 0 {
+				newChild.children[0], newChild.children[1] = leaf, oldChild
+			}
+			t.children[k] = newChild
+		}
+		t.adopt(k, l)
+		t.best = max(t.best, 0)
+		t.count++
+		return zero, false
+	}
+	value, ok := fn(zero, false)
+	if !ok {
+		return zero, false
+	}
+	leaf := &kvTrie[V]{key: l.own(key), endpoint: 1, value: value, count: 1}
+	if l.unsorted {
+		t.children = append(t.children, leaf)
+	} else {
+		// Keep the children sorted so that iteration happens in order
+		i := sort.Search(len(t.children), func(i int) bool {
+			return bytes.Compare(t.children[i].key, key) > 0
+		})
+		t.children = insertChild(t.children, i, leaf)
+		if t.index != nil {
+			t.index.inserted(i, len(t.children), key[0])
 		}
 	}
-	t.children = append(t.children, &kvTrie{key: key, endpoint: 1, value: vals[0]})
+	if t.index == nil {
+		t.reindex(l.indexed())
+	}
+	t.best = max(t.best, 0)
+	t.count++
+	return zero, false
+}
+
+// store is update for the key which ends at this node
+func (t *kvTrie[V]) store(fn func(V, bool) (V, bool)) (V, bool) {
+	var old V
+	existed := t.endpoint != 0
+	if existed {
+		old = t.value
+	}
+	value, ok := fn(old, existed)
+	if !ok {
+		return old, existed
+	}
+	t.value = value
+	if !existed {
+		t.endpoint = 1
+		t.best = max(t.best, 0)
+		t.count++
+	}
+	return old, existed
 }
 
-func (t *kvTrie) drop(key []byte) {
-	if t.key == nil && key == nil {
-		t.children = []*kvTrie{}
+func (t *kvTrie[V]) drop(key []byte) {
+	if len(key) == 0 {
+		// Every key has the empty prefix
+		var zero V
+		t.children = []*kvTrie[V]{}
+		t.endpoint, t.value, t.score = 0, zero, 0
+		t.index = nil
+		t.tally()
 		return
 	}
-	for k, v := range t.children {
+	children := t.children[:0]
+	for _, v := range t.children {
 		if lcp := longestCommonPrefix(key, v.key); lcp > 0 {
 			if lcp == len(key) {
-				if k == 0 {
-					t.children = append(t.children[1:])
-				} else {
-					t.children = append(t.children[:k], t.children[k+1:]...)
-				}
-			} else if lcp < len(v.key) {
-				// The delete key is part of, but less than the entire child key, Cannot be an exact match
-				return
-			} else {
+				// The whole child has the prefix.  So might its siblings, if the
+				// prefix ends part way through a rune
+				continue
+			}
+			if lcp == len(v.key) {
 				// The child key is less than the delete key but it is a prefix of the delete key, recurse
 				v.drop(key[lcp:])
 				if v.endpoint == 0 && len(v.children) == 0 {
-					if k == 0 {
-						t.children = append(t.children[1:])
-					} else {
-						t.children = append(t.children[:k], t.children[k+1:]...)
-					}
+					continue
 				}
 			}
+			// Otherwise the delete key is part of, but less than the entire child key, Cannot be an exact match
 		}
+		children = append(children, v)
 	}
+	clear(t.children[len(children):])
+	t.children = children
+	if t.index != nil {
+		t.index.fill(len(children), func(i int) []byte { return children[i].key })
+	}
+	t.tally()
 }
 
-func (t *kvTrie) del(key []byte) {
-	for k, v := range t.children {
+func (t *kvTrie[V]) del(key []byte) (V, bool) {
+	var zero V
+	if len(key) == 0 {
+		old, existed := t.value, t.endpoint != 0
+		t.endpoint, t.value, t.score = 0, zero, 0
+		t.tally()
+		return old, existed
+	}
+	lo, children := t.span(layout{}, key)
+	for i, v := range children {
+		k := lo + i
 		if lcp := longestCommonPrefix(key, v.key); lcp > 0 {
 			if lcp < len(v.key) {
-				// Delete key is a prefix of child, but is not child or further, nothing to do
-				return
+				// Delete key is a prefix of child, but is not child or further.
+				// A sibling could still start with the same byte though
+				continue
 			}
 			if lcp == len(key) && lcp == len(v.key) {
 				// This is the key we came for
+				old, existed := v.value, v.endpoint != 0
 				v.endpoint = 0
-				v.value = nil
+				v.value = zero
+				v.score = 0
+				v.tally()
 				if len(v.children) == 0 {
-					if k == 0 {
-						t.children = append(t.children[1:])
-					} else {
-						t.children = append(t.children[:k], t.children[k+1:]...)
-					}
+					t.removeChild(k)
 				}
-				return
+				t.tally()
+				return old, existed
 			}
 			if lcp == len(v.key) {
-				v.del(key[lcp:])
+				old, existed := v.del(key[lcp:])
+				if !existed {
+					// A sibling which starts with the same byte might hold
+					// it, see get
+					continue
+				}
 				if v.endpoint == 0 && len(v.children) == 0 {
-					if k == 0 {
-						t.children = append(t.children[1:])
-					} else {
-						t.children = append(t.children[:k], t.children[k+1:]...)
-					}
+					t.removeChild(k)
 				}
-				return
+				t.tally()
+				return old, existed
 			}
 		}
 	}
 	// No such key found in the tree
+	return zero, false
 }
 
-func (t *kvTrie) get(key []byte) (bool, interface{}) {
-	for _, v := range t.children {
+func (t *kvTrie[V]) get(key []byte, l layout) (bool, V) {
+	var zero V
+	if len(key) == 0 {
+		if t.endpoint == 0 {
+			return false, zero
+		}
+		return true, t.value
+	}
+	_, children := t.span(l, key)
+	for _, v := range children {
 		if key[0] != v.key[0] {
 			continue
 		}
@@ -150,38 +271,357 @@ func (t *kvTrie) get(key []byte) (bool, interface{}) {
 		if lcp := longestCommonPrefix(key, v.key); lcp > 0 {
 			if lcp < len(v.key) {
 				// if the common prefix less than the entirety of the child
-				// key, it cannot possibly match the child key
-				return false, nil
+				// key, it cannot possibly match the child key, but a sibling
+				// which starts with the same byte might
+				continue
 			}
 			if lcp == len(key) {
 				// the child is exactly the key we're looking for
 				if v.endpoint != 0 {
 					return true, v.value
 				}
-				return false, nil
+				return false, zero
+			}
+			if found, value := v.get(key[lcp:], l); found {
+				return true, value
 			}
-			return v.get(key[lcp:])
+			// In a Unicode trie a sibling which starts with the same byte
+			// can hold the rest of the key, when the keys part ways in the
+			// middle of a rune.  eg: "a" and "a\x80"
 		}
 	}
-	return false, nil
+	return false, zero
 }
 
-func (t *kvTrie) iterate(key []byte, callback IterFunc) {
+// setWeight changes the weight of key, if it exists, and reports whether it
+// did
+func (t *kvTrie[V]) setWeight(key []byte, weight float64) bool {
+	if len(key) == 0 {
+		if t.endpoint == 0 {
+			return false
+		}
+		t.score = weight
+		t.tally()
+		return true
+	}
+	_, children := t.span(layout{}, key)
+	for _, v := range children {
+		if lcp := longestCommonPrefix(key, v.key); lcp > 0 {
+			if lcp < len(v.key) {
+				continue
+			}
+			if lcp == len(key) {
+				if v.endpoint == 0 {
+					return false
+				}
+				v.score = weight
+				v.tally()
+			} else if !v.setWeight(key[lcp:], weight) {
+				// A sibling which starts with the same byte might hold it,
+				// see get
+				continue
+			}
+			t.tally()
+			return true
+		}
+	}
+	return false
+}
+
+// span returns the children which could lead to key, and where they start,
+// see span
+func (t *kvTrie[V]) span(l layout, key []byte) (int, []*kvTrie[V]) {
+	return span(l, t.index, t.children, (*kvTrie[V]).edge, key)
+}
+
+// adopt moves the siblings of the k'th child which begin with its key
+// beneath it.  Siblings only begin with the same byte in tries split on rune
+// boundaries, and then the k'th child only has a key which is a prefix of a
+// sibling when it has just been split in the middle of a rune, for a key
+// which isn't valid UTF-8.  See boundary
+func (t *kvTrie[V]) adopt(k int, l layout) {
+	c := t.children[k]
+	lo, siblings := t.span(l, c.key)
+	if len(siblings) < 2 {
+		return
+	}
+	adopted := false
+	for i := lo + len(siblings) - 1; i >= lo; i-- {
+		s := t.children[i]
+		if s == c || len(s.key) <= len(c.key) || !bytes.HasPrefix(s.key, c.key) {
+			continue
+		}
+		t.removeChild(i)
+		s.key = s.key[len(c.key):]
+		c.children = append(c.children, s)
+		c.count += s.count
+		c.best = max(c.best, s.best)
+		adopted = true
+	}
+	if !adopted {
+		return
+	}
+	if !l.unsorted {
+		slices.SortFunc(c.children, func(a, b *kvTrie[V]) int { return bytes.Compare(a.key, b.key) })
+	}
+	c.reindex(l.indexed())
+}
+
+// removeChild takes the k'th child away, keeping the index up to date
+func (t *kvTrie[V]) removeChild(k int) {
+	b := t.children[k].key[0]
+	t.children = slices.Delete(t.children, k, k+1)
+	if t.index != nil {
+		t.index.removed(k, b, k < len(t.children) && t.children[k].key[0] == b)
+	}
+}
+
+// reindex gives the node a new index after children have come or gone, for
+// nodes which might share their old one (see childIndex.)  Nodes which have an
+// index get a new one, otherwise they only get one if indexed is set and they
+// have enough children
+func (t *kvTrie[V]) reindex(indexed bool) {
+	if indexed || t.index != nil {
+		t.index = newChildIndex(t.children, (*kvTrie[V]).edge)
+	}
+}
+
+// tally works out best and count again from the children, for when keys have
+// been removed from beneath the node or a weight beneath it might have gone
+// down
+func (t *kvTrie[V]) tally() {
+	t.best = math.Inf(-1)
+	t.count = int(t.endpoint)
 	if t.endpoint != 0 {
-		callback(key, t.value)
+		t.best = t.score
 	}
 	for _, v := range t.children {
-		v.iterate(append(key, v.key...), callback)
+		t.best = max(t.best, v.best)
+		t.count += v.count
+	}
+}
+
+// clone returns a shallow copy of the node with its own children slice, which
+// can be modified without affecting the original node
+func (t *kvTrie[V]) clone() *kvTrie[V] {
+	c := *t
+	c.children = slices.Clone(t.children)
+	return &c
+}
+
+func (t *kvTrie[V]) thaw(key []byte) node[V] {
+	return t.thawed(key)
+}
+
+// thawed returns a copy of the node which can be changed anywhere along the
+// path to key without changing the node itself, for tries whose nodes are
+// shared with older versions of themselves (see ConcurrentTrie.)  It is the
+// path copying of with and without done up front, so that the usual methods
+// can then make the change in place.  The copy has its own children slice and
+// index.  Children which begin with the same byte as key are copied too, as
+// they are the only ones a change to key can reach, and the ones key goes
+// down through are thawed in turn.  Everything else is shared
+func (t *kvTrie[V]) thawed(key []byte) *kvTrie[V] {
+	n := t.clone()
+	if t.index != nil {
+		n.index = t.index.clone()
+	}
+	for k, v := range n.children {
+		switch lcp := longestCommonPrefix(key, v.key); {
+		case lcp == 0:
+		case lcp == len(v.key) && lcp < len(key):
+			n.children[k] = v.thawed(key[lcp:])
+		default:
+			c := *v
+			n.children[k] = &c
+		}
+	}
+	return n
+}
+
+// with is the path copying version of set (or of add when overwrite is false.)
+// Rather than modifying the trie it returns a copy of the node with the key
+// added beneath it.  Only the nodes along the path to the key are copied, the
+// rest are shared with the original
+func (t *kvTrie[V]) with(key []byte, value V, overwrite bool) *kvTrie[V] {
+	if len(key) == 0 {
+		// The empty key is kept by the root
+		if t.endpoint != 0 && !overwrite {
+			return t
+		}
+		n := t.clone()
+		n.endpoint, n.value, n.score = 1, value, 0
+		n.tally()
+		return n
+	}
+	for k, v := range t.children {
+		if lcp := longestCommonPrefix(v.key, key); lcp > 0 {
+			var newChild *kvTrie[V]
+			if lcp == len(key) && lcp == len(v.key) {
+				// This key exists exactly
+				if v.endpoint != 0 && !overwrite {
+					return t
+				}
+				newChild = v.clone()
+				newChild.endpoint = 1
+				newChild.value = value
+				newChild.score = 0
+				newChild.tally()
+			} else if lcp == len(key) {
+				// the entire key is a sub-key of the child key
+				oldChild := v.clone()
+				oldChild.key = v.key[lcp:]
+				newChild = &kvTrie[V]{
+					endpoint: 1,
+					key:      v.key[:lcp:lcp],
+					value:    value,
+					children: []*kvTrie[V]{oldChild},
+					best:     max(oldChild.best, 0),
+					count:    oldChild.count + 1,
+				}
+			} else if lcp == len(v.key) {
+				// the entire child key is a prefix for the key
+				newChild = v.with(key[lcp:], value, overwrite)
+				if newChild == v {
+					return t
+				}
+			} else {
+				// the key and child key share a common prefix but are both going to
+				// end up as their own children of the common prefix
+				oldChild := v.clone()
+				oldChild.key = v.key[lcp:]
+				leaf := &kvTrie[V]{
+					endpoint: 1,
+					value:    value,
+					key:      bytes.Clone(key[lcp:]),
+					count:    1,
+				}
+				newChild = &kvTrie[V]{
+					key:      v.key[:lcp:lcp],
+					children: []*kvTrie[V]{oldChild, leaf},
+					best:     max(oldChild.best, 0),
+					count:    oldChild.count + 1,
+				}
+				if leaf.key[0] < oldChild.key[0] {
+					newChild.children[0], newChild.children[1] = leaf, oldChild
+				}
+			}
+			n := t.clone()
+			n.children[k] = newChild
+			n.tally()
+			return n
+		}
+	}
+	n := t.clone()
+	i := sort.Search(len(n.children), func(i int) bool {
+		return bytes.Compare(n.children[i].key, key) > 0
+	})
+	n.children = insertChild(n.children, i, &kvTrie[V]{key: bytes.Clone(key), endpoint: 1, value: value, count: 1})
+	n.reindex(true)
+	n.best = max(n.best, 0)
+	n.count++
+	return n
+}
+
+// without is the path copying version of del.  If the key does not exist then
+// the node itself is returned
+func (t *kvTrie[V]) without(key []byte) *kvTrie[V] {
+	if len(key) == 0 {
+		if t.endpoint == 0 {
+			return t
+		}
+		var zero V
+		n := t.clone()
+		n.endpoint, n.value, n.score = 0, zero, 0
+		n.tally()
+		return n
+	}
+	for k, v := range t.children {
+		if lcp := longestCommonPrefix(key, v.key); lcp > 0 {
+			if lcp < len(v.key) {
+				// Delete key is a prefix of child, but is not child or further
+				return t
+			}
+			var newChild *kvTrie[V]
+			if lcp == len(key) {
+				// This is the key we came for
+				if v.endpoint == 0 {
+					return t
+				}
+				var zero V
+				newChild = v.clone()
+				newChild.endpoint = 0
+				newChild.value = zero
+				newChild.score = 0
+				newChild.tally()
+			} else if newChild = v.without(key[lcp:]); newChild == v {
+				return t
+			}
+			n := t.clone()
+			if newChild.endpoint == 0 && len(newChild.children) == 0 {
+				n.children = slices.Delete(n.children, k, k+1)
+				n.reindex(true)
+			} else {
+				n.children[k] = newChild
+			}
+			n.tally()
+			return n
+		}
+	}
+	return t
+}
+
+// pruned is the path copying version of drop.  If no keys have the prefix then
+// the node itself is returned
+func (t *kvTrie[V]) pruned(prefix []byte) *kvTrie[V] {
+	for k, v := range t.children {
+		if lcp := longestCommonPrefix(prefix, v.key); lcp > 0 {
+			// if the child key has the prefix, then so does everything beneath it
+			// and newChild stays nil
+			var newChild *kvTrie[V]
+			if lcp < len(prefix) {
+				if lcp < len(v.key) {
+					// The prefix diverges from the child key, nothing to drop
+					return t
+				}
+				if newChild = v.pruned(prefix[lcp:]); newChild == v {
+					return t
+				}
+			}
+			n := t.clone()
+			if newChild == nil || (newChild.endpoint == 0 && len(newChild.children) == 0) {
+				n.children = slices.Delete(n.children, k, k+1)
+				n.reindex(true)
+			} else {
+				n.children[k] = newChild
+			}
+			n.tally()
+			return n
+		}
 	}
+	return t
 }
 
-func (t *kvTrie) iterateFrom(prefix []byte, callback IterFunc) {
+func (t *kvTrie[V]) iterate(key []byte, callback func([]byte, V) bool) bool {
+	if t.endpoint != 0 && !callback(key, t.value) {
+		return false
+	}
 	for _, v := range t.children {
-		if len(prefix) == 0 {
-			v.iterate(v.key, callback)
-			continue
+		// siblings share the space after key, so a key passed to callback is
+		// only good until callback returns
+		if !v.iterate(extend(key, v.key), callback) {
+			return false
 		}
+	}
+	return true
+}
 
+func (t *kvTrie[V]) iterateFrom(path, prefix []byte, callback func([]byte, V) bool) bool {
+	if len(prefix) == 0 {
+		return t.iterate(path, callback)
+	}
+	_, children := t.span(layout{}, prefix)
+	for _, v := range children {
 		if prefix[0] != v.key[0] {
 			// This child key cannot be prefixed by the prefix argument
 			continue
@@ -191,19 +631,196 @@ func (t *kvTrie) iterateFrom(prefix []byte, callback IterFunc) {
 		lcp := longestCommonPrefix(prefix, v.key)
 
 		if lcp == len(prefix) {
-			// the child key is entirely prefixed by the prefix argument
-			v.iterate(v.key, callback)
+			// the child key is entirely prefixed by the prefix argument, and so
+			// might its siblings be if the prefix ends part way through a rune
+			if !v.iterate(extend(path, v.key), callback) {
+				return false
+			}
 		} else if lcp == len(v.key) {
 			// the entire child key is a shared sub prefix of the prefix argument
-			// time to recurse
-			v.iterateFrom(prefix[lcp:], callback)
+			// time to recurse.  A sibling which starts with the same byte can
+			// be one too, see get, so keep looking afterwards
+			if !v.iterateFrom(extend(path, v.key), prefix[lcp:], callback) {
+				return false
+			}
 		}
+		// otherwise a sibling which starts with the same byte might match
+	}
+	return true
+}
 
-		return
+func (t *kvTrie[V]) min(path []byte) ([]byte, V, bool) {
+	if t.endpoint != 0 {
+		return path, t.value, true
+	}
+	for _, v := range t.children {
+		if k, d, ok := v.min(append(path[:len(path):len(path)], v.key...)); ok {
+			return k, d, ok
+		}
 	}
+	var zero V
+	return nil, zero, false
+}
+
+func (t *kvTrie[V]) max(path []byte) ([]byte, V, bool) {
+	for i := len(t.children) - 1; i >= 0; i-- {
+		v := t.children[i]
+		if k, d, ok := v.max(append(path[:len(path):len(path)], v.key...)); ok {
+			return k, d, ok
+		}
+	}
+	if t.endpoint != 0 {
+		return path, t.value, true
+	}
+	var zero V
+	return nil, zero, false
+}
+
+func (t *kvTrie[V]) successor(path, key []byte) ([]byte, V, bool) {
+	for _, v := range t.children {
+		lcp := longestCommonPrefix(key, v.key)
+		if lcp == len(v.key) {
+			// the child key is a prefix of the key, the successor may be beneath
+			// the child, and if it isn't it's in one of the following children
+			k, d, ok := v.successor(append(path[:len(path):len(path)], v.key...), key[lcp:])
+			if ok {
+				return k, d, ok
+			}
+			continue
+		}
+		if lcp == len(key) || v.key[lcp] > key[lcp] {
+			// everything beneath this child sorts after the key
+			return v.min(append(path[:len(path):len(path)], v.key...))
+		}
+	}
+	var zero V
+	return nil, zero, false
+}
+
+func (t *kvTrie[V]) predecessor(path, key []byte) ([]byte, V, bool) {
+	if len(key) == 0 {
+		// Nothing beneath this node can sort before it
+		var zero V
+		return nil, zero, false
+	}
+	for i := len(t.children) - 1; i >= 0; i-- {
+		v := t.children[i]
+		lcp := longestCommonPrefix(key, v.key)
+		if lcp == len(v.key) {
+			// the child key is a prefix of the key, the predecessor may be
+			// beneath the child, or be the child itself
+			childPath := append(path[:len(path):len(path)], v.key...)
+			if k, d, ok := v.predecessor(childPath, key[lcp:]); ok {
+				return k, d, ok
+			}
+			if v.endpoint != 0 && lcp < len(key) {
+				return childPath, v.value, true
+			}
+			continue
+		}
+		if lcp < len(key) && v.key[lcp] < key[lcp] {
+			// everything beneath this child sorts before the key
+			return v.max(append(path[:len(path):len(path)], v.key...))
+		}
+	}
+	if t.endpoint != 0 {
+		return path, t.value, true
+	}
+	var zero V
+	return nil, zero, false
+}
+
+func (t *kvTrie[V]) rangeScan(path []byte, r keyRange, reverse bool, callback func([]byte, V) bool) bool {
+	if !reverse && t.endpoint != 0 && r.contains(path) && !callback(path, t.value) {
+		return false
+	}
+	for i := range t.children {
+		v := t.children[i]
+		if reverse {
+			v = t.children[len(t.children)-1-i]
+		}
+		childPath := extend(path, v.key)
+		if r.below(childPath) {
+			if reverse {
+				// every remaining child sorts even earlier
+				break
+			}
+			continue
+		}
+		if r.above(childPath) {
+			if !reverse {
+				// every remaining child sorts even later
+				break
+			}
+			continue
+		}
+		if !v.rangeScan(childPath, r, reverse, callback) {
+			return false
+		}
+	}
+	if reverse && t.endpoint != 0 && r.contains(path) {
+		return callback(path, t.value)
+	}
+	return true
+}
+
+func (t *kvTrie[V]) prefixesOf(key []byte, depth int, callback func([]byte, V)) {
+	if depth == 0 && t.endpoint != 0 {
+		// the empty key, at the root, is a prefix of everything
+		callback(key[:0], t.value)
+	}
+	_, children := t.span(layout{}, key[depth:])
+	for _, v := range children {
+		if lcp := longestCommonPrefix(key[depth:], v.key); lcp > 0 {
+			if lcp < len(v.key) {
+				// the child key runs past the end of the key, or away from it, so
+				// neither the child nor anything beneath it can be a prefix of key
+				continue
+			}
+			if v.endpoint != 0 {
+				callback(key[:depth+lcp], v.value)
+			}
+			// Siblings which start with the same byte can be prefixes too, see
+			// get.  They come in order of length, and only the longest can
+			// have children which lead further along key
+			v.prefixesOf(key, depth+lcp, callback)
+		}
+	}
+}
+
+func (t *kvTrie[V]) edge() []byte {
+	return t.key
+}
+
+func (t *kvTrie[V]) isEndpoint() bool {
+	return t.endpoint != 0
+}
+
+func (t *kvTrie[V]) val() V {
+	return t.value
+}
+
+func (t *kvTrie[V]) weight() float64 {
+	return t.score
+}
+
+func (t *kvTrie[V]) maxWeight() float64 {
+	return t.best
+}
+
+func (t *kvTrie[V]) size() int {
+	return t.count
+}
+
+func (t *kvTrie[V]) numChildren() int {
+	return len(t.children)
+}
+
+func (t *kvTrie[V]) child(i int) node[V] {
+	return t.children[i]
 }
 
-func (t *kvTrie) log(indent ...int) {
+func (t *kvTrie[V]) log(indent ...int) {
 	var indentLevel = len(indent)
 	if indentLevel > 0 {
 		indentLevel = indent[0]
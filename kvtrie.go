@@ -0,0 +1,219 @@
+package trie
+
+import (
+	"bytes"
+	"iter"
+)
+
+// Key describes the types which may be used as keys for a KVTrie. Anything
+// which is, at heart, a string or a byte slice will do.
+type Key interface {
+	~string | ~[]byte
+}
+
+// KVTrie is a type safe Key/Value trie. It uses the same radix trie as the
+// one returned by NewKVTrie but the values stored in it are all of type V, so
+// there is no need for type assertions when getting data back out of it.
+// Like a Trie it keeps its own copy of every key, and hands back keys which
+// belong to the caller.
+type KVTrie[K Key, V any] struct {
+	root  *kvTrie[V]
+	codec Codec[V]
+}
+
+// NewKV returns a new, empty, type safe Key/Value trie.
+//
+//	t := trie.NewKV[string, int]()
+//	t.Set("apple", 1)
+//	v, ok := t.Get("apple") // 1, true
+func NewKV[K Key, V any]() *KVTrie[K, V] {
+	return &KVTrie[K, V]{
+		root: &kvTrie[V]{
+			children: []*kvTrie[V]{},
+		},
+	}
+}
+
+// Set stores value under key, overwriting any value which was already stored
+// there.  It returns the value it overwrote, and whether there was one
+func (t *KVTrie[K, V]) Set(key K, value V) (old V, existed bool) {
+	return t.root.set([]byte(key), layout{}, value)
+}
+
+// Add stores value under key.  Unlike Set, Add will not replace the value of
+// a key which already exists in the trie.  It reports whether it added the
+// key
+func (t *KVTrie[K, V]) Add(key K, value V) bool {
+	return t.root.add([]byte(key), layout{}, value)
+}
+
+// Del removes a single key from the trie.  It returns the value the key had,
+// and whether it existed
+func (t *KVTrie[K, V]) Del(key K) (old V, existed bool) {
+	return t.root.del([]byte(key))
+}
+
+// Drop removes every key of which key is a prefix (inclusive) from the trie.
+// It returns how many keys it removed
+func (t *KVTrie[K, V]) Drop(key K) int {
+	before := t.root.count
+	t.root.drop([]byte(key))
+	return before - t.root.count
+}
+
+// DropFunc works the same as Drop except that callback is run against every
+// key, and its value, before they are removed.  See Trie.DropFunc
+func (t *KVTrie[K, V]) DropFunc(prefix K, callback func(K, V)) int {
+	t.IterateFrom(prefix, callback)
+	return t.Drop(prefix)
+}
+
+// Get returns the value stored under key, and whether or not the key exists.
+// If the key does not exist the zero value of V is returned.
+func (t *KVTrie[K, V]) Get(key K) (V, bool) {
+	ok, v := t.root.get([]byte(key), layout{})
+	return v, ok
+}
+
+// Exists returns whether or not key has been stored in the trie.
+func (t *KVTrie[K, V]) Exists(key K) bool {
+	ok, _ := t.root.get([]byte(key), layout{})
+	return ok
+}
+
+// GetBranch returns all of the keys which have a prefix of the prefix argument
+// (inclusive.)
+func (t *KVTrie[K, V]) GetBranch(prefix K) []K {
+	var rval = []K{}
+	t.IterateFrom(prefix, func(key K, _ V) {
+		rval = append(rval, key)
+	})
+	return rval
+}
+
+// Iterate runs callback against every key and value stored in the trie, in
+// order.
+func (t *KVTrie[K, V]) Iterate(callback func(K, V)) {
+	t.root.iterate([]byte{}, func(key []byte, value V) bool {
+		callback(K(bytes.Clone(key)), value)
+		return true
+	})
+}
+
+// IterateFrom works the same as Iterate except that it only iterates on keys
+// for which the prefix parameter is a prefix (inclusive.)
+func (t *KVTrie[K, V]) IterateFrom(prefix K, callback func(K, V)) {
+	t.root.iterateFrom([]byte{}, []byte(prefix), func(key []byte, value V) bool {
+		callback(K(bytes.Clone(key)), value)
+		return true
+	})
+}
+
+// Walk works the same as Iterate except that the walk stops as soon as
+// callback returns false
+func (t *KVTrie[K, V]) Walk(callback func(K, V) bool) {
+	t.root.iterate([]byte{}, func(key []byte, value V) bool {
+		return callback(K(bytes.Clone(key)), value)
+	})
+}
+
+// WalkFrom works the same as IterateFrom except that the walk stops as soon as
+// callback returns false
+func (t *KVTrie[K, V]) WalkFrom(prefix K, callback func(K, V) bool) {
+	t.root.iterateFrom([]byte{}, []byte(prefix), func(key []byte, value V) bool {
+		return callback(K(bytes.Clone(key)), value)
+	})
+}
+
+// All returns an iterator over every key and value in the trie, in order.
+func (t *KVTrie[K, V]) All() iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		t.Walk(yield)
+	}
+}
+
+// WithPrefix returns an iterator over every key, and value, for which prefix
+// is a prefix (inclusive,) in order.
+//
+//	for key, value := range t.WithPrefix("user:") {
+//		...
+//	}
+func (t *KVTrie[K, V]) WithPrefix(prefix K) iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		t.WalkFrom(prefix, yield)
+	}
+}
+
+// Backward returns an iterator over every key and value in the trie in
+// reverse order.
+func (t *KVTrie[K, V]) Backward() iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		t.root.rangeScan([]byte{}, keyRange{}, true, func(key []byte, value V) bool {
+			return yield(K(bytes.Clone(key)), value)
+		})
+	}
+}
+
+// Range runs callback against every key in the trie between start and end, in
+// order.  An empty start or end leaves that side of the range open.  See
+// Trie.Range and RangeFlag
+func (t *KVTrie[K, V]) Range(start, end K, flags RangeFlag, callback func(K, V)) {
+	r := newKeyRange([]byte(start), []byte(end), flags)
+	t.root.rangeScan([]byte{}, r, flags&Reverse != 0, func(k []byte, v V) bool {
+		callback(K(bytes.Clone(k)), v)
+		return true
+	})
+}
+
+// Min returns the smallest key in the trie, and its value.
+func (t *KVTrie[K, V]) Min() (key K, value V, ok bool) {
+	k, v, ok := t.root.min([]byte{})
+	return K(k), v, ok
+}
+
+// Max returns the largest key in the trie, and its value.
+func (t *KVTrie[K, V]) Max() (key K, value V, ok bool) {
+	k, v, ok := t.root.max([]byte{})
+	return K(k), v, ok
+}
+
+// Successor returns the smallest key in the trie which sorts after the key
+// argument, and its value.
+func (t *KVTrie[K, V]) Successor(key K) (next K, value V, ok bool) {
+	k, v, ok := t.root.successor([]byte{}, []byte(key))
+	return K(k), v, ok
+}
+
+// Predecessor returns the largest key in the trie which sorts before the key
+// argument, and its value.
+func (t *KVTrie[K, V]) Predecessor(key K) (prev K, value V, ok bool) {
+	k, v, ok := t.root.predecessor([]byte{}, []byte(key))
+	return K(k), v, ok
+}
+
+// LongestPrefix finds the longest key in the trie which is a prefix of the key
+// argument (inclusive.) See Trie.LongestPrefix
+func (t *KVTrie[K, V]) LongestPrefix(key K) (matchedKey K, value V, ok bool) {
+	t.AllPrefixes(key, func(k K, v V) {
+		matchedKey, value, ok = k, v, true
+	})
+	return
+}
+
+// AllPrefixes runs callback against every key in the trie which is a prefix of
+// the key argument (inclusive,) shortest first.
+func (t *KVTrie[K, V]) AllPrefixes(key K, callback func(K, V)) {
+	t.root.prefixesOf([]byte(key), 0, func(k []byte, v V) {
+		callback(K(k), v)
+	})
+}
+
+// Log prints a "pretty" representation of the trie. See Trie.Log
+func (t *KVTrie[K, V]) Log() {
+	t.root.log(0)
+}
+
+// Count returns the number of keys in the trie.
+func (t *KVTrie[K, V]) Count() int {
+	return t.root.size()
+}
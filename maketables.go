@@ -0,0 +1,153 @@
+//go:build ignore
+
+// maketables generates normtables.go, the Unicode tables behind NFC, NFKC
+// and case folding, from files in the Unicode Character Database.  It wants
+// UnicodeData.txt, CompositionExclusions.txt and CaseFolding.txt, all from the
+// same version, in the directory given with -ucd
+//
+//	go run maketables.go -ucd ~/ucd/16.0.0 -version 16.0.0
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	ucd     = flag.String("ucd", ".", "directory holding the Unicode Character Database files")
+	version = flag.String("version", "", "Unicode version of the files")
+	output  = flag.String("output", "normtables.go", "file to write")
+)
+
+func main() {
+	flag.Parse()
+	if *version == "" {
+		log.Fatal("maketables: -version is required")
+	}
+	classes := map[rune]string{}
+	canonical := map[rune]string{}
+	compatibility := map[rune]string{}
+	readFields("UnicodeData.txt", func(fields []string) {
+		r := parseRune(fields[0])
+		if fields[3] != "0" {
+			classes[r] = fields[3]
+		}
+		if d := fields[5]; strings.HasPrefix(d, "<") {
+			compatibility[r] = parseRunes(d[strings.Index(d, ">")+1:])
+		} else if d != "" {
+			canonical[r] = parseRunes(d)
+		}
+	})
+	exclusions := map[rune]string{}
+	readFields("CompositionExclusions.txt", func(fields []string) {
+		exclusions[parseRune(fields[0])] = "true"
+	})
+	folds := map[rune]string{}
+	readFields("CaseFolding.txt", func(fields []string) {
+		if fields[1] == "F" {
+			folds[parseRune(fields[0])] = parseRunes(fields[2])
+		}
+	})
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by maketables.go from the Unicode Character Database version %s. DO NOT EDIT.\n\n", *version)
+	fmt.Fprintf(&buf, "package trie\n\n")
+	writeMap(&buf, "combiningClasses", "uint8", "are the canonical combining classes of the runes which have one other than 0", classes)
+	writeMap(&buf, "canonicalDecompositions", "string", "map runes to their canonical decompositions, which may decompose further in turn.  Hangul syllables are decomposed by arithmetic instead", quoteAll(canonical))
+	writeMap(&buf, "compatibilityDecompositions", "string", "map runes to the decompositions which only the compatibility forms use, which may decompose further in turn", quoteAll(compatibility))
+	writeMap(&buf, "compositionExclusions", "bool", "are the runes which are never composed even though they have a canonical decomposition into two starters", exclusions)
+	writeMap(&buf, "fullFolds", "string", "are the full case foldings which fold a single rune into several", quoteAll(folds))
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatalf("maketables: formatting: %v", err)
+	}
+	if err := os.WriteFile(*output, src, 0o644); err != nil {
+		log.Fatalf("maketables: %v", err)
+	}
+}
+
+// readFields calls fn with the semicolon separated fields of every line of a
+// UCD file, without comments
+func readFields(name string, fn func([]string)) {
+	f, err := os.Open(filepath.Join(*ucd, name))
+	if err != nil {
+		log.Fatalf("maketables: %v", err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line, _, _ := strings.Cut(s.Text(), "#")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, ";")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		fn(fields)
+	}
+	if err := s.Err(); err != nil {
+		log.Fatalf("maketables: reading %s: %v", name, err)
+	}
+}
+
+func parseRune(s string) rune {
+	r, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		log.Fatalf("maketables: bad code point %q", s)
+	}
+	return rune(r)
+}
+
+func parseRunes(s string) string {
+	var runes []rune
+	for _, f := range strings.Fields(s) {
+		runes = append(runes, parseRune(f))
+	}
+	return string(runes)
+}
+
+func quoteAll(m map[rune]string) map[rune]string {
+	quoted := map[rune]string{}
+	for r, s := range m {
+		quoted[r] = strconv.QuoteToASCII(s)
+	}
+	return quoted
+}
+
+// writeMap writes out a map variable, four entries to a line in order of rune
+func writeMap(buf *bytes.Buffer, name, typ, doc string, m map[rune]string) {
+	var runes []rune
+	for r := range m {
+		runes = append(runes, r)
+	}
+	slices.Sort(runes)
+	line := "//"
+	for _, word := range strings.Split(name+" "+doc, " ") {
+		if len(line)+1+len(word) > 79 {
+			fmt.Fprintf(buf, "%s\n", line)
+			line = "//"
+		}
+		line += " " + word
+	}
+	fmt.Fprintf(buf, "%s\n", line)
+	fmt.Fprintf(buf, "var %s = map[rune]%s{\n", name, typ)
+	for i, r := range runes {
+		fmt.Fprintf(buf, "0x%04X: %s,", r, m[r])
+		if i%4 == 3 || i == len(runes)-1 {
+			buf.WriteString("\n")
+		} else {
+			buf.WriteString(" ")
+		}
+	}
+	fmt.Fprintf(buf, "}\n\n")
+}
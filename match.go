@@ -0,0 +1,301 @@
+package trie
+
+import (
+	"bytes"
+	"errors"
+	"unicode/utf8"
+)
+
+// ErrBadPattern is returned by Match when the pattern is malformed
+var ErrBadPattern = errors.New("trie: syntax error in pattern")
+
+// automaton is a state machine over runes which can be run down the branches
+// of a trie, see automatonWalk.  S is its state, which must not be modified by
+// step as the same state is stepped once for each child of a node
+type automaton[S any] interface {
+	start() S
+	step(state S, r rune) S
+	// dead reports that the state can never lead to a match
+	dead(state S) bool
+	accepts(state S) bool
+	// acceptsAll reports that anything at all following the state matches
+	acceptsAll(state S) bool
+}
+
+// automatonState is an automaton state plus the bytes of a rune which has only
+// been partly walked so far.  Child keys can begin and end part way through a
+// multi byte rune
+type automatonState[S any] struct {
+	s       S
+	pending [utf8.UTFMax]byte
+	n       int
+}
+
+// automatonWalk runs callback against every key in the trie accepted by a,
+// along with the state a accepted it in.  Each branch of the trie is only
+// followed while a still has some chance of accepting the keys beneath it
+func automatonWalk[V any, S any](root node[V], a automaton[S], callback func([]byte, V, S) bool) {
+	st := automatonState[S]{s: a.start()}
+	if root.isEndpoint() && a.accepts(st.s) && !callback([]byte{}, root.val(), st.s) {
+		return
+	}
+	walkAutomaton(root, a, []byte{}, st, callback)
+}
+
+func walkAutomaton[V any, S any](n node[V], a automaton[S], path []byte, st automatonState[S], callback func([]byte, V, S) bool) bool {
+	for i := 0; i < n.numChildren(); i++ {
+		c := n.child(i)
+		cst, alive := st, true
+		for _, b := range c.edge() {
+			if cst, alive = feedAutomaton(a, cst, b); !alive {
+				break
+			}
+		}
+		if !alive {
+			continue
+		}
+		childPath := append(path[:len(path):len(path)], c.edge()...)
+		if a.acceptsAll(cst.s) {
+			// No need to check anything more, every key down here matches.
+			// iterate reuses one buffer for all the keys it passes, so the
+			// callback gets copies
+			if !c.iterate(childPath, func(k []byte, v V) bool { return callback(bytes.Clone(k), v, cst.s) }) {
+				return false
+			}
+			continue
+		}
+		if c.isEndpoint() {
+			if s := finishAutomaton(a, cst); a.accepts(s) && !callback(childPath, c.val(), s) {
+				return false
+			}
+		}
+		if !walkAutomaton(c, a, childPath, cst, callback) {
+			return false
+		}
+	}
+	return true
+}
+
+// feedAutomaton steps a with b, once b completes a rune
+func feedAutomaton[S any](a automaton[S], st automatonState[S], b byte) (automatonState[S], bool) {
+	st.pending[st.n] = b
+	st.n++
+	for st.n > 0 && utf8.FullRune(st.pending[:st.n]) {
+		r, size := utf8.DecodeRune(st.pending[:st.n])
+		if st.s = a.step(st.s, r); a.dead(st.s) {
+			return st, false
+		}
+		st.n = copy(st.pending[:], st.pending[size:st.n])
+	}
+	return st, true
+}
+
+// finishAutomaton steps a with any bytes left over at the end of a key, which
+// can only be the start of an invalid rune, as utf8.RuneError
+func finishAutomaton[S any](a automaton[S], st automatonState[S]) S {
+	s := st.s
+	for i := 0; i < st.n; i++ {
+		s = a.step(s, utf8.RuneError)
+	}
+	return s
+}
+
+const (
+	globLiteral = iota
+	globAny
+	globStar
+	globClass
+)
+
+type globToken struct {
+	kind    int
+	r       rune
+	negated bool
+	ranges  []rune
+}
+
+func (t globToken) matches(r rune) bool {
+	switch t.kind {
+	case globLiteral:
+		return r == t.r
+	case globAny:
+		return true
+	case globClass:
+		for i := 0; i < len(t.ranges); i += 2 {
+			if t.ranges[i] <= r && r <= t.ranges[i+1] {
+				return !t.negated
+			}
+		}
+		return t.negated
+	}
+	return false
+}
+
+// glob is an automaton for a glob pattern.  Its state is the set of positions
+// in the pattern which the key so far could have reached
+type glob []globToken
+
+func compileGlob(pattern string) (glob, error) {
+	var g glob
+	for i := 0; i < len(pattern); {
+		r, size := utf8.DecodeRuneInString(pattern[i:])
+		i += size
+		switch r {
+		case '*':
+			if len(g) == 0 || g[len(g)-1].kind != globStar {
+				g = append(g, globToken{kind: globStar})
+			}
+		case '?':
+			g = append(g, globToken{kind: globAny})
+		case '\\':
+			if i == len(pattern) {
+				return nil, ErrBadPattern
+			}
+			r, size = utf8.DecodeRuneInString(pattern[i:])
+			i += size
+			g = append(g, globToken{kind: globLiteral, r: r})
+		case '[':
+			tok := globToken{kind: globClass}
+			if i < len(pattern) && (pattern[i] == '!' || pattern[i] == '^') {
+				tok.negated = true
+				i++
+			}
+			closed := false
+			for i < len(pattern) {
+				if pattern[i] == ']' && len(tok.ranges) > 0 {
+					closed = true
+					i++
+					break
+				}
+				lo, n, err := globClassRune(pattern[i:])
+				if err != nil {
+					return nil, err
+				}
+				i += n
+				hi := lo
+				if i+1 < len(pattern) && pattern[i] == '-' && pattern[i+1] != ']' {
+					if hi, n, err = globClassRune(pattern[i+1:]); err != nil {
+						return nil, err
+					}
+					i += 1 + n
+					if hi < lo {
+						return nil, ErrBadPattern
+					}
+				}
+				tok.ranges = append(tok.ranges, lo, hi)
+			}
+			if !closed {
+				return nil, ErrBadPattern
+			}
+			g = append(g, tok)
+		default:
+			g = append(g, globToken{kind: globLiteral, r: r})
+		}
+	}
+	return g, nil
+}
+
+func globClassRune(s string) (rune, int, error) {
+	r, size := utf8.DecodeRuneInString(s)
+	if r != '\\' {
+		return r, size, nil
+	}
+	if size == len(s) {
+		return 0, 0, ErrBadPattern
+	}
+	r, n := utf8.DecodeRuneInString(s[size:])
+	return r, size + n, nil
+}
+
+// closure adds the positions reachable by matching stars with nothing
+func (g glob) closure(s []bool) []bool {
+	for p := 0; p < len(g); p++ {
+		if s[p] && g[p].kind == globStar {
+			s[p+1] = true
+		}
+	}
+	return s
+}
+
+func (g glob) start() []bool {
+	s := make([]bool, len(g)+1)
+	s[0] = true
+	return g.closure(s)
+}
+
+func (g glob) step(state []bool, r rune) []bool {
+	next := make([]bool, len(g)+1)
+	for p, ok := range state[:len(g)] {
+		if !ok {
+			continue
+		}
+		if g[p].kind == globStar {
+			next[p] = true
+		} else if g[p].matches(r) {
+			next[p+1] = true
+		}
+	}
+	return g.closure(next)
+}
+
+func (g glob) dead(state []bool) bool {
+	for _, ok := range state {
+		if ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (g glob) accepts(state []bool) bool {
+	return state[len(g)]
+}
+
+func (g glob) acceptsAll(state []bool) bool {
+	// Reaching a trailing star means anything goes
+	return len(g) > 0 && g[len(g)-1].kind == globStar && state[len(g)-1]
+}
+
+// Match runs callback against every key in the trie which matches the glob
+// pattern, in order.  In the pattern
+//
+//	?      matches any single rune
+//	*      matches any run of runes, including none
+//	[abc]  matches any one of the runes in the brackets
+//	[a-z]  matches any one rune in the range, ranges and runes can be mixed
+//	[!a-z] or [^a-z] matches any one rune not in the brackets
+//	\c     matches c, for when c is one of the above
+//
+// and anything else matches itself.  The whole key must match the pattern.
+// Branches of the trie which can't match the pattern are never visited.  The
+// only error returned is ErrBadPattern
+func (t *Trie) Match(pattern string, callback IterFunc) error {
+	g, err := compileGlob(pattern)
+	if err != nil {
+		return err
+	}
+	automatonWalk[interface{}, []bool](t.root, g, func(k []byte, v interface{}, _ []bool) bool {
+		callback(t.spell(k), v)
+		return true
+	})
+	return nil
+}
+
+// Match runs callback against every key in the trie which matches the glob
+// pattern, in order.  See Trie.Match
+func (t *KVTrie[K, V]) Match(pattern string, callback func(K, V)) error {
+	g, err := compileGlob(pattern)
+	if err != nil {
+		return err
+	}
+	automatonWalk[V, []bool](t.root, g, func(k []byte, v V, _ []bool) bool {
+		callback(K(k), v)
+		return true
+	})
+	return nil
+}
+
+// Match is the concurrency safe version of Trie.Match
+func (t *ConcurrentTrie) Match(pattern string, callback IterFunc) error {
+	return t.load().Match(pattern, callback)
+}
@@ -1,8 +1,417 @@
 package trie
 
+import (
+	"bytes"
+	"math"
+	"slices"
+	"sort"
+	"unicode/utf8"
+)
+
 func longestCommonPrefix(a, b []byte) int {
 	var i = 0
 	for ; i < len(b) && i < len(a) && b[i] == a[i]; i++ {
 	}
 	return i
 }
+
+// boundary says where keys may be split between two nodes when they are added
+// to the trie
+type boundary uint8
+
+const (
+	// byteBoundary allows a split anywhere
+	byteBoundary boundary = iota
+	// runeBoundary only allows splits between UTF-8 encoded runes, so that the
+	// key of every node is valid UTF-8 (when the keys are.)  This means that
+	// siblings can start with the same byte, when they start with different
+	// runes which begin with the same byte.  Siblings must still never have
+	// one key be a prefix of another, or the keys beneath the shorter one
+	// could sort after the longer one, so invalid UTF-8 is split anywhere
+	runeBoundary
+)
+
+// commonPrefix is longestCommonPrefix cut back to the nearest point at which
+// a and b may both be split.  When one of them is a prefix of the other, or
+// they part ways inside a rune which isn't valid UTF-8 in both of them, there
+// is nowhere to cut back to which keeps the trie in order, and the split is
+// made where they part
+func (s boundary) commonPrefix(a, b []byte) int {
+	lcp := longestCommonPrefix(a, b)
+	if s != runeBoundary || lcp == len(a) || lcp == len(b) {
+		return lcp
+	}
+	for i := lcp - 1; i >= 0 && i > lcp-utf8.UTFMax; i-- {
+		if utf8.RuneStart(a[i]) {
+			if runeLen(a[i:]) > lcp-i && runeLen(b[i:]) > lcp-i {
+				return i
+			}
+			break
+		}
+	}
+	return lcp
+}
+
+// runeLen is the length of the valid UTF-8 encoded rune which k begins with,
+// or 0 if it doesn't begin with one
+func runeLen(k []byte) int {
+	r, size := utf8.DecodeRune(k)
+	if r == utf8.RuneError && size < 2 {
+		return 0
+	}
+	return size
+}
+
+// layout is how a trie arranges the children of its nodes.  It is handed down
+// to the node methods which look for a child, or add one
+type layout struct {
+	split    boundary
+	unsorted bool
+	index    ChildIndex
+	// arena, when there is one, is where the keys of new nodes are copied to
+	arena *keyArena
+}
+
+// own copies key into memory which belongs to the trie, so that the caller is
+// free to reuse the slice they added it with
+func (l layout) own(key []byte) []byte {
+	if l.arena != nil {
+		return l.arena.alloc(key)
+	}
+	return bytes.Clone(key)
+}
+
+// keyArena hands out keys from large chunks of memory rather than allocating
+// each one separately, see WithKeyArena.  A chunk is only freed once every key
+// in it has left the trie
+type keyArena struct {
+	chunk []byte
+	size  int
+}
+
+func (a *keyArena) alloc(key []byte) []byte {
+	if len(key) > a.size/4 {
+		// big keys would waste too much of a chunk
+		return bytes.Clone(key)
+	}
+	if len(key) > cap(a.chunk)-len(a.chunk) {
+		a.chunk = make([]byte, 0, a.size)
+	}
+	start := len(a.chunk)
+	a.chunk = append(a.chunk, key...)
+	// the capacity is cut so that appending to the key can never overwrite
+	// the key after it
+	return a.chunk[start:len(a.chunk):len(a.chunk)]
+}
+
+// indexed reports whether nodes should get a childIndex once they have enough
+// children
+func (l layout) indexed() bool {
+	return l.index == AdaptiveChildren && !l.unsorted
+}
+
+// indexedFanOut is how many children a node can have before it gets a
+// childIndex.  Up to there scanning the children is as quick as anything, the
+// same as the Node4 and Node16 of an adaptive radix tree
+const indexedFanOut = 16
+
+// childIndex finds the children of a node by their first byte, the same as
+// the Node48 and Node256 of an adaptive radix tree.  It holds the position of
+// the first child which begins with each byte, plus one so that 0 means there
+// isn't one.  The positions fit in a byte, so the index takes 256 bytes, until
+// the node has more than 255 children.  Only nodes split on rune boundaries,
+// or with all 256 bytes in use, get that many, and they move to wide positions
+// instead.  Nodes copied by PersistentTrie share their index with the
+// original, so the copy is given a new index rather than having the shared one
+// modified.  Nodes thawed for a ConcurrentTrie get a clone of it instead
+type childIndex struct {
+	narrow [256]uint8
+	wide   *[256]int32
+}
+
+func newChildIndex[T any](children []T, edge func(T) []byte) *childIndex {
+	if len(children) <= indexedFanOut {
+		return nil
+	}
+	x := new(childIndex)
+	x.fill(len(children), func(i int) []byte { return edge(children[i]) })
+	return x
+}
+
+// fill sets the index up from scratch for n children, whose edges are given
+// by edge
+func (x *childIndex) fill(n int, edge func(int) []byte) {
+	clear(x.narrow[:])
+	switch {
+	case n <= math.MaxUint8:
+		x.wide = nil
+	case x.wide == nil:
+		x.wide = new([256]int32)
+	default:
+		clear(x.wide[:])
+	}
+	for i := n - 1; i >= 0; i-- {
+		if e := edge(i); len(e) > 0 {
+			x.set(e[0], i+1)
+		}
+	}
+}
+
+// clone returns a copy of the index which can be changed without changing x
+func (x *childIndex) clone() *childIndex {
+	c := *x
+	if x.wide != nil {
+		wide := *x.wide
+		c.wide = &wide
+	}
+	return &c
+}
+
+// get returns the position of the first child which begins with b, plus one
+func (x *childIndex) get(b byte) int {
+	if x.wide != nil {
+		return int(x.wide[b])
+	}
+	return int(x.narrow[b])
+}
+
+func (x *childIndex) set(b byte, p int) {
+	if x.wide != nil {
+		x.wide[b] = int32(p)
+	} else {
+		x.narrow[b] = uint8(p)
+	}
+}
+
+// inserted updates the index for a child beginning with b having been
+// inserted at position i, making n children.  The children are in order, so
+// only the ones which begin with a later byte have moved
+func (x *childIndex) inserted(i, n int, b byte) {
+	if x.wide == nil && n > math.MaxUint8 {
+		x.wide = new([256]int32)
+		for c, p := range x.narrow {
+			x.wide[c] = int32(p)
+		}
+	}
+	if x.wide != nil {
+		shift(x.wide, int(b)+1, true)
+	} else {
+		shift(&x.narrow, int(b)+1, true)
+	}
+	if p := x.get(b); p == 0 || p > i+1 {
+		x.set(b, i+1)
+	}
+}
+
+// removed updates the index for a child beginning with b having been removed
+// from position i.  next says whether the child which has taken its place
+// begins with b as well
+func (x *childIndex) removed(i int, b byte, next bool) {
+	if x.wide != nil {
+		shift(x.wide, int(b)+1, false)
+	} else {
+		shift(&x.narrow, int(b)+1, false)
+	}
+	if x.get(b) == i+1 && !next {
+		x.set(b, 0)
+	}
+}
+
+// shift moves the children which begin with byte from or later one position
+// up, or down
+func shift[P uint8 | int32](positions *[256]P, from int, up bool) {
+	for b := from; b < len(positions); b++ {
+		if positions[b] == 0 {
+			continue
+		}
+		if up {
+			positions[b]++
+		} else {
+			positions[b]--
+		}
+	}
+}
+
+// span narrows children down to the ones which begin with the same byte as
+// key, the only ones which could lead to it, and returns the position of the
+// first of them.  Siblings only share a first byte in tries split on rune
+// boundaries, so there is usually one at most.  Without an index, and unless
+// the layout says to search them, the children are left for the caller to
+// scan
+func span[T any](l layout, x *childIndex, children []T, edge func(T) []byte, key []byte) (int, []T) {
+	if len(key) == 0 {
+		return 0, children
+	}
+	var lo int
+	switch {
+	case x != nil:
+		if lo = x.get(key[0]) - 1; lo < 0 {
+			return len(children), nil
+		}
+	case l.index == SearchChildren && !l.unsorted:
+		lo = sort.Search(len(children), func(i int) bool {
+			e := edge(children[i])
+			return len(e) > 0 && e[0] >= key[0]
+		})
+	default:
+		return 0, children
+	}
+	hi := lo
+	for hi < len(children) {
+		if e := edge(children[hi]); len(e) == 0 || e[0] != key[0] {
+			break
+		}
+		hi++
+	}
+	return lo, children[lo:hi]
+}
+
+// inOrder returns a function which gets the children of n in key order.  The
+// children are already in order unless the trie was made with unsorted
+// children, in which case they are sorted on the side
+func inOrder[V any](n node[V]) func(int) node[V] {
+	var order []int
+	for i := 1; i < n.numChildren(); i++ {
+		if bytes.Compare(n.child(i-1).edge(), n.child(i).edge()) > 0 {
+			order = make([]int, n.numChildren())
+			for j := range order {
+				order[j] = j
+			}
+			sort.Slice(order, func(a, b int) bool {
+				return bytes.Compare(n.child(order[a]).edge(), n.child(order[b]).edge()) < 0
+			})
+			break
+		}
+	}
+	if order == nil {
+		return n.child
+	}
+	return func(i int) node[V] {
+		return n.child(order[i])
+	}
+}
+
+// iterateInOrder is node.iterate for when the keys must come out in order even
+// if the children are unsorted
+func iterateInOrder[V any](n node[V], path []byte, callback func([]byte, V) bool) bool {
+	if n.isEndpoint() && !callback(path, n.val()) {
+		return false
+	}
+	child := inOrder(n)
+	for i := 0; i < n.numChildren(); i++ {
+		c := child(i)
+		if !iterateInOrder(c, append(path[:len(path):len(path)], c.edge()...), callback) {
+			return false
+		}
+	}
+	return true
+}
+
+// extend appends edge to path for iterating beneath a child.  The siblings
+// and children of the child reuse the same buffer, so when it has to grow it
+// is given room for the keys beneath the child as well
+func extend(path, edge []byte) []byte {
+	if len(path)+len(edge) > cap(path) {
+		path = slices.Grow(path, len(edge)+64)
+	}
+	return append(path, edge...)
+}
+
+// first returns the first of vals, the value passed to a variadic set or add,
+// or the zero value if there isn't one
+func first[V any](vals []V) V {
+	var v V
+	if len(vals) > 0 {
+		v = vals[0]
+	}
+	return v
+}
+
+func insertChild[T any](children []T, i int, child T) []T {
+	children = append(children, child)
+	copy(children[i+1:], children[i:])
+	children[i] = child
+	return children
+}
+
+// orig is the key argument as it was given, before any normalization, for
+// remembering its spelling
+func orig(key interface{}) []byte {
+	k, _ := keyBytes(key)
+	return k
+}
+
+// keyRange describes the bounds of a range scan.  An empty start or end means
+// that side of the range is unbounded
+type keyRange struct {
+	start        []byte
+	end          []byte
+	excludeStart bool
+	includeEnd   bool
+}
+
+func newKeyRange(start, end []byte, flags RangeFlag) keyRange {
+	return keyRange{
+		start:        start,
+		end:          end,
+		excludeStart: flags&ExcludeStart != 0,
+		includeEnd:   flags&IncludeEnd != 0,
+	}
+}
+
+// contains reports whether key falls within the range
+func (r keyRange) contains(key []byte) bool {
+	if len(r.start) > 0 {
+		if c := bytes.Compare(key, r.start); c < 0 || (c == 0 && r.excludeStart) {
+			return false
+		}
+	}
+	if len(r.end) > 0 {
+		if c := bytes.Compare(key, r.end); c > 0 || (c == 0 && !r.includeEnd) {
+			return false
+		}
+	}
+	return true
+}
+
+// below reports whether every key which has path as a prefix sorts before the
+// start of the range
+func (r keyRange) below(path []byte) bool {
+	return len(r.start) > 0 && bytes.Compare(path, r.start) < 0 && !bytes.HasPrefix(r.start, path)
+}
+
+// above reports whether every key which has path as a prefix sorts after the
+// end of the range
+func (r keyRange) above(path []byte) bool {
+	if len(r.end) == 0 {
+		return false
+	}
+	c := bytes.Compare(path, r.end)
+	return c > 0 || (c == 0 && !r.includeEnd)
+}
+
+// keepGoing adapts a callback which has no say in when iteration stops into one
+// which never stops it
+func keepGoing[V any](callback func([]byte, V)) func([]byte, V) bool {
+	return func(key []byte, value V) bool {
+		callback(key, value)
+		return true
+	}
+}
+
+// emptyLike returns a new, empty root of the same kind as n
+func emptyLike(n node[interface{}]) node[interface{}] {
+	if _, bw := n.(*bwTrie); bw {
+		return &bwTrie{children: []*bwTrie{}}
+	}
+	return &kvTrie[interface{}]{children: []*kvTrie[interface{}]{}}
+}
+
+// addAll adds every key beneath from to the root to, splitting them as l
+// says.  Weights are left behind
+func addAll[V any](from, to node[V], l layout) {
+	from.iterate([]byte{}, func(k []byte, v V) bool {
+		to.add(k, l, v)
+		return true
+	})
+}
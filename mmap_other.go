@@ -0,0 +1,18 @@
+//go:build !unix
+
+package trie
+
+import (
+	"io"
+	"os"
+)
+
+// mmapFile reads the whole of f into memory, for platforms where it cannot be
+// memory mapped
+func mmapFile(f *os.File) ([]byte, func() error, error) {
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return nil }, nil
+}
@@ -0,0 +1,26 @@
+//go:build unix
+
+package trie
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the whole of f into memory, read only.  The returned function
+// unmaps it again
+func mmapFile(f *os.File) ([]byte, func() error, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.Size() == 0 {
+		// Empty files cannot be mapped, and are not static tries anyway
+		return nil, nil, ErrInvalidEncoding
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
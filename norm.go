@@ -0,0 +1,163 @@
+package trie
+
+import (
+	"sync"
+	"unicode/utf8"
+)
+
+//go:generate go run maketables.go -ucd ucd -version 14.0.0
+
+// NFC puts k into Unicode Normalization Form C, where every rune is
+// decomposed and then composed again into its precomposed form wherever there
+// is one.  It is the usual choice for Unicode.Normalize, so that a
+// precomposed "é" and an "e" followed by a combining acute accent are the same
+// key.  Invalid UTF-8 is copied over untouched.  The tables come from Unicode
+// 14.0.0, runes added since then are left as they are
+func NFC(k []byte) []byte {
+	return normalize(k, false)
+}
+
+// NFKC puts k into Unicode Normalization Form KC, which is NFC after also
+// replacing compatibility characters with what they are equivalent to, so
+// that "ﬁ" becomes "fi" and "①" becomes "1"
+func NFKC(k []byte) []byte {
+	return normalize(k, true)
+}
+
+// normalize is NFC, or NFKC with compat set.  Bytes of invalid UTF-8 are
+// carried through as negative runes, which never decompose or compose
+func normalize(k []byte, compat bool) []byte {
+	ascii := true
+	for _, b := range k {
+		if b >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		// ASCII is already in every normalization form
+		return k
+	}
+	runes := make([]rune, 0, len(k))
+	for len(k) > 0 {
+		r, size := utf8.DecodeRune(k)
+		if r == utf8.RuneError && size == 1 {
+			runes = append(runes, -1-rune(k[0]))
+		} else {
+			runes = decompose(runes, r, compat)
+		}
+		k = k[size:]
+	}
+	reorder(runes)
+	runes = compose(runes)
+	normalized := make([]byte, 0, len(runes)*2)
+	for _, r := range runes {
+		if r < 0 {
+			normalized = append(normalized, byte(-1-r))
+		} else {
+			normalized = utf8.AppendRune(normalized, r)
+		}
+	}
+	return normalized
+}
+
+// Hangul syllables are composed and decomposed by arithmetic, from a leading
+// consonant, a vowel and an optional trailing consonant
+const (
+	hangulBase  = 0xac00
+	hangulL     = 0x1100
+	hangulV     = 0x1161
+	hangulT     = 0x11a7
+	hangulLs    = 19
+	hangulVs    = 21
+	hangulTs    = 28
+	hangulCount = hangulLs * hangulVs * hangulTs
+)
+
+// decompose appends the full decomposition of r to runes
+func decompose(runes []rune, r rune, compat bool) []rune {
+	if s := r - hangulBase; s >= 0 && s < hangulCount {
+		runes = append(runes, hangulL+s/(hangulVs*hangulTs), hangulV+s%(hangulVs*hangulTs)/hangulTs)
+		if t := s % hangulTs; t != 0 {
+			runes = append(runes, hangulT+t)
+		}
+		return runes
+	}
+	d, ok := canonicalDecompositions[r]
+	if !ok && compat {
+		d, ok = compatibilityDecompositions[r]
+	}
+	if !ok {
+		return append(runes, r)
+	}
+	for _, c := range d {
+		runes = decompose(runes, c, compat)
+	}
+	return runes
+}
+
+// reorder puts every run of combining marks into the canonical order, which
+// is a stable sort by combining class
+func reorder(runes []rune) {
+	for i := 1; i < len(runes); i++ {
+		c := combiningClasses[runes[i]]
+		if c == 0 {
+			continue
+		}
+		for j := i; j > 0 && combiningClasses[runes[j-1]] > c; j-- {
+			runes[j], runes[j-1] = runes[j-1], runes[j]
+		}
+	}
+}
+
+// compose is the canonical composition algorithm.  Each rune is combined with
+// the last starter, the last rune with a combining class of 0, if they have a
+// primary composite and no rune between them blocks it.  runes is reused for
+// the result
+func compose(runes []rune) []rune {
+	composed := runes[:0]
+	starter, last := -1, 0
+	for _, r := range runes {
+		class := int(combiningClasses[r])
+		blocked := len(composed)-1 > starter && (last == 0 || last >= class)
+		if starter >= 0 && !blocked {
+			if c, ok := composite(composed[starter], r); ok {
+				composed[starter] = c
+				continue
+			}
+		}
+		if class == 0 {
+			starter = len(composed)
+		}
+		last = class
+		composed = append(composed, r)
+	}
+	return composed
+}
+
+// composite returns the primary composite of a and b, if there is one
+func composite(a, b rune) (rune, bool) {
+	if l, v := a-hangulL, b-hangulV; l >= 0 && l < hangulLs && v >= 0 && v < hangulVs {
+		return hangulBase + (l*hangulVs+v)*hangulTs, true
+	}
+	if s, t := a-hangulBase, b-hangulT; s >= 0 && s < hangulCount && s%hangulTs == 0 && t > 0 && t < hangulTs {
+		return a + t, true
+	}
+	c, ok := composites()[[2]rune{a, b}]
+	return c, ok
+}
+
+// composites maps pairs of runes to their primary composites.  Those are the
+// canonical decompositions into two runes, leaving out the exclusions and
+// anything which starts with, or is, a combining mark
+var composites = sync.OnceValue(func() map[[2]rune]rune {
+	m := map[[2]rune]rune{}
+	for c, d := range canonicalDecompositions {
+		pair := []rune(d)
+		if len(pair) != 2 || compositionExclusions[c] || combiningClasses[c] != 0 || combiningClasses[pair[0]] != 0 {
+			continue
+		}
+		m[[2]rune{pair[0], pair[1]}] = c
+	}
+	return m
+})
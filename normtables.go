@@ -0,0 +1,1753 @@
+// Code generated by maketables.go from the Unicode Character Database version 14.0.0. DO NOT EDIT.
+
+package trie
+
+// combiningClasses are the canonical combining classes of the runes which have
+// one other than 0
+var combiningClasses = map[rune]uint8{
+	0x0300: 230, 0x0301: 230, 0x0302: 230, 0x0303: 230,
+	0x0304: 230, 0x0305: 230, 0x0306: 230, 0x0307: 230,
+	0x0308: 230, 0x0309: 230, 0x030A: 230, 0x030B: 230,
+	0x030C: 230, 0x030D: 230, 0x030E: 230, 0x030F: 230,
+	0x0310: 230, 0x0311: 230, 0x0312: 230, 0x0313: 230,
+	0x0314: 230, 0x0315: 232, 0x0316: 220, 0x0317: 220,
+	0x0318: 220, 0x0319: 220, 0x031A: 232, 0x031B: 216,
+	0x031C: 220, 0x031D: 220, 0x031E: 220, 0x031F: 220,
+	0x0320: 220, 0x0321: 202, 0x0322: 202, 0x0323: 220,
+	0x0324: 220, 0x0325: 220, 0x0326: 220, 0x0327: 202,
+	0x0328: 202, 0x0329: 220, 0x032A: 220, 0x032B: 220,
+	0x032C: 220, 0x032D: 220, 0x032E: 220, 0x032F: 220,
+	0x0330: 220, 0x0331: 220, 0x0332: 220, 0x0333: 220,
+	0x0334: 1, 0x0335: 1, 0x0336: 1, 0x0337: 1,
+	0x0338: 1, 0x0339: 220, 0x033A: 220, 0x033B: 220,
+	0x033C: 220, 0x033D: 230, 0x033E: 230, 0x033F: 230,
+	0x0340: 230, 0x0341: 230, 0x0342: 230, 0x0343: 230,
+	0x0344: 230, 0x0345: 240, 0x0346: 230, 0x0347: 220,
+	0x0348: 220, 0x0349: 220, 0x034A: 230, 0x034B: 230,
+	0x034C: 230, 0x034D: 220, 0x034E: 220, 0x0350: 230,
+	0x0351: 230, 0x0352: 230, 0x0353: 220, 0x0354: 220,
+	0x0355: 220, 0x0356: 220, 0x0357: 230, 0x0358: 232,
+	0x0359: 220, 0x035A: 220, 0x035B: 230, 0x035C: 233,
+	0x035D: 234, 0x035E: 234, 0x035F: 233, 0x0360: 234,
+	0x0361: 234, 0x0362: 233, 0x0363: 230, 0x0364: 230,
+	0x0365: 230, 0x0366: 230, 0x0367: 230, 0x0368: 230,
+	0x0369: 230, 0x036A: 230, 0x036B: 230, 0x036C: 230,
+	0x036D: 230, 0x036E: 230, 0x036F: 230, 0x0483: 230,
+	0x0484: 230, 0x0485: 230, 0x0486: 230, 0x0487: 230,
+	0x0591: 220, 0x0592: 230, 0x0593: 230, 0x0594: 230,
+	0x0595: 230, 0x0596: 220, 0x0597: 230, 0x0598: 230,
+	0x0599: 230, 0x059A: 222, 0x059B: 220, 0x059C: 230,
+	0x059D: 230, 0x059E: 230, 0x059F: 230, 0x05A0: 230,
+	0x05A1: 230, 0x05A2: 220, 0x05A3: 220, 0x05A4: 220,
+	0x05A5: 220, 0x05A6: 220, 0x05A7: 220, 0x05A8: 230,
+	0x05A9: 230, 0x05AA: 220, 0x05AB: 230, 0x05AC: 230,
+	0x05AD: 222, 0x05AE: 228, 0x05AF: 230, 0x05B0: 10,
+	0x05B1: 11, 0x05B2: 12, 0x05B3: 13, 0x05B4: 14,
+	0x05B5: 15, 0x05B6: 16, 0x05B7: 17, 0x05B8: 18,
+	0x05B9: 19, 0x05BA: 19, 0x05BB: 20, 0x05BC: 21,
+	0x05BD: 22, 0x05BF: 23, 0x05C1: 24, 0x05C2: 25,
+	0x05C4: 230, 0x05C5: 220, 0x05C7: 18, 0x0610: 230,
+	0x0611: 230, 0x0612: 230, 0x0613: 230, 0x0614: 230,
+	0x0615: 230, 0x0616: 230, 0x0617: 230, 0x0618: 30,
+	0x0619: 31, 0x061A: 32, 0x064B: 27, 0x064C: 28,
+	0x064D: 29, 0x064E: 30, 0x064F: 31, 0x0650: 32,
+	0x0651: 33, 0x0652: 34, 0x0653: 230, 0x0654: 230,
+	0x0655: 220, 0x0656: 220, 0x0657: 230, 0x0658: 230,
+	0x0659: 230, 0x065A: 230, 0x065B: 230, 0x065C: 220,
+	0x065D: 230, 0x065E: 230, 0x065F: 220, 0x0670: 35,
+	0x06D6: 230, 0x06D7: 230, 0x06D8: 230, 0x06D9: 230,
+	0x06DA: 230, 0x06DB: 230, 0x06DC: 230, 0x06DF: 230,
+	0x06E0: 230, 0x06E1: 230, 0x06E2: 230, 0x06E3: 220,
+	0x06E4: 230, 0x06E7: 230, 0x06E8: 230, 0x06EA: 220,
+	0x06EB: 230, 0x06EC: 230, 0x06ED: 220, 0x0711: 36,
+	0x0730: 230, 0x0731: 220, 0x0732: 230, 0x0733: 230,
+	0x0734: 220, 0x0735: 230, 0x0736: 230, 0x0737: 220,
+	0x0738: 220, 0x0739: 220, 0x073A: 230, 0x073B: 220,
+	0x073C: 220, 0x073D: 230, 0x073E: 220, 0x073F: 230,
+	0x0740: 230, 0x0741: 230, 0x0742: 220, 0x0743: 230,
+	0x0744: 220, 0x0745: 230, 0x0746: 220, 0x0747: 230,
+	0x0748: 220, 0x0749: 230, 0x074A: 230, 0x07EB: 230,
+	0x07EC: 230, 0x07ED: 230, 0x07EE: 230, 0x07EF: 230,
+	0x07F0: 230, 0x07F1: 230, 0x07F2: 220, 0x07F3: 230,
+	0x07FD: 220, 0x0816: 230, 0x0817: 230, 0x0818: 230,
+	0x0819: 230, 0x081B: 230, 0x081C: 230, 0x081D: 230,
+	0x081E: 230, 0x081F: 230, 0x0820: 230, 0x0821: 230,
+	0x0822: 230, 0x0823: 230, 0x0825: 230, 0x0826: 230,
+	0x0827: 230, 0x0829: 230, 0x082A: 230, 0x082B: 230,
+	0x082C: 230, 0x082D: 230, 0x0859: 220, 0x085A: 220,
+	0x085B: 220, 0x0898: 230, 0x0899: 220, 0x089A: 220,
+	0x089B: 220, 0x089C: 230, 0x089D: 230, 0x089E: 230,
+	0x089F: 230, 0x08CA: 230, 0x08CB: 230, 0x08CC: 230,
+	0x08CD: 230, 0x08CE: 230, 0x08CF: 220, 0x08D0: 220,
+	0x08D1: 220, 0x08D2: 220, 0x08D3: 220, 0x08D4: 230,
+	0x08D5: 230, 0x08D6: 230, 0x08D7: 230, 0x08D8: 230,
+	0x08D9: 230, 0x08DA: 230, 0x08DB: 230, 0x08DC: 230,
+	0x08DD: 230, 0x08DE: 230, 0x08DF: 230, 0x08E0: 230,
+	0x08E1: 230, 0x08E3: 220, 0x08E4: 230, 0x08E5: 230,
+	0x08E6: 220, 0x08E7: 230, 0x08E8: 230, 0x08E9: 220,
+	0x08EA: 230, 0x08EB: 230, 0x08EC: 230, 0x08ED: 220,
+	0x08EE: 220, 0x08EF: 220, 0x08F0: 27, 0x08F1: 28,
+	0x08F2: 29, 0x08F3: 230, 0x08F4: 230, 0x08F5: 230,
+	0x08F6: 220, 0x08F7: 230, 0x08F8: 230, 0x08F9: 220,
+	0x08FA: 220, 0x08FB: 230, 0x08FC: 230, 0x08FD: 230,
+	0x08FE: 230, 0x08FF: 230, 0x093C: 7, 0x094D: 9,
+	0x0951: 230, 0x0952: 220, 0x0953: 230, 0x0954: 230,
+	0x09BC: 7, 0x09CD: 9, 0x09FE: 230, 0x0A3C: 7,
+	0x0A4D: 9, 0x0ABC: 7, 0x0ACD: 9, 0x0B3C: 7,
+	0x0B4D: 9, 0x0BCD: 9, 0x0C3C: 7, 0x0C4D: 9,
+	0x0C55: 84, 0x0C56: 91, 0x0CBC: 7, 0x0CCD: 9,
+	0x0D3B: 9, 0x0D3C: 9, 0x0D4D: 9, 0x0DCA: 9,
+	0x0E38: 103, 0x0E39: 103, 0x0E3A: 9, 0x0E48: 107,
+	0x0E49: 107, 0x0E4A: 107, 0x0E4B: 107, 0x0EB8: 118,
+	0x0EB9: 118, 0x0EBA: 9, 0x0EC8: 122, 0x0EC9: 122,
+	0x0ECA: 122, 0x0ECB: 122, 0x0F18: 220, 0x0F19: 220,
+	0x0F35: 220, 0x0F37: 220, 0x0F39: 216, 0x0F71: 129,
+	0x0F72: 130, 0x0F74: 132, 0x0F7A: 130, 0x0F7B: 130,
+	0x0F7C: 130, 0x0F7D: 130, 0x0F80: 130, 0x0F82: 230,
+	0x0F83: 230, 0x0F84: 9, 0x0F86: 230, 0x0F87: 230,
+	0x0FC6: 220, 0x1037: 7, 0x1039: 9, 0x103A: 9,
+	0x108D: 220, 0x135D: 230, 0x135E: 230, 0x135F: 230,
+	0x1714: 9, 0x1715: 9, 0x1734: 9, 0x17D2: 9,
+	0x17DD: 230, 0x18A9: 228, 0x1939: 222, 0x193A: 230,
+	0x193B: 220, 0x1A17: 230, 0x1A18: 220, 0x1A60: 9,
+	0x1A75: 230, 0x1A76: 230, 0x1A77: 230, 0x1A78: 230,
+	0x1A79: 230, 0x1A7A: 230, 0x1A7B: 230, 0x1A7C: 230,
+	0x1A7F: 220, 0x1AB0: 230, 0x1AB1: 230, 0x1AB2: 230,
+	0x1AB3: 230, 0x1AB4: 230, 0x1AB5: 220, 0x1AB6: 220,
+	0x1AB7: 220, 0x1AB8: 220, 0x1AB9: 220, 0x1ABA: 220,
+	0x1ABB: 230, 0x1ABC: 230, 0x1ABD: 220, 0x1ABF: 220,
+	0x1AC0: 220, 0x1AC1: 230, 0x1AC2: 230, 0x1AC3: 220,
+	0x1AC4: 220, 0x1AC5: 230, 0x1AC6: 230, 0x1AC7: 230,
+	0x1AC8: 230, 0x1AC9: 230, 0x1ACA: 220, 0x1ACB: 230,
+	0x1ACC: 230, 0x1ACD: 230, 0x1ACE: 230, 0x1B34: 7,
+	0x1B44: 9, 0x1B6B: 230, 0x1B6C: 220, 0x1B6D: 230,
+	0x1B6E: 230, 0x1B6F: 230, 0x1B70: 230, 0x1B71: 230,
+	0x1B72: 230, 0x1B73: 230, 0x1BAA: 9, 0x1BAB: 9,
+	0x1BE6: 7, 0x1BF2: 9, 0x1BF3: 9, 0x1C37: 7,
+	0x1CD0: 230, 0x1CD1: 230, 0x1CD2: 230, 0x1CD4: 1,
+	0x1CD5: 220, 0x1CD6: 220, 0x1CD7: 220, 0x1CD8: 220,
+	0x1CD9: 220, 0x1CDA: 230, 0x1CDB: 230, 0x1CDC: 220,
+	0x1CDD: 220, 0x1CDE: 220, 0x1CDF: 220, 0x1CE0: 230,
+	0x1CE2: 1, 0x1CE3: 1, 0x1CE4: 1, 0x1CE5: 1,
+	0x1CE6: 1, 0x1CE7: 1, 0x1CE8: 1, 0x1CED: 220,
+	0x1CF4: 230, 0x1CF8: 230, 0x1CF9: 230, 0x1DC0: 230,
+	0x1DC1: 230, 0x1DC2: 220, 0x1DC3: 230, 0x1DC4: 230,
+	0x1DC5: 230, 0x1DC6: 230, 0x1DC7: 230, 0x1DC8: 230,
+	0x1DC9: 230, 0x1DCA: 220, 0x1DCB: 230, 0x1DCC: 230,
+	0x1DCD: 234, 0x1DCE: 214, 0x1DCF: 220, 0x1DD0: 202,
+	0x1DD1: 230, 0x1DD2: 230, 0x1DD3: 230, 0x1DD4: 230,
+	0x1DD5: 230, 0x1DD6: 230, 0x1DD7: 230, 0x1DD8: 230,
+	0x1DD9: 230, 0x1DDA: 230, 0x1DDB: 230, 0x1DDC: 230,
+	0x1DDD: 230, 0x1DDE: 230, 0x1DDF: 230, 0x1DE0: 230,
+	0x1DE1: 230, 0x1DE2: 230, 0x1DE3: 230, 0x1DE4: 230,
+	0x1DE5: 230, 0x1DE6: 230, 0x1DE7: 230, 0x1DE8: 230,
+	0x1DE9: 230, 0x1DEA: 230, 0x1DEB: 230, 0x1DEC: 230,
+	0x1DED: 230, 0x1DEE: 230, 0x1DEF: 230, 0x1DF0: 230,
+	0x1DF1: 230, 0x1DF2: 230, 0x1DF3: 230, 0x1DF4: 230,
+	0x1DF5: 230, 0x1DF6: 232, 0x1DF7: 228, 0x1DF8: 228,
+	0x1DF9: 220, 0x1DFA: 218, 0x1DFB: 230, 0x1DFC: 233,
+	0x1DFD: 220, 0x1DFE: 230, 0x1DFF: 220, 0x20D0: 230,
+	0x20D1: 230, 0x20D2: 1, 0x20D3: 1, 0x20D4: 230,
+	0x20D5: 230, 0x20D6: 230, 0x20D7: 230, 0x20D8: 1,
+	0x20D9: 1, 0x20DA: 1, 0x20DB: 230, 0x20DC: 230,
+	0x20E1: 230, 0x20E5: 1, 0x20E6: 1, 0x20E7: 230,
+	0x20E8: 220, 0x20E9: 230, 0x20EA: 1, 0x20EB: 1,
+	0x20EC: 220, 0x20ED: 220, 0x20EE: 220, 0x20EF: 220,
+	0x20F0: 230, 0x2CEF: 230, 0x2CF0: 230, 0x2CF1: 230,
+	0x2D7F: 9, 0x2DE0: 230, 0x2DE1: 230, 0x2DE2: 230,
+	0x2DE3: 230, 0x2DE4: 230, 0x2DE5: 230, 0x2DE6: 230,
+	0x2DE7: 230, 0x2DE8: 230, 0x2DE9: 230, 0x2DEA: 230,
+	0x2DEB: 230, 0x2DEC: 230, 0x2DED: 230, 0x2DEE: 230,
+	0x2DEF: 230, 0x2DF0: 230, 0x2DF1: 230, 0x2DF2: 230,
+	0x2DF3: 230, 0x2DF4: 230, 0x2DF5: 230, 0x2DF6: 230,
+	0x2DF7: 230, 0x2DF8: 230, 0x2DF9: 230, 0x2DFA: 230,
+	0x2DFB: 230, 0x2DFC: 230, 0x2DFD: 230, 0x2DFE: 230,
+	0x2DFF: 230, 0x302A: 218, 0x302B: 228, 0x302C: 232,
+	0x302D: 222, 0x302E: 224, 0x302F: 224, 0x3099: 8,
+	0x309A: 8, 0xA66F: 230, 0xA674: 230, 0xA675: 230,
+	0xA676: 230, 0xA677: 230, 0xA678: 230, 0xA679: 230,
+	0xA67A: 230, 0xA67B: 230, 0xA67C: 230, 0xA67D: 230,
+	0xA69E: 230, 0xA69F: 230, 0xA6F0: 230, 0xA6F1: 230,
+	0xA806: 9, 0xA82C: 9, 0xA8C4: 9, 0xA8E0: 230,
+	0xA8E1: 230, 0xA8E2: 230, 0xA8E3: 230, 0xA8E4: 230,
+	0xA8E5: 230, 0xA8E6: 230, 0xA8E7: 230, 0xA8E8: 230,
+	0xA8E9: 230, 0xA8EA: 230, 0xA8EB: 230, 0xA8EC: 230,
+	0xA8ED: 230, 0xA8EE: 230, 0xA8EF: 230, 0xA8F0: 230,
+	0xA8F1: 230, 0xA92B: 220, 0xA92C: 220, 0xA92D: 220,
+	0xA953: 9, 0xA9B3: 7, 0xA9C0: 9, 0xAAB0: 230,
+	0xAAB2: 230, 0xAAB3: 230, 0xAAB4: 220, 0xAAB7: 230,
+	0xAAB8: 230, 0xAABE: 230, 0xAABF: 230, 0xAAC1: 230,
+	0xAAF6: 9, 0xABED: 9, 0xFB1E: 26, 0xFE20: 230,
+	0xFE21: 230, 0xFE22: 230, 0xFE23: 230, 0xFE24: 230,
+	0xFE25: 230, 0xFE26: 230, 0xFE27: 220, 0xFE28: 220,
+	0xFE29: 220, 0xFE2A: 220, 0xFE2B: 220, 0xFE2C: 220,
+	0xFE2D: 220, 0xFE2E: 230, 0xFE2F: 230, 0x101FD: 220,
+	0x102E0: 220, 0x10376: 230, 0x10377: 230, 0x10378: 230,
+	0x10379: 230, 0x1037A: 230, 0x10A0D: 220, 0x10A0F: 230,
+	0x10A38: 230, 0x10A39: 1, 0x10A3A: 220, 0x10A3F: 9,
+	0x10AE5: 230, 0x10AE6: 220, 0x10D24: 230, 0x10D25: 230,
+	0x10D26: 230, 0x10D27: 230, 0x10EAB: 230, 0x10EAC: 230,
+	0x10F46: 220, 0x10F47: 220, 0x10F48: 230, 0x10F49: 230,
+	0x10F4A: 230, 0x10F4B: 220, 0x10F4C: 230, 0x10F4D: 220,
+	0x10F4E: 220, 0x10F4F: 220, 0x10F50: 220, 0x10F82: 230,
+	0x10F83: 220, 0x10F84: 230, 0x10F85: 220, 0x11046: 9,
+	0x11070: 9, 0x1107F: 9, 0x110B9: 9, 0x110BA: 7,
+	0x11100: 230, 0x11101: 230, 0x11102: 230, 0x11133: 9,
+	0x11134: 9, 0x11173: 7, 0x111C0: 9, 0x111CA: 7,
+	0x11235: 9, 0x11236: 7, 0x112E9: 7, 0x112EA: 9,
+	0x1133B: 7, 0x1133C: 7, 0x1134D: 9, 0x11366: 230,
+	0x11367: 230, 0x11368: 230, 0x11369: 230, 0x1136A: 230,
+	0x1136B: 230, 0x1136C: 230, 0x11370: 230, 0x11371: 230,
+	0x11372: 230, 0x11373: 230, 0x11374: 230, 0x11442: 9,
+	0x11446: 7, 0x1145E: 230, 0x114C2: 9, 0x114C3: 7,
+	0x115BF: 9, 0x115C0: 7, 0x1163F: 9, 0x116B6: 9,
+	0x116B7: 7, 0x1172B: 9, 0x11839: 9, 0x1183A: 7,
+	0x1193D: 9, 0x1193E: 9, 0x11943: 7, 0x119E0: 9,
+	0x11A34: 9, 0x11A47: 9, 0x11A99: 9, 0x11C3F: 9,
+	0x11D42: 7, 0x11D44: 9, 0x11D45: 9, 0x11D97: 9,
+	0x16AF0: 1, 0x16AF1: 1, 0x16AF2: 1, 0x16AF3: 1,
+	0x16AF4: 1, 0x16B30: 230, 0x16B31: 230, 0x16B32: 230,
+	0x16B33: 230, 0x16B34: 230, 0x16B35: 230, 0x16B36: 230,
+	0x16FF0: 6, 0x16FF1: 6, 0x1BC9E: 1, 0x1D165: 216,
+	0x1D166: 216, 0x1D167: 1, 0x1D168: 1, 0x1D169: 1,
+	0x1D16D: 226, 0x1D16E: 216, 0x1D16F: 216, 0x1D170: 216,
+	0x1D171: 216, 0x1D172: 216, 0x1D17B: 220, 0x1D17C: 220,
+	0x1D17D: 220, 0x1D17E: 220, 0x1D17F: 220, 0x1D180: 220,
+	0x1D181: 220, 0x1D182: 220, 0x1D185: 230, 0x1D186: 230,
+	0x1D187: 230, 0x1D188: 230, 0x1D189: 230, 0x1D18A: 220,
+	0x1D18B: 220, 0x1D1AA: 230, 0x1D1AB: 230, 0x1D1AC: 230,
+	0x1D1AD: 230, 0x1D242: 230, 0x1D243: 230, 0x1D244: 230,
+	0x1E000: 230, 0x1E001: 230, 0x1E002: 230, 0x1E003: 230,
+	0x1E004: 230, 0x1E005: 230, 0x1E006: 230, 0x1E008: 230,
+	0x1E009: 230, 0x1E00A: 230, 0x1E00B: 230, 0x1E00C: 230,
+	0x1E00D: 230, 0x1E00E: 230, 0x1E00F: 230, 0x1E010: 230,
+	0x1E011: 230, 0x1E012: 230, 0x1E013: 230, 0x1E014: 230,
+	0x1E015: 230, 0x1E016: 230, 0x1E017: 230, 0x1E018: 230,
+	0x1E01B: 230, 0x1E01C: 230, 0x1E01D: 230, 0x1E01E: 230,
+	0x1E01F: 230, 0x1E020: 230, 0x1E021: 230, 0x1E023: 230,
+	0x1E024: 230, 0x1E026: 230, 0x1E027: 230, 0x1E028: 230,
+	0x1E029: 230, 0x1E02A: 230, 0x1E130: 230, 0x1E131: 230,
+	0x1E132: 230, 0x1E133: 230, 0x1E134: 230, 0x1E135: 230,
+	0x1E136: 230, 0x1E2AE: 230, 0x1E2EC: 230, 0x1E2ED: 230,
+	0x1E2EE: 230, 0x1E2EF: 230, 0x1E8D0: 220, 0x1E8D1: 220,
+	0x1E8D2: 220, 0x1E8D3: 220, 0x1E8D4: 220, 0x1E8D5: 220,
+	0x1E8D6: 220, 0x1E944: 230, 0x1E945: 230, 0x1E946: 230,
+	0x1E947: 230, 0x1E948: 230, 0x1E949: 230, 0x1E94A: 7,
+}
+
+// canonicalDecompositions map runes to their canonical decompositions, which
+// may decompose further in turn.  Hangul syllables are decomposed by
+// arithmetic instead
+var canonicalDecompositions = map[rune]string{
+	0x00C0: "A\u0300", 0x00C1: "A\u0301", 0x00C2: "A\u0302", 0x00C3: "A\u0303",
+	0x00C4: "A\u0308", 0x00C5: "A\u030a", 0x00C7: "C\u0327", 0x00C8: "E\u0300",
+	0x00C9: "E\u0301", 0x00CA: "E\u0302", 0x00CB: "E\u0308", 0x00CC: "I\u0300",
+	0x00CD: "I\u0301", 0x00CE: "I\u0302", 0x00CF: "I\u0308", 0x00D1: "N\u0303",
+	0x00D2: "O\u0300", 0x00D3: "O\u0301", 0x00D4: "O\u0302", 0x00D5: "O\u0303",
+	0x00D6: "O\u0308", 0x00D9: "U\u0300", 0x00DA: "U\u0301", 0x00DB: "U\u0302",
+	0x00DC: "U\u0308", 0x00DD: "Y\u0301", 0x00E0: "a\u0300", 0x00E1: "a\u0301",
+	0x00E2: "a\u0302", 0x00E3: "a\u0303", 0x00E4: "a\u0308", 0x00E5: "a\u030a",
+	0x00E7: "c\u0327", 0x00E8: "e\u0300", 0x00E9: "e\u0301", 0x00EA: "e\u0302",
+	0x00EB: "e\u0308", 0x00EC: "i\u0300", 0x00ED: "i\u0301", 0x00EE: "i\u0302",
+	0x00EF: "i\u0308", 0x00F1: "n\u0303", 0x00F2: "o\u0300", 0x00F3: "o\u0301",
+	0x00F4: "o\u0302", 0x00F5: "o\u0303", 0x00F6: "o\u0308", 0x00F9: "u\u0300",
+	0x00FA: "u\u0301", 0x00FB: "u\u0302", 0x00FC: "u\u0308", 0x00FD: "y\u0301",
+	0x00FF: "y\u0308", 0x0100: "A\u0304", 0x0101: "a\u0304", 0x0102: "A\u0306",
+	0x0103: "a\u0306", 0x0104: "A\u0328", 0x0105: "a\u0328", 0x0106: "C\u0301",
+	0x0107: "c\u0301", 0x0108: "C\u0302", 0x0109: "c\u0302", 0x010A: "C\u0307",
+	0x010B: "c\u0307", 0x010C: "C\u030c", 0x010D: "c\u030c", 0x010E: "D\u030c",
+	0x010F: "d\u030c", 0x0112: "E\u0304", 0x0113: "e\u0304", 0x0114: "E\u0306",
+	0x0115: "e\u0306", 0x0116: "E\u0307", 0x0117: "e\u0307", 0x0118: "E\u0328",
+	0x0119: "e\u0328", 0x011A: "E\u030c", 0x011B: "e\u030c", 0x011C: "G\u0302",
+	0x011D: "g\u0302", 0x011E: "G\u0306", 0x011F: "g\u0306", 0x0120: "G\u0307",
+	0x0121: "g\u0307", 0x0122: "G\u0327", 0x0123: "g\u0327", 0x0124: "H\u0302",
+	0x0125: "h\u0302", 0x0128: "I\u0303", 0x0129: "i\u0303", 0x012A: "I\u0304",
+	0x012B: "i\u0304", 0x012C: "I\u0306", 0x012D: "i\u0306", 0x012E: "I\u0328",
+	0x012F: "i\u0328", 0x0130: "I\u0307", 0x0134: "J\u0302", 0x0135: "j\u0302",
+	0x0136: "K\u0327", 0x0137: "k\u0327", 0x0139: "L\u0301", 0x013A: "l\u0301",
+	0x013B: "L\u0327", 0x013C: "l\u0327", 0x013D: "L\u030c", 0x013E: "l\u030c",
+	0x0143: "N\u0301", 0x0144: "n\u0301", 0x0145: "N\u0327", 0x0146: "n\u0327",
+	0x0147: "N\u030c", 0x0148: "n\u030c", 0x014C: "O\u0304", 0x014D: "o\u0304",
+	0x014E: "O\u0306", 0x014F: "o\u0306", 0x0150: "O\u030b", 0x0151: "o\u030b",
+	0x0154: "R\u0301", 0x0155: "r\u0301", 0x0156: "R\u0327", 0x0157: "r\u0327",
+	0x0158: "R\u030c", 0x0159: "r\u030c", 0x015A: "S\u0301", 0x015B: "s\u0301",
+	0x015C: "S\u0302", 0x015D: "s\u0302", 0x015E: "S\u0327", 0x015F: "s\u0327",
+	0x0160: "S\u030c", 0x0161: "s\u030c", 0x0162: "T\u0327", 0x0163: "t\u0327",
+	0x0164: "T\u030c", 0x0165: "t\u030c", 0x0168: "U\u0303", 0x0169: "u\u0303",
+	0x016A: "U\u0304", 0x016B: "u\u0304", 0x016C: "U\u0306", 0x016D: "u\u0306",
+	0x016E: "U\u030a", 0x016F: "u\u030a", 0x0170: "U\u030b", 0x0171: "u\u030b",
+	0x0172: "U\u0328", 0x0173: "u\u0328", 0x0174: "W\u0302", 0x0175: "w\u0302",
+	0x0176: "Y\u0302", 0x0177: "y\u0302", 0x0178: "Y\u0308", 0x0179: "Z\u0301",
+	0x017A: "z\u0301", 0x017B: "Z\u0307", 0x017C: "z\u0307", 0x017D: "Z\u030c",
+	0x017E: "z\u030c", 0x01A0: "O\u031b", 0x01A1: "o\u031b", 0x01AF: "U\u031b",
+	0x01B0: "u\u031b", 0x01CD: "A\u030c", 0x01CE: "a\u030c", 0x01CF: "I\u030c",
+	0x01D0: "i\u030c", 0x01D1: "O\u030c", 0x01D2: "o\u030c", 0x01D3: "U\u030c",
+	0x01D4: "u\u030c", 0x01D5: "\u00dc\u0304", 0x01D6: "\u00fc\u0304", 0x01D7: "\u00dc\u0301",
+	0x01D8: "\u00fc\u0301", 0x01D9: "\u00dc\u030c", 0x01DA: "\u00fc\u030c", 0x01DB: "\u00dc\u0300",
+	0x01DC: "\u00fc\u0300", 0x01DE: "\u00c4\u0304", 0x01DF: "\u00e4\u0304", 0x01E0: "\u0226\u0304",
+	0x01E1: "\u0227\u0304", 0x01E2: "\u00c6\u0304", 0x01E3: "\u00e6\u0304", 0x01E6: "G\u030c",
+	0x01E7: "g\u030c", 0x01E8: "K\u030c", 0x01E9: "k\u030c", 0x01EA: "O\u0328",
+	0x01EB: "o\u0328", 0x01EC: "\u01ea\u0304", 0x01ED: "\u01eb\u0304", 0x01EE: "\u01b7\u030c",
+	0x01EF: "\u0292\u030c", 0x01F0: "j\u030c", 0x01F4: "G\u0301", 0x01F5: "g\u0301",
+	0x01F8: "N\u0300", 0x01F9: "n\u0300", 0x01FA: "\u00c5\u0301", 0x01FB: "\u00e5\u0301",
+	0x01FC: "\u00c6\u0301", 0x01FD: "\u00e6\u0301", 0x01FE: "\u00d8\u0301", 0x01FF: "\u00f8\u0301",
+	0x0200: "A\u030f", 0x0201: "a\u030f", 0x0202: "A\u0311", 0x0203: "a\u0311",
+	0x0204: "E\u030f", 0x0205: "e\u030f", 0x0206: "E\u0311", 0x0207: "e\u0311",
+	0x0208: "I\u030f", 0x0209: "i\u030f", 0x020A: "I\u0311", 0x020B: "i\u0311",
+	0x020C: "O\u030f", 0x020D: "o\u030f", 0x020E: "O\u0311", 0x020F: "o\u0311",
+	0x0210: "R\u030f", 0x0211: "r\u030f", 0x0212: "R\u0311", 0x0213: "r\u0311",
+	0x0214: "U\u030f", 0x0215: "u\u030f", 0x0216: "U\u0311", 0x0217: "u\u0311",
+	0x0218: "S\u0326", 0x0219: "s\u0326", 0x021A: "T\u0326", 0x021B: "t\u0326",
+	0x021E: "H\u030c", 0x021F: "h\u030c", 0x0226: "A\u0307", 0x0227: "a\u0307",
+	0x0228: "E\u0327", 0x0229: "e\u0327", 0x022A: "\u00d6\u0304", 0x022B: "\u00f6\u0304",
+	0x022C: "\u00d5\u0304", 0x022D: "\u00f5\u0304", 0x022E: "O\u0307", 0x022F: "o\u0307",
+	0x0230: "\u022e\u0304", 0x0231: "\u022f\u0304", 0x0232: "Y\u0304", 0x0233: "y\u0304",
+	0x0340: "\u0300", 0x0341: "\u0301", 0x0343: "\u0313", 0x0344: "\u0308\u0301",
+	0x0374: "\u02b9", 0x037E: ";", 0x0385: "\u00a8\u0301", 0x0386: "\u0391\u0301",
+	0x0387: "\u00b7", 0x0388: "\u0395\u0301", 0x0389: "\u0397\u0301", 0x038A: "\u0399\u0301",
+	0x038C: "\u039f\u0301", 0x038E: "\u03a5\u0301", 0x038F: "\u03a9\u0301", 0x0390: "\u03ca\u0301",
+	0x03AA: "\u0399\u0308", 0x03AB: "\u03a5\u0308", 0x03AC: "\u03b1\u0301", 0x03AD: "\u03b5\u0301",
+	0x03AE: "\u03b7\u0301", 0x03AF: "\u03b9\u0301", 0x03B0: "\u03cb\u0301", 0x03CA: "\u03b9\u0308",
+	0x03CB: "\u03c5\u0308", 0x03CC: "\u03bf\u0301", 0x03CD: "\u03c5\u0301", 0x03CE: "\u03c9\u0301",
+	0x03D3: "\u03d2\u0301", 0x03D4: "\u03d2\u0308", 0x0400: "\u0415\u0300", 0x0401: "\u0415\u0308",
+	0x0403: "\u0413\u0301", 0x0407: "\u0406\u0308", 0x040C: "\u041a\u0301", 0x040D: "\u0418\u0300",
+	0x040E: "\u0423\u0306", 0x0419: "\u0418\u0306", 0x0439: "\u0438\u0306", 0x0450: "\u0435\u0300",
+	0x0451: "\u0435\u0308", 0x0453: "\u0433\u0301", 0x0457: "\u0456\u0308", 0x045C: "\u043a\u0301",
+	0x045D: "\u0438\u0300", 0x045E: "\u0443\u0306", 0x0476: "\u0474\u030f", 0x0477: "\u0475\u030f",
+	0x04C1: "\u0416\u0306", 0x04C2: "\u0436\u0306", 0x04D0: "\u0410\u0306", 0x04D1: "\u0430\u0306",
+	0x04D2: "\u0410\u0308", 0x04D3: "\u0430\u0308", 0x04D6: "\u0415\u0306", 0x04D7: "\u0435\u0306",
+	0x04DA: "\u04d8\u0308", 0x04DB: "\u04d9\u0308", 0x04DC: "\u0416\u0308", 0x04DD: "\u0436\u0308",
+	0x04DE: "\u0417\u0308", 0x04DF: "\u0437\u0308", 0x04E2: "\u0418\u0304", 0x04E3: "\u0438\u0304",
+	0x04E4: "\u0418\u0308", 0x04E5: "\u0438\u0308", 0x04E6: "\u041e\u0308", 0x04E7: "\u043e\u0308",
+	0x04EA: "\u04e8\u0308", 0x04EB: "\u04e9\u0308", 0x04EC: "\u042d\u0308", 0x04ED: "\u044d\u0308",
+	0x04EE: "\u0423\u0304", 0x04EF: "\u0443\u0304", 0x04F0: "\u0423\u0308", 0x04F1: "\u0443\u0308",
+	0x04F2: "\u0423\u030b", 0x04F3: "\u0443\u030b", 0x04F4: "\u0427\u0308", 0x04F5: "\u0447\u0308",
+	0x04F8: "\u042b\u0308", 0x04F9: "\u044b\u0308", 0x0622: "\u0627\u0653", 0x0623: "\u0627\u0654",
+	0x0624: "\u0648\u0654", 0x0625: "\u0627\u0655", 0x0626: "\u064a\u0654", 0x06C0: "\u06d5\u0654",
+	0x06C2: "\u06c1\u0654", 0x06D3: "\u06d2\u0654", 0x0929: "\u0928\u093c", 0x0931: "\u0930\u093c",
+	0x0934: "\u0933\u093c", 0x0958: "\u0915\u093c", 0x0959: "\u0916\u093c", 0x095A: "\u0917\u093c",
+	0x095B: "\u091c\u093c", 0x095C: "\u0921\u093c", 0x095D: "\u0922\u093c", 0x095E: "\u092b\u093c",
+	0x095F: "\u092f\u093c", 0x09CB: "\u09c7\u09be", 0x09CC: "\u09c7\u09d7", 0x09DC: "\u09a1\u09bc",
+	0x09DD: "\u09a2\u09bc", 0x09DF: "\u09af\u09bc", 0x0A33: "\u0a32\u0a3c", 0x0A36: "\u0a38\u0a3c",
+	0x0A59: "\u0a16\u0a3c", 0x0A5A: "\u0a17\u0a3c", 0x0A5B: "\u0a1c\u0a3c", 0x0A5E: "\u0a2b\u0a3c",
+	0x0B48: "\u0b47\u0b56", 0x0B4B: "\u0b47\u0b3e", 0x0B4C: "\u0b47\u0b57", 0x0B5C: "\u0b21\u0b3c",
+	0x0B5D: "\u0b22\u0b3c", 0x0B94: "\u0b92\u0bd7", 0x0BCA: "\u0bc6\u0bbe", 0x0BCB: "\u0bc7\u0bbe",
+	0x0BCC: "\u0bc6\u0bd7", 0x0C48: "\u0c46\u0c56", 0x0CC0: "\u0cbf\u0cd5", 0x0CC7: "\u0cc6\u0cd5",
+	0x0CC8: "\u0cc6\u0cd6", 0x0CCA: "\u0cc6\u0cc2", 0x0CCB: "\u0cca\u0cd5", 0x0D4A: "\u0d46\u0d3e",
+	0x0D4B: "\u0d47\u0d3e", 0x0D4C: "\u0d46\u0d57", 0x0DDA: "\u0dd9\u0dca", 0x0DDC: "\u0dd9\u0dcf",
+	0x0DDD: "\u0ddc\u0dca", 0x0DDE: "\u0dd9\u0ddf", 0x0F43: "\u0f42\u0fb7", 0x0F4D: "\u0f4c\u0fb7",
+	0x0F52: "\u0f51\u0fb7", 0x0F57: "\u0f56\u0fb7", 0x0F5C: "\u0f5b\u0fb7", 0x0F69: "\u0f40\u0fb5",
+	0x0F73: "\u0f71\u0f72", 0x0F75: "\u0f71\u0f74", 0x0F76: "\u0fb2\u0f80", 0x0F78: "\u0fb3\u0f80",
+	0x0F81: "\u0f71\u0f80", 0x0F93: "\u0f92\u0fb7", 0x0F9D: "\u0f9c\u0fb7", 0x0FA2: "\u0fa1\u0fb7",
+	0x0FA7: "\u0fa6\u0fb7", 0x0FAC: "\u0fab\u0fb7", 0x0FB9: "\u0f90\u0fb5", 0x1026: "\u1025\u102e",
+	0x1B06: "\u1b05\u1b35", 0x1B08: "\u1b07\u1b35", 0x1B0A: "\u1b09\u1b35", 0x1B0C: "\u1b0b\u1b35",
+	0x1B0E: "\u1b0d\u1b35", 0x1B12: "\u1b11\u1b35", 0x1B3B: "\u1b3a\u1b35", 0x1B3D: "\u1b3c\u1b35",
+	0x1B40: "\u1b3e\u1b35", 0x1B41: "\u1b3f\u1b35", 0x1B43: "\u1b42\u1b35", 0x1E00: "A\u0325",
+	0x1E01: "a\u0325", 0x1E02: "B\u0307", 0x1E03: "b\u0307", 0x1E04: "B\u0323",
+	0x1E05: "b\u0323", 0x1E06: "B\u0331", 0x1E07: "b\u0331", 0x1E08: "\u00c7\u0301",
+	0x1E09: "\u00e7\u0301", 0x1E0A: "D\u0307", 0x1E0B: "d\u0307", 0x1E0C: "D\u0323",
+	0x1E0D: "d\u0323", 0x1E0E: "D\u0331", 0x1E0F: "d\u0331", 0x1E10: "D\u0327",
+	0x1E11: "d\u0327", 0x1E12: "D\u032d", 0x1E13: "d\u032d", 0x1E14: "\u0112\u0300",
+	0x1E15: "\u0113\u0300", 0x1E16: "\u0112\u0301", 0x1E17: "\u0113\u0301", 0x1E18: "E\u032d",
+	0x1E19: "e\u032d", 0x1E1A: "E\u0330", 0x1E1B: "e\u0330", 0x1E1C: "\u0228\u0306",
+	0x1E1D: "\u0229\u0306", 0x1E1E: "F\u0307", 0x1E1F: "f\u0307", 0x1E20: "G\u0304",
+	0x1E21: "g\u0304", 0x1E22: "H\u0307", 0x1E23: "h\u0307", 0x1E24: "H\u0323",
+	0x1E25: "h\u0323", 0x1E26: "H\u0308", 0x1E27: "h\u0308", 0x1E28: "H\u0327",
+	0x1E29: "h\u0327", 0x1E2A: "H\u032e", 0x1E2B: "h\u032e", 0x1E2C: "I\u0330",
+	0x1E2D: "i\u0330", 0x1E2E: "\u00cf\u0301", 0x1E2F: "\u00ef\u0301", 0x1E30: "K\u0301",
+	0x1E31: "k\u0301", 0x1E32: "K\u0323", 0x1E33: "k\u0323", 0x1E34: "K\u0331",
+	0x1E35: "k\u0331", 0x1E36: "L\u0323", 0x1E37: "l\u0323", 0x1E38: "\u1e36\u0304",
+	0x1E39: "\u1e37\u0304", 0x1E3A: "L\u0331", 0x1E3B: "l\u0331", 0x1E3C: "L\u032d",
+	0x1E3D: "l\u032d", 0x1E3E: "M\u0301", 0x1E3F: "m\u0301", 0x1E40: "M\u0307",
+	0x1E41: "m\u0307", 0x1E42: "M\u0323", 0x1E43: "m\u0323", 0x1E44: "N\u0307",
+	0x1E45: "n\u0307", 0x1E46: "N\u0323", 0x1E47: "n\u0323", 0x1E48: "N\u0331",
+	0x1E49: "n\u0331", 0x1E4A: "N\u032d", 0x1E4B: "n\u032d", 0x1E4C: "\u00d5\u0301",
+	0x1E4D: "\u00f5\u0301", 0x1E4E: "\u00d5\u0308", 0x1E4F: "\u00f5\u0308", 0x1E50: "\u014c\u0300",
+	0x1E51: "\u014d\u0300", 0x1E52: "\u014c\u0301", 0x1E53: "\u014d\u0301", 0x1E54: "P\u0301",
+	0x1E55: "p\u0301", 0x1E56: "P\u0307", 0x1E57: "p\u0307", 0x1E58: "R\u0307",
+	0x1E59: "r\u0307", 0x1E5A: "R\u0323", 0x1E5B: "r\u0323", 0x1E5C: "\u1e5a\u0304",
+	0x1E5D: "\u1e5b\u0304", 0x1E5E: "R\u0331", 0x1E5F: "r\u0331", 0x1E60: "S\u0307",
+	0x1E61: "s\u0307", 0x1E62: "S\u0323", 0x1E63: "s\u0323", 0x1E64: "\u015a\u0307",
+	0x1E65: "\u015b\u0307", 0x1E66: "\u0160\u0307", 0x1E67: "\u0161\u0307", 0x1E68: "\u1e62\u0307",
+	0x1E69: "\u1e63\u0307", 0x1E6A: "T\u0307", 0x1E6B: "t\u0307", 0x1E6C: "T\u0323",
+	0x1E6D: "t\u0323", 0x1E6E: "T\u0331", 0x1E6F: "t\u0331", 0x1E70: "T\u032d",
+	0x1E71: "t\u032d", 0x1E72: "U\u0324", 0x1E73: "u\u0324", 0x1E74: "U\u0330",
+	0x1E75: "u\u0330", 0x1E76: "U\u032d", 0x1E77: "u\u032d", 0x1E78: "\u0168\u0301",
+	0x1E79: "\u0169\u0301", 0x1E7A: "\u016a\u0308", 0x1E7B: "\u016b\u0308", 0x1E7C: "V\u0303",
+	0x1E7D: "v\u0303", 0x1E7E: "V\u0323", 0x1E7F: "v\u0323", 0x1E80: "W\u0300",
+	0x1E81: "w\u0300", 0x1E82: "W\u0301", 0x1E83: "w\u0301", 0x1E84: "W\u0308",
+	0x1E85: "w\u0308", 0x1E86: "W\u0307", 0x1E87: "w\u0307", 0x1E88: "W\u0323",
+	0x1E89: "w\u0323", 0x1E8A: "X\u0307", 0x1E8B: "x\u0307", 0x1E8C: "X\u0308",
+	0x1E8D: "x\u0308", 0x1E8E: "Y\u0307", 0x1E8F: "y\u0307", 0x1E90: "Z\u0302",
+	0x1E91: "z\u0302", 0x1E92: "Z\u0323", 0x1E93: "z\u0323", 0x1E94: "Z\u0331",
+	0x1E95: "z\u0331", 0x1E96: "h\u0331", 0x1E97: "t\u0308", 0x1E98: "w\u030a",
+	0x1E99: "y\u030a", 0x1E9B: "\u017f\u0307", 0x1EA0: "A\u0323", 0x1EA1: "a\u0323",
+	0x1EA2: "A\u0309", 0x1EA3: "a\u0309", 0x1EA4: "\u00c2\u0301", 0x1EA5: "\u00e2\u0301",
+	0x1EA6: "\u00c2\u0300", 0x1EA7: "\u00e2\u0300", 0x1EA8: "\u00c2\u0309", 0x1EA9: "\u00e2\u0309",
+	0x1EAA: "\u00c2\u0303", 0x1EAB: "\u00e2\u0303", 0x1EAC: "\u1ea0\u0302", 0x1EAD: "\u1ea1\u0302",
+	0x1EAE: "\u0102\u0301", 0x1EAF: "\u0103\u0301", 0x1EB0: "\u0102\u0300", 0x1EB1: "\u0103\u0300",
+	0x1EB2: "\u0102\u0309", 0x1EB3: "\u0103\u0309", 0x1EB4: "\u0102\u0303", 0x1EB5: "\u0103\u0303",
+	0x1EB6: "\u1ea0\u0306", 0x1EB7: "\u1ea1\u0306", 0x1EB8: "E\u0323", 0x1EB9: "e\u0323",
+	0x1EBA: "E\u0309", 0x1EBB: "e\u0309", 0x1EBC: "E\u0303", 0x1EBD: "e\u0303",
+	0x1EBE: "\u00ca\u0301", 0x1EBF: "\u00ea\u0301", 0x1EC0: "\u00ca\u0300", 0x1EC1: "\u00ea\u0300",
+	0x1EC2: "\u00ca\u0309", 0x1EC3: "\u00ea\u0309", 0x1EC4: "\u00ca\u0303", 0x1EC5: "\u00ea\u0303",
+	0x1EC6: "\u1eb8\u0302", 0x1EC7: "\u1eb9\u0302", 0x1EC8: "I\u0309", 0x1EC9: "i\u0309",
+	0x1ECA: "I\u0323", 0x1ECB: "i\u0323", 0x1ECC: "O\u0323", 0x1ECD: "o\u0323",
+	0x1ECE: "O\u0309", 0x1ECF: "o\u0309", 0x1ED0: "\u00d4\u0301", 0x1ED1: "\u00f4\u0301",
+	0x1ED2: "\u00d4\u0300", 0x1ED3: "\u00f4\u0300", 0x1ED4: "\u00d4\u0309", 0x1ED5: "\u00f4\u0309",
+	0x1ED6: "\u00d4\u0303", 0x1ED7: "\u00f4\u0303", 0x1ED8: "\u1ecc\u0302", 0x1ED9: "\u1ecd\u0302",
+	0x1EDA: "\u01a0\u0301", 0x1EDB: "\u01a1\u0301", 0x1EDC: "\u01a0\u0300", 0x1EDD: "\u01a1\u0300",
+	0x1EDE: "\u01a0\u0309", 0x1EDF: "\u01a1\u0309", 0x1EE0: "\u01a0\u0303", 0x1EE1: "\u01a1\u0303",
+	0x1EE2: "\u01a0\u0323", 0x1EE3: "\u01a1\u0323", 0x1EE4: "U\u0323", 0x1EE5: "u\u0323",
+	0x1EE6: "U\u0309", 0x1EE7: "u\u0309", 0x1EE8: "\u01af\u0301", 0x1EE9: "\u01b0\u0301",
+	0x1EEA: "\u01af\u0300", 0x1EEB: "\u01b0\u0300", 0x1EEC: "\u01af\u0309", 0x1EED: "\u01b0\u0309",
+	0x1EEE: "\u01af\u0303", 0x1EEF: "\u01b0\u0303", 0x1EF0: "\u01af\u0323", 0x1EF1: "\u01b0\u0323",
+	0x1EF2: "Y\u0300", 0x1EF3: "y\u0300", 0x1EF4: "Y\u0323", 0x1EF5: "y\u0323",
+	0x1EF6: "Y\u0309", 0x1EF7: "y\u0309", 0x1EF8: "Y\u0303", 0x1EF9: "y\u0303",
+	0x1F00: "\u03b1\u0313", 0x1F01: "\u03b1\u0314", 0x1F02: "\u1f00\u0300", 0x1F03: "\u1f01\u0300",
+	0x1F04: "\u1f00\u0301", 0x1F05: "\u1f01\u0301", 0x1F06: "\u1f00\u0342", 0x1F07: "\u1f01\u0342",
+	0x1F08: "\u0391\u0313", 0x1F09: "\u0391\u0314", 0x1F0A: "\u1f08\u0300", 0x1F0B: "\u1f09\u0300",
+	0x1F0C: "\u1f08\u0301", 0x1F0D: "\u1f09\u0301", 0x1F0E: "\u1f08\u0342", 0x1F0F: "\u1f09\u0342",
+	0x1F10: "\u03b5\u0313", 0x1F11: "\u03b5\u0314", 0x1F12: "\u1f10\u0300", 0x1F13: "\u1f11\u0300",
+	0x1F14: "\u1f10\u0301", 0x1F15: "\u1f11\u0301", 0x1F18: "\u0395\u0313", 0x1F19: "\u0395\u0314",
+	0x1F1A: "\u1f18\u0300", 0x1F1B: "\u1f19\u0300", 0x1F1C: "\u1f18\u0301", 0x1F1D: "\u1f19\u0301",
+	0x1F20: "\u03b7\u0313", 0x1F21: "\u03b7\u0314", 0x1F22: "\u1f20\u0300", 0x1F23: "\u1f21\u0300",
+	0x1F24: "\u1f20\u0301", 0x1F25: "\u1f21\u0301", 0x1F26: "\u1f20\u0342", 0x1F27: "\u1f21\u0342",
+	0x1F28: "\u0397\u0313", 0x1F29: "\u0397\u0314", 0x1F2A: "\u1f28\u0300", 0x1F2B: "\u1f29\u0300",
+	0x1F2C: "\u1f28\u0301", 0x1F2D: "\u1f29\u0301", 0x1F2E: "\u1f28\u0342", 0x1F2F: "\u1f29\u0342",
+	0x1F30: "\u03b9\u0313", 0x1F31: "\u03b9\u0314", 0x1F32: "\u1f30\u0300", 0x1F33: "\u1f31\u0300",
+	0x1F34: "\u1f30\u0301", 0x1F35: "\u1f31\u0301", 0x1F36: "\u1f30\u0342", 0x1F37: "\u1f31\u0342",
+	0x1F38: "\u0399\u0313", 0x1F39: "\u0399\u0314", 0x1F3A: "\u1f38\u0300", 0x1F3B: "\u1f39\u0300",
+	0x1F3C: "\u1f38\u0301", 0x1F3D: "\u1f39\u0301", 0x1F3E: "\u1f38\u0342", 0x1F3F: "\u1f39\u0342",
+	0x1F40: "\u03bf\u0313", 0x1F41: "\u03bf\u0314", 0x1F42: "\u1f40\u0300", 0x1F43: "\u1f41\u0300",
+	0x1F44: "\u1f40\u0301", 0x1F45: "\u1f41\u0301", 0x1F48: "\u039f\u0313", 0x1F49: "\u039f\u0314",
+	0x1F4A: "\u1f48\u0300", 0x1F4B: "\u1f49\u0300", 0x1F4C: "\u1f48\u0301", 0x1F4D: "\u1f49\u0301",
+	0x1F50: "\u03c5\u0313", 0x1F51: "\u03c5\u0314", 0x1F52: "\u1f50\u0300", 0x1F53: "\u1f51\u0300",
+	0x1F54: "\u1f50\u0301", 0x1F55: "\u1f51\u0301", 0x1F56: "\u1f50\u0342", 0x1F57: "\u1f51\u0342",
+	0x1F59: "\u03a5\u0314", 0x1F5B: "\u1f59\u0300", 0x1F5D: "\u1f59\u0301", 0x1F5F: "\u1f59\u0342",
+	0x1F60: "\u03c9\u0313", 0x1F61: "\u03c9\u0314", 0x1F62: "\u1f60\u0300", 0x1F63: "\u1f61\u0300",
+	0x1F64: "\u1f60\u0301", 0x1F65: "\u1f61\u0301", 0x1F66: "\u1f60\u0342", 0x1F67: "\u1f61\u0342",
+	0x1F68: "\u03a9\u0313", 0x1F69: "\u03a9\u0314", 0x1F6A: "\u1f68\u0300", 0x1F6B: "\u1f69\u0300",
+	0x1F6C: "\u1f68\u0301", 0x1F6D: "\u1f69\u0301", 0x1F6E: "\u1f68\u0342", 0x1F6F: "\u1f69\u0342",
+	0x1F70: "\u03b1\u0300", 0x1F71: "\u03ac", 0x1F72: "\u03b5\u0300", 0x1F73: "\u03ad",
+	0x1F74: "\u03b7\u0300", 0x1F75: "\u03ae", 0x1F76: "\u03b9\u0300", 0x1F77: "\u03af",
+	0x1F78: "\u03bf\u0300", 0x1F79: "\u03cc", 0x1F7A: "\u03c5\u0300", 0x1F7B: "\u03cd",
+	0x1F7C: "\u03c9\u0300", 0x1F7D: "\u03ce", 0x1F80: "\u1f00\u0345", 0x1F81: "\u1f01\u0345",
+	0x1F82: "\u1f02\u0345", 0x1F83: "\u1f03\u0345", 0x1F84: "\u1f04\u0345", 0x1F85: "\u1f05\u0345",
+	0x1F86: "\u1f06\u0345", 0x1F87: "\u1f07\u0345", 0x1F88: "\u1f08\u0345", 0x1F89: "\u1f09\u0345",
+	0x1F8A: "\u1f0a\u0345", 0x1F8B: "\u1f0b\u0345", 0x1F8C: "\u1f0c\u0345", 0x1F8D: "\u1f0d\u0345",
+	0x1F8E: "\u1f0e\u0345", 0x1F8F: "\u1f0f\u0345", 0x1F90: "\u1f20\u0345", 0x1F91: "\u1f21\u0345",
+	0x1F92: "\u1f22\u0345", 0x1F93: "\u1f23\u0345", 0x1F94: "\u1f24\u0345", 0x1F95: "\u1f25\u0345",
+	0x1F96: "\u1f26\u0345", 0x1F97: "\u1f27\u0345", 0x1F98: "\u1f28\u0345", 0x1F99: "\u1f29\u0345",
+	0x1F9A: "\u1f2a\u0345", 0x1F9B: "\u1f2b\u0345", 0x1F9C: "\u1f2c\u0345", 0x1F9D: "\u1f2d\u0345",
+	0x1F9E: "\u1f2e\u0345", 0x1F9F: "\u1f2f\u0345", 0x1FA0: "\u1f60\u0345", 0x1FA1: "\u1f61\u0345",
+	0x1FA2: "\u1f62\u0345", 0x1FA3: "\u1f63\u0345", 0x1FA4: "\u1f64\u0345", 0x1FA5: "\u1f65\u0345",
+	0x1FA6: "\u1f66\u0345", 0x1FA7: "\u1f67\u0345", 0x1FA8: "\u1f68\u0345", 0x1FA9: "\u1f69\u0345",
+	0x1FAA: "\u1f6a\u0345", 0x1FAB: "\u1f6b\u0345", 0x1FAC: "\u1f6c\u0345", 0x1FAD: "\u1f6d\u0345",
+	0x1FAE: "\u1f6e\u0345", 0x1FAF: "\u1f6f\u0345", 0x1FB0: "\u03b1\u0306", 0x1FB1: "\u03b1\u0304",
+	0x1FB2: "\u1f70\u0345", 0x1FB3: "\u03b1\u0345", 0x1FB4: "\u03ac\u0345", 0x1FB6: "\u03b1\u0342",
+	0x1FB7: "\u1fb6\u0345", 0x1FB8: "\u0391\u0306", 0x1FB9: "\u0391\u0304", 0x1FBA: "\u0391\u0300",
+	0x1FBB: "\u0386", 0x1FBC: "\u0391\u0345", 0x1FBE: "\u03b9", 0x1FC1: "\u00a8\u0342",
+	0x1FC2: "\u1f74\u0345", 0x1FC3: "\u03b7\u0345", 0x1FC4: "\u03ae\u0345", 0x1FC6: "\u03b7\u0342",
+	0x1FC7: "\u1fc6\u0345", 0x1FC8: "\u0395\u0300", 0x1FC9: "\u0388", 0x1FCA: "\u0397\u0300",
+	0x1FCB: "\u0389", 0x1FCC: "\u0397\u0345", 0x1FCD: "\u1fbf\u0300", 0x1FCE: "\u1fbf\u0301",
+	0x1FCF: "\u1fbf\u0342", 0x1FD0: "\u03b9\u0306", 0x1FD1: "\u03b9\u0304", 0x1FD2: "\u03ca\u0300",
+	0x1FD3: "\u0390", 0x1FD6: "\u03b9\u0342", 0x1FD7: "\u03ca\u0342", 0x1FD8: "\u0399\u0306",
+	0x1FD9: "\u0399\u0304", 0x1FDA: "\u0399\u0300", 0x1FDB: "\u038a", 0x1FDD: "\u1ffe\u0300",
+	0x1FDE: "\u1ffe\u0301", 0x1FDF: "\u1ffe\u0342", 0x1FE0: "\u03c5\u0306", 0x1FE1: "\u03c5\u0304",
+	0x1FE2: "\u03cb\u0300", 0x1FE3: "\u03b0", 0x1FE4: "\u03c1\u0313", 0x1FE5: "\u03c1\u0314",
+	0x1FE6: "\u03c5\u0342", 0x1FE7: "\u03cb\u0342", 0x1FE8: "\u03a5\u0306", 0x1FE9: "\u03a5\u0304",
+	0x1FEA: "\u03a5\u0300", 0x1FEB: "\u038e", 0x1FEC: "\u03a1\u0314", 0x1FED: "\u00a8\u0300",
+	0x1FEE: "\u0385", 0x1FEF: "`", 0x1FF2: "\u1f7c\u0345", 0x1FF3: "\u03c9\u0345",
+	0x1FF4: "\u03ce\u0345", 0x1FF6: "\u03c9\u0342", 0x1FF7: "\u1ff6\u0345", 0x1FF8: "\u039f\u0300",
+	0x1FF9: "\u038c", 0x1FFA: "\u03a9\u0300", 0x1FFB: "\u038f", 0x1FFC: "\u03a9\u0345",
+	0x1FFD: "\u00b4", 0x2000: "\u2002", 0x2001: "\u2003", 0x2126: "\u03a9",
+	0x212A: "K", 0x212B: "\u00c5", 0x219A: "\u2190\u0338", 0x219B: "\u2192\u0338",
+	0x21AE: "\u2194\u0338", 0x21CD: "\u21d0\u0338", 0x21CE: "\u21d4\u0338", 0x21CF: "\u21d2\u0338",
+	0x2204: "\u2203\u0338", 0x2209: "\u2208\u0338", 0x220C: "\u220b\u0338", 0x2224: "\u2223\u0338",
+	0x2226: "\u2225\u0338", 0x2241: "\u223c\u0338", 0x2244: "\u2243\u0338", 0x2247: "\u2245\u0338",
+	0x2249: "\u2248\u0338", 0x2260: "=\u0338", 0x2262: "\u2261\u0338", 0x226D: "\u224d\u0338",
+	0x226E: "<\u0338", 0x226F: ">\u0338", 0x2270: "\u2264\u0338", 0x2271: "\u2265\u0338",
+	0x2274: "\u2272\u0338", 0x2275: "\u2273\u0338", 0x2278: "\u2276\u0338", 0x2279: "\u2277\u0338",
+	0x2280: "\u227a\u0338", 0x2281: "\u227b\u0338", 0x2284: "\u2282\u0338", 0x2285: "\u2283\u0338",
+	0x2288: "\u2286\u0338", 0x2289: "\u2287\u0338", 0x22AC: "\u22a2\u0338", 0x22AD: "\u22a8\u0338",
+	0x22AE: "\u22a9\u0338", 0x22AF: "\u22ab\u0338", 0x22E0: "\u227c\u0338", 0x22E1: "\u227d\u0338",
+	0x22E2: "\u2291\u0338", 0x22E3: "\u2292\u0338", 0x22EA: "\u22b2\u0338", 0x22EB: "\u22b3\u0338",
+	0x22EC: "\u22b4\u0338", 0x22ED: "\u22b5\u0338", 0x2329: "\u3008", 0x232A: "\u3009",
+	0x2ADC: "\u2add\u0338", 0x304C: "\u304b\u3099", 0x304E: "\u304d\u3099", 0x3050: "\u304f\u3099",
+	0x3052: "\u3051\u3099", 0x3054: "\u3053\u3099", 0x3056: "\u3055\u3099", 0x3058: "\u3057\u3099",
+	0x305A: "\u3059\u3099", 0x305C: "\u305b\u3099", 0x305E: "\u305d\u3099", 0x3060: "\u305f\u3099",
+	0x3062: "\u3061\u3099", 0x3065: "\u3064\u3099", 0x3067: "\u3066\u3099", 0x3069: "\u3068\u3099",
+	0x3070: "\u306f\u3099", 0x3071: "\u306f\u309a", 0x3073: "\u3072\u3099", 0x3074: "\u3072\u309a",
+	0x3076: "\u3075\u3099", 0x3077: "\u3075\u309a", 0x3079: "\u3078\u3099", 0x307A: "\u3078\u309a",
+	0x307C: "\u307b\u3099", 0x307D: "\u307b\u309a", 0x3094: "\u3046\u3099", 0x309E: "\u309d\u3099",
+	0x30AC: "\u30ab\u3099", 0x30AE: "\u30ad\u3099", 0x30B0: "\u30af\u3099", 0x30B2: "\u30b1\u3099",
+	0x30B4: "\u30b3\u3099", 0x30B6: "\u30b5\u3099", 0x30B8: "\u30b7\u3099", 0x30BA: "\u30b9\u3099",
+	0x30BC: "\u30bb\u3099", 0x30BE: "\u30bd\u3099", 0x30C0: "\u30bf\u3099", 0x30C2: "\u30c1\u3099",
+	0x30C5: "\u30c4\u3099", 0x30C7: "\u30c6\u3099", 0x30C9: "\u30c8\u3099", 0x30D0: "\u30cf\u3099",
+	0x30D1: "\u30cf\u309a", 0x30D3: "\u30d2\u3099", 0x30D4: "\u30d2\u309a", 0x30D6: "\u30d5\u3099",
+	0x30D7: "\u30d5\u309a", 0x30D9: "\u30d8\u3099", 0x30DA: "\u30d8\u309a", 0x30DC: "\u30db\u3099",
+	0x30DD: "\u30db\u309a", 0x30F4: "\u30a6\u3099", 0x30F7: "\u30ef\u3099", 0x30F8: "\u30f0\u3099",
+	0x30F9: "\u30f1\u3099", 0x30FA: "\u30f2\u3099", 0x30FE: "\u30fd\u3099", 0xF900: "\u8c48",
+	0xF901: "\u66f4", 0xF902: "\u8eca", 0xF903: "\u8cc8", 0xF904: "\u6ed1",
+	0xF905: "\u4e32", 0xF906: "\u53e5", 0xF907: "\u9f9c", 0xF908: "\u9f9c",
+	0xF909: "\u5951", 0xF90A: "\u91d1", 0xF90B: "\u5587", 0xF90C: "\u5948",
+	0xF90D: "\u61f6", 0xF90E: "\u7669", 0xF90F: "\u7f85", 0xF910: "\u863f",
+	0xF911: "\u87ba", 0xF912: "\u88f8", 0xF913: "\u908f", 0xF914: "\u6a02",
+	0xF915: "\u6d1b", 0xF916: "\u70d9", 0xF917: "\u73de", 0xF918: "\u843d",
+	0xF919: "\u916a", 0xF91A: "\u99f1", 0xF91B: "\u4e82", 0xF91C: "\u5375",
+	0xF91D: "\u6b04", 0xF91E: "\u721b", 0xF91F: "\u862d", 0xF920: "\u9e1e",
+	0xF921: "\u5d50", 0xF922: "\u6feb", 0xF923: "\u85cd", 0xF924: "\u8964",
+	0xF925: "\u62c9", 0xF926: "\u81d8", 0xF927: "\u881f", 0xF928: "\u5eca",
+	0xF929: "\u6717", 0xF92A: "\u6d6a", 0xF92B: "\u72fc", 0xF92C: "\u90ce",
+	0xF92D: "\u4f86", 0xF92E: "\u51b7", 0xF92F: "\u52de", 0xF930: "\u64c4",
+	0xF931: "\u6ad3", 0xF932: "\u7210", 0xF933: "\u76e7", 0xF934: "\u8001",
+	0xF935: "\u8606", 0xF936: "\u865c", 0xF937: "\u8def", 0xF938: "\u9732",
+	0xF939: "\u9b6f", 0xF93A: "\u9dfa", 0xF93B: "\u788c", 0xF93C: "\u797f",
+	0xF93D: "\u7da0", 0xF93E: "\u83c9", 0xF93F: "\u9304", 0xF940: "\u9e7f",
+	0xF941: "\u8ad6", 0xF942: "\u58df", 0xF943: "\u5f04", 0xF944: "\u7c60",
+	0xF945: "\u807e", 0xF946: "\u7262", 0xF947: "\u78ca", 0xF948: "\u8cc2",
+	0xF949: "\u96f7", 0xF94A: "\u58d8", 0xF94B: "\u5c62", 0xF94C: "\u6a13",
+	0xF94D: "\u6dda", 0xF94E: "\u6f0f", 0xF94F: "\u7d2f", 0xF950: "\u7e37",
+	0xF951: "\u964b", 0xF952: "\u52d2", 0xF953: "\u808b", 0xF954: "\u51dc",
+	0xF955: "\u51cc", 0xF956: "\u7a1c", 0xF957: "\u7dbe", 0xF958: "\u83f1",
+	0xF959: "\u9675", 0xF95A: "\u8b80", 0xF95B: "\u62cf", 0xF95C: "\u6a02",
+	0xF95D: "\u8afe", 0xF95E: "\u4e39", 0xF95F: "\u5be7", 0xF960: "\u6012",
+	0xF961: "\u7387", 0xF962: "\u7570", 0xF963: "\u5317", 0xF964: "\u78fb",
+	0xF965: "\u4fbf", 0xF966: "\u5fa9", 0xF967: "\u4e0d", 0xF968: "\u6ccc",
+	0xF969: "\u6578", 0xF96A: "\u7d22", 0xF96B: "\u53c3", 0xF96C: "\u585e",
+	0xF96D: "\u7701", 0xF96E: "\u8449", 0xF96F: "\u8aaa", 0xF970: "\u6bba",
+	0xF971: "\u8fb0", 0xF972: "\u6c88", 0xF973: "\u62fe", 0xF974: "\u82e5",
+	0xF975: "\u63a0", 0xF976: "\u7565", 0xF977: "\u4eae", 0xF978: "\u5169",
+	0xF979: "\u51c9", 0xF97A: "\u6881", 0xF97B: "\u7ce7", 0xF97C: "\u826f",
+	0xF97D: "\u8ad2", 0xF97E: "\u91cf", 0xF97F: "\u52f5", 0xF980: "\u5442",
+	0xF981: "\u5973", 0xF982: "\u5eec", 0xF983: "\u65c5", 0xF984: "\u6ffe",
+	0xF985: "\u792a", 0xF986: "\u95ad", 0xF987: "\u9a6a", 0xF988: "\u9e97",
+	0xF989: "\u9ece", 0xF98A: "\u529b", 0xF98B: "\u66c6", 0xF98C: "\u6b77",
+	0xF98D: "\u8f62", 0xF98E: "\u5e74", 0xF98F: "\u6190", 0xF990: "\u6200",
+	0xF991: "\u649a", 0xF992: "\u6f23", 0xF993: "\u7149", 0xF994: "\u7489",
+	0xF995: "\u79ca", 0xF996: "\u7df4", 0xF997: "\u806f", 0xF998: "\u8f26",
+	0xF999: "\u84ee", 0xF99A: "\u9023", 0xF99B: "\u934a", 0xF99C: "\u5217",
+	0xF99D: "\u52a3", 0xF99E: "\u54bd", 0xF99F: "\u70c8", 0xF9A0: "\u88c2",
+	0xF9A1: "\u8aaa", 0xF9A2: "\u5ec9", 0xF9A3: "\u5ff5", 0xF9A4: "\u637b",
+	0xF9A5: "\u6bae", 0xF9A6: "\u7c3e", 0xF9A7: "\u7375", 0xF9A8: "\u4ee4",
+	0xF9A9: "\u56f9", 0xF9AA: "\u5be7", 0xF9AB: "\u5dba", 0xF9AC: "\u601c",
+	0xF9AD: "\u73b2", 0xF9AE: "\u7469", 0xF9AF: "\u7f9a", 0xF9B0: "\u8046",
+	0xF9B1: "\u9234", 0xF9B2: "\u96f6", 0xF9B3: "\u9748", 0xF9B4: "\u9818",
+	0xF9B5: "\u4f8b", 0xF9B6: "\u79ae", 0xF9B7: "\u91b4", 0xF9B8: "\u96b8",
+	0xF9B9: "\u60e1", 0xF9BA: "\u4e86", 0xF9BB: "\u50da", 0xF9BC: "\u5bee",
+	0xF9BD: "\u5c3f", 0xF9BE: "\u6599", 0xF9BF: "\u6a02", 0xF9C0: "\u71ce",
+	0xF9C1: "\u7642", 0xF9C2: "\u84fc", 0xF9C3: "\u907c", 0xF9C4: "\u9f8d",
+	0xF9C5: "\u6688", 0xF9C6: "\u962e", 0xF9C7: "\u5289", 0xF9C8: "\u677b",
+	0xF9C9: "\u67f3", 0xF9CA: "\u6d41", 0xF9CB: "\u6e9c", 0xF9CC: "\u7409",
+	0xF9CD: "\u7559", 0xF9CE: "\u786b", 0xF9CF: "\u7d10", 0xF9D0: "\u985e",
+	0xF9D1: "\u516d", 0xF9D2: "\u622e", 0xF9D3: "\u9678", 0xF9D4: "\u502b",
+	0xF9D5: "\u5d19", 0xF9D6: "\u6dea", 0xF9D7: "\u8f2a", 0xF9D8: "\u5f8b",
+	0xF9D9: "\u6144", 0xF9DA: "\u6817", 0xF9DB: "\u7387", 0xF9DC: "\u9686",
+	0xF9DD: "\u5229", 0xF9DE: "\u540f", 0xF9DF: "\u5c65", 0xF9E0: "\u6613",
+	0xF9E1: "\u674e", 0xF9E2: "\u68a8", 0xF9E3: "\u6ce5", 0xF9E4: "\u7406",
+	0xF9E5: "\u75e2", 0xF9E6: "\u7f79", 0xF9E7: "\u88cf", 0xF9E8: "\u88e1",
+	0xF9E9: "\u91cc", 0xF9EA: "\u96e2", 0xF9EB: "\u533f", 0xF9EC: "\u6eba",
+	0xF9ED: "\u541d", 0xF9EE: "\u71d0", 0xF9EF: "\u7498", 0xF9F0: "\u85fa",
+	0xF9F1: "\u96a3", 0xF9F2: "\u9c57", 0xF9F3: "\u9e9f", 0xF9F4: "\u6797",
+	0xF9F5: "\u6dcb", 0xF9F6: "\u81e8", 0xF9F7: "\u7acb", 0xF9F8: "\u7b20",
+	0xF9F9: "\u7c92", 0xF9FA: "\u72c0", 0xF9FB: "\u7099", 0xF9FC: "\u8b58",
+	0xF9FD: "\u4ec0", 0xF9FE: "\u8336", 0xF9FF: "\u523a", 0xFA00: "\u5207",
+	0xFA01: "\u5ea6", 0xFA02: "\u62d3", 0xFA03: "\u7cd6", 0xFA04: "\u5b85",
+	0xFA05: "\u6d1e", 0xFA06: "\u66b4", 0xFA07: "\u8f3b", 0xFA08: "\u884c",
+	0xFA09: "\u964d", 0xFA0A: "\u898b", 0xFA0B: "\u5ed3", 0xFA0C: "\u5140",
+	0xFA0D: "\u55c0", 0xFA10: "\u585a", 0xFA12: "\u6674", 0xFA15: "\u51de",
+	0xFA16: "\u732a", 0xFA17: "\u76ca", 0xFA18: "\u793c", 0xFA19: "\u795e",
+	0xFA1A: "\u7965", 0xFA1B: "\u798f", 0xFA1C: "\u9756", 0xFA1D: "\u7cbe",
+	0xFA1E: "\u7fbd", 0xFA20: "\u8612", 0xFA22: "\u8af8", 0xFA25: "\u9038",
+	0xFA26: "\u90fd", 0xFA2A: "\u98ef", 0xFA2B: "\u98fc", 0xFA2C: "\u9928",
+	0xFA2D: "\u9db4", 0xFA2E: "\u90de", 0xFA2F: "\u96b7", 0xFA30: "\u4fae",
+	0xFA31: "\u50e7", 0xFA32: "\u514d", 0xFA33: "\u52c9", 0xFA34: "\u52e4",
+	0xFA35: "\u5351", 0xFA36: "\u559d", 0xFA37: "\u5606", 0xFA38: "\u5668",
+	0xFA39: "\u5840", 0xFA3A: "\u58a8", 0xFA3B: "\u5c64", 0xFA3C: "\u5c6e",
+	0xFA3D: "\u6094", 0xFA3E: "\u6168", 0xFA3F: "\u618e", 0xFA40: "\u61f2",
+	0xFA41: "\u654f", 0xFA42: "\u65e2", 0xFA43: "\u6691", 0xFA44: "\u6885",
+	0xFA45: "\u6d77", 0xFA46: "\u6e1a", 0xFA47: "\u6f22", 0xFA48: "\u716e",
+	0xFA49: "\u722b", 0xFA4A: "\u7422", 0xFA4B: "\u7891", 0xFA4C: "\u793e",
+	0xFA4D: "\u7949", 0xFA4E: "\u7948", 0xFA4F: "\u7950", 0xFA50: "\u7956",
+	0xFA51: "\u795d", 0xFA52: "\u798d", 0xFA53: "\u798e", 0xFA54: "\u7a40",
+	0xFA55: "\u7a81", 0xFA56: "\u7bc0", 0xFA57: "\u7df4", 0xFA58: "\u7e09",
+	0xFA59: "\u7e41", 0xFA5A: "\u7f72", 0xFA5B: "\u8005", 0xFA5C: "\u81ed",
+	0xFA5D: "\u8279", 0xFA5E: "\u8279", 0xFA5F: "\u8457", 0xFA60: "\u8910",
+	0xFA61: "\u8996", 0xFA62: "\u8b01", 0xFA63: "\u8b39", 0xFA64: "\u8cd3",
+	0xFA65: "\u8d08", 0xFA66: "\u8fb6", 0xFA67: "\u9038", 0xFA68: "\u96e3",
+	0xFA69: "\u97ff", 0xFA6A: "\u983b", 0xFA6B: "\u6075", 0xFA6C: "\U000242ee",
+	0xFA6D: "\u8218", 0xFA70: "\u4e26", 0xFA71: "\u51b5", 0xFA72: "\u5168",
+	0xFA73: "\u4f80", 0xFA74: "\u5145", 0xFA75: "\u5180", 0xFA76: "\u52c7",
+	0xFA77: "\u52fa", 0xFA78: "\u559d", 0xFA79: "\u5555", 0xFA7A: "\u5599",
+	0xFA7B: "\u55e2", 0xFA7C: "\u585a", 0xFA7D: "\u58b3", 0xFA7E: "\u5944",
+	0xFA7F: "\u5954", 0xFA80: "\u5a62", 0xFA81: "\u5b28", 0xFA82: "\u5ed2",
+	0xFA83: "\u5ed9", 0xFA84: "\u5f69", 0xFA85: "\u5fad", 0xFA86: "\u60d8",
+	0xFA87: "\u614e", 0xFA88: "\u6108", 0xFA89: "\u618e", 0xFA8A: "\u6160",
+	0xFA8B: "\u61f2", 0xFA8C: "\u6234", 0xFA8D: "\u63c4", 0xFA8E: "\u641c",
+	0xFA8F: "\u6452", 0xFA90: "\u6556", 0xFA91: "\u6674", 0xFA92: "\u6717",
+	0xFA93: "\u671b", 0xFA94: "\u6756", 0xFA95: "\u6b79", 0xFA96: "\u6bba",
+	0xFA97: "\u6d41", 0xFA98: "\u6edb", 0xFA99: "\u6ecb", 0xFA9A: "\u6f22",
+	0xFA9B: "\u701e", 0xFA9C: "\u716e", 0xFA9D: "\u77a7", 0xFA9E: "\u7235",
+	0xFA9F: "\u72af", 0xFAA0: "\u732a", 0xFAA1: "\u7471", 0xFAA2: "\u7506",
+	0xFAA3: "\u753b", 0xFAA4: "\u761d", 0xFAA5: "\u761f", 0xFAA6: "\u76ca",
+	0xFAA7: "\u76db", 0xFAA8: "\u76f4", 0xFAA9: "\u774a", 0xFAAA: "\u7740",
+	0xFAAB: "\u78cc", 0xFAAC: "\u7ab1", 0xFAAD: "\u7bc0", 0xFAAE: "\u7c7b",
+	0xFAAF: "\u7d5b", 0xFAB0: "\u7df4", 0xFAB1: "\u7f3e", 0xFAB2: "\u8005",
+	0xFAB3: "\u8352", 0xFAB4: "\u83ef", 0xFAB5: "\u8779", 0xFAB6: "\u8941",
+	0xFAB7: "\u8986", 0xFAB8: "\u8996", 0xFAB9: "\u8abf", 0xFABA: "\u8af8",
+	0xFABB: "\u8acb", 0xFABC: "\u8b01", 0xFABD: "\u8afe", 0xFABE: "\u8aed",
+	0xFABF: "\u8b39", 0xFAC0: "\u8b8a", 0xFAC1: "\u8d08", 0xFAC2: "\u8f38",
+	0xFAC3: "\u9072", 0xFAC4: "\u9199", 0xFAC5: "\u9276", 0xFAC6: "\u967c",
+	0xFAC7: "\u96e3", 0xFAC8: "\u9756", 0xFAC9: "\u97db", 0xFACA: "\u97ff",
+	0xFACB: "\u980b", 0xFACC: "\u983b", 0xFACD: "\u9b12", 0xFACE: "\u9f9c",
+	0xFACF: "\U0002284a", 0xFAD0: "\U00022844", 0xFAD1: "\U000233d5", 0xFAD2: "\u3b9d",
+	0xFAD3: "\u4018", 0xFAD4: "\u4039", 0xFAD5: "\U00025249", 0xFAD6: "\U00025cd0",
+	0xFAD7: "\U00027ed3", 0xFAD8: "\u9f43", 0xFAD9: "\u9f8e", 0xFB1D: "\u05d9\u05b4",
+	0xFB1F: "\u05f2\u05b7", 0xFB2A: "\u05e9\u05c1", 0xFB2B: "\u05e9\u05c2", 0xFB2C: "\ufb49\u05c1",
+	0xFB2D: "\ufb49\u05c2", 0xFB2E: "\u05d0\u05b7", 0xFB2F: "\u05d0\u05b8", 0xFB30: "\u05d0\u05bc",
+	0xFB31: "\u05d1\u05bc", 0xFB32: "\u05d2\u05bc", 0xFB33: "\u05d3\u05bc", 0xFB34: "\u05d4\u05bc",
+	0xFB35: "\u05d5\u05bc", 0xFB36: "\u05d6\u05bc", 0xFB38: "\u05d8\u05bc", 0xFB39: "\u05d9\u05bc",
+	0xFB3A: "\u05da\u05bc", 0xFB3B: "\u05db\u05bc", 0xFB3C: "\u05dc\u05bc", 0xFB3E: "\u05de\u05bc",
+	0xFB40: "\u05e0\u05bc", 0xFB41: "\u05e1\u05bc", 0xFB43: "\u05e3\u05bc", 0xFB44: "\u05e4\u05bc",
+	0xFB46: "\u05e6\u05bc", 0xFB47: "\u05e7\u05bc", 0xFB48: "\u05e8\u05bc", 0xFB49: "\u05e9\u05bc",
+	0xFB4A: "\u05ea\u05bc", 0xFB4B: "\u05d5\u05b9", 0xFB4C: "\u05d1\u05bf", 0xFB4D: "\u05db\u05bf",
+	0xFB4E: "\u05e4\u05bf", 0x1109A: "\U00011099\U000110ba", 0x1109C: "\U0001109b\U000110ba", 0x110AB: "\U000110a5\U000110ba",
+	0x1112E: "\U00011131\U00011127", 0x1112F: "\U00011132\U00011127", 0x1134B: "\U00011347\U0001133e", 0x1134C: "\U00011347\U00011357",
+	0x114BB: "\U000114b9\U000114ba", 0x114BC: "\U000114b9\U000114b0", 0x114BE: "\U000114b9\U000114bd", 0x115BA: "\U000115b8\U000115af",
+	0x115BB: "\U000115b9\U000115af", 0x11938: "\U00011935\U00011930", 0x1D15E: "\U0001d157\U0001d165", 0x1D15F: "\U0001d158\U0001d165",
+	0x1D160: "\U0001d15f\U0001d16e", 0x1D161: "\U0001d15f\U0001d16f", 0x1D162: "\U0001d15f\U0001d170", 0x1D163: "\U0001d15f\U0001d171",
+	0x1D164: "\U0001d15f\U0001d172", 0x1D1BB: "\U0001d1b9\U0001d165", 0x1D1BC: "\U0001d1ba\U0001d165", 0x1D1BD: "\U0001d1bb\U0001d16e",
+	0x1D1BE: "\U0001d1bc\U0001d16e", 0x1D1BF: "\U0001d1bb\U0001d16f", 0x1D1C0: "\U0001d1bc\U0001d16f", 0x2F800: "\u4e3d",
+	0x2F801: "\u4e38", 0x2F802: "\u4e41", 0x2F803: "\U00020122", 0x2F804: "\u4f60",
+	0x2F805: "\u4fae", 0x2F806: "\u4fbb", 0x2F807: "\u5002", 0x2F808: "\u507a",
+	0x2F809: "\u5099", 0x2F80A: "\u50e7", 0x2F80B: "\u50cf", 0x2F80C: "\u349e",
+	0x2F80D: "\U0002063a", 0x2F80E: "\u514d", 0x2F80F: "\u5154", 0x2F810: "\u5164",
+	0x2F811: "\u5177", 0x2F812: "\U0002051c", 0x2F813: "\u34b9", 0x2F814: "\u5167",
+	0x2F815: "\u518d", 0x2F816: "\U0002054b", 0x2F817: "\u5197", 0x2F818: "\u51a4",
+	0x2F819: "\u4ecc", 0x2F81A: "\u51ac", 0x2F81B: "\u51b5", 0x2F81C: "\U000291df",
+	0x2F81D: "\u51f5", 0x2F81E: "\u5203", 0x2F81F: "\u34df", 0x2F820: "\u523b",
+	0x2F821: "\u5246", 0x2F822: "\u5272", 0x2F823: "\u5277", 0x2F824: "\u3515",
+	0x2F825: "\u52c7", 0x2F826: "\u52c9", 0x2F827: "\u52e4", 0x2F828: "\u52fa",
+	0x2F829: "\u5305", 0x2F82A: "\u5306", 0x2F82B: "\u5317", 0x2F82C: "\u5349",
+	0x2F82D: "\u5351", 0x2F82E: "\u535a", 0x2F82F: "\u5373", 0x2F830: "\u537d",
+	0x2F831: "\u537f", 0x2F832: "\u537f", 0x2F833: "\u537f", 0x2F834: "\U00020a2c",
+	0x2F835: "\u7070", 0x2F836: "\u53ca", 0x2F837: "\u53df", 0x2F838: "\U00020b63",
+	0x2F839: "\u53eb", 0x2F83A: "\u53f1", 0x2F83B: "\u5406", 0x2F83C: "\u549e",
+	0x2F83D: "\u5438", 0x2F83E: "\u5448", 0x2F83F: "\u5468", 0x2F840: "\u54a2",
+	0x2F841: "\u54f6", 0x2F842: "\u5510", 0x2F843: "\u5553", 0x2F844: "\u5563",
+	0x2F845: "\u5584", 0x2F846: "\u5584", 0x2F847: "\u5599", 0x2F848: "\u55ab",
+	0x2F849: "\u55b3", 0x2F84A: "\u55c2", 0x2F84B: "\u5716", 0x2F84C: "\u5606",
+	0x2F84D: "\u5717", 0x2F84E: "\u5651", 0x2F84F: "\u5674", 0x2F850: "\u5207",
+	0x2F851: "\u58ee", 0x2F852: "\u57ce", 0x2F853: "\u57f4", 0x2F854: "\u580d",
+	0x2F855: "\u578b", 0x2F856: "\u5832", 0x2F857: "\u5831", 0x2F858: "\u58ac",
+	0x2F859: "\U000214e4", 0x2F85A: "\u58f2", 0x2F85B: "\u58f7", 0x2F85C: "\u5906",
+	0x2F85D: "\u591a", 0x2F85E: "\u5922", 0x2F85F: "\u5962", 0x2F860: "\U000216a8",
+	0x2F861: "\U000216ea", 0x2F862: "\u59ec", 0x2F863: "\u5a1b", 0x2F864: "\u5a27",
+	0x2F865: "\u59d8", 0x2F866: "\u5a66", 0x2F867: "\u36ee", 0x2F868: "\u36fc",
+	0x2F869: "\u5b08", 0x2F86A: "\u5b3e", 0x2F86B: "\u5b3e", 0x2F86C: "\U000219c8",
+	0x2F86D: "\u5bc3", 0x2F86E: "\u5bd8", 0x2F86F: "\u5be7", 0x2F870: "\u5bf3",
+	0x2F871: "\U00021b18", 0x2F872: "\u5bff", 0x2F873: "\u5c06", 0x2F874: "\u5f53",
+	0x2F875: "\u5c22", 0x2F876: "\u3781", 0x2F877: "\u5c60", 0x2F878: "\u5c6e",
+	0x2F879: "\u5cc0", 0x2F87A: "\u5c8d", 0x2F87B: "\U00021de4", 0x2F87C: "\u5d43",
+	0x2F87D: "\U00021de6", 0x2F87E: "\u5d6e", 0x2F87F: "\u5d6b", 0x2F880: "\u5d7c",
+	0x2F881: "\u5de1", 0x2F882: "\u5de2", 0x2F883: "\u382f", 0x2F884: "\u5dfd",
+	0x2F885: "\u5e28", 0x2F886: "\u5e3d", 0x2F887: "\u5e69", 0x2F888: "\u3862",
+	0x2F889: "\U00022183", 0x2F88A: "\u387c", 0x2F88B: "\u5eb0", 0x2F88C: "\u5eb3",
+	0x2F88D: "\u5eb6", 0x2F88E: "\u5eca", 0x2F88F: "\U0002a392", 0x2F890: "\u5efe",
+	0x2F891: "\U00022331", 0x2F892: "\U00022331", 0x2F893: "\u8201", 0x2F894: "\u5f22",
+	0x2F895: "\u5f22", 0x2F896: "\u38c7", 0x2F897: "\U000232b8", 0x2F898: "\U000261da",
+	0x2F899: "\u5f62", 0x2F89A: "\u5f6b", 0x2F89B: "\u38e3", 0x2F89C: "\u5f9a",
+	0x2F89D: "\u5fcd", 0x2F89E: "\u5fd7", 0x2F89F: "\u5ff9", 0x2F8A0: "\u6081",
+	0x2F8A1: "\u393a", 0x2F8A2: "\u391c", 0x2F8A3: "\u6094", 0x2F8A4: "\U000226d4",
+	0x2F8A5: "\u60c7", 0x2F8A6: "\u6148", 0x2F8A7: "\u614c", 0x2F8A8: "\u614e",
+	0x2F8A9: "\u614c", 0x2F8AA: "\u617a", 0x2F8AB: "\u618e", 0x2F8AC: "\u61b2",
+	0x2F8AD: "\u61a4", 0x2F8AE: "\u61af", 0x2F8AF: "\u61de", 0x2F8B0: "\u61f2",
+	0x2F8B1: "\u61f6", 0x2F8B2: "\u6210", 0x2F8B3: "\u621b", 0x2F8B4: "\u625d",
+	0x2F8B5: "\u62b1", 0x2F8B6: "\u62d4", 0x2F8B7: "\u6350", 0x2F8B8: "\U00022b0c",
+	0x2F8B9: "\u633d", 0x2F8BA: "\u62fc", 0x2F8BB: "\u6368", 0x2F8BC: "\u6383",
+	0x2F8BD: "\u63e4", 0x2F8BE: "\U00022bf1", 0x2F8BF: "\u6422", 0x2F8C0: "\u63c5",
+	0x2F8C1: "\u63a9", 0x2F8C2: "\u3a2e", 0x2F8C3: "\u6469", 0x2F8C4: "\u647e",
+	0x2F8C5: "\u649d", 0x2F8C6: "\u6477", 0x2F8C7: "\u3a6c", 0x2F8C8: "\u654f",
+	0x2F8C9: "\u656c", 0x2F8CA: "\U0002300a", 0x2F8CB: "\u65e3", 0x2F8CC: "\u66f8",
+	0x2F8CD: "\u6649", 0x2F8CE: "\u3b19", 0x2F8CF: "\u6691", 0x2F8D0: "\u3b08",
+	0x2F8D1: "\u3ae4", 0x2F8D2: "\u5192", 0x2F8D3: "\u5195", 0x2F8D4: "\u6700",
+	0x2F8D5: "\u669c", 0x2F8D6: "\u80ad", 0x2F8D7: "\u43d9", 0x2F8D8: "\u6717",
+	0x2F8D9: "\u671b", 0x2F8DA: "\u6721", 0x2F8DB: "\u675e", 0x2F8DC: "\u6753",
+	0x2F8DD: "\U000233c3", 0x2F8DE: "\u3b49", 0x2F8DF: "\u67fa", 0x2F8E0: "\u6785",
+	0x2F8E1: "\u6852", 0x2F8E2: "\u6885", 0x2F8E3: "\U0002346d", 0x2F8E4: "\u688e",
+	0x2F8E5: "\u681f", 0x2F8E6: "\u6914", 0x2F8E7: "\u3b9d", 0x2F8E8: "\u6942",
+	0x2F8E9: "\u69a3", 0x2F8EA: "\u69ea", 0x2F8EB: "\u6aa8", 0x2F8EC: "\U000236a3",
+	0x2F8ED: "\u6adb", 0x2F8EE: "\u3c18", 0x2F8EF: "\u6b21", 0x2F8F0: "\U000238a7",
+	0x2F8F1: "\u6b54", 0x2F8F2: "\u3c4e", 0x2F8F3: "\u6b72", 0x2F8F4: "\u6b9f",
+	0x2F8F5: "\u6bba", 0x2F8F6: "\u6bbb", 0x2F8F7: "\U00023a8d", 0x2F8F8: "\U00021d0b",
+	0x2F8F9: "\U00023afa", 0x2F8FA: "\u6c4e", 0x2F8FB: "\U00023cbc", 0x2F8FC: "\u6cbf",
+	0x2F8FD: "\u6ccd", 0x2F8FE: "\u6c67", 0x2F8FF: "\u6d16", 0x2F900: "\u6d3e",
+	0x2F901: "\u6d77", 0x2F902: "\u6d41", 0x2F903: "\u6d69", 0x2F904: "\u6d78",
+	0x2F905: "\u6d85", 0x2F906: "\U00023d1e", 0x2F907: "\u6d34", 0x2F908: "\u6e2f",
+	0x2F909: "\u6e6e", 0x2F90A: "\u3d33", 0x2F90B: "\u6ecb", 0x2F90C: "\u6ec7",
+	0x2F90D: "\U00023ed1", 0x2F90E: "\u6df9", 0x2F90F: "\u6f6e", 0x2F910: "\U00023f5e",
+	0x2F911: "\U00023f8e", 0x2F912: "\u6fc6", 0x2F913: "\u7039", 0x2F914: "\u701e",
+	0x2F915: "\u701b", 0x2F916: "\u3d96", 0x2F917: "\u704a", 0x2F918: "\u707d",
+	0x2F919: "\u7077", 0x2F91A: "\u70ad", 0x2F91B: "\U00020525", 0x2F91C: "\u7145",
+	0x2F91D: "\U00024263", 0x2F91E: "\u719c", 0x2F91F: "\U000243ab", 0x2F920: "\u7228",
+	0x2F921: "\u7235", 0x2F922: "\u7250", 0x2F923: "\U00024608", 0x2F924: "\u7280",
+	0x2F925: "\u7295", 0x2F926: "\U00024735", 0x2F927: "\U00024814", 0x2F928: "\u737a",
+	0x2F929: "\u738b", 0x2F92A: "\u3eac", 0x2F92B: "\u73a5", 0x2F92C: "\u3eb8",
+	0x2F92D: "\u3eb8", 0x2F92E: "\u7447", 0x2F92F: "\u745c", 0x2F930: "\u7471",
+	0x2F931: "\u7485", 0x2F932: "\u74ca", 0x2F933: "\u3f1b", 0x2F934: "\u7524",
+	0x2F935: "\U00024c36", 0x2F936: "\u753e", 0x2F937: "\U00024c92", 0x2F938: "\u7570",
+	0x2F939: "\U0002219f", 0x2F93A: "\u7610", 0x2F93B: "\U00024fa1", 0x2F93C: "\U00024fb8",
+	0x2F93D: "\U00025044", 0x2F93E: "\u3ffc", 0x2F93F: "\u4008", 0x2F940: "\u76f4",
+	0x2F941: "\U000250f3", 0x2F942: "\U000250f2", 0x2F943: "\U00025119", 0x2F944: "\U00025133",
+	0x2F945: "\u771e", 0x2F946: "\u771f", 0x2F947: "\u771f", 0x2F948: "\u774a",
+	0x2F949: "\u4039", 0x2F94A: "\u778b", 0x2F94B: "\u4046", 0x2F94C: "\u4096",
+	0x2F94D: "\U0002541d", 0x2F94E: "\u784e", 0x2F94F: "\u788c", 0x2F950: "\u78cc",
+	0x2F951: "\u40e3", 0x2F952: "\U00025626", 0x2F953: "\u7956", 0x2F954: "\U0002569a",
+	0x2F955: "\U000256c5", 0x2F956: "\u798f", 0x2F957: "\u79eb", 0x2F958: "\u412f",
+	0x2F959: "\u7a40", 0x2F95A: "\u7a4a", 0x2F95B: "\u7a4f", 0x2F95C: "\U0002597c",
+	0x2F95D: "\U00025aa7", 0x2F95E: "\U00025aa7", 0x2F95F: "\u7aee", 0x2F960: "\u4202",
+	0x2F961: "\U00025bab", 0x2F962: "\u7bc6", 0x2F963: "\u7bc9", 0x2F964: "\u4227",
+	0x2F965: "\U00025c80", 0x2F966: "\u7cd2", 0x2F967: "\u42a0", 0x2F968: "\u7ce8",
+	0x2F969: "\u7ce3", 0x2F96A: "\u7d00", 0x2F96B: "\U00025f86", 0x2F96C: "\u7d63",
+	0x2F96D: "\u4301", 0x2F96E: "\u7dc7", 0x2F96F: "\u7e02", 0x2F970: "\u7e45",
+	0x2F971: "\u4334", 0x2F972: "\U00026228", 0x2F973: "\U00026247", 0x2F974: "\u4359",
+	0x2F975: "\U000262d9", 0x2F976: "\u7f7a", 0x2F977: "\U0002633e", 0x2F978: "\u7f95",
+	0x2F979: "\u7ffa", 0x2F97A: "\u8005", 0x2F97B: "\U000264da", 0x2F97C: "\U00026523",
+	0x2F97D: "\u8060", 0x2F97E: "\U000265a8", 0x2F97F: "\u8070", 0x2F980: "\U0002335f",
+	0x2F981: "\u43d5", 0x2F982: "\u80b2", 0x2F983: "\u8103", 0x2F984: "\u440b",
+	0x2F985: "\u813e", 0x2F986: "\u5ab5", 0x2F987: "\U000267a7", 0x2F988: "\U000267b5",
+	0x2F989: "\U00023393", 0x2F98A: "\U0002339c", 0x2F98B: "\u8201", 0x2F98C: "\u8204",
+	0x2F98D: "\u8f9e", 0x2F98E: "\u446b", 0x2F98F: "\u8291", 0x2F990: "\u828b",
+	0x2F991: "\u829d", 0x2F992: "\u52b3", 0x2F993: "\u82b1", 0x2F994: "\u82b3",
+	0x2F995: "\u82bd", 0x2F996: "\u82e6", 0x2F997: "\U00026b3c", 0x2F998: "\u82e5",
+	0x2F999: "\u831d", 0x2F99A: "\u8363", 0x2F99B: "\u83ad", 0x2F99C: "\u8323",
+	0x2F99D: "\u83bd", 0x2F99E: "\u83e7", 0x2F99F: "\u8457", 0x2F9A0: "\u8353",
+	0x2F9A1: "\u83ca", 0x2F9A2: "\u83cc", 0x2F9A3: "\u83dc", 0x2F9A4: "\U00026c36",
+	0x2F9A5: "\U00026d6b", 0x2F9A6: "\U00026cd5", 0x2F9A7: "\u452b", 0x2F9A8: "\u84f1",
+	0x2F9A9: "\u84f3", 0x2F9AA: "\u8516", 0x2F9AB: "\U000273ca", 0x2F9AC: "\u8564",
+	0x2F9AD: "\U00026f2c", 0x2F9AE: "\u455d", 0x2F9AF: "\u4561", 0x2F9B0: "\U00026fb1",
+	0x2F9B1: "\U000270d2", 0x2F9B2: "\u456b", 0x2F9B3: "\u8650", 0x2F9B4: "\u865c",
+	0x2F9B5: "\u8667", 0x2F9B6: "\u8669", 0x2F9B7: "\u86a9", 0x2F9B8: "\u8688",
+	0x2F9B9: "\u870e", 0x2F9BA: "\u86e2", 0x2F9BB: "\u8779", 0x2F9BC: "\u8728",
+	0x2F9BD: "\u876b", 0x2F9BE: "\u8786", 0x2F9BF: "\u45d7", 0x2F9C0: "\u87e1",
+	0x2F9C1: "\u8801", 0x2F9C2: "\u45f9", 0x2F9C3: "\u8860", 0x2F9C4: "\u8863",
+	0x2F9C5: "\U00027667", 0x2F9C6: "\u88d7", 0x2F9C7: "\u88de", 0x2F9C8: "\u4635",
+	0x2F9C9: "\u88fa", 0x2F9CA: "\u34bb", 0x2F9CB: "\U000278ae", 0x2F9CC: "\U00027966",
+	0x2F9CD: "\u46be", 0x2F9CE: "\u46c7", 0x2F9CF: "\u8aa0", 0x2F9D0: "\u8aed",
+	0x2F9D1: "\u8b8a", 0x2F9D2: "\u8c55", 0x2F9D3: "\U00027ca8", 0x2F9D4: "\u8cab",
+	0x2F9D5: "\u8cc1", 0x2F9D6: "\u8d1b", 0x2F9D7: "\u8d77", 0x2F9D8: "\U00027f2f",
+	0x2F9D9: "\U00020804", 0x2F9DA: "\u8dcb", 0x2F9DB: "\u8dbc", 0x2F9DC: "\u8df0",
+	0x2F9DD: "\U000208de", 0x2F9DE: "\u8ed4", 0x2F9DF: "\u8f38", 0x2F9E0: "\U000285d2",
+	0x2F9E1: "\U000285ed", 0x2F9E2: "\u9094", 0x2F9E3: "\u90f1", 0x2F9E4: "\u9111",
+	0x2F9E5: "\U0002872e", 0x2F9E6: "\u911b", 0x2F9E7: "\u9238", 0x2F9E8: "\u92d7",
+	0x2F9E9: "\u92d8", 0x2F9EA: "\u927c", 0x2F9EB: "\u93f9", 0x2F9EC: "\u9415",
+	0x2F9ED: "\U00028bfa", 0x2F9EE: "\u958b", 0x2F9EF: "\u4995", 0x2F9F0: "\u95b7",
+	0x2F9F1: "\U00028d77", 0x2F9F2: "\u49e6", 0x2F9F3: "\u96c3", 0x2F9F4: "\u5db2",
+	0x2F9F5: "\u9723", 0x2F9F6: "\U00029145", 0x2F9F7: "\U0002921a", 0x2F9F8: "\u4a6e",
+	0x2F9F9: "\u4a76", 0x2F9FA: "\u97e0", 0x2F9FB: "\U0002940a", 0x2F9FC: "\u4ab2",
+	0x2F9FD: "\U00029496", 0x2F9FE: "\u980b", 0x2F9FF: "\u980b", 0x2FA00: "\u9829",
+	0x2FA01: "\U000295b6", 0x2FA02: "\u98e2", 0x2FA03: "\u4b33", 0x2FA04: "\u9929",
+	0x2FA05: "\u99a7", 0x2FA06: "\u99c2", 0x2FA07: "\u99fe", 0x2FA08: "\u4bce",
+	0x2FA09: "\U00029b30", 0x2FA0A: "\u9b12", 0x2FA0B: "\u9c40", 0x2FA0C: "\u9cfd",
+	0x2FA0D: "\u4cce", 0x2FA0E: "\u4ced", 0x2FA0F: "\u9d67", 0x2FA10: "\U0002a0ce",
+	0x2FA11: "\u4cf8", 0x2FA12: "\U0002a105", 0x2FA13: "\U0002a20e", 0x2FA14: "\U0002a291",
+	0x2FA15: "\u9ebb", 0x2FA16: "\u4d56", 0x2FA17: "\u9ef9", 0x2FA18: "\u9efe",
+	0x2FA19: "\u9f05", 0x2FA1A: "\u9f0f", 0x2FA1B: "\u9f16", 0x2FA1C: "\u9f3b",
+	0x2FA1D: "\U0002a600",
+}
+
+// compatibilityDecompositions map runes to the decompositions which only the
+// compatibility forms use, which may decompose further in turn
+var compatibilityDecompositions = map[rune]string{
+	0x00A0: " ", 0x00A8: " \u0308", 0x00AA: "a", 0x00AF: " \u0304",
+	0x00B2: "2", 0x00B3: "3", 0x00B4: " \u0301", 0x00B5: "\u03bc",
+	0x00B8: " \u0327", 0x00B9: "1", 0x00BA: "o", 0x00BC: "1\u20444",
+	0x00BD: "1\u20442", 0x00BE: "3\u20444", 0x0132: "IJ", 0x0133: "ij",
+	0x013F: "L\u00b7", 0x0140: "l\u00b7", 0x0149: "\u02bcn", 0x017F: "s",
+	0x01C4: "D\u017d", 0x01C5: "D\u017e", 0x01C6: "d\u017e", 0x01C7: "LJ",
+	0x01C8: "Lj", 0x01C9: "lj", 0x01CA: "NJ", 0x01CB: "Nj",
+	0x01CC: "nj", 0x01F1: "DZ", 0x01F2: "Dz", 0x01F3: "dz",
+	0x02B0: "h", 0x02B1: "\u0266", 0x02B2: "j", 0x02B3: "r",
+	0x02B4: "\u0279", 0x02B5: "\u027b", 0x02B6: "\u0281", 0x02B7: "w",
+	0x02B8: "y", 0x02D8: " \u0306", 0x02D9: " \u0307", 0x02DA: " \u030a",
+	0x02DB: " \u0328", 0x02DC: " \u0303", 0x02DD: " \u030b", 0x02E0: "\u0263",
+	0x02E1: "l", 0x02E2: "s", 0x02E3: "x", 0x02E4: "\u0295",
+	0x037A: " \u0345", 0x0384: " \u0301", 0x03D0: "\u03b2", 0x03D1: "\u03b8",
+	0x03D2: "\u03a5", 0x03D5: "\u03c6", 0x03D6: "\u03c0", 0x03F0: "\u03ba",
+	0x03F1: "\u03c1", 0x03F2: "\u03c2", 0x03F4: "\u0398", 0x03F5: "\u03b5",
+	0x03F9: "\u03a3", 0x0587: "\u0565\u0582", 0x0675: "\u0627\u0674", 0x0676: "\u0648\u0674",
+	0x0677: "\u06c7\u0674", 0x0678: "\u064a\u0674", 0x0E33: "\u0e4d\u0e32", 0x0EB3: "\u0ecd\u0eb2",
+	0x0EDC: "\u0eab\u0e99", 0x0EDD: "\u0eab\u0ea1", 0x0F0C: "\u0f0b", 0x0F77: "\u0fb2\u0f81",
+	0x0F79: "\u0fb3\u0f81", 0x10FC: "\u10dc", 0x1D2C: "A", 0x1D2D: "\u00c6",
+	0x1D2E: "B", 0x1D30: "D", 0x1D31: "E", 0x1D32: "\u018e",
+	0x1D33: "G", 0x1D34: "H", 0x1D35: "I", 0x1D36: "J",
+	0x1D37: "K", 0x1D38: "L", 0x1D39: "M", 0x1D3A: "N",
+	0x1D3C: "O", 0x1D3D: "\u0222", 0x1D3E: "P", 0x1D3F: "R",
+	0x1D40: "T", 0x1D41: "U", 0x1D42: "W", 0x1D43: "a",
+	0x1D44: "\u0250", 0x1D45: "\u0251", 0x1D46: "\u1d02", 0x1D47: "b",
+	0x1D48: "d", 0x1D49: "e", 0x1D4A: "\u0259", 0x1D4B: "\u025b",
+	0x1D4C: "\u025c", 0x1D4D: "g", 0x1D4F: "k", 0x1D50: "m",
+	0x1D51: "\u014b", 0x1D52: "o", 0x1D53: "\u0254", 0x1D54: "\u1d16",
+	0x1D55: "\u1d17", 0x1D56: "p", 0x1D57: "t", 0x1D58: "u",
+	0x1D59: "\u1d1d", 0x1D5A: "\u026f", 0x1D5B: "v", 0x1D5C: "\u1d25",
+	0x1D5D: "\u03b2", 0x1D5E: "\u03b3", 0x1D5F: "\u03b4", 0x1D60: "\u03c6",
+	0x1D61: "\u03c7", 0x1D62: "i", 0x1D63: "r", 0x1D64: "u",
+	0x1D65: "v", 0x1D66: "\u03b2", 0x1D67: "\u03b3", 0x1D68: "\u03c1",
+	0x1D69: "\u03c6", 0x1D6A: "\u03c7", 0x1D78: "\u043d", 0x1D9B: "\u0252",
+	0x1D9C: "c", 0x1D9D: "\u0255", 0x1D9E: "\u00f0", 0x1D9F: "\u025c",
+	0x1DA0: "f", 0x1DA1: "\u025f", 0x1DA2: "\u0261", 0x1DA3: "\u0265",
+	0x1DA4: "\u0268", 0x1DA5: "\u0269", 0x1DA6: "\u026a", 0x1DA7: "\u1d7b",
+	0x1DA8: "\u029d", 0x1DA9: "\u026d", 0x1DAA: "\u1d85", 0x1DAB: "\u029f",
+	0x1DAC: "\u0271", 0x1DAD: "\u0270", 0x1DAE: "\u0272", 0x1DAF: "\u0273",
+	0x1DB0: "\u0274", 0x1DB1: "\u0275", 0x1DB2: "\u0278", 0x1DB3: "\u0282",
+	0x1DB4: "\u0283", 0x1DB5: "\u01ab", 0x1DB6: "\u0289", 0x1DB7: "\u028a",
+	0x1DB8: "\u1d1c", 0x1DB9: "\u028b", 0x1DBA: "\u028c", 0x1DBB: "z",
+	0x1DBC: "\u0290", 0x1DBD: "\u0291", 0x1DBE: "\u0292", 0x1DBF: "\u03b8",
+	0x1E9A: "a\u02be", 0x1FBD: " \u0313", 0x1FBF: " \u0313", 0x1FC0: " \u0342",
+	0x1FFE: " \u0314", 0x2002: " ", 0x2003: " ", 0x2004: " ",
+	0x2005: " ", 0x2006: " ", 0x2007: " ", 0x2008: " ",
+	0x2009: " ", 0x200A: " ", 0x2011: "\u2010", 0x2017: " \u0333",
+	0x2024: ".", 0x2025: "..", 0x2026: "...", 0x202F: " ",
+	0x2033: "\u2032\u2032", 0x2034: "\u2032\u2032\u2032", 0x2036: "\u2035\u2035", 0x2037: "\u2035\u2035\u2035",
+	0x203C: "!!", 0x203E: " \u0305", 0x2047: "??", 0x2048: "?!",
+	0x2049: "!?", 0x2057: "\u2032\u2032\u2032\u2032", 0x205F: " ", 0x2070: "0",
+	0x2071: "i", 0x2074: "4", 0x2075: "5", 0x2076: "6",
+	0x2077: "7", 0x2078: "8", 0x2079: "9", 0x207A: "+",
+	0x207B: "\u2212", 0x207C: "=", 0x207D: "(", 0x207E: ")",
+	0x207F: "n", 0x2080: "0", 0x2081: "1", 0x2082: "2",
+	0x2083: "3", 0x2084: "4", 0x2085: "5", 0x2086: "6",
+	0x2087: "7", 0x2088: "8", 0x2089: "9", 0x208A: "+",
+	0x208B: "\u2212", 0x208C: "=", 0x208D: "(", 0x208E: ")",
+	0x2090: "a", 0x2091: "e", 0x2092: "o", 0x2093: "x",
+	0x2094: "\u0259", 0x2095: "h", 0x2096: "k", 0x2097: "l",
+	0x2098: "m", 0x2099: "n", 0x209A: "p", 0x209B: "s",
+	0x209C: "t", 0x20A8: "Rs", 0x2100: "a/c", 0x2101: "a/s",
+	0x2102: "C", 0x2103: "\u00b0C", 0x2105: "c/o", 0x2106: "c/u",
+	0x2107: "\u0190", 0x2109: "\u00b0F", 0x210A: "g", 0x210B: "H",
+	0x210C: "H", 0x210D: "H", 0x210E: "h", 0x210F: "\u0127",
+	0x2110: "I", 0x2111: "I", 0x2112: "L", 0x2113: "l",
+	0x2115: "N", 0x2116: "No", 0x2119: "P", 0x211A: "Q",
+	0x211B: "R", 0x211C: "R", 0x211D: "R", 0x2120: "SM",
+	0x2121: "TEL", 0x2122: "TM", 0x2124: "Z", 0x2128: "Z",
+	0x212C: "B", 0x212D: "C", 0x212F: "e", 0x2130: "E",
+	0x2131: "F", 0x2133: "M", 0x2134: "o", 0x2135: "\u05d0",
+	0x2136: "\u05d1", 0x2137: "\u05d2", 0x2138: "\u05d3", 0x2139: "i",
+	0x213B: "FAX", 0x213C: "\u03c0", 0x213D: "\u03b3", 0x213E: "\u0393",
+	0x213F: "\u03a0", 0x2140: "\u2211", 0x2145: "D", 0x2146: "d",
+	0x2147: "e", 0x2148: "i", 0x2149: "j", 0x2150: "1\u20447",
+	0x2151: "1\u20449", 0x2152: "1\u204410", 0x2153: "1\u20443", 0x2154: "2\u20443",
+	0x2155: "1\u20445", 0x2156: "2\u20445", 0x2157: "3\u20445", 0x2158: "4\u20445",
+	0x2159: "1\u20446", 0x215A: "5\u20446", 0x215B: "1\u20448", 0x215C: "3\u20448",
+	0x215D: "5\u20448", 0x215E: "7\u20448", 0x215F: "1\u2044", 0x2160: "I",
+	0x2161: "II", 0x2162: "III", 0x2163: "IV", 0x2164: "V",
+	0x2165: "VI", 0x2166: "VII", 0x2167: "VIII", 0x2168: "IX",
+	0x2169: "X", 0x216A: "XI", 0x216B: "XII", 0x216C: "L",
+	0x216D: "C", 0x216E: "D", 0x216F: "M", 0x2170: "i",
+	0x2171: "ii", 0x2172: "iii", 0x2173: "iv", 0x2174: "v",
+	0x2175: "vi", 0x2176: "vii", 0x2177: "viii", 0x2178: "ix",
+	0x2179: "x", 0x217A: "xi", 0x217B: "xii", 0x217C: "l",
+	0x217D: "c", 0x217E: "d", 0x217F: "m", 0x2189: "0\u20443",
+	0x222C: "\u222b\u222b", 0x222D: "\u222b\u222b\u222b", 0x222F: "\u222e\u222e", 0x2230: "\u222e\u222e\u222e",
+	0x2460: "1", 0x2461: "2", 0x2462: "3", 0x2463: "4",
+	0x2464: "5", 0x2465: "6", 0x2466: "7", 0x2467: "8",
+	0x2468: "9", 0x2469: "10", 0x246A: "11", 0x246B: "12",
+	0x246C: "13", 0x246D: "14", 0x246E: "15", 0x246F: "16",
+	0x2470: "17", 0x2471: "18", 0x2472: "19", 0x2473: "20",
+	0x2474: "(1)", 0x2475: "(2)", 0x2476: "(3)", 0x2477: "(4)",
+	0x2478: "(5)", 0x2479: "(6)", 0x247A: "(7)", 0x247B: "(8)",
+	0x247C: "(9)", 0x247D: "(10)", 0x247E: "(11)", 0x247F: "(12)",
+	0x2480: "(13)", 0x2481: "(14)", 0x2482: "(15)", 0x2483: "(16)",
+	0x2484: "(17)", 0x2485: "(18)", 0x2486: "(19)", 0x2487: "(20)",
+	0x2488: "1.", 0x2489: "2.", 0x248A: "3.", 0x248B: "4.",
+	0x248C: "5.", 0x248D: "6.", 0x248E: "7.", 0x248F: "8.",
+	0x2490: "9.", 0x2491: "10.", 0x2492: "11.", 0x2493: "12.",
+	0x2494: "13.", 0x2495: "14.", 0x2496: "15.", 0x2497: "16.",
+	0x2498: "17.", 0x2499: "18.", 0x249A: "19.", 0x249B: "20.",
+	0x249C: "(a)", 0x249D: "(b)", 0x249E: "(c)", 0x249F: "(d)",
+	0x24A0: "(e)", 0x24A1: "(f)", 0x24A2: "(g)", 0x24A3: "(h)",
+	0x24A4: "(i)", 0x24A5: "(j)", 0x24A6: "(k)", 0x24A7: "(l)",
+	0x24A8: "(m)", 0x24A9: "(n)", 0x24AA: "(o)", 0x24AB: "(p)",
+	0x24AC: "(q)", 0x24AD: "(r)", 0x24AE: "(s)", 0x24AF: "(t)",
+	0x24B0: "(u)", 0x24B1: "(v)", 0x24B2: "(w)", 0x24B3: "(x)",
+	0x24B4: "(y)", 0x24B5: "(z)", 0x24B6: "A", 0x24B7: "B",
+	0x24B8: "C", 0x24B9: "D", 0x24BA: "E", 0x24BB: "F",
+	0x24BC: "G", 0x24BD: "H", 0x24BE: "I", 0x24BF: "J",
+	0x24C0: "K", 0x24C1: "L", 0x24C2: "M", 0x24C3: "N",
+	0x24C4: "O", 0x24C5: "P", 0x24C6: "Q", 0x24C7: "R",
+	0x24C8: "S", 0x24C9: "T", 0x24CA: "U", 0x24CB: "V",
+	0x24CC: "W", 0x24CD: "X", 0x24CE: "Y", 0x24CF: "Z",
+	0x24D0: "a", 0x24D1: "b", 0x24D2: "c", 0x24D3: "d",
+	0x24D4: "e", 0x24D5: "f", 0x24D6: "g", 0x24D7: "h",
+	0x24D8: "i", 0x24D9: "j", 0x24DA: "k", 0x24DB: "l",
+	0x24DC: "m", 0x24DD: "n", 0x24DE: "o", 0x24DF: "p",
+	0x24E0: "q", 0x24E1: "r", 0x24E2: "s", 0x24E3: "t",
+	0x24E4: "u", 0x24E5: "v", 0x24E6: "w", 0x24E7: "x",
+	0x24E8: "y", 0x24E9: "z", 0x24EA: "0", 0x2A0C: "\u222b\u222b\u222b\u222b",
+	0x2A74: "::=", 0x2A75: "==", 0x2A76: "===", 0x2C7C: "j",
+	0x2C7D: "V", 0x2D6F: "\u2d61", 0x2E9F: "\u6bcd", 0x2EF3: "\u9f9f",
+	0x2F00: "\u4e00", 0x2F01: "\u4e28", 0x2F02: "\u4e36", 0x2F03: "\u4e3f",
+	0x2F04: "\u4e59", 0x2F05: "\u4e85", 0x2F06: "\u4e8c", 0x2F07: "\u4ea0",
+	0x2F08: "\u4eba", 0x2F09: "\u513f", 0x2F0A: "\u5165", 0x2F0B: "\u516b",
+	0x2F0C: "\u5182", 0x2F0D: "\u5196", 0x2F0E: "\u51ab", 0x2F0F: "\u51e0",
+	0x2F10: "\u51f5", 0x2F11: "\u5200", 0x2F12: "\u529b", 0x2F13: "\u52f9",
+	0x2F14: "\u5315", 0x2F15: "\u531a", 0x2F16: "\u5338", 0x2F17: "\u5341",
+	0x2F18: "\u535c", 0x2F19: "\u5369", 0x2F1A: "\u5382", 0x2F1B: "\u53b6",
+	0x2F1C: "\u53c8", 0x2F1D: "\u53e3", 0x2F1E: "\u56d7", 0x2F1F: "\u571f",
+	0x2F20: "\u58eb", 0x2F21: "\u5902", 0x2F22: "\u590a", 0x2F23: "\u5915",
+	0x2F24: "\u5927", 0x2F25: "\u5973", 0x2F26: "\u5b50", 0x2F27: "\u5b80",
+	0x2F28: "\u5bf8", 0x2F29: "\u5c0f", 0x2F2A: "\u5c22", 0x2F2B: "\u5c38",
+	0x2F2C: "\u5c6e", 0x2F2D: "\u5c71", 0x2F2E: "\u5ddb", 0x2F2F: "\u5de5",
+	0x2F30: "\u5df1", 0x2F31: "\u5dfe", 0x2F32: "\u5e72", 0x2F33: "\u5e7a",
+	0x2F34: "\u5e7f", 0x2F35: "\u5ef4", 0x2F36: "\u5efe", 0x2F37: "\u5f0b",
+	0x2F38: "\u5f13", 0x2F39: "\u5f50", 0x2F3A: "\u5f61", 0x2F3B: "\u5f73",
+	0x2F3C: "\u5fc3", 0x2F3D: "\u6208", 0x2F3E: "\u6236", 0x2F3F: "\u624b",
+	0x2F40: "\u652f", 0x2F41: "\u6534", 0x2F42: "\u6587", 0x2F43: "\u6597",
+	0x2F44: "\u65a4", 0x2F45: "\u65b9", 0x2F46: "\u65e0", 0x2F47: "\u65e5",
+	0x2F48: "\u66f0", 0x2F49: "\u6708", 0x2F4A: "\u6728", 0x2F4B: "\u6b20",
+	0x2F4C: "\u6b62", 0x2F4D: "\u6b79", 0x2F4E: "\u6bb3", 0x2F4F: "\u6bcb",
+	0x2F50: "\u6bd4", 0x2F51: "\u6bdb", 0x2F52: "\u6c0f", 0x2F53: "\u6c14",
+	0x2F54: "\u6c34", 0x2F55: "\u706b", 0x2F56: "\u722a", 0x2F57: "\u7236",
+	0x2F58: "\u723b", 0x2F59: "\u723f", 0x2F5A: "\u7247", 0x2F5B: "\u7259",
+	0x2F5C: "\u725b", 0x2F5D: "\u72ac", 0x2F5E: "\u7384", 0x2F5F: "\u7389",
+	0x2F60: "\u74dc", 0x2F61: "\u74e6", 0x2F62: "\u7518", 0x2F63: "\u751f",
+	0x2F64: "\u7528", 0x2F65: "\u7530", 0x2F66: "\u758b", 0x2F67: "\u7592",
+	0x2F68: "\u7676", 0x2F69: "\u767d", 0x2F6A: "\u76ae", 0x2F6B: "\u76bf",
+	0x2F6C: "\u76ee", 0x2F6D: "\u77db", 0x2F6E: "\u77e2", 0x2F6F: "\u77f3",
+	0x2F70: "\u793a", 0x2F71: "\u79b8", 0x2F72: "\u79be", 0x2F73: "\u7a74",
+	0x2F74: "\u7acb", 0x2F75: "\u7af9", 0x2F76: "\u7c73", 0x2F77: "\u7cf8",
+	0x2F78: "\u7f36", 0x2F79: "\u7f51", 0x2F7A: "\u7f8a", 0x2F7B: "\u7fbd",
+	0x2F7C: "\u8001", 0x2F7D: "\u800c", 0x2F7E: "\u8012", 0x2F7F: "\u8033",
+	0x2F80: "\u807f", 0x2F81: "\u8089", 0x2F82: "\u81e3", 0x2F83: "\u81ea",
+	0x2F84: "\u81f3", 0x2F85: "\u81fc", 0x2F86: "\u820c", 0x2F87: "\u821b",
+	0x2F88: "\u821f", 0x2F89: "\u826e", 0x2F8A: "\u8272", 0x2F8B: "\u8278",
+	0x2F8C: "\u864d", 0x2F8D: "\u866b", 0x2F8E: "\u8840", 0x2F8F: "\u884c",
+	0x2F90: "\u8863", 0x2F91: "\u897e", 0x2F92: "\u898b", 0x2F93: "\u89d2",
+	0x2F94: "\u8a00", 0x2F95: "\u8c37", 0x2F96: "\u8c46", 0x2F97: "\u8c55",
+	0x2F98: "\u8c78", 0x2F99: "\u8c9d", 0x2F9A: "\u8d64", 0x2F9B: "\u8d70",
+	0x2F9C: "\u8db3", 0x2F9D: "\u8eab", 0x2F9E: "\u8eca", 0x2F9F: "\u8f9b",
+	0x2FA0: "\u8fb0", 0x2FA1: "\u8fb5", 0x2FA2: "\u9091", 0x2FA3: "\u9149",
+	0x2FA4: "\u91c6", 0x2FA5: "\u91cc", 0x2FA6: "\u91d1", 0x2FA7: "\u9577",
+	0x2FA8: "\u9580", 0x2FA9: "\u961c", 0x2FAA: "\u96b6", 0x2FAB: "\u96b9",
+	0x2FAC: "\u96e8", 0x2FAD: "\u9751", 0x2FAE: "\u975e", 0x2FAF: "\u9762",
+	0x2FB0: "\u9769", 0x2FB1: "\u97cb", 0x2FB2: "\u97ed", 0x2FB3: "\u97f3",
+	0x2FB4: "\u9801", 0x2FB5: "\u98a8", 0x2FB6: "\u98db", 0x2FB7: "\u98df",
+	0x2FB8: "\u9996", 0x2FB9: "\u9999", 0x2FBA: "\u99ac", 0x2FBB: "\u9aa8",
+	0x2FBC: "\u9ad8", 0x2FBD: "\u9adf", 0x2FBE: "\u9b25", 0x2FBF: "\u9b2f",
+	0x2FC0: "\u9b32", 0x2FC1: "\u9b3c", 0x2FC2: "\u9b5a", 0x2FC3: "\u9ce5",
+	0x2FC4: "\u9e75", 0x2FC5: "\u9e7f", 0x2FC6: "\u9ea5", 0x2FC7: "\u9ebb",
+	0x2FC8: "\u9ec3", 0x2FC9: "\u9ecd", 0x2FCA: "\u9ed1", 0x2FCB: "\u9ef9",
+	0x2FCC: "\u9efd", 0x2FCD: "\u9f0e", 0x2FCE: "\u9f13", 0x2FCF: "\u9f20",
+	0x2FD0: "\u9f3b", 0x2FD1: "\u9f4a", 0x2FD2: "\u9f52", 0x2FD3: "\u9f8d",
+	0x2FD4: "\u9f9c", 0x2FD5: "\u9fa0", 0x3000: " ", 0x3036: "\u3012",
+	0x3038: "\u5341", 0x3039: "\u5344", 0x303A: "\u5345", 0x309B: " \u3099",
+	0x309C: " \u309a", 0x309F: "\u3088\u308a", 0x30FF: "\u30b3\u30c8", 0x3131: "\u1100",
+	0x3132: "\u1101", 0x3133: "\u11aa", 0x3134: "\u1102", 0x3135: "\u11ac",
+	0x3136: "\u11ad", 0x3137: "\u1103", 0x3138: "\u1104", 0x3139: "\u1105",
+	0x313A: "\u11b0", 0x313B: "\u11b1", 0x313C: "\u11b2", 0x313D: "\u11b3",
+	0x313E: "\u11b4", 0x313F: "\u11b5", 0x3140: "\u111a", 0x3141: "\u1106",
+	0x3142: "\u1107", 0x3143: "\u1108", 0x3144: "\u1121", 0x3145: "\u1109",
+	0x3146: "\u110a", 0x3147: "\u110b", 0x3148: "\u110c", 0x3149: "\u110d",
+	0x314A: "\u110e", 0x314B: "\u110f", 0x314C: "\u1110", 0x314D: "\u1111",
+	0x314E: "\u1112", 0x314F: "\u1161", 0x3150: "\u1162", 0x3151: "\u1163",
+	0x3152: "\u1164", 0x3153: "\u1165", 0x3154: "\u1166", 0x3155: "\u1167",
+	0x3156: "\u1168", 0x3157: "\u1169", 0x3158: "\u116a", 0x3159: "\u116b",
+	0x315A: "\u116c", 0x315B: "\u116d", 0x315C: "\u116e", 0x315D: "\u116f",
+	0x315E: "\u1170", 0x315F: "\u1171", 0x3160: "\u1172", 0x3161: "\u1173",
+	0x3162: "\u1174", 0x3163: "\u1175", 0x3164: "\u1160", 0x3165: "\u1114",
+	0x3166: "\u1115", 0x3167: "\u11c7", 0x3168: "\u11c8", 0x3169: "\u11cc",
+	0x316A: "\u11ce", 0x316B: "\u11d3", 0x316C: "\u11d7", 0x316D: "\u11d9",
+	0x316E: "\u111c", 0x316F: "\u11dd", 0x3170: "\u11df", 0x3171: "\u111d",
+	0x3172: "\u111e", 0x3173: "\u1120", 0x3174: "\u1122", 0x3175: "\u1123",
+	0x3176: "\u1127", 0x3177: "\u1129", 0x3178: "\u112b", 0x3179: "\u112c",
+	0x317A: "\u112d", 0x317B: "\u112e", 0x317C: "\u112f", 0x317D: "\u1132",
+	0x317E: "\u1136", 0x317F: "\u1140", 0x3180: "\u1147", 0x3181: "\u114c",
+	0x3182: "\u11f1", 0x3183: "\u11f2", 0x3184: "\u1157", 0x3185: "\u1158",
+	0x3186: "\u1159", 0x3187: "\u1184", 0x3188: "\u1185", 0x3189: "\u1188",
+	0x318A: "\u1191", 0x318B: "\u1192", 0x318C: "\u1194", 0x318D: "\u119e",
+	0x318E: "\u11a1", 0x3192: "\u4e00", 0x3193: "\u4e8c", 0x3194: "\u4e09",
+	0x3195: "\u56db", 0x3196: "\u4e0a", 0x3197: "\u4e2d", 0x3198: "\u4e0b",
+	0x3199: "\u7532", 0x319A: "\u4e59", 0x319B: "\u4e19", 0x319C: "\u4e01",
+	0x319D: "\u5929", 0x319E: "\u5730", 0x319F: "\u4eba", 0x3200: "(\u1100)",
+	0x3201: "(\u1102)", 0x3202: "(\u1103)", 0x3203: "(\u1105)", 0x3204: "(\u1106)",
+	0x3205: "(\u1107)", 0x3206: "(\u1109)", 0x3207: "(\u110b)", 0x3208: "(\u110c)",
+	0x3209: "(\u110e)", 0x320A: "(\u110f)", 0x320B: "(\u1110)", 0x320C: "(\u1111)",
+	0x320D: "(\u1112)", 0x320E: "(\u1100\u1161)", 0x320F: "(\u1102\u1161)", 0x3210: "(\u1103\u1161)",
+	0x3211: "(\u1105\u1161)", 0x3212: "(\u1106\u1161)", 0x3213: "(\u1107\u1161)", 0x3214: "(\u1109\u1161)",
+	0x3215: "(\u110b\u1161)", 0x3216: "(\u110c\u1161)", 0x3217: "(\u110e\u1161)", 0x3218: "(\u110f\u1161)",
+	0x3219: "(\u1110\u1161)", 0x321A: "(\u1111\u1161)", 0x321B: "(\u1112\u1161)", 0x321C: "(\u110c\u116e)",
+	0x321D: "(\u110b\u1169\u110c\u1165\u11ab)", 0x321E: "(\u110b\u1169\u1112\u116e)", 0x3220: "(\u4e00)", 0x3221: "(\u4e8c)",
+	0x3222: "(\u4e09)", 0x3223: "(\u56db)", 0x3224: "(\u4e94)", 0x3225: "(\u516d)",
+	0x3226: "(\u4e03)", 0x3227: "(\u516b)", 0x3228: "(\u4e5d)", 0x3229: "(\u5341)",
+	0x322A: "(\u6708)", 0x322B: "(\u706b)", 0x322C: "(\u6c34)", 0x322D: "(\u6728)",
+	0x322E: "(\u91d1)", 0x322F: "(\u571f)", 0x3230: "(\u65e5)", 0x3231: "(\u682a)",
+	0x3232: "(\u6709)", 0x3233: "(\u793e)", 0x3234: "(\u540d)", 0x3235: "(\u7279)",
+	0x3236: "(\u8ca1)", 0x3237: "(\u795d)", 0x3238: "(\u52b4)", 0x3239: "(\u4ee3)",
+	0x323A: "(\u547c)", 0x323B: "(\u5b66)", 0x323C: "(\u76e3)", 0x323D: "(\u4f01)",
+	0x323E: "(\u8cc7)", 0x323F: "(\u5354)", 0x3240: "(\u796d)", 0x3241: "(\u4f11)",
+	0x3242: "(\u81ea)", 0x3243: "(\u81f3)", 0x3244: "\u554f", 0x3245: "\u5e7c",
+	0x3246: "\u6587", 0x3247: "\u7b8f", 0x3250: "PTE", 0x3251: "21",
+	0x3252: "22", 0x3253: "23", 0x3254: "24", 0x3255: "25",
+	0x3256: "26", 0x3257: "27", 0x3258: "28", 0x3259: "29",
+	0x325A: "30", 0x325B: "31", 0x325C: "32", 0x325D: "33",
+	0x325E: "34", 0x325F: "35", 0x3260: "\u1100", 0x3261: "\u1102",
+	0x3262: "\u1103", 0x3263: "\u1105", 0x3264: "\u1106", 0x3265: "\u1107",
+	0x3266: "\u1109", 0x3267: "\u110b", 0x3268: "\u110c", 0x3269: "\u110e",
+	0x326A: "\u110f", 0x326B: "\u1110", 0x326C: "\u1111", 0x326D: "\u1112",
+	0x326E: "\u1100\u1161", 0x326F: "\u1102\u1161", 0x3270: "\u1103\u1161", 0x3271: "\u1105\u1161",
+	0x3272: "\u1106\u1161", 0x3273: "\u1107\u1161", 0x3274: "\u1109\u1161", 0x3275: "\u110b\u1161",
+	0x3276: "\u110c\u1161", 0x3277: "\u110e\u1161", 0x3278: "\u110f\u1161", 0x3279: "\u1110\u1161",
+	0x327A: "\u1111\u1161", 0x327B: "\u1112\u1161", 0x327C: "\u110e\u1161\u11b7\u1100\u1169", 0x327D: "\u110c\u116e\u110b\u1174",
+	0x327E: "\u110b\u116e", 0x3280: "\u4e00", 0x3281: "\u4e8c", 0x3282: "\u4e09",
+	0x3283: "\u56db", 0x3284: "\u4e94", 0x3285: "\u516d", 0x3286: "\u4e03",
+	0x3287: "\u516b", 0x3288: "\u4e5d", 0x3289: "\u5341", 0x328A: "\u6708",
+	0x328B: "\u706b", 0x328C: "\u6c34", 0x328D: "\u6728", 0x328E: "\u91d1",
+	0x328F: "\u571f", 0x3290: "\u65e5", 0x3291: "\u682a", 0x3292: "\u6709",
+	0x3293: "\u793e", 0x3294: "\u540d", 0x3295: "\u7279", 0x3296: "\u8ca1",
+	0x3297: "\u795d", 0x3298: "\u52b4", 0x3299: "\u79d8", 0x329A: "\u7537",
+	0x329B: "\u5973", 0x329C: "\u9069", 0x329D: "\u512a", 0x329E: "\u5370",
+	0x329F: "\u6ce8", 0x32A0: "\u9805", 0x32A1: "\u4f11", 0x32A2: "\u5199",
+	0x32A3: "\u6b63", 0x32A4: "\u4e0a", 0x32A5: "\u4e2d", 0x32A6: "\u4e0b",
+	0x32A7: "\u5de6", 0x32A8: "\u53f3", 0x32A9: "\u533b", 0x32AA: "\u5b97",
+	0x32AB: "\u5b66", 0x32AC: "\u76e3", 0x32AD: "\u4f01", 0x32AE: "\u8cc7",
+	0x32AF: "\u5354", 0x32B0: "\u591c", 0x32B1: "36", 0x32B2: "37",
+	0x32B3: "38", 0x32B4: "39", 0x32B5: "40", 0x32B6: "41",
+	0x32B7: "42", 0x32B8: "43", 0x32B9: "44", 0x32BA: "45",
+	0x32BB: "46", 0x32BC: "47", 0x32BD: "48", 0x32BE: "49",
+	0x32BF: "50", 0x32C0: "1\u6708", 0x32C1: "2\u6708", 0x32C2: "3\u6708",
+	0x32C3: "4\u6708", 0x32C4: "5\u6708", 0x32C5: "6\u6708", 0x32C6: "7\u6708",
+	0x32C7: "8\u6708", 0x32C8: "9\u6708", 0x32C9: "10\u6708", 0x32CA: "11\u6708",
+	0x32CB: "12\u6708", 0x32CC: "Hg", 0x32CD: "erg", 0x32CE: "eV",
+	0x32CF: "LTD", 0x32D0: "\u30a2", 0x32D1: "\u30a4", 0x32D2: "\u30a6",
+	0x32D3: "\u30a8", 0x32D4: "\u30aa", 0x32D5: "\u30ab", 0x32D6: "\u30ad",
+	0x32D7: "\u30af", 0x32D8: "\u30b1", 0x32D9: "\u30b3", 0x32DA: "\u30b5",
+	0x32DB: "\u30b7", 0x32DC: "\u30b9", 0x32DD: "\u30bb", 0x32DE: "\u30bd",
+	0x32DF: "\u30bf", 0x32E0: "\u30c1", 0x32E1: "\u30c4", 0x32E2: "\u30c6",
+	0x32E3: "\u30c8", 0x32E4: "\u30ca", 0x32E5: "\u30cb", 0x32E6: "\u30cc",
+	0x32E7: "\u30cd", 0x32E8: "\u30ce", 0x32E9: "\u30cf", 0x32EA: "\u30d2",
+	0x32EB: "\u30d5", 0x32EC: "\u30d8", 0x32ED: "\u30db", 0x32EE: "\u30de",
+	0x32EF: "\u30df", 0x32F0: "\u30e0", 0x32F1: "\u30e1", 0x32F2: "\u30e2",
+	0x32F3: "\u30e4", 0x32F4: "\u30e6", 0x32F5: "\u30e8", 0x32F6: "\u30e9",
+	0x32F7: "\u30ea", 0x32F8: "\u30eb", 0x32F9: "\u30ec", 0x32FA: "\u30ed",
+	0x32FB: "\u30ef", 0x32FC: "\u30f0", 0x32FD: "\u30f1", 0x32FE: "\u30f2",
+	0x32FF: "\u4ee4\u548c", 0x3300: "\u30a2\u30d1\u30fc\u30c8", 0x3301: "\u30a2\u30eb\u30d5\u30a1", 0x3302: "\u30a2\u30f3\u30da\u30a2",
+	0x3303: "\u30a2\u30fc\u30eb", 0x3304: "\u30a4\u30cb\u30f3\u30b0", 0x3305: "\u30a4\u30f3\u30c1", 0x3306: "\u30a6\u30a9\u30f3",
+	0x3307: "\u30a8\u30b9\u30af\u30fc\u30c9", 0x3308: "\u30a8\u30fc\u30ab\u30fc", 0x3309: "\u30aa\u30f3\u30b9", 0x330A: "\u30aa\u30fc\u30e0",
+	0x330B: "\u30ab\u30a4\u30ea", 0x330C: "\u30ab\u30e9\u30c3\u30c8", 0x330D: "\u30ab\u30ed\u30ea\u30fc", 0x330E: "\u30ac\u30ed\u30f3",
+	0x330F: "\u30ac\u30f3\u30de", 0x3310: "\u30ae\u30ac", 0x3311: "\u30ae\u30cb\u30fc", 0x3312: "\u30ad\u30e5\u30ea\u30fc",
+	0x3313: "\u30ae\u30eb\u30c0\u30fc", 0x3314: "\u30ad\u30ed", 0x3315: "\u30ad\u30ed\u30b0\u30e9\u30e0", 0x3316: "\u30ad\u30ed\u30e1\u30fc\u30c8\u30eb",
+	0x3317: "\u30ad\u30ed\u30ef\u30c3\u30c8", 0x3318: "\u30b0\u30e9\u30e0", 0x3319: "\u30b0\u30e9\u30e0\u30c8\u30f3", 0x331A: "\u30af\u30eb\u30bc\u30a4\u30ed",
+	0x331B: "\u30af\u30ed\u30fc\u30cd", 0x331C: "\u30b1\u30fc\u30b9", 0x331D: "\u30b3\u30eb\u30ca", 0x331E: "\u30b3\u30fc\u30dd",
+	0x331F: "\u30b5\u30a4\u30af\u30eb", 0x3320: "\u30b5\u30f3\u30c1\u30fc\u30e0", 0x3321: "\u30b7\u30ea\u30f3\u30b0", 0x3322: "\u30bb\u30f3\u30c1",
+	0x3323: "\u30bb\u30f3\u30c8", 0x3324: "\u30c0\u30fc\u30b9", 0x3325: "\u30c7\u30b7", 0x3326: "\u30c9\u30eb",
+	0x3327: "\u30c8\u30f3", 0x3328: "\u30ca\u30ce", 0x3329: "\u30ce\u30c3\u30c8", 0x332A: "\u30cf\u30a4\u30c4",
+	0x332B: "\u30d1\u30fc\u30bb\u30f3\u30c8", 0x332C: "\u30d1\u30fc\u30c4", 0x332D: "\u30d0\u30fc\u30ec\u30eb", 0x332E: "\u30d4\u30a2\u30b9\u30c8\u30eb",
+	0x332F: "\u30d4\u30af\u30eb", 0x3330: "\u30d4\u30b3", 0x3331: "\u30d3\u30eb", 0x3332: "\u30d5\u30a1\u30e9\u30c3\u30c9",
+	0x3333: "\u30d5\u30a3\u30fc\u30c8", 0x3334: "\u30d6\u30c3\u30b7\u30a7\u30eb", 0x3335: "\u30d5\u30e9\u30f3", 0x3336: "\u30d8\u30af\u30bf\u30fc\u30eb",
+	0x3337: "\u30da\u30bd", 0x3338: "\u30da\u30cb\u30d2", 0x3339: "\u30d8\u30eb\u30c4", 0x333A: "\u30da\u30f3\u30b9",
+	0x333B: "\u30da\u30fc\u30b8", 0x333C: "\u30d9\u30fc\u30bf", 0x333D: "\u30dd\u30a4\u30f3\u30c8", 0x333E: "\u30dc\u30eb\u30c8",
+	0x333F: "\u30db\u30f3", 0x3340: "\u30dd\u30f3\u30c9", 0x3341: "\u30db\u30fc\u30eb", 0x3342: "\u30db\u30fc\u30f3",
+	0x3343: "\u30de\u30a4\u30af\u30ed", 0x3344: "\u30de\u30a4\u30eb", 0x3345: "\u30de\u30c3\u30cf", 0x3346: "\u30de\u30eb\u30af",
+	0x3347: "\u30de\u30f3\u30b7\u30e7\u30f3", 0x3348: "\u30df\u30af\u30ed\u30f3", 0x3349: "\u30df\u30ea", 0x334A: "\u30df\u30ea\u30d0\u30fc\u30eb",
+	0x334B: "\u30e1\u30ac", 0x334C: "\u30e1\u30ac\u30c8\u30f3", 0x334D: "\u30e1\u30fc\u30c8\u30eb", 0x334E: "\u30e4\u30fc\u30c9",
+	0x334F: "\u30e4\u30fc\u30eb", 0x3350: "\u30e6\u30a2\u30f3", 0x3351: "\u30ea\u30c3\u30c8\u30eb", 0x3352: "\u30ea\u30e9",
+	0x3353: "\u30eb\u30d4\u30fc", 0x3354: "\u30eb\u30fc\u30d6\u30eb", 0x3355: "\u30ec\u30e0", 0x3356: "\u30ec\u30f3\u30c8\u30b2\u30f3",
+	0x3357: "\u30ef\u30c3\u30c8", 0x3358: "0\u70b9", 0x3359: "1\u70b9", 0x335A: "2\u70b9",
+	0x335B: "3\u70b9", 0x335C: "4\u70b9", 0x335D: "5\u70b9", 0x335E: "6\u70b9",
+	0x335F: "7\u70b9", 0x3360: "8\u70b9", 0x3361: "9\u70b9", 0x3362: "10\u70b9",
+	0x3363: "11\u70b9", 0x3364: "12\u70b9", 0x3365: "13\u70b9", 0x3366: "14\u70b9",
+	0x3367: "15\u70b9", 0x3368: "16\u70b9", 0x3369: "17\u70b9", 0x336A: "18\u70b9",
+	0x336B: "19\u70b9", 0x336C: "20\u70b9", 0x336D: "21\u70b9", 0x336E: "22\u70b9",
+	0x336F: "23\u70b9", 0x3370: "24\u70b9", 0x3371: "hPa", 0x3372: "da",
+	0x3373: "AU", 0x3374: "bar", 0x3375: "oV", 0x3376: "pc",
+	0x3377: "dm", 0x3378: "dm\u00b2", 0x3379: "dm\u00b3", 0x337A: "IU",
+	0x337B: "\u5e73\u6210", 0x337C: "\u662d\u548c", 0x337D: "\u5927\u6b63", 0x337E: "\u660e\u6cbb",
+	0x337F: "\u682a\u5f0f\u4f1a\u793e", 0x3380: "pA", 0x3381: "nA", 0x3382: "\u03bcA",
+	0x3383: "mA", 0x3384: "kA", 0x3385: "KB", 0x3386: "MB",
+	0x3387: "GB", 0x3388: "cal", 0x3389: "kcal", 0x338A: "pF",
+	0x338B: "nF", 0x338C: "\u03bcF", 0x338D: "\u03bcg", 0x338E: "mg",
+	0x338F: "kg", 0x3390: "Hz", 0x3391: "kHz", 0x3392: "MHz",
+	0x3393: "GHz", 0x3394: "THz", 0x3395: "\u03bc\u2113", 0x3396: "m\u2113",
+	0x3397: "d\u2113", 0x3398: "k\u2113", 0x3399: "fm", 0x339A: "nm",
+	0x339B: "\u03bcm", 0x339C: "mm", 0x339D: "cm", 0x339E: "km",
+	0x339F: "mm\u00b2", 0x33A0: "cm\u00b2", 0x33A1: "m\u00b2", 0x33A2: "km\u00b2",
+	0x33A3: "mm\u00b3", 0x33A4: "cm\u00b3", 0x33A5: "m\u00b3", 0x33A6: "km\u00b3",
+	0x33A7: "m\u2215s", 0x33A8: "m\u2215s\u00b2", 0x33A9: "Pa", 0x33AA: "kPa",
+	0x33AB: "MPa", 0x33AC: "GPa", 0x33AD: "rad", 0x33AE: "rad\u2215s",
+	0x33AF: "rad\u2215s\u00b2", 0x33B0: "ps", 0x33B1: "ns", 0x33B2: "\u03bcs",
+	0x33B3: "ms", 0x33B4: "pV", 0x33B5: "nV", 0x33B6: "\u03bcV",
+	0x33B7: "mV", 0x33B8: "kV", 0x33B9: "MV", 0x33BA: "pW",
+	0x33BB: "nW", 0x33BC: "\u03bcW", 0x33BD: "mW", 0x33BE: "kW",
+	0x33BF: "MW", 0x33C0: "k\u03a9", 0x33C1: "M\u03a9", 0x33C2: "a.m.",
+	0x33C3: "Bq", 0x33C4: "cc", 0x33C5: "cd", 0x33C6: "C\u2215kg",
+	0x33C7: "Co.", 0x33C8: "dB", 0x33C9: "Gy", 0x33CA: "ha",
+	0x33CB: "HP", 0x33CC: "in", 0x33CD: "KK", 0x33CE: "KM",
+	0x33CF: "kt", 0x33D0: "lm", 0x33D1: "ln", 0x33D2: "log",
+	0x33D3: "lx", 0x33D4: "mb", 0x33D5: "mil", 0x33D6: "mol",
+	0x33D7: "PH", 0x33D8: "p.m.", 0x33D9: "PPM", 0x33DA: "PR",
+	0x33DB: "sr", 0x33DC: "Sv", 0x33DD: "Wb", 0x33DE: "V\u2215m",
+	0x33DF: "A\u2215m", 0x33E0: "1\u65e5", 0x33E1: "2\u65e5", 0x33E2: "3\u65e5",
+	0x33E3: "4\u65e5", 0x33E4: "5\u65e5", 0x33E5: "6\u65e5", 0x33E6: "7\u65e5",
+	0x33E7: "8\u65e5", 0x33E8: "9\u65e5", 0x33E9: "10\u65e5", 0x33EA: "11\u65e5",
+	0x33EB: "12\u65e5", 0x33EC: "13\u65e5", 0x33ED: "14\u65e5", 0x33EE: "15\u65e5",
+	0x33EF: "16\u65e5", 0x33F0: "17\u65e5", 0x33F1: "18\u65e5", 0x33F2: "19\u65e5",
+	0x33F3: "20\u65e5", 0x33F4: "21\u65e5", 0x33F5: "22\u65e5", 0x33F6: "23\u65e5",
+	0x33F7: "24\u65e5", 0x33F8: "25\u65e5", 0x33F9: "26\u65e5", 0x33FA: "27\u65e5",
+	0x33FB: "28\u65e5", 0x33FC: "29\u65e5", 0x33FD: "30\u65e5", 0x33FE: "31\u65e5",
+	0x33FF: "gal", 0xA69C: "\u044a", 0xA69D: "\u044c", 0xA770: "\ua76f",
+	0xA7F2: "C", 0xA7F3: "F", 0xA7F4: "Q", 0xA7F8: "\u0126",
+	0xA7F9: "\u0153", 0xAB5C: "\ua727", 0xAB5D: "\uab37", 0xAB5E: "\u026b",
+	0xAB5F: "\uab52", 0xAB69: "\u028d", 0xFB00: "ff", 0xFB01: "fi",
+	0xFB02: "fl", 0xFB03: "ffi", 0xFB04: "ffl", 0xFB05: "\u017ft",
+	0xFB06: "st", 0xFB13: "\u0574\u0576", 0xFB14: "\u0574\u0565", 0xFB15: "\u0574\u056b",
+	0xFB16: "\u057e\u0576", 0xFB17: "\u0574\u056d", 0xFB20: "\u05e2", 0xFB21: "\u05d0",
+	0xFB22: "\u05d3", 0xFB23: "\u05d4", 0xFB24: "\u05db", 0xFB25: "\u05dc",
+	0xFB26: "\u05dd", 0xFB27: "\u05e8", 0xFB28: "\u05ea", 0xFB29: "+",
+	0xFB4F: "\u05d0\u05dc", 0xFB50: "\u0671", 0xFB51: "\u0671", 0xFB52: "\u067b",
+	0xFB53: "\u067b", 0xFB54: "\u067b", 0xFB55: "\u067b", 0xFB56: "\u067e",
+	0xFB57: "\u067e", 0xFB58: "\u067e", 0xFB59: "\u067e", 0xFB5A: "\u0680",
+	0xFB5B: "\u0680", 0xFB5C: "\u0680", 0xFB5D: "\u0680", 0xFB5E: "\u067a",
+	0xFB5F: "\u067a", 0xFB60: "\u067a", 0xFB61: "\u067a", 0xFB62: "\u067f",
+	0xFB63: "\u067f", 0xFB64: "\u067f", 0xFB65: "\u067f", 0xFB66: "\u0679",
+	0xFB67: "\u0679", 0xFB68: "\u0679", 0xFB69: "\u0679", 0xFB6A: "\u06a4",
+	0xFB6B: "\u06a4", 0xFB6C: "\u06a4", 0xFB6D: "\u06a4", 0xFB6E: "\u06a6",
+	0xFB6F: "\u06a6", 0xFB70: "\u06a6", 0xFB71: "\u06a6", 0xFB72: "\u0684",
+	0xFB73: "\u0684", 0xFB74: "\u0684", 0xFB75: "\u0684", 0xFB76: "\u0683",
+	0xFB77: "\u0683", 0xFB78: "\u0683", 0xFB79: "\u0683", 0xFB7A: "\u0686",
+	0xFB7B: "\u0686", 0xFB7C: "\u0686", 0xFB7D: "\u0686", 0xFB7E: "\u0687",
+	0xFB7F: "\u0687", 0xFB80: "\u0687", 0xFB81: "\u0687", 0xFB82: "\u068d",
+	0xFB83: "\u068d", 0xFB84: "\u068c", 0xFB85: "\u068c", 0xFB86: "\u068e",
+	0xFB87: "\u068e", 0xFB88: "\u0688", 0xFB89: "\u0688", 0xFB8A: "\u0698",
+	0xFB8B: "\u0698", 0xFB8C: "\u0691", 0xFB8D: "\u0691", 0xFB8E: "\u06a9",
+	0xFB8F: "\u06a9", 0xFB90: "\u06a9", 0xFB91: "\u06a9", 0xFB92: "\u06af",
+	0xFB93: "\u06af", 0xFB94: "\u06af", 0xFB95: "\u06af", 0xFB96: "\u06b3",
+	0xFB97: "\u06b3", 0xFB98: "\u06b3", 0xFB99: "\u06b3", 0xFB9A: "\u06b1",
+	0xFB9B: "\u06b1", 0xFB9C: "\u06b1", 0xFB9D: "\u06b1", 0xFB9E: "\u06ba",
+	0xFB9F: "\u06ba", 0xFBA0: "\u06bb", 0xFBA1: "\u06bb", 0xFBA2: "\u06bb",
+	0xFBA3: "\u06bb", 0xFBA4: "\u06c0", 0xFBA5: "\u06c0", 0xFBA6: "\u06c1",
+	0xFBA7: "\u06c1", 0xFBA8: "\u06c1", 0xFBA9: "\u06c1", 0xFBAA: "\u06be",
+	0xFBAB: "\u06be", 0xFBAC: "\u06be", 0xFBAD: "\u06be", 0xFBAE: "\u06d2",
+	0xFBAF: "\u06d2", 0xFBB0: "\u06d3", 0xFBB1: "\u06d3", 0xFBD3: "\u06ad",
+	0xFBD4: "\u06ad", 0xFBD5: "\u06ad", 0xFBD6: "\u06ad", 0xFBD7: "\u06c7",
+	0xFBD8: "\u06c7", 0xFBD9: "\u06c6", 0xFBDA: "\u06c6", 0xFBDB: "\u06c8",
+	0xFBDC: "\u06c8", 0xFBDD: "\u0677", 0xFBDE: "\u06cb", 0xFBDF: "\u06cb",
+	0xFBE0: "\u06c5", 0xFBE1: "\u06c5", 0xFBE2: "\u06c9", 0xFBE3: "\u06c9",
+	0xFBE4: "\u06d0", 0xFBE5: "\u06d0", 0xFBE6: "\u06d0", 0xFBE7: "\u06d0",
+	0xFBE8: "\u0649", 0xFBE9: "\u0649", 0xFBEA: "\u0626\u0627", 0xFBEB: "\u0626\u0627",
+	0xFBEC: "\u0626\u06d5", 0xFBED: "\u0626\u06d5", 0xFBEE: "\u0626\u0648", 0xFBEF: "\u0626\u0648",
+	0xFBF0: "\u0626\u06c7", 0xFBF1: "\u0626\u06c7", 0xFBF2: "\u0626\u06c6", 0xFBF3: "\u0626\u06c6",
+	0xFBF4: "\u0626\u06c8", 0xFBF5: "\u0626\u06c8", 0xFBF6: "\u0626\u06d0", 0xFBF7: "\u0626\u06d0",
+	0xFBF8: "\u0626\u06d0", 0xFBF9: "\u0626\u0649", 0xFBFA: "\u0626\u0649", 0xFBFB: "\u0626\u0649",
+	0xFBFC: "\u06cc", 0xFBFD: "\u06cc", 0xFBFE: "\u06cc", 0xFBFF: "\u06cc",
+	0xFC00: "\u0626\u062c", 0xFC01: "\u0626\u062d", 0xFC02: "\u0626\u0645", 0xFC03: "\u0626\u0649",
+	0xFC04: "\u0626\u064a", 0xFC05: "\u0628\u062c", 0xFC06: "\u0628\u062d", 0xFC07: "\u0628\u062e",
+	0xFC08: "\u0628\u0645", 0xFC09: "\u0628\u0649", 0xFC0A: "\u0628\u064a", 0xFC0B: "\u062a\u062c",
+	0xFC0C: "\u062a\u062d", 0xFC0D: "\u062a\u062e", 0xFC0E: "\u062a\u0645", 0xFC0F: "\u062a\u0649",
+	0xFC10: "\u062a\u064a", 0xFC11: "\u062b\u062c", 0xFC12: "\u062b\u0645", 0xFC13: "\u062b\u0649",
+	0xFC14: "\u062b\u064a", 0xFC15: "\u062c\u062d", 0xFC16: "\u062c\u0645", 0xFC17: "\u062d\u062c",
+	0xFC18: "\u062d\u0645", 0xFC19: "\u062e\u062c", 0xFC1A: "\u062e\u062d", 0xFC1B: "\u062e\u0645",
+	0xFC1C: "\u0633\u062c", 0xFC1D: "\u0633\u062d", 0xFC1E: "\u0633\u062e", 0xFC1F: "\u0633\u0645",
+	0xFC20: "\u0635\u062d", 0xFC21: "\u0635\u0645", 0xFC22: "\u0636\u062c", 0xFC23: "\u0636\u062d",
+	0xFC24: "\u0636\u062e", 0xFC25: "\u0636\u0645", 0xFC26: "\u0637\u062d", 0xFC27: "\u0637\u0645",
+	0xFC28: "\u0638\u0645", 0xFC29: "\u0639\u062c", 0xFC2A: "\u0639\u0645", 0xFC2B: "\u063a\u062c",
+	0xFC2C: "\u063a\u0645", 0xFC2D: "\u0641\u062c", 0xFC2E: "\u0641\u062d", 0xFC2F: "\u0641\u062e",
+	0xFC30: "\u0641\u0645", 0xFC31: "\u0641\u0649", 0xFC32: "\u0641\u064a", 0xFC33: "\u0642\u062d",
+	0xFC34: "\u0642\u0645", 0xFC35: "\u0642\u0649", 0xFC36: "\u0642\u064a", 0xFC37: "\u0643\u0627",
+	0xFC38: "\u0643\u062c", 0xFC39: "\u0643\u062d", 0xFC3A: "\u0643\u062e", 0xFC3B: "\u0643\u0644",
+	0xFC3C: "\u0643\u0645", 0xFC3D: "\u0643\u0649", 0xFC3E: "\u0643\u064a", 0xFC3F: "\u0644\u062c",
+	0xFC40: "\u0644\u062d", 0xFC41: "\u0644\u062e", 0xFC42: "\u0644\u0645", 0xFC43: "\u0644\u0649",
+	0xFC44: "\u0644\u064a", 0xFC45: "\u0645\u062c", 0xFC46: "\u0645\u062d", 0xFC47: "\u0645\u062e",
+	0xFC48: "\u0645\u0645", 0xFC49: "\u0645\u0649", 0xFC4A: "\u0645\u064a", 0xFC4B: "\u0646\u062c",
+	0xFC4C: "\u0646\u062d", 0xFC4D: "\u0646\u062e", 0xFC4E: "\u0646\u0645", 0xFC4F: "\u0646\u0649",
+	0xFC50: "\u0646\u064a", 0xFC51: "\u0647\u062c", 0xFC52: "\u0647\u0645", 0xFC53: "\u0647\u0649",
+	0xFC54: "\u0647\u064a", 0xFC55: "\u064a\u062c", 0xFC56: "\u064a\u062d", 0xFC57: "\u064a\u062e",
+	0xFC58: "\u064a\u0645", 0xFC59: "\u064a\u0649", 0xFC5A: "\u064a\u064a", 0xFC5B: "\u0630\u0670",
+	0xFC5C: "\u0631\u0670", 0xFC5D: "\u0649\u0670", 0xFC5E: " \u064c\u0651", 0xFC5F: " \u064d\u0651",
+	0xFC60: " \u064e\u0651", 0xFC61: " \u064f\u0651", 0xFC62: " \u0650\u0651", 0xFC63: " \u0651\u0670",
+	0xFC64: "\u0626\u0631", 0xFC65: "\u0626\u0632", 0xFC66: "\u0626\u0645", 0xFC67: "\u0626\u0646",
+	0xFC68: "\u0626\u0649", 0xFC69: "\u0626\u064a", 0xFC6A: "\u0628\u0631", 0xFC6B: "\u0628\u0632",
+	0xFC6C: "\u0628\u0645", 0xFC6D: "\u0628\u0646", 0xFC6E: "\u0628\u0649", 0xFC6F: "\u0628\u064a",
+	0xFC70: "\u062a\u0631", 0xFC71: "\u062a\u0632", 0xFC72: "\u062a\u0645", 0xFC73: "\u062a\u0646",
+	0xFC74: "\u062a\u0649", 0xFC75: "\u062a\u064a", 0xFC76: "\u062b\u0631", 0xFC77: "\u062b\u0632",
+	0xFC78: "\u062b\u0645", 0xFC79: "\u062b\u0646", 0xFC7A: "\u062b\u0649", 0xFC7B: "\u062b\u064a",
+	0xFC7C: "\u0641\u0649", 0xFC7D: "\u0641\u064a", 0xFC7E: "\u0642\u0649", 0xFC7F: "\u0642\u064a",
+	0xFC80: "\u0643\u0627", 0xFC81: "\u0643\u0644", 0xFC82: "\u0643\u0645", 0xFC83: "\u0643\u0649",
+	0xFC84: "\u0643\u064a", 0xFC85: "\u0644\u0645", 0xFC86: "\u0644\u0649", 0xFC87: "\u0644\u064a",
+	0xFC88: "\u0645\u0627", 0xFC89: "\u0645\u0645", 0xFC8A: "\u0646\u0631", 0xFC8B: "\u0646\u0632",
+	0xFC8C: "\u0646\u0645", 0xFC8D: "\u0646\u0646", 0xFC8E: "\u0646\u0649", 0xFC8F: "\u0646\u064a",
+	0xFC90: "\u0649\u0670", 0xFC91: "\u064a\u0631", 0xFC92: "\u064a\u0632", 0xFC93: "\u064a\u0645",
+	0xFC94: "\u064a\u0646", 0xFC95: "\u064a\u0649", 0xFC96: "\u064a\u064a", 0xFC97: "\u0626\u062c",
+	0xFC98: "\u0626\u062d", 0xFC99: "\u0626\u062e", 0xFC9A: "\u0626\u0645", 0xFC9B: "\u0626\u0647",
+	0xFC9C: "\u0628\u062c", 0xFC9D: "\u0628\u062d", 0xFC9E: "\u0628\u062e", 0xFC9F: "\u0628\u0645",
+	0xFCA0: "\u0628\u0647", 0xFCA1: "\u062a\u062c", 0xFCA2: "\u062a\u062d", 0xFCA3: "\u062a\u062e",
+	0xFCA4: "\u062a\u0645", 0xFCA5: "\u062a\u0647", 0xFCA6: "\u062b\u0645", 0xFCA7: "\u062c\u062d",
+	0xFCA8: "\u062c\u0645", 0xFCA9: "\u062d\u062c", 0xFCAA: "\u062d\u0645", 0xFCAB: "\u062e\u062c",
+	0xFCAC: "\u062e\u0645", 0xFCAD: "\u0633\u062c", 0xFCAE: "\u0633\u062d", 0xFCAF: "\u0633\u062e",
+	0xFCB0: "\u0633\u0645", 0xFCB1: "\u0635\u062d", 0xFCB2: "\u0635\u062e", 0xFCB3: "\u0635\u0645",
+	0xFCB4: "\u0636\u062c", 0xFCB5: "\u0636\u062d", 0xFCB6: "\u0636\u062e", 0xFCB7: "\u0636\u0645",
+	0xFCB8: "\u0637\u062d", 0xFCB9: "\u0638\u0645", 0xFCBA: "\u0639\u062c", 0xFCBB: "\u0639\u0645",
+	0xFCBC: "\u063a\u062c", 0xFCBD: "\u063a\u0645", 0xFCBE: "\u0641\u062c", 0xFCBF: "\u0641\u062d",
+	0xFCC0: "\u0641\u062e", 0xFCC1: "\u0641\u0645", 0xFCC2: "\u0642\u062d", 0xFCC3: "\u0642\u0645",
+	0xFCC4: "\u0643\u062c", 0xFCC5: "\u0643\u062d", 0xFCC6: "\u0643\u062e", 0xFCC7: "\u0643\u0644",
+	0xFCC8: "\u0643\u0645", 0xFCC9: "\u0644\u062c", 0xFCCA: "\u0644\u062d", 0xFCCB: "\u0644\u062e",
+	0xFCCC: "\u0644\u0645", 0xFCCD: "\u0644\u0647", 0xFCCE: "\u0645\u062c", 0xFCCF: "\u0645\u062d",
+	0xFCD0: "\u0645\u062e", 0xFCD1: "\u0645\u0645", 0xFCD2: "\u0646\u062c", 0xFCD3: "\u0646\u062d",
+	0xFCD4: "\u0646\u062e", 0xFCD5: "\u0646\u0645", 0xFCD6: "\u0646\u0647", 0xFCD7: "\u0647\u062c",
+	0xFCD8: "\u0647\u0645", 0xFCD9: "\u0647\u0670", 0xFCDA: "\u064a\u062c", 0xFCDB: "\u064a\u062d",
+	0xFCDC: "\u064a\u062e", 0xFCDD: "\u064a\u0645", 0xFCDE: "\u064a\u0647", 0xFCDF: "\u0626\u0645",
+	0xFCE0: "\u0626\u0647", 0xFCE1: "\u0628\u0645", 0xFCE2: "\u0628\u0647", 0xFCE3: "\u062a\u0645",
+	0xFCE4: "\u062a\u0647", 0xFCE5: "\u062b\u0645", 0xFCE6: "\u062b\u0647", 0xFCE7: "\u0633\u0645",
+	0xFCE8: "\u0633\u0647", 0xFCE9: "\u0634\u0645", 0xFCEA: "\u0634\u0647", 0xFCEB: "\u0643\u0644",
+	0xFCEC: "\u0643\u0645", 0xFCED: "\u0644\u0645", 0xFCEE: "\u0646\u0645", 0xFCEF: "\u0646\u0647",
+	0xFCF0: "\u064a\u0645", 0xFCF1: "\u064a\u0647", 0xFCF2: "\u0640\u064e\u0651", 0xFCF3: "\u0640\u064f\u0651",
+	0xFCF4: "\u0640\u0650\u0651", 0xFCF5: "\u0637\u0649", 0xFCF6: "\u0637\u064a", 0xFCF7: "\u0639\u0649",
+	0xFCF8: "\u0639\u064a", 0xFCF9: "\u063a\u0649", 0xFCFA: "\u063a\u064a", 0xFCFB: "\u0633\u0649",
+	0xFCFC: "\u0633\u064a", 0xFCFD: "\u0634\u0649", 0xFCFE: "\u0634\u064a", 0xFCFF: "\u062d\u0649",
+	0xFD00: "\u062d\u064a", 0xFD01: "\u062c\u0649", 0xFD02: "\u062c\u064a", 0xFD03: "\u062e\u0649",
+	0xFD04: "\u062e\u064a", 0xFD05: "\u0635\u0649", 0xFD06: "\u0635\u064a", 0xFD07: "\u0636\u0649",
+	0xFD08: "\u0636\u064a", 0xFD09: "\u0634\u062c", 0xFD0A: "\u0634\u062d", 0xFD0B: "\u0634\u062e",
+	0xFD0C: "\u0634\u0645", 0xFD0D: "\u0634\u0631", 0xFD0E: "\u0633\u0631", 0xFD0F: "\u0635\u0631",
+	0xFD10: "\u0636\u0631", 0xFD11: "\u0637\u0649", 0xFD12: "\u0637\u064a", 0xFD13: "\u0639\u0649",
+	0xFD14: "\u0639\u064a", 0xFD15: "\u063a\u0649", 0xFD16: "\u063a\u064a", 0xFD17: "\u0633\u0649",
+	0xFD18: "\u0633\u064a", 0xFD19: "\u0634\u0649", 0xFD1A: "\u0634\u064a", 0xFD1B: "\u062d\u0649",
+	0xFD1C: "\u062d\u064a", 0xFD1D: "\u062c\u0649", 0xFD1E: "\u062c\u064a", 0xFD1F: "\u062e\u0649",
+	0xFD20: "\u062e\u064a", 0xFD21: "\u0635\u0649", 0xFD22: "\u0635\u064a", 0xFD23: "\u0636\u0649",
+	0xFD24: "\u0636\u064a", 0xFD25: "\u0634\u062c", 0xFD26: "\u0634\u062d", 0xFD27: "\u0634\u062e",
+	0xFD28: "\u0634\u0645", 0xFD29: "\u0634\u0631", 0xFD2A: "\u0633\u0631", 0xFD2B: "\u0635\u0631",
+	0xFD2C: "\u0636\u0631", 0xFD2D: "\u0634\u062c", 0xFD2E: "\u0634\u062d", 0xFD2F: "\u0634\u062e",
+	0xFD30: "\u0634\u0645", 0xFD31: "\u0633\u0647", 0xFD32: "\u0634\u0647", 0xFD33: "\u0637\u0645",
+	0xFD34: "\u0633\u062c", 0xFD35: "\u0633\u062d", 0xFD36: "\u0633\u062e", 0xFD37: "\u0634\u062c",
+	0xFD38: "\u0634\u062d", 0xFD39: "\u0634\u062e", 0xFD3A: "\u0637\u0645", 0xFD3B: "\u0638\u0645",
+	0xFD3C: "\u0627\u064b", 0xFD3D: "\u0627\u064b", 0xFD50: "\u062a\u062c\u0645", 0xFD51: "\u062a\u062d\u062c",
+	0xFD52: "\u062a\u062d\u062c", 0xFD53: "\u062a\u062d\u0645", 0xFD54: "\u062a\u062e\u0645", 0xFD55: "\u062a\u0645\u062c",
+	0xFD56: "\u062a\u0645\u062d", 0xFD57: "\u062a\u0645\u062e", 0xFD58: "\u062c\u0645\u062d", 0xFD59: "\u062c\u0645\u062d",
+	0xFD5A: "\u062d\u0645\u064a", 0xFD5B: "\u062d\u0645\u0649", 0xFD5C: "\u0633\u062d\u062c", 0xFD5D: "\u0633\u062c\u062d",
+	0xFD5E: "\u0633\u062c\u0649", 0xFD5F: "\u0633\u0645\u062d", 0xFD60: "\u0633\u0645\u062d", 0xFD61: "\u0633\u0645\u062c",
+	0xFD62: "\u0633\u0645\u0645", 0xFD63: "\u0633\u0645\u0645", 0xFD64: "\u0635\u062d\u062d", 0xFD65: "\u0635\u062d\u062d",
+	0xFD66: "\u0635\u0645\u0645", 0xFD67: "\u0634\u062d\u0645", 0xFD68: "\u0634\u062d\u0645", 0xFD69: "\u0634\u062c\u064a",
+	0xFD6A: "\u0634\u0645\u062e", 0xFD6B: "\u0634\u0645\u062e", 0xFD6C: "\u0634\u0645\u0645", 0xFD6D: "\u0634\u0645\u0645",
+	0xFD6E: "\u0636\u062d\u0649", 0xFD6F: "\u0636\u062e\u0645", 0xFD70: "\u0636\u062e\u0645", 0xFD71: "\u0637\u0645\u062d",
+	0xFD72: "\u0637\u0645\u062d", 0xFD73: "\u0637\u0645\u0645", 0xFD74: "\u0637\u0645\u064a", 0xFD75: "\u0639\u062c\u0645",
+	0xFD76: "\u0639\u0645\u0645", 0xFD77: "\u0639\u0645\u0645", 0xFD78: "\u0639\u0645\u0649", 0xFD79: "\u063a\u0645\u0645",
+	0xFD7A: "\u063a\u0645\u064a", 0xFD7B: "\u063a\u0645\u0649", 0xFD7C: "\u0641\u062e\u0645", 0xFD7D: "\u0641\u062e\u0645",
+	0xFD7E: "\u0642\u0645\u062d", 0xFD7F: "\u0642\u0645\u0645", 0xFD80: "\u0644\u062d\u0645", 0xFD81: "\u0644\u062d\u064a",
+	0xFD82: "\u0644\u062d\u0649", 0xFD83: "\u0644\u062c\u062c", 0xFD84: "\u0644\u062c\u062c", 0xFD85: "\u0644\u062e\u0645",
+	0xFD86: "\u0644\u062e\u0645", 0xFD87: "\u0644\u0645\u062d", 0xFD88: "\u0644\u0645\u062d", 0xFD89: "\u0645\u062d\u062c",
+	0xFD8A: "\u0645\u062d\u0645", 0xFD8B: "\u0645\u062d\u064a", 0xFD8C: "\u0645\u062c\u062d", 0xFD8D: "\u0645\u062c\u0645",
+	0xFD8E: "\u0645\u062e\u062c", 0xFD8F: "\u0645\u062e\u0645", 0xFD92: "\u0645\u062c\u062e", 0xFD93: "\u0647\u0645\u062c",
+	0xFD94: "\u0647\u0645\u0645", 0xFD95: "\u0646\u062d\u0645", 0xFD96: "\u0646\u062d\u0649", 0xFD97: "\u0646\u062c\u0645",
+	0xFD98: "\u0646\u062c\u0645", 0xFD99: "\u0646\u062c\u0649", 0xFD9A: "\u0646\u0645\u064a", 0xFD9B: "\u0646\u0645\u0649",
+	0xFD9C: "\u064a\u0645\u0645", 0xFD9D: "\u064a\u0645\u0645", 0xFD9E: "\u0628\u062e\u064a", 0xFD9F: "\u062a\u062c\u064a",
+	0xFDA0: "\u062a\u062c\u0649", 0xFDA1: "\u062a\u062e\u064a", 0xFDA2: "\u062a\u062e\u0649", 0xFDA3: "\u062a\u0645\u064a",
+	0xFDA4: "\u062a\u0645\u0649", 0xFDA5: "\u062c\u0645\u064a", 0xFDA6: "\u062c\u062d\u0649", 0xFDA7: "\u062c\u0645\u0649",
+	0xFDA8: "\u0633\u062e\u0649", 0xFDA9: "\u0635\u062d\u064a", 0xFDAA: "\u0634\u062d\u064a", 0xFDAB: "\u0636\u062d\u064a",
+	0xFDAC: "\u0644\u062c\u064a", 0xFDAD: "\u0644\u0645\u064a", 0xFDAE: "\u064a\u062d\u064a", 0xFDAF: "\u064a\u062c\u064a",
+	0xFDB0: "\u064a\u0645\u064a", 0xFDB1: "\u0645\u0645\u064a", 0xFDB2: "\u0642\u0645\u064a", 0xFDB3: "\u0646\u062d\u064a",
+	0xFDB4: "\u0642\u0645\u062d", 0xFDB5: "\u0644\u062d\u0645", 0xFDB6: "\u0639\u0645\u064a", 0xFDB7: "\u0643\u0645\u064a",
+	0xFDB8: "\u0646\u062c\u062d", 0xFDB9: "\u0645\u062e\u064a", 0xFDBA: "\u0644\u062c\u0645", 0xFDBB: "\u0643\u0645\u0645",
+	0xFDBC: "\u0644\u062c\u0645", 0xFDBD: "\u0646\u062c\u062d", 0xFDBE: "\u062c\u062d\u064a", 0xFDBF: "\u062d\u062c\u064a",
+	0xFDC0: "\u0645\u062c\u064a", 0xFDC1: "\u0641\u0645\u064a", 0xFDC2: "\u0628\u062d\u064a", 0xFDC3: "\u0643\u0645\u0645",
+	0xFDC4: "\u0639\u062c\u0645", 0xFDC5: "\u0635\u0645\u0645", 0xFDC6: "\u0633\u062e\u064a", 0xFDC7: "\u0646\u062c\u064a",
+	0xFDF0: "\u0635\u0644\u06d2", 0xFDF1: "\u0642\u0644\u06d2", 0xFDF2: "\u0627\u0644\u0644\u0647", 0xFDF3: "\u0627\u0643\u0628\u0631",
+	0xFDF4: "\u0645\u062d\u0645\u062f", 0xFDF5: "\u0635\u0644\u0639\u0645", 0xFDF6: "\u0631\u0633\u0648\u0644", 0xFDF7: "\u0639\u0644\u064a\u0647",
+	0xFDF8: "\u0648\u0633\u0644\u0645", 0xFDF9: "\u0635\u0644\u0649", 0xFDFA: "\u0635\u0644\u0649 \u0627\u0644\u0644\u0647 \u0639\u0644\u064a\u0647 \u0648\u0633\u0644\u0645", 0xFDFB: "\u062c\u0644 \u062c\u0644\u0627\u0644\u0647",
+	0xFDFC: "\u0631\u06cc\u0627\u0644", 0xFE10: ",", 0xFE11: "\u3001", 0xFE12: "\u3002",
+	0xFE13: ":", 0xFE14: ";", 0xFE15: "!", 0xFE16: "?",
+	0xFE17: "\u3016", 0xFE18: "\u3017", 0xFE19: "\u2026", 0xFE30: "\u2025",
+	0xFE31: "\u2014", 0xFE32: "\u2013", 0xFE33: "_", 0xFE34: "_",
+	0xFE35: "(", 0xFE36: ")", 0xFE37: "{", 0xFE38: "}",
+	0xFE39: "\u3014", 0xFE3A: "\u3015", 0xFE3B: "\u3010", 0xFE3C: "\u3011",
+	0xFE3D: "\u300a", 0xFE3E: "\u300b", 0xFE3F: "\u3008", 0xFE40: "\u3009",
+	0xFE41: "\u300c", 0xFE42: "\u300d", 0xFE43: "\u300e", 0xFE44: "\u300f",
+	0xFE47: "[", 0xFE48: "]", 0xFE49: "\u203e", 0xFE4A: "\u203e",
+	0xFE4B: "\u203e", 0xFE4C: "\u203e", 0xFE4D: "_", 0xFE4E: "_",
+	0xFE4F: "_", 0xFE50: ",", 0xFE51: "\u3001", 0xFE52: ".",
+	0xFE54: ";", 0xFE55: ":", 0xFE56: "?", 0xFE57: "!",
+	0xFE58: "\u2014", 0xFE59: "(", 0xFE5A: ")", 0xFE5B: "{",
+	0xFE5C: "}", 0xFE5D: "\u3014", 0xFE5E: "\u3015", 0xFE5F: "#",
+	0xFE60: "&", 0xFE61: "*", 0xFE62: "+", 0xFE63: "-",
+	0xFE64: "<", 0xFE65: ">", 0xFE66: "=", 0xFE68: "\\",
+	0xFE69: "$", 0xFE6A: "%", 0xFE6B: "@", 0xFE70: " \u064b",
+	0xFE71: "\u0640\u064b", 0xFE72: " \u064c", 0xFE74: " \u064d", 0xFE76: " \u064e",
+	0xFE77: "\u0640\u064e", 0xFE78: " \u064f", 0xFE79: "\u0640\u064f", 0xFE7A: " \u0650",
+	0xFE7B: "\u0640\u0650", 0xFE7C: " \u0651", 0xFE7D: "\u0640\u0651", 0xFE7E: " \u0652",
+	0xFE7F: "\u0640\u0652", 0xFE80: "\u0621", 0xFE81: "\u0622", 0xFE82: "\u0622",
+	0xFE83: "\u0623", 0xFE84: "\u0623", 0xFE85: "\u0624", 0xFE86: "\u0624",
+	0xFE87: "\u0625", 0xFE88: "\u0625", 0xFE89: "\u0626", 0xFE8A: "\u0626",
+	0xFE8B: "\u0626", 0xFE8C: "\u0626", 0xFE8D: "\u0627", 0xFE8E: "\u0627",
+	0xFE8F: "\u0628", 0xFE90: "\u0628", 0xFE91: "\u0628", 0xFE92: "\u0628",
+	0xFE93: "\u0629", 0xFE94: "\u0629", 0xFE95: "\u062a", 0xFE96: "\u062a",
+	0xFE97: "\u062a", 0xFE98: "\u062a", 0xFE99: "\u062b", 0xFE9A: "\u062b",
+	0xFE9B: "\u062b", 0xFE9C: "\u062b", 0xFE9D: "\u062c", 0xFE9E: "\u062c",
+	0xFE9F: "\u062c", 0xFEA0: "\u062c", 0xFEA1: "\u062d", 0xFEA2: "\u062d",
+	0xFEA3: "\u062d", 0xFEA4: "\u062d", 0xFEA5: "\u062e", 0xFEA6: "\u062e",
+	0xFEA7: "\u062e", 0xFEA8: "\u062e", 0xFEA9: "\u062f", 0xFEAA: "\u062f",
+	0xFEAB: "\u0630", 0xFEAC: "\u0630", 0xFEAD: "\u0631", 0xFEAE: "\u0631",
+	0xFEAF: "\u0632", 0xFEB0: "\u0632", 0xFEB1: "\u0633", 0xFEB2: "\u0633",
+	0xFEB3: "\u0633", 0xFEB4: "\u0633", 0xFEB5: "\u0634", 0xFEB6: "\u0634",
+	0xFEB7: "\u0634", 0xFEB8: "\u0634", 0xFEB9: "\u0635", 0xFEBA: "\u0635",
+	0xFEBB: "\u0635", 0xFEBC: "\u0635", 0xFEBD: "\u0636", 0xFEBE: "\u0636",
+	0xFEBF: "\u0636", 0xFEC0: "\u0636", 0xFEC1: "\u0637", 0xFEC2: "\u0637",
+	0xFEC3: "\u0637", 0xFEC4: "\u0637", 0xFEC5: "\u0638", 0xFEC6: "\u0638",
+	0xFEC7: "\u0638", 0xFEC8: "\u0638", 0xFEC9: "\u0639", 0xFECA: "\u0639",
+	0xFECB: "\u0639", 0xFECC: "\u0639", 0xFECD: "\u063a", 0xFECE: "\u063a",
+	0xFECF: "\u063a", 0xFED0: "\u063a", 0xFED1: "\u0641", 0xFED2: "\u0641",
+	0xFED3: "\u0641", 0xFED4: "\u0641", 0xFED5: "\u0642", 0xFED6: "\u0642",
+	0xFED7: "\u0642", 0xFED8: "\u0642", 0xFED9: "\u0643", 0xFEDA: "\u0643",
+	0xFEDB: "\u0643", 0xFEDC: "\u0643", 0xFEDD: "\u0644", 0xFEDE: "\u0644",
+	0xFEDF: "\u0644", 0xFEE0: "\u0644", 0xFEE1: "\u0645", 0xFEE2: "\u0645",
+	0xFEE3: "\u0645", 0xFEE4: "\u0645", 0xFEE5: "\u0646", 0xFEE6: "\u0646",
+	0xFEE7: "\u0646", 0xFEE8: "\u0646", 0xFEE9: "\u0647", 0xFEEA: "\u0647",
+	0xFEEB: "\u0647", 0xFEEC: "\u0647", 0xFEED: "\u0648", 0xFEEE: "\u0648",
+	0xFEEF: "\u0649", 0xFEF0: "\u0649", 0xFEF1: "\u064a", 0xFEF2: "\u064a",
+	0xFEF3: "\u064a", 0xFEF4: "\u064a", 0xFEF5: "\u0644\u0622", 0xFEF6: "\u0644\u0622",
+	0xFEF7: "\u0644\u0623", 0xFEF8: "\u0644\u0623", 0xFEF9: "\u0644\u0625", 0xFEFA: "\u0644\u0625",
+	0xFEFB: "\u0644\u0627", 0xFEFC: "\u0644\u0627", 0xFF01: "!", 0xFF02: "\"",
+	0xFF03: "#", 0xFF04: "$", 0xFF05: "%", 0xFF06: "&",
+	0xFF07: "'", 0xFF08: "(", 0xFF09: ")", 0xFF0A: "*",
+	0xFF0B: "+", 0xFF0C: ",", 0xFF0D: "-", 0xFF0E: ".",
+	0xFF0F: "/", 0xFF10: "0", 0xFF11: "1", 0xFF12: "2",
+	0xFF13: "3", 0xFF14: "4", 0xFF15: "5", 0xFF16: "6",
+	0xFF17: "7", 0xFF18: "8", 0xFF19: "9", 0xFF1A: ":",
+	0xFF1B: ";", 0xFF1C: "<", 0xFF1D: "=", 0xFF1E: ">",
+	0xFF1F: "?", 0xFF20: "@", 0xFF21: "A", 0xFF22: "B",
+	0xFF23: "C", 0xFF24: "D", 0xFF25: "E", 0xFF26: "F",
+	0xFF27: "G", 0xFF28: "H", 0xFF29: "I", 0xFF2A: "J",
+	0xFF2B: "K", 0xFF2C: "L", 0xFF2D: "M", 0xFF2E: "N",
+	0xFF2F: "O", 0xFF30: "P", 0xFF31: "Q", 0xFF32: "R",
+	0xFF33: "S", 0xFF34: "T", 0xFF35: "U", 0xFF36: "V",
+	0xFF37: "W", 0xFF38: "X", 0xFF39: "Y", 0xFF3A: "Z",
+	0xFF3B: "[", 0xFF3C: "\\", 0xFF3D: "]", 0xFF3E: "^",
+	0xFF3F: "_", 0xFF40: "`", 0xFF41: "a", 0xFF42: "b",
+	0xFF43: "c", 0xFF44: "d", 0xFF45: "e", 0xFF46: "f",
+	0xFF47: "g", 0xFF48: "h", 0xFF49: "i", 0xFF4A: "j",
+	0xFF4B: "k", 0xFF4C: "l", 0xFF4D: "m", 0xFF4E: "n",
+	0xFF4F: "o", 0xFF50: "p", 0xFF51: "q", 0xFF52: "r",
+	0xFF53: "s", 0xFF54: "t", 0xFF55: "u", 0xFF56: "v",
+	0xFF57: "w", 0xFF58: "x", 0xFF59: "y", 0xFF5A: "z",
+	0xFF5B: "{", 0xFF5C: "|", 0xFF5D: "}", 0xFF5E: "~",
+	0xFF5F: "\u2985", 0xFF60: "\u2986", 0xFF61: "\u3002", 0xFF62: "\u300c",
+	0xFF63: "\u300d", 0xFF64: "\u3001", 0xFF65: "\u30fb", 0xFF66: "\u30f2",
+	0xFF67: "\u30a1", 0xFF68: "\u30a3", 0xFF69: "\u30a5", 0xFF6A: "\u30a7",
+	0xFF6B: "\u30a9", 0xFF6C: "\u30e3", 0xFF6D: "\u30e5", 0xFF6E: "\u30e7",
+	0xFF6F: "\u30c3", 0xFF70: "\u30fc", 0xFF71: "\u30a2", 0xFF72: "\u30a4",
+	0xFF73: "\u30a6", 0xFF74: "\u30a8", 0xFF75: "\u30aa", 0xFF76: "\u30ab",
+	0xFF77: "\u30ad", 0xFF78: "\u30af", 0xFF79: "\u30b1", 0xFF7A: "\u30b3",
+	0xFF7B: "\u30b5", 0xFF7C: "\u30b7", 0xFF7D: "\u30b9", 0xFF7E: "\u30bb",
+	0xFF7F: "\u30bd", 0xFF80: "\u30bf", 0xFF81: "\u30c1", 0xFF82: "\u30c4",
+	0xFF83: "\u30c6", 0xFF84: "\u30c8", 0xFF85: "\u30ca", 0xFF86: "\u30cb",
+	0xFF87: "\u30cc", 0xFF88: "\u30cd", 0xFF89: "\u30ce", 0xFF8A: "\u30cf",
+	0xFF8B: "\u30d2", 0xFF8C: "\u30d5", 0xFF8D: "\u30d8", 0xFF8E: "\u30db",
+	0xFF8F: "\u30de", 0xFF90: "\u30df", 0xFF91: "\u30e0", 0xFF92: "\u30e1",
+	0xFF93: "\u30e2", 0xFF94: "\u30e4", 0xFF95: "\u30e6", 0xFF96: "\u30e8",
+	0xFF97: "\u30e9", 0xFF98: "\u30ea", 0xFF99: "\u30eb", 0xFF9A: "\u30ec",
+	0xFF9B: "\u30ed", 0xFF9C: "\u30ef", 0xFF9D: "\u30f3", 0xFF9E: "\u3099",
+	0xFF9F: "\u309a", 0xFFA0: "\u3164", 0xFFA1: "\u3131", 0xFFA2: "\u3132",
+	0xFFA3: "\u3133", 0xFFA4: "\u3134", 0xFFA5: "\u3135", 0xFFA6: "\u3136",
+	0xFFA7: "\u3137", 0xFFA8: "\u3138", 0xFFA9: "\u3139", 0xFFAA: "\u313a",
+	0xFFAB: "\u313b", 0xFFAC: "\u313c", 0xFFAD: "\u313d", 0xFFAE: "\u313e",
+	0xFFAF: "\u313f", 0xFFB0: "\u3140", 0xFFB1: "\u3141", 0xFFB2: "\u3142",
+	0xFFB3: "\u3143", 0xFFB4: "\u3144", 0xFFB5: "\u3145", 0xFFB6: "\u3146",
+	0xFFB7: "\u3147", 0xFFB8: "\u3148", 0xFFB9: "\u3149", 0xFFBA: "\u314a",
+	0xFFBB: "\u314b", 0xFFBC: "\u314c", 0xFFBD: "\u314d", 0xFFBE: "\u314e",
+	0xFFC2: "\u314f", 0xFFC3: "\u3150", 0xFFC4: "\u3151", 0xFFC5: "\u3152",
+	0xFFC6: "\u3153", 0xFFC7: "\u3154", 0xFFCA: "\u3155", 0xFFCB: "\u3156",
+	0xFFCC: "\u3157", 0xFFCD: "\u3158", 0xFFCE: "\u3159", 0xFFCF: "\u315a",
+	0xFFD2: "\u315b", 0xFFD3: "\u315c", 0xFFD4: "\u315d", 0xFFD5: "\u315e",
+	0xFFD6: "\u315f", 0xFFD7: "\u3160", 0xFFDA: "\u3161", 0xFFDB: "\u3162",
+	0xFFDC: "\u3163", 0xFFE0: "\u00a2", 0xFFE1: "\u00a3", 0xFFE2: "\u00ac",
+	0xFFE3: "\u00af", 0xFFE4: "\u00a6", 0xFFE5: "\u00a5", 0xFFE6: "\u20a9",
+	0xFFE8: "\u2502", 0xFFE9: "\u2190", 0xFFEA: "\u2191", 0xFFEB: "\u2192",
+	0xFFEC: "\u2193", 0xFFED: "\u25a0", 0xFFEE: "\u25cb", 0x10781: "\u02d0",
+	0x10782: "\u02d1", 0x10783: "\u00e6", 0x10784: "\u0299", 0x10785: "\u0253",
+	0x10787: "\u02a3", 0x10788: "\uab66", 0x10789: "\u02a5", 0x1078A: "\u02a4",
+	0x1078B: "\u0256", 0x1078C: "\u0257", 0x1078D: "\u1d91", 0x1078E: "\u0258",
+	0x1078F: "\u025e", 0x10790: "\u02a9", 0x10791: "\u0264", 0x10792: "\u0262",
+	0x10793: "\u0260", 0x10794: "\u029b", 0x10795: "\u0127", 0x10796: "\u029c",
+	0x10797: "\u0267", 0x10798: "\u0284", 0x10799: "\u02aa", 0x1079A: "\u02ab",
+	0x1079B: "\u026c", 0x1079C: "\U0001df04", 0x1079D: "\ua78e", 0x1079E: "\u026e",
+	0x1079F: "\U0001df05", 0x107A0: "\u028e", 0x107A1: "\U0001df06", 0x107A2: "\u00f8",
+	0x107A3: "\u0276", 0x107A4: "\u0277", 0x107A5: "q", 0x107A6: "\u027a",
+	0x107A7: "\U0001df08", 0x107A8: "\u027d", 0x107A9: "\u027e", 0x107AA: "\u0280",
+	0x107AB: "\u02a8", 0x107AC: "\u02a6", 0x107AD: "\uab67", 0x107AE: "\u02a7",
+	0x107AF: "\u0288", 0x107B0: "\u2c71", 0x107B2: "\u028f", 0x107B3: "\u02a1",
+	0x107B4: "\u02a2", 0x107B5: "\u0298", 0x107B6: "\u01c0", 0x107B7: "\u01c1",
+	0x107B8: "\u01c2", 0x107B9: "\U0001df0a", 0x107BA: "\U0001df1e", 0x1D400: "A",
+	0x1D401: "B", 0x1D402: "C", 0x1D403: "D", 0x1D404: "E",
+	0x1D405: "F", 0x1D406: "G", 0x1D407: "H", 0x1D408: "I",
+	0x1D409: "J", 0x1D40A: "K", 0x1D40B: "L", 0x1D40C: "M",
+	0x1D40D: "N", 0x1D40E: "O", 0x1D40F: "P", 0x1D410: "Q",
+	0x1D411: "R", 0x1D412: "S", 0x1D413: "T", 0x1D414: "U",
+	0x1D415: "V", 0x1D416: "W", 0x1D417: "X", 0x1D418: "Y",
+	0x1D419: "Z", 0x1D41A: "a", 0x1D41B: "b", 0x1D41C: "c",
+	0x1D41D: "d", 0x1D41E: "e", 0x1D41F: "f", 0x1D420: "g",
+	0x1D421: "h", 0x1D422: "i", 0x1D423: "j", 0x1D424: "k",
+	0x1D425: "l", 0x1D426: "m", 0x1D427: "n", 0x1D428: "o",
+	0x1D429: "p", 0x1D42A: "q", 0x1D42B: "r", 0x1D42C: "s",
+	0x1D42D: "t", 0x1D42E: "u", 0x1D42F: "v", 0x1D430: "w",
+	0x1D431: "x", 0x1D432: "y", 0x1D433: "z", 0x1D434: "A",
+	0x1D435: "B", 0x1D436: "C", 0x1D437: "D", 0x1D438: "E",
+	0x1D439: "F", 0x1D43A: "G", 0x1D43B: "H", 0x1D43C: "I",
+	0x1D43D: "J", 0x1D43E: "K", 0x1D43F: "L", 0x1D440: "M",
+	0x1D441: "N", 0x1D442: "O", 0x1D443: "P", 0x1D444: "Q",
+	0x1D445: "R", 0x1D446: "S", 0x1D447: "T", 0x1D448: "U",
+	0x1D449: "V", 0x1D44A: "W", 0x1D44B: "X", 0x1D44C: "Y",
+	0x1D44D: "Z", 0x1D44E: "a", 0x1D44F: "b", 0x1D450: "c",
+	0x1D451: "d", 0x1D452: "e", 0x1D453: "f", 0x1D454: "g",
+	0x1D456: "i", 0x1D457: "j", 0x1D458: "k", 0x1D459: "l",
+	0x1D45A: "m", 0x1D45B: "n", 0x1D45C: "o", 0x1D45D: "p",
+	0x1D45E: "q", 0x1D45F: "r", 0x1D460: "s", 0x1D461: "t",
+	0x1D462: "u", 0x1D463: "v", 0x1D464: "w", 0x1D465: "x",
+	0x1D466: "y", 0x1D467: "z", 0x1D468: "A", 0x1D469: "B",
+	0x1D46A: "C", 0x1D46B: "D", 0x1D46C: "E", 0x1D46D: "F",
+	0x1D46E: "G", 0x1D46F: "H", 0x1D470: "I", 0x1D471: "J",
+	0x1D472: "K", 0x1D473: "L", 0x1D474: "M", 0x1D475: "N",
+	0x1D476: "O", 0x1D477: "P", 0x1D478: "Q", 0x1D479: "R",
+	0x1D47A: "S", 0x1D47B: "T", 0x1D47C: "U", 0x1D47D: "V",
+	0x1D47E: "W", 0x1D47F: "X", 0x1D480: "Y", 0x1D481: "Z",
+	0x1D482: "a", 0x1D483: "b", 0x1D484: "c", 0x1D485: "d",
+	0x1D486: "e", 0x1D487: "f", 0x1D488: "g", 0x1D489: "h",
+	0x1D48A: "i", 0x1D48B: "j", 0x1D48C: "k", 0x1D48D: "l",
+	0x1D48E: "m", 0x1D48F: "n", 0x1D490: "o", 0x1D491: "p",
+	0x1D492: "q", 0x1D493: "r", 0x1D494: "s", 0x1D495: "t",
+	0x1D496: "u", 0x1D497: "v", 0x1D498: "w", 0x1D499: "x",
+	0x1D49A: "y", 0x1D49B: "z", 0x1D49C: "A", 0x1D49E: "C",
+	0x1D49F: "D", 0x1D4A2: "G", 0x1D4A5: "J", 0x1D4A6: "K",
+	0x1D4A9: "N", 0x1D4AA: "O", 0x1D4AB: "P", 0x1D4AC: "Q",
+	0x1D4AE: "S", 0x1D4AF: "T", 0x1D4B0: "U", 0x1D4B1: "V",
+	0x1D4B2: "W", 0x1D4B3: "X", 0x1D4B4: "Y", 0x1D4B5: "Z",
+	0x1D4B6: "a", 0x1D4B7: "b", 0x1D4B8: "c", 0x1D4B9: "d",
+	0x1D4BB: "f", 0x1D4BD: "h", 0x1D4BE: "i", 0x1D4BF: "j",
+	0x1D4C0: "k", 0x1D4C1: "l", 0x1D4C2: "m", 0x1D4C3: "n",
+	0x1D4C5: "p", 0x1D4C6: "q", 0x1D4C7: "r", 0x1D4C8: "s",
+	0x1D4C9: "t", 0x1D4CA: "u", 0x1D4CB: "v", 0x1D4CC: "w",
+	0x1D4CD: "x", 0x1D4CE: "y", 0x1D4CF: "z", 0x1D4D0: "A",
+	0x1D4D1: "B", 0x1D4D2: "C", 0x1D4D3: "D", 0x1D4D4: "E",
+	0x1D4D5: "F", 0x1D4D6: "G", 0x1D4D7: "H", 0x1D4D8: "I",
+	0x1D4D9: "J", 0x1D4DA: "K", 0x1D4DB: "L", 0x1D4DC: "M",
+	0x1D4DD: "N", 0x1D4DE: "O", 0x1D4DF: "P", 0x1D4E0: "Q",
+	0x1D4E1: "R", 0x1D4E2: "S", 0x1D4E3: "T", 0x1D4E4: "U",
+	0x1D4E5: "V", 0x1D4E6: "W", 0x1D4E7: "X", 0x1D4E8: "Y",
+	0x1D4E9: "Z", 0x1D4EA: "a", 0x1D4EB: "b", 0x1D4EC: "c",
+	0x1D4ED: "d", 0x1D4EE: "e", 0x1D4EF: "f", 0x1D4F0: "g",
+	0x1D4F1: "h", 0x1D4F2: "i", 0x1D4F3: "j", 0x1D4F4: "k",
+	0x1D4F5: "l", 0x1D4F6: "m", 0x1D4F7: "n", 0x1D4F8: "o",
+	0x1D4F9: "p", 0x1D4FA: "q", 0x1D4FB: "r", 0x1D4FC: "s",
+	0x1D4FD: "t", 0x1D4FE: "u", 0x1D4FF: "v", 0x1D500: "w",
+	0x1D501: "x", 0x1D502: "y", 0x1D503: "z", 0x1D504: "A",
+	0x1D505: "B", 0x1D507: "D", 0x1D508: "E", 0x1D509: "F",
+	0x1D50A: "G", 0x1D50D: "J", 0x1D50E: "K", 0x1D50F: "L",
+	0x1D510: "M", 0x1D511: "N", 0x1D512: "O", 0x1D513: "P",
+	0x1D514: "Q", 0x1D516: "S", 0x1D517: "T", 0x1D518: "U",
+	0x1D519: "V", 0x1D51A: "W", 0x1D51B: "X", 0x1D51C: "Y",
+	0x1D51E: "a", 0x1D51F: "b", 0x1D520: "c", 0x1D521: "d",
+	0x1D522: "e", 0x1D523: "f", 0x1D524: "g", 0x1D525: "h",
+	0x1D526: "i", 0x1D527: "j", 0x1D528: "k", 0x1D529: "l",
+	0x1D52A: "m", 0x1D52B: "n", 0x1D52C: "o", 0x1D52D: "p",
+	0x1D52E: "q", 0x1D52F: "r", 0x1D530: "s", 0x1D531: "t",
+	0x1D532: "u", 0x1D533: "v", 0x1D534: "w", 0x1D535: "x",
+	0x1D536: "y", 0x1D537: "z", 0x1D538: "A", 0x1D539: "B",
+	0x1D53B: "D", 0x1D53C: "E", 0x1D53D: "F", 0x1D53E: "G",
+	0x1D540: "I", 0x1D541: "J", 0x1D542: "K", 0x1D543: "L",
+	0x1D544: "M", 0x1D546: "O", 0x1D54A: "S", 0x1D54B: "T",
+	0x1D54C: "U", 0x1D54D: "V", 0x1D54E: "W", 0x1D54F: "X",
+	0x1D550: "Y", 0x1D552: "a", 0x1D553: "b", 0x1D554: "c",
+	0x1D555: "d", 0x1D556: "e", 0x1D557: "f", 0x1D558: "g",
+	0x1D559: "h", 0x1D55A: "i", 0x1D55B: "j", 0x1D55C: "k",
+	0x1D55D: "l", 0x1D55E: "m", 0x1D55F: "n", 0x1D560: "o",
+	0x1D561: "p", 0x1D562: "q", 0x1D563: "r", 0x1D564: "s",
+	0x1D565: "t", 0x1D566: "u", 0x1D567: "v", 0x1D568: "w",
+	0x1D569: "x", 0x1D56A: "y", 0x1D56B: "z", 0x1D56C: "A",
+	0x1D56D: "B", 0x1D56E: "C", 0x1D56F: "D", 0x1D570: "E",
+	0x1D571: "F", 0x1D572: "G", 0x1D573: "H", 0x1D574: "I",
+	0x1D575: "J", 0x1D576: "K", 0x1D577: "L", 0x1D578: "M",
+	0x1D579: "N", 0x1D57A: "O", 0x1D57B: "P", 0x1D57C: "Q",
+	0x1D57D: "R", 0x1D57E: "S", 0x1D57F: "T", 0x1D580: "U",
+	0x1D581: "V", 0x1D582: "W", 0x1D583: "X", 0x1D584: "Y",
+	0x1D585: "Z", 0x1D586: "a", 0x1D587: "b", 0x1D588: "c",
+	0x1D589: "d", 0x1D58A: "e", 0x1D58B: "f", 0x1D58C: "g",
+	0x1D58D: "h", 0x1D58E: "i", 0x1D58F: "j", 0x1D590: "k",
+	0x1D591: "l", 0x1D592: "m", 0x1D593: "n", 0x1D594: "o",
+	0x1D595: "p", 0x1D596: "q", 0x1D597: "r", 0x1D598: "s",
+	0x1D599: "t", 0x1D59A: "u", 0x1D59B: "v", 0x1D59C: "w",
+	0x1D59D: "x", 0x1D59E: "y", 0x1D59F: "z", 0x1D5A0: "A",
+	0x1D5A1: "B", 0x1D5A2: "C", 0x1D5A3: "D", 0x1D5A4: "E",
+	0x1D5A5: "F", 0x1D5A6: "G", 0x1D5A7: "H", 0x1D5A8: "I",
+	0x1D5A9: "J", 0x1D5AA: "K", 0x1D5AB: "L", 0x1D5AC: "M",
+	0x1D5AD: "N", 0x1D5AE: "O", 0x1D5AF: "P", 0x1D5B0: "Q",
+	0x1D5B1: "R", 0x1D5B2: "S", 0x1D5B3: "T", 0x1D5B4: "U",
+	0x1D5B5: "V", 0x1D5B6: "W", 0x1D5B7: "X", 0x1D5B8: "Y",
+	0x1D5B9: "Z", 0x1D5BA: "a", 0x1D5BB: "b", 0x1D5BC: "c",
+	0x1D5BD: "d", 0x1D5BE: "e", 0x1D5BF: "f", 0x1D5C0: "g",
+	0x1D5C1: "h", 0x1D5C2: "i", 0x1D5C3: "j", 0x1D5C4: "k",
+	0x1D5C5: "l", 0x1D5C6: "m", 0x1D5C7: "n", 0x1D5C8: "o",
+	0x1D5C9: "p", 0x1D5CA: "q", 0x1D5CB: "r", 0x1D5CC: "s",
+	0x1D5CD: "t", 0x1D5CE: "u", 0x1D5CF: "v", 0x1D5D0: "w",
+	0x1D5D1: "x", 0x1D5D2: "y", 0x1D5D3: "z", 0x1D5D4: "A",
+	0x1D5D5: "B", 0x1D5D6: "C", 0x1D5D7: "D", 0x1D5D8: "E",
+	0x1D5D9: "F", 0x1D5DA: "G", 0x1D5DB: "H", 0x1D5DC: "I",
+	0x1D5DD: "J", 0x1D5DE: "K", 0x1D5DF: "L", 0x1D5E0: "M",
+	0x1D5E1: "N", 0x1D5E2: "O", 0x1D5E3: "P", 0x1D5E4: "Q",
+	0x1D5E5: "R", 0x1D5E6: "S", 0x1D5E7: "T", 0x1D5E8: "U",
+	0x1D5E9: "V", 0x1D5EA: "W", 0x1D5EB: "X", 0x1D5EC: "Y",
+	0x1D5ED: "Z", 0x1D5EE: "a", 0x1D5EF: "b", 0x1D5F0: "c",
+	0x1D5F1: "d", 0x1D5F2: "e", 0x1D5F3: "f", 0x1D5F4: "g",
+	0x1D5F5: "h", 0x1D5F6: "i", 0x1D5F7: "j", 0x1D5F8: "k",
+	0x1D5F9: "l", 0x1D5FA: "m", 0x1D5FB: "n", 0x1D5FC: "o",
+	0x1D5FD: "p", 0x1D5FE: "q", 0x1D5FF: "r", 0x1D600: "s",
+	0x1D601: "t", 0x1D602: "u", 0x1D603: "v", 0x1D604: "w",
+	0x1D605: "x", 0x1D606: "y", 0x1D607: "z", 0x1D608: "A",
+	0x1D609: "B", 0x1D60A: "C", 0x1D60B: "D", 0x1D60C: "E",
+	0x1D60D: "F", 0x1D60E: "G", 0x1D60F: "H", 0x1D610: "I",
+	0x1D611: "J", 0x1D612: "K", 0x1D613: "L", 0x1D614: "M",
+	0x1D615: "N", 0x1D616: "O", 0x1D617: "P", 0x1D618: "Q",
+	0x1D619: "R", 0x1D61A: "S", 0x1D61B: "T", 0x1D61C: "U",
+	0x1D61D: "V", 0x1D61E: "W", 0x1D61F: "X", 0x1D620: "Y",
+	0x1D621: "Z", 0x1D622: "a", 0x1D623: "b", 0x1D624: "c",
+	0x1D625: "d", 0x1D626: "e", 0x1D627: "f", 0x1D628: "g",
+	0x1D629: "h", 0x1D62A: "i", 0x1D62B: "j", 0x1D62C: "k",
+	0x1D62D: "l", 0x1D62E: "m", 0x1D62F: "n", 0x1D630: "o",
+	0x1D631: "p", 0x1D632: "q", 0x1D633: "r", 0x1D634: "s",
+	0x1D635: "t", 0x1D636: "u", 0x1D637: "v", 0x1D638: "w",
+	0x1D639: "x", 0x1D63A: "y", 0x1D63B: "z", 0x1D63C: "A",
+	0x1D63D: "B", 0x1D63E: "C", 0x1D63F: "D", 0x1D640: "E",
+	0x1D641: "F", 0x1D642: "G", 0x1D643: "H", 0x1D644: "I",
+	0x1D645: "J", 0x1D646: "K", 0x1D647: "L", 0x1D648: "M",
+	0x1D649: "N", 0x1D64A: "O", 0x1D64B: "P", 0x1D64C: "Q",
+	0x1D64D: "R", 0x1D64E: "S", 0x1D64F: "T", 0x1D650: "U",
+	0x1D651: "V", 0x1D652: "W", 0x1D653: "X", 0x1D654: "Y",
+	0x1D655: "Z", 0x1D656: "a", 0x1D657: "b", 0x1D658: "c",
+	0x1D659: "d", 0x1D65A: "e", 0x1D65B: "f", 0x1D65C: "g",
+	0x1D65D: "h", 0x1D65E: "i", 0x1D65F: "j", 0x1D660: "k",
+	0x1D661: "l", 0x1D662: "m", 0x1D663: "n", 0x1D664: "o",
+	0x1D665: "p", 0x1D666: "q", 0x1D667: "r", 0x1D668: "s",
+	0x1D669: "t", 0x1D66A: "u", 0x1D66B: "v", 0x1D66C: "w",
+	0x1D66D: "x", 0x1D66E: "y", 0x1D66F: "z", 0x1D670: "A",
+	0x1D671: "B", 0x1D672: "C", 0x1D673: "D", 0x1D674: "E",
+	0x1D675: "F", 0x1D676: "G", 0x1D677: "H", 0x1D678: "I",
+	0x1D679: "J", 0x1D67A: "K", 0x1D67B: "L", 0x1D67C: "M",
+	0x1D67D: "N", 0x1D67E: "O", 0x1D67F: "P", 0x1D680: "Q",
+	0x1D681: "R", 0x1D682: "S", 0x1D683: "T", 0x1D684: "U",
+	0x1D685: "V", 0x1D686: "W", 0x1D687: "X", 0x1D688: "Y",
+	0x1D689: "Z", 0x1D68A: "a", 0x1D68B: "b", 0x1D68C: "c",
+	0x1D68D: "d", 0x1D68E: "e", 0x1D68F: "f", 0x1D690: "g",
+	0x1D691: "h", 0x1D692: "i", 0x1D693: "j", 0x1D694: "k",
+	0x1D695: "l", 0x1D696: "m", 0x1D697: "n", 0x1D698: "o",
+	0x1D699: "p", 0x1D69A: "q", 0x1D69B: "r", 0x1D69C: "s",
+	0x1D69D: "t", 0x1D69E: "u", 0x1D69F: "v", 0x1D6A0: "w",
+	0x1D6A1: "x", 0x1D6A2: "y", 0x1D6A3: "z", 0x1D6A4: "\u0131",
+	0x1D6A5: "\u0237", 0x1D6A8: "\u0391", 0x1D6A9: "\u0392", 0x1D6AA: "\u0393",
+	0x1D6AB: "\u0394", 0x1D6AC: "\u0395", 0x1D6AD: "\u0396", 0x1D6AE: "\u0397",
+	0x1D6AF: "\u0398", 0x1D6B0: "\u0399", 0x1D6B1: "\u039a", 0x1D6B2: "\u039b",
+	0x1D6B3: "\u039c", 0x1D6B4: "\u039d", 0x1D6B5: "\u039e", 0x1D6B6: "\u039f",
+	0x1D6B7: "\u03a0", 0x1D6B8: "\u03a1", 0x1D6B9: "\u03f4", 0x1D6BA: "\u03a3",
+	0x1D6BB: "\u03a4", 0x1D6BC: "\u03a5", 0x1D6BD: "\u03a6", 0x1D6BE: "\u03a7",
+	0x1D6BF: "\u03a8", 0x1D6C0: "\u03a9", 0x1D6C1: "\u2207", 0x1D6C2: "\u03b1",
+	0x1D6C3: "\u03b2", 0x1D6C4: "\u03b3", 0x1D6C5: "\u03b4", 0x1D6C6: "\u03b5",
+	0x1D6C7: "\u03b6", 0x1D6C8: "\u03b7", 0x1D6C9: "\u03b8", 0x1D6CA: "\u03b9",
+	0x1D6CB: "\u03ba", 0x1D6CC: "\u03bb", 0x1D6CD: "\u03bc", 0x1D6CE: "\u03bd",
+	0x1D6CF: "\u03be", 0x1D6D0: "\u03bf", 0x1D6D1: "\u03c0", 0x1D6D2: "\u03c1",
+	0x1D6D3: "\u03c2", 0x1D6D4: "\u03c3", 0x1D6D5: "\u03c4", 0x1D6D6: "\u03c5",
+	0x1D6D7: "\u03c6", 0x1D6D8: "\u03c7", 0x1D6D9: "\u03c8", 0x1D6DA: "\u03c9",
+	0x1D6DB: "\u2202", 0x1D6DC: "\u03f5", 0x1D6DD: "\u03d1", 0x1D6DE: "\u03f0",
+	0x1D6DF: "\u03d5", 0x1D6E0: "\u03f1", 0x1D6E1: "\u03d6", 0x1D6E2: "\u0391",
+	0x1D6E3: "\u0392", 0x1D6E4: "\u0393", 0x1D6E5: "\u0394", 0x1D6E6: "\u0395",
+	0x1D6E7: "\u0396", 0x1D6E8: "\u0397", 0x1D6E9: "\u0398", 0x1D6EA: "\u0399",
+	0x1D6EB: "\u039a", 0x1D6EC: "\u039b", 0x1D6ED: "\u039c", 0x1D6EE: "\u039d",
+	0x1D6EF: "\u039e", 0x1D6F0: "\u039f", 0x1D6F1: "\u03a0", 0x1D6F2: "\u03a1",
+	0x1D6F3: "\u03f4", 0x1D6F4: "\u03a3", 0x1D6F5: "\u03a4", 0x1D6F6: "\u03a5",
+	0x1D6F7: "\u03a6", 0x1D6F8: "\u03a7", 0x1D6F9: "\u03a8", 0x1D6FA: "\u03a9",
+	0x1D6FB: "\u2207", 0x1D6FC: "\u03b1", 0x1D6FD: "\u03b2", 0x1D6FE: "\u03b3",
+	0x1D6FF: "\u03b4", 0x1D700: "\u03b5", 0x1D701: "\u03b6", 0x1D702: "\u03b7",
+	0x1D703: "\u03b8", 0x1D704: "\u03b9", 0x1D705: "\u03ba", 0x1D706: "\u03bb",
+	0x1D707: "\u03bc", 0x1D708: "\u03bd", 0x1D709: "\u03be", 0x1D70A: "\u03bf",
+	0x1D70B: "\u03c0", 0x1D70C: "\u03c1", 0x1D70D: "\u03c2", 0x1D70E: "\u03c3",
+	0x1D70F: "\u03c4", 0x1D710: "\u03c5", 0x1D711: "\u03c6", 0x1D712: "\u03c7",
+	0x1D713: "\u03c8", 0x1D714: "\u03c9", 0x1D715: "\u2202", 0x1D716: "\u03f5",
+	0x1D717: "\u03d1", 0x1D718: "\u03f0", 0x1D719: "\u03d5", 0x1D71A: "\u03f1",
+	0x1D71B: "\u03d6", 0x1D71C: "\u0391", 0x1D71D: "\u0392", 0x1D71E: "\u0393",
+	0x1D71F: "\u0394", 0x1D720: "\u0395", 0x1D721: "\u0396", 0x1D722: "\u0397",
+	0x1D723: "\u0398", 0x1D724: "\u0399", 0x1D725: "\u039a", 0x1D726: "\u039b",
+	0x1D727: "\u039c", 0x1D728: "\u039d", 0x1D729: "\u039e", 0x1D72A: "\u039f",
+	0x1D72B: "\u03a0", 0x1D72C: "\u03a1", 0x1D72D: "\u03f4", 0x1D72E: "\u03a3",
+	0x1D72F: "\u03a4", 0x1D730: "\u03a5", 0x1D731: "\u03a6", 0x1D732: "\u03a7",
+	0x1D733: "\u03a8", 0x1D734: "\u03a9", 0x1D735: "\u2207", 0x1D736: "\u03b1",
+	0x1D737: "\u03b2", 0x1D738: "\u03b3", 0x1D739: "\u03b4", 0x1D73A: "\u03b5",
+	0x1D73B: "\u03b6", 0x1D73C: "\u03b7", 0x1D73D: "\u03b8", 0x1D73E: "\u03b9",
+	0x1D73F: "\u03ba", 0x1D740: "\u03bb", 0x1D741: "\u03bc", 0x1D742: "\u03bd",
+	0x1D743: "\u03be", 0x1D744: "\u03bf", 0x1D745: "\u03c0", 0x1D746: "\u03c1",
+	0x1D747: "\u03c2", 0x1D748: "\u03c3", 0x1D749: "\u03c4", 0x1D74A: "\u03c5",
+	0x1D74B: "\u03c6", 0x1D74C: "\u03c7", 0x1D74D: "\u03c8", 0x1D74E: "\u03c9",
+	0x1D74F: "\u2202", 0x1D750: "\u03f5", 0x1D751: "\u03d1", 0x1D752: "\u03f0",
+	0x1D753: "\u03d5", 0x1D754: "\u03f1", 0x1D755: "\u03d6", 0x1D756: "\u0391",
+	0x1D757: "\u0392", 0x1D758: "\u0393", 0x1D759: "\u0394", 0x1D75A: "\u0395",
+	0x1D75B: "\u0396", 0x1D75C: "\u0397", 0x1D75D: "\u0398", 0x1D75E: "\u0399",
+	0x1D75F: "\u039a", 0x1D760: "\u039b", 0x1D761: "\u039c", 0x1D762: "\u039d",
+	0x1D763: "\u039e", 0x1D764: "\u039f", 0x1D765: "\u03a0", 0x1D766: "\u03a1",
+	0x1D767: "\u03f4", 0x1D768: "\u03a3", 0x1D769: "\u03a4", 0x1D76A: "\u03a5",
+	0x1D76B: "\u03a6", 0x1D76C: "\u03a7", 0x1D76D: "\u03a8", 0x1D76E: "\u03a9",
+	0x1D76F: "\u2207", 0x1D770: "\u03b1", 0x1D771: "\u03b2", 0x1D772: "\u03b3",
+	0x1D773: "\u03b4", 0x1D774: "\u03b5", 0x1D775: "\u03b6", 0x1D776: "\u03b7",
+	0x1D777: "\u03b8", 0x1D778: "\u03b9", 0x1D779: "\u03ba", 0x1D77A: "\u03bb",
+	0x1D77B: "\u03bc", 0x1D77C: "\u03bd", 0x1D77D: "\u03be", 0x1D77E: "\u03bf",
+	0x1D77F: "\u03c0", 0x1D780: "\u03c1", 0x1D781: "\u03c2", 0x1D782: "\u03c3",
+	0x1D783: "\u03c4", 0x1D784: "\u03c5", 0x1D785: "\u03c6", 0x1D786: "\u03c7",
+	0x1D787: "\u03c8", 0x1D788: "\u03c9", 0x1D789: "\u2202", 0x1D78A: "\u03f5",
+	0x1D78B: "\u03d1", 0x1D78C: "\u03f0", 0x1D78D: "\u03d5", 0x1D78E: "\u03f1",
+	0x1D78F: "\u03d6", 0x1D790: "\u0391", 0x1D791: "\u0392", 0x1D792: "\u0393",
+	0x1D793: "\u0394", 0x1D794: "\u0395", 0x1D795: "\u0396", 0x1D796: "\u0397",
+	0x1D797: "\u0398", 0x1D798: "\u0399", 0x1D799: "\u039a", 0x1D79A: "\u039b",
+	0x1D79B: "\u039c", 0x1D79C: "\u039d", 0x1D79D: "\u039e", 0x1D79E: "\u039f",
+	0x1D79F: "\u03a0", 0x1D7A0: "\u03a1", 0x1D7A1: "\u03f4", 0x1D7A2: "\u03a3",
+	0x1D7A3: "\u03a4", 0x1D7A4: "\u03a5", 0x1D7A5: "\u03a6", 0x1D7A6: "\u03a7",
+	0x1D7A7: "\u03a8", 0x1D7A8: "\u03a9", 0x1D7A9: "\u2207", 0x1D7AA: "\u03b1",
+	0x1D7AB: "\u03b2", 0x1D7AC: "\u03b3", 0x1D7AD: "\u03b4", 0x1D7AE: "\u03b5",
+	0x1D7AF: "\u03b6", 0x1D7B0: "\u03b7", 0x1D7B1: "\u03b8", 0x1D7B2: "\u03b9",
+	0x1D7B3: "\u03ba", 0x1D7B4: "\u03bb", 0x1D7B5: "\u03bc", 0x1D7B6: "\u03bd",
+	0x1D7B7: "\u03be", 0x1D7B8: "\u03bf", 0x1D7B9: "\u03c0", 0x1D7BA: "\u03c1",
+	0x1D7BB: "\u03c2", 0x1D7BC: "\u03c3", 0x1D7BD: "\u03c4", 0x1D7BE: "\u03c5",
+	0x1D7BF: "\u03c6", 0x1D7C0: "\u03c7", 0x1D7C1: "\u03c8", 0x1D7C2: "\u03c9",
+	0x1D7C3: "\u2202", 0x1D7C4: "\u03f5", 0x1D7C5: "\u03d1", 0x1D7C6: "\u03f0",
+	0x1D7C7: "\u03d5", 0x1D7C8: "\u03f1", 0x1D7C9: "\u03d6", 0x1D7CA: "\u03dc",
+	0x1D7CB: "\u03dd", 0x1D7CE: "0", 0x1D7CF: "1", 0x1D7D0: "2",
+	0x1D7D1: "3", 0x1D7D2: "4", 0x1D7D3: "5", 0x1D7D4: "6",
+	0x1D7D5: "7", 0x1D7D6: "8", 0x1D7D7: "9", 0x1D7D8: "0",
+	0x1D7D9: "1", 0x1D7DA: "2", 0x1D7DB: "3", 0x1D7DC: "4",
+	0x1D7DD: "5", 0x1D7DE: "6", 0x1D7DF: "7", 0x1D7E0: "8",
+	0x1D7E1: "9", 0x1D7E2: "0", 0x1D7E3: "1", 0x1D7E4: "2",
+	0x1D7E5: "3", 0x1D7E6: "4", 0x1D7E7: "5", 0x1D7E8: "6",
+	0x1D7E9: "7", 0x1D7EA: "8", 0x1D7EB: "9", 0x1D7EC: "0",
+	0x1D7ED: "1", 0x1D7EE: "2", 0x1D7EF: "3", 0x1D7F0: "4",
+	0x1D7F1: "5", 0x1D7F2: "6", 0x1D7F3: "7", 0x1D7F4: "8",
+	0x1D7F5: "9", 0x1D7F6: "0", 0x1D7F7: "1", 0x1D7F8: "2",
+	0x1D7F9: "3", 0x1D7FA: "4", 0x1D7FB: "5", 0x1D7FC: "6",
+	0x1D7FD: "7", 0x1D7FE: "8", 0x1D7FF: "9", 0x1EE00: "\u0627",
+	0x1EE01: "\u0628", 0x1EE02: "\u062c", 0x1EE03: "\u062f", 0x1EE05: "\u0648",
+	0x1EE06: "\u0632", 0x1EE07: "\u062d", 0x1EE08: "\u0637", 0x1EE09: "\u064a",
+	0x1EE0A: "\u0643", 0x1EE0B: "\u0644", 0x1EE0C: "\u0645", 0x1EE0D: "\u0646",
+	0x1EE0E: "\u0633", 0x1EE0F: "\u0639", 0x1EE10: "\u0641", 0x1EE11: "\u0635",
+	0x1EE12: "\u0642", 0x1EE13: "\u0631", 0x1EE14: "\u0634", 0x1EE15: "\u062a",
+	0x1EE16: "\u062b", 0x1EE17: "\u062e", 0x1EE18: "\u0630", 0x1EE19: "\u0636",
+	0x1EE1A: "\u0638", 0x1EE1B: "\u063a", 0x1EE1C: "\u066e", 0x1EE1D: "\u06ba",
+	0x1EE1E: "\u06a1", 0x1EE1F: "\u066f", 0x1EE21: "\u0628", 0x1EE22: "\u062c",
+	0x1EE24: "\u0647", 0x1EE27: "\u062d", 0x1EE29: "\u064a", 0x1EE2A: "\u0643",
+	0x1EE2B: "\u0644", 0x1EE2C: "\u0645", 0x1EE2D: "\u0646", 0x1EE2E: "\u0633",
+	0x1EE2F: "\u0639", 0x1EE30: "\u0641", 0x1EE31: "\u0635", 0x1EE32: "\u0642",
+	0x1EE34: "\u0634", 0x1EE35: "\u062a", 0x1EE36: "\u062b", 0x1EE37: "\u062e",
+	0x1EE39: "\u0636", 0x1EE3B: "\u063a", 0x1EE42: "\u062c", 0x1EE47: "\u062d",
+	0x1EE49: "\u064a", 0x1EE4B: "\u0644", 0x1EE4D: "\u0646", 0x1EE4E: "\u0633",
+	0x1EE4F: "\u0639", 0x1EE51: "\u0635", 0x1EE52: "\u0642", 0x1EE54: "\u0634",
+	0x1EE57: "\u062e", 0x1EE59: "\u0636", 0x1EE5B: "\u063a", 0x1EE5D: "\u06ba",
+	0x1EE5F: "\u066f", 0x1EE61: "\u0628", 0x1EE62: "\u062c", 0x1EE64: "\u0647",
+	0x1EE67: "\u062d", 0x1EE68: "\u0637", 0x1EE69: "\u064a", 0x1EE6A: "\u0643",
+	0x1EE6C: "\u0645", 0x1EE6D: "\u0646", 0x1EE6E: "\u0633", 0x1EE6F: "\u0639",
+	0x1EE70: "\u0641", 0x1EE71: "\u0635", 0x1EE72: "\u0642", 0x1EE74: "\u0634",
+	0x1EE75: "\u062a", 0x1EE76: "\u062b", 0x1EE77: "\u062e", 0x1EE79: "\u0636",
+	0x1EE7A: "\u0638", 0x1EE7B: "\u063a", 0x1EE7C: "\u066e", 0x1EE7E: "\u06a1",
+	0x1EE80: "\u0627", 0x1EE81: "\u0628", 0x1EE82: "\u062c", 0x1EE83: "\u062f",
+	0x1EE84: "\u0647", 0x1EE85: "\u0648", 0x1EE86: "\u0632", 0x1EE87: "\u062d",
+	0x1EE88: "\u0637", 0x1EE89: "\u064a", 0x1EE8B: "\u0644", 0x1EE8C: "\u0645",
+	0x1EE8D: "\u0646", 0x1EE8E: "\u0633", 0x1EE8F: "\u0639", 0x1EE90: "\u0641",
+	0x1EE91: "\u0635", 0x1EE92: "\u0642", 0x1EE93: "\u0631", 0x1EE94: "\u0634",
+	0x1EE95: "\u062a", 0x1EE96: "\u062b", 0x1EE97: "\u062e", 0x1EE98: "\u0630",
+	0x1EE99: "\u0636", 0x1EE9A: "\u0638", 0x1EE9B: "\u063a", 0x1EEA1: "\u0628",
+	0x1EEA2: "\u062c", 0x1EEA3: "\u062f", 0x1EEA5: "\u0648", 0x1EEA6: "\u0632",
+	0x1EEA7: "\u062d", 0x1EEA8: "\u0637", 0x1EEA9: "\u064a", 0x1EEAB: "\u0644",
+	0x1EEAC: "\u0645", 0x1EEAD: "\u0646", 0x1EEAE: "\u0633", 0x1EEAF: "\u0639",
+	0x1EEB0: "\u0641", 0x1EEB1: "\u0635", 0x1EEB2: "\u0642", 0x1EEB3: "\u0631",
+	0x1EEB4: "\u0634", 0x1EEB5: "\u062a", 0x1EEB6: "\u062b", 0x1EEB7: "\u062e",
+	0x1EEB8: "\u0630", 0x1EEB9: "\u0636", 0x1EEBA: "\u0638", 0x1EEBB: "\u063a",
+	0x1F100: "0.", 0x1F101: "0,", 0x1F102: "1,", 0x1F103: "2,",
+	0x1F104: "3,", 0x1F105: "4,", 0x1F106: "5,", 0x1F107: "6,",
+	0x1F108: "7,", 0x1F109: "8,", 0x1F10A: "9,", 0x1F110: "(A)",
+	0x1F111: "(B)", 0x1F112: "(C)", 0x1F113: "(D)", 0x1F114: "(E)",
+	0x1F115: "(F)", 0x1F116: "(G)", 0x1F117: "(H)", 0x1F118: "(I)",
+	0x1F119: "(J)", 0x1F11A: "(K)", 0x1F11B: "(L)", 0x1F11C: "(M)",
+	0x1F11D: "(N)", 0x1F11E: "(O)", 0x1F11F: "(P)", 0x1F120: "(Q)",
+	0x1F121: "(R)", 0x1F122: "(S)", 0x1F123: "(T)", 0x1F124: "(U)",
+	0x1F125: "(V)", 0x1F126: "(W)", 0x1F127: "(X)", 0x1F128: "(Y)",
+	0x1F129: "(Z)", 0x1F12A: "\u3014S\u3015", 0x1F12B: "C", 0x1F12C: "R",
+	0x1F12D: "CD", 0x1F12E: "WZ", 0x1F130: "A", 0x1F131: "B",
+	0x1F132: "C", 0x1F133: "D", 0x1F134: "E", 0x1F135: "F",
+	0x1F136: "G", 0x1F137: "H", 0x1F138: "I", 0x1F139: "J",
+	0x1F13A: "K", 0x1F13B: "L", 0x1F13C: "M", 0x1F13D: "N",
+	0x1F13E: "O", 0x1F13F: "P", 0x1F140: "Q", 0x1F141: "R",
+	0x1F142: "S", 0x1F143: "T", 0x1F144: "U", 0x1F145: "V",
+	0x1F146: "W", 0x1F147: "X", 0x1F148: "Y", 0x1F149: "Z",
+	0x1F14A: "HV", 0x1F14B: "MV", 0x1F14C: "SD", 0x1F14D: "SS",
+	0x1F14E: "PPV", 0x1F14F: "WC", 0x1F16A: "MC", 0x1F16B: "MD",
+	0x1F16C: "MR", 0x1F190: "DJ", 0x1F200: "\u307b\u304b", 0x1F201: "\u30b3\u30b3",
+	0x1F202: "\u30b5", 0x1F210: "\u624b", 0x1F211: "\u5b57", 0x1F212: "\u53cc",
+	0x1F213: "\u30c7", 0x1F214: "\u4e8c", 0x1F215: "\u591a", 0x1F216: "\u89e3",
+	0x1F217: "\u5929", 0x1F218: "\u4ea4", 0x1F219: "\u6620", 0x1F21A: "\u7121",
+	0x1F21B: "\u6599", 0x1F21C: "\u524d", 0x1F21D: "\u5f8c", 0x1F21E: "\u518d",
+	0x1F21F: "\u65b0", 0x1F220: "\u521d", 0x1F221: "\u7d42", 0x1F222: "\u751f",
+	0x1F223: "\u8ca9", 0x1F224: "\u58f0", 0x1F225: "\u5439", 0x1F226: "\u6f14",
+	0x1F227: "\u6295", 0x1F228: "\u6355", 0x1F229: "\u4e00", 0x1F22A: "\u4e09",
+	0x1F22B: "\u904a", 0x1F22C: "\u5de6", 0x1F22D: "\u4e2d", 0x1F22E: "\u53f3",
+	0x1F22F: "\u6307", 0x1F230: "\u8d70", 0x1F231: "\u6253", 0x1F232: "\u7981",
+	0x1F233: "\u7a7a", 0x1F234: "\u5408", 0x1F235: "\u6e80", 0x1F236: "\u6709",
+	0x1F237: "\u6708", 0x1F238: "\u7533", 0x1F239: "\u5272", 0x1F23A: "\u55b6",
+	0x1F23B: "\u914d", 0x1F240: "\u3014\u672c\u3015", 0x1F241: "\u3014\u4e09\u3015", 0x1F242: "\u3014\u4e8c\u3015",
+	0x1F243: "\u3014\u5b89\u3015", 0x1F244: "\u3014\u70b9\u3015", 0x1F245: "\u3014\u6253\u3015", 0x1F246: "\u3014\u76d7\u3015",
+	0x1F247: "\u3014\u52dd\u3015", 0x1F248: "\u3014\u6557\u3015", 0x1F250: "\u5f97", 0x1F251: "\u53ef",
+	0x1FBF0: "0", 0x1FBF1: "1", 0x1FBF2: "2", 0x1FBF3: "3",
+	0x1FBF4: "4", 0x1FBF5: "5", 0x1FBF6: "6", 0x1FBF7: "7",
+	0x1FBF8: "8", 0x1FBF9: "9",
+}
+
+// compositionExclusions are the runes which are never composed even though
+// they have a canonical decomposition into two starters
+var compositionExclusions = map[rune]bool{
+	0x0958: true, 0x0959: true, 0x095A: true, 0x095B: true,
+	0x095C: true, 0x095D: true, 0x095E: true, 0x095F: true,
+	0x09DC: true, 0x09DD: true, 0x09DF: true, 0x0A33: true,
+	0x0A36: true, 0x0A59: true, 0x0A5A: true, 0x0A5B: true,
+	0x0A5E: true, 0x0B5C: true, 0x0B5D: true, 0x0F43: true,
+	0x0F4D: true, 0x0F52: true, 0x0F57: true, 0x0F5C: true,
+	0x0F69: true, 0x0F76: true, 0x0F78: true, 0x0F93: true,
+	0x0F9D: true, 0x0FA2: true, 0x0FA7: true, 0x0FAC: true,
+	0x0FB9: true, 0x2ADC: true, 0xFB1D: true, 0xFB1F: true,
+	0xFB2A: true, 0xFB2B: true, 0xFB2C: true, 0xFB2D: true,
+	0xFB2E: true, 0xFB2F: true, 0xFB30: true, 0xFB31: true,
+	0xFB32: true, 0xFB33: true, 0xFB34: true, 0xFB35: true,
+	0xFB36: true, 0xFB38: true, 0xFB39: true, 0xFB3A: true,
+	0xFB3B: true, 0xFB3C: true, 0xFB3E: true, 0xFB40: true,
+	0xFB41: true, 0xFB43: true, 0xFB44: true, 0xFB46: true,
+	0xFB47: true, 0xFB48: true, 0xFB49: true, 0xFB4A: true,
+	0xFB4B: true, 0xFB4C: true, 0xFB4D: true, 0xFB4E: true,
+	0x1D15E: true, 0x1D15F: true, 0x1D160: true, 0x1D161: true,
+	0x1D162: true, 0x1D163: true, 0x1D164: true, 0x1D1BB: true,
+	0x1D1BC: true, 0x1D1BD: true, 0x1D1BE: true, 0x1D1BF: true,
+	0x1D1C0: true,
+}
+
+// fullFolds are the full case foldings which fold a single rune into several
+var fullFolds = map[rune]string{
+	0x00DF: "ss", 0x0130: "i\u0307", 0x0149: "\u02bcn", 0x01F0: "j\u030c",
+	0x0390: "\u03b9\u0308\u0301", 0x03B0: "\u03c5\u0308\u0301", 0x0587: "\u0565\u0582", 0x1E96: "h\u0331",
+	0x1E97: "t\u0308", 0x1E98: "w\u030a", 0x1E99: "y\u030a", 0x1E9A: "a\u02be",
+	0x1E9E: "ss", 0x1F50: "\u03c5\u0313", 0x1F52: "\u03c5\u0313\u0300", 0x1F54: "\u03c5\u0313\u0301",
+	0x1F56: "\u03c5\u0313\u0342", 0x1F80: "\u1f00\u03b9", 0x1F81: "\u1f01\u03b9", 0x1F82: "\u1f02\u03b9",
+	0x1F83: "\u1f03\u03b9", 0x1F84: "\u1f04\u03b9", 0x1F85: "\u1f05\u03b9", 0x1F86: "\u1f06\u03b9",
+	0x1F87: "\u1f07\u03b9", 0x1F88: "\u1f00\u03b9", 0x1F89: "\u1f01\u03b9", 0x1F8A: "\u1f02\u03b9",
+	0x1F8B: "\u1f03\u03b9", 0x1F8C: "\u1f04\u03b9", 0x1F8D: "\u1f05\u03b9", 0x1F8E: "\u1f06\u03b9",
+	0x1F8F: "\u1f07\u03b9", 0x1F90: "\u1f20\u03b9", 0x1F91: "\u1f21\u03b9", 0x1F92: "\u1f22\u03b9",
+	0x1F93: "\u1f23\u03b9", 0x1F94: "\u1f24\u03b9", 0x1F95: "\u1f25\u03b9", 0x1F96: "\u1f26\u03b9",
+	0x1F97: "\u1f27\u03b9", 0x1F98: "\u1f20\u03b9", 0x1F99: "\u1f21\u03b9", 0x1F9A: "\u1f22\u03b9",
+	0x1F9B: "\u1f23\u03b9", 0x1F9C: "\u1f24\u03b9", 0x1F9D: "\u1f25\u03b9", 0x1F9E: "\u1f26\u03b9",
+	0x1F9F: "\u1f27\u03b9", 0x1FA0: "\u1f60\u03b9", 0x1FA1: "\u1f61\u03b9", 0x1FA2: "\u1f62\u03b9",
+	0x1FA3: "\u1f63\u03b9", 0x1FA4: "\u1f64\u03b9", 0x1FA5: "\u1f65\u03b9", 0x1FA6: "\u1f66\u03b9",
+	0x1FA7: "\u1f67\u03b9", 0x1FA8: "\u1f60\u03b9", 0x1FA9: "\u1f61\u03b9", 0x1FAA: "\u1f62\u03b9",
+	0x1FAB: "\u1f63\u03b9", 0x1FAC: "\u1f64\u03b9", 0x1FAD: "\u1f65\u03b9", 0x1FAE: "\u1f66\u03b9",
+	0x1FAF: "\u1f67\u03b9", 0x1FB2: "\u1f70\u03b9", 0x1FB3: "\u03b1\u03b9", 0x1FB4: "\u03ac\u03b9",
+	0x1FB6: "\u03b1\u0342", 0x1FB7: "\u03b1\u0342\u03b9", 0x1FBC: "\u03b1\u03b9", 0x1FC2: "\u1f74\u03b9",
+	0x1FC3: "\u03b7\u03b9", 0x1FC4: "\u03ae\u03b9", 0x1FC6: "\u03b7\u0342", 0x1FC7: "\u03b7\u0342\u03b9",
+	0x1FCC: "\u03b7\u03b9", 0x1FD2: "\u03b9\u0308\u0300", 0x1FD3: "\u03b9\u0308\u0301", 0x1FD6: "\u03b9\u0342",
+	0x1FD7: "\u03b9\u0308\u0342", 0x1FE2: "\u03c5\u0308\u0300", 0x1FE3: "\u03c5\u0308\u0301", 0x1FE4: "\u03c1\u0313",
+	0x1FE6: "\u03c5\u0342", 0x1FE7: "\u03c5\u0308\u0342", 0x1FF2: "\u1f7c\u03b9", 0x1FF3: "\u03c9\u03b9",
+	0x1FF4: "\u03ce\u03b9", 0x1FF6: "\u03c9\u0342", 0x1FF7: "\u03c9\u0342\u03b9", 0x1FFC: "\u03c9\u03b9",
+	0xFB00: "ff", 0xFB01: "fi", 0xFB02: "fl", 0xFB03: "ffi",
+	0xFB04: "ffl", 0xFB05: "st", 0xFB06: "st", 0xFB13: "\u0574\u0576",
+	0xFB14: "\u0574\u0565", 0xFB15: "\u0574\u056b", 0xFB16: "\u057e\u0576", 0xFB17: "\u0574\u056d",
+}
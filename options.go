@@ -0,0 +1,161 @@
+package trie
+
+// Option changes how New builds a trie.  Options are applied in order
+type Option func(*options)
+
+type options struct {
+	values       bool
+	unicode      *Unicode
+	unsorted     bool
+	index        ChildIndex
+	maxKeyLength int
+	arena        int
+	sharedKeys   bool
+}
+
+// ChildIndex is how a trie finds the right child of a node while it looks up,
+// or adds, a key.  See WithChildIndex
+type ChildIndex uint8
+
+const (
+	// AdaptiveChildren picks how to find each node's children by how many
+	// it has, along the lines of an adaptive radix tree.  Nodes with up to
+	// 16 children have them scanned, and nodes with more, such as the root
+	// of a trie of random keys, keep an index of them by their first byte.
+	// The index takes 256 bytes, or 1280 for the rare node with more than
+	// 255 children.  This is the default
+	AdaptiveChildren ChildIndex = iota
+	// ScanChildren always looks through the children of a node one at a
+	// time.  It saves the 256 bytes or more which AdaptiveChildren spends on
+	// the index of every node with more than 16 children, at the cost of
+	// slow lookups in those nodes
+	ScanChildren
+	// SearchChildren binary searches the children of a node.  It needs
+	// sorted children, with unsorted children it is the same as
+	// ScanChildren
+	SearchChildren
+)
+
+// WithValues makes a Key/Value trie rather than a "black and white" one, see
+// NewKVTrie
+func WithValues() Option {
+	return func(o *options) {
+		o.values = true
+	}
+}
+
+// WithUnicode normalizes, and optionally case folds, every key, see
+// Trie.SetUnicode
+func WithUnicode(u Unicode) Option {
+	return func(o *options) {
+		o.unicode = &u
+	}
+}
+
+// WithCaseInsensitive makes a trie which ignores the case of its keys, but
+// hands them back the way they were first spelled, see
+// NewCaseInsensitiveKVTrie
+func WithCaseInsensitive() Option {
+	return WithUnicode(Unicode{Fold: true, KeepSpelling: true})
+}
+
+// WithSortedChildren decides whether the children of every node are kept in
+// order, which they are by default.  Unsorted children make adding keys a
+// little cheaper, but then keys are iterated in no particular order, and
+// whatever relies on the order of the keys (Min, Max, Successor, Predecessor,
+// Range, Backward, Rank, Select, Cursor and the order of ties in TopK) gives
+// meaningless answers.  WriteTo and WriteStatic still write keys in order
+func WithSortedChildren(sorted bool) Option {
+	return func(o *options) {
+		o.unsorted = !sorted
+	}
+}
+
+// WithChildIndex sets how nodes find their children, see ChildIndex
+func WithChildIndex(index ChildIndex) Option {
+	return func(o *options) {
+		o.index = index
+	}
+}
+
+// WithMaxKeyLength stops keys longer than n bytes from being added to the
+// trie.  The length is measured after any Unicode normalization.  0, the
+// default, means there is no limit.
+//
+// Set, Add, Upsert, GetOrInsert and the same methods of a Txn silently ignore
+// a key which is too long, the same way they ignore keys of the wrong type:
+// nothing is stored, and nothing says so.  Set reports the key as not having
+// existed, which is no different from a key it stored.  Use Strict to find
+// out, its methods return ErrKeyTooLong instead
+func WithMaxKeyLength(n int) Option {
+	return func(o *options) {
+		o.maxKeyLength = n
+	}
+}
+
+// WithKeyArena copies the keys added to the trie into chunks of chunkSize
+// bytes, rather than allocating memory for each one, which suits tries of lots
+// of small keys which are added once and seldom deleted.  The memory of a key
+// which is deleted can't be reused, a chunk is only freed once every key in it
+// has gone.  Keys longer than a quarter of chunkSize are allocated by
+// themselves.  Either way the trie keeps its own copy of every key, the slice a
+// key was added with is never kept
+func WithKeyArena(chunkSize int) Option {
+	return func(o *options) {
+		o.arena = chunkSize
+	}
+}
+
+// WithSharedKeys stops the trie copying the keys it passes to the callbacks of
+// Iterate, IterateFrom, Walk, WalkFrom and Range, and the keys from All,
+// WithPrefix and Backward.  Instead they all share one buffer which is reused
+// for the next key, so a key is only good until the callback returns, or the
+// loop goes round again, and must not be modified.  Copy any key that is kept.
+// This saves an allocation for every key visited.  Without it every key is a
+// new slice which belongs to the caller
+func WithSharedKeys() Option {
+	return func(o *options) {
+		o.sharedKeys = true
+	}
+}
+
+// New returns a new trie, configured by opts.  With no options it is the same
+// as NewBWTrie.
+//
+//	t := trie.New(
+//		trie.WithValues(),
+//		trie.WithCaseInsensitive(),
+//		trie.WithMaxKeyLength(255),
+//	)
+func New(opts ...Option) *Trie {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	t := &Trie{maxKeyLength: o.maxKeyLength, sharedKeys: o.sharedKeys}
+	if o.values {
+		t.root = &kvTrie[interface{}]{children: []*kvTrie[interface{}]{}}
+	} else {
+		t.root = &bwTrie{children: []*bwTrie{}}
+	}
+	t.layout.unsorted = o.unsorted
+	t.layout.index = o.index
+	if o.arena > 0 {
+		t.layout.arena = &keyArena{size: o.arena}
+	}
+	if o.unicode != nil {
+		t.SetUnicode(*o.unicode)
+	}
+	return t
+}
+
+// NewConcurrent returns a new, concurrency safe, trie configured by opts.  See
+// New
+func NewConcurrent(opts ...Option) *ConcurrentTrie {
+	return newConcurrent(New(opts...))
+}
+
+// tooLong reports whether k is longer than the trie allows keys to be
+func (t *Trie) tooLong(k []byte) bool {
+	return t.maxKeyLength > 0 && len(k) > t.maxKeyLength
+}
@@ -0,0 +1,239 @@
+package trie
+
+import (
+	"iter"
+	"sync"
+	"sync/atomic"
+)
+
+// PersistentTrie is an immutable, type safe, Key/Value trie.  Set, Add, Del
+// and Drop never modify the trie they are called on.  Instead they return a
+// new trie with the change applied, which shares every node it can with the
+// original.  Only the nodes along the path to the changed key are copied.
+//
+// This makes every version of a PersistentTrie a snapshot.  Holding on to a
+// version costs nothing, reading from it is always consistent no matter what
+// changes have been made since, and rolling back is a matter of going back to
+// using an older version
+//
+//	v1 := trie.NewPersistent[string, string]().Set("mode", "safe")
+//	v2 := v1.Set("mode", "fast")
+//	v1.Get("mode") // "safe", true
+//	v2.Get("mode") // "fast", true
+//
+// A PersistentTrie may be read from any number of goroutines at once.  Values
+// are shared between versions just as nodes are, they are not copied, so a
+// value which is a pointer, slice or map must not be changed in place once it
+// has been stored or every version holding it sees the change.  Store a new
+// value instead.  See Versions for handing new versions out to other
+// goroutines.
+type PersistentTrie[K Key, V any] struct {
+	root *kvTrie[V]
+}
+
+// NewPersistent returns a new, empty, PersistentTrie
+func NewPersistent[K Key, V any]() *PersistentTrie[K, V] {
+	return &PersistentTrie[K, V]{
+		root: &kvTrie[V]{
+			children: []*kvTrie[V]{},
+		},
+	}
+}
+
+func (t *PersistentTrie[K, V]) version(root *kvTrie[V]) *PersistentTrie[K, V] {
+	if root == t.root {
+		return t
+	}
+	return &PersistentTrie[K, V]{root: root}
+}
+
+// view returns a KVTrie sharing the root of t, for reading only
+func (t *PersistentTrie[K, V]) view() *KVTrie[K, V] {
+	return &KVTrie[K, V]{root: t.root}
+}
+
+// Set returns a new version of the trie with value stored under key,
+// overwriting any value which was already stored there.
+func (t *PersistentTrie[K, V]) Set(key K, value V) *PersistentTrie[K, V] {
+	return t.version(t.root.with([]byte(key), value, true))
+}
+
+// Add returns a new version of the trie with value stored under key.  If the
+// key already exists then t itself is returned.
+func (t *PersistentTrie[K, V]) Add(key K, value V) *PersistentTrie[K, V] {
+	return t.version(t.root.with([]byte(key), value, false))
+}
+
+// Del returns a new version of the trie without key.  If the key does not
+// exist then t itself is returned.
+func (t *PersistentTrie[K, V]) Del(key K) *PersistentTrie[K, V] {
+	return t.version(t.root.without([]byte(key)))
+}
+
+// Drop returns a new version of the trie without any of the keys of which key
+// is a prefix (inclusive.)  If there are no such keys then t itself is
+// returned.
+func (t *PersistentTrie[K, V]) Drop(key K) *PersistentTrie[K, V] {
+	if len(key) == 0 {
+		return NewPersistent[K, V]()
+	}
+	return t.version(t.root.pruned([]byte(key)))
+}
+
+// Get returns the value stored under key, and whether or not the key exists.
+func (t *PersistentTrie[K, V]) Get(key K) (V, bool) {
+	return t.view().Get(key)
+}
+
+// Exists returns whether or not key has been stored in the trie.
+func (t *PersistentTrie[K, V]) Exists(key K) bool {
+	return t.view().Exists(key)
+}
+
+// GetBranch returns all of the keys which have a prefix of the prefix argument
+// (inclusive.)
+func (t *PersistentTrie[K, V]) GetBranch(prefix K) []K {
+	return t.view().GetBranch(prefix)
+}
+
+// Iterate runs callback against every key and value stored in the trie, in
+// order.
+func (t *PersistentTrie[K, V]) Iterate(callback func(K, V)) {
+	t.view().Iterate(callback)
+}
+
+// IterateFrom works the same as Iterate except that it only iterates on keys
+// for which the prefix parameter is a prefix (inclusive.)
+func (t *PersistentTrie[K, V]) IterateFrom(prefix K, callback func(K, V)) {
+	t.view().IterateFrom(prefix, callback)
+}
+
+// Walk works the same as Iterate except that the walk stops as soon as
+// callback returns false
+func (t *PersistentTrie[K, V]) Walk(callback func(K, V) bool) {
+	t.view().Walk(callback)
+}
+
+// WalkFrom works the same as IterateFrom except that the walk stops as soon as
+// callback returns false
+func (t *PersistentTrie[K, V]) WalkFrom(prefix K, callback func(K, V) bool) {
+	t.view().WalkFrom(prefix, callback)
+}
+
+// All returns an iterator over every key and value in the trie, in order.
+func (t *PersistentTrie[K, V]) All() iter.Seq2[K, V] {
+	return t.view().All()
+}
+
+// WithPrefix returns an iterator over every key, and value, for which prefix
+// is a prefix (inclusive,) in order.
+func (t *PersistentTrie[K, V]) WithPrefix(prefix K) iter.Seq2[K, V] {
+	return t.view().WithPrefix(prefix)
+}
+
+// Backward returns an iterator over every key and value in the trie in
+// reverse order.
+func (t *PersistentTrie[K, V]) Backward() iter.Seq2[K, V] {
+	return t.view().Backward()
+}
+
+// Range runs callback against every key in the trie between start and end, in
+// order.  See KVTrie.Range
+func (t *PersistentTrie[K, V]) Range(start, end K, flags RangeFlag, callback func(K, V)) {
+	t.view().Range(start, end, flags, callback)
+}
+
+// Min returns the smallest key in the trie, and its value.
+func (t *PersistentTrie[K, V]) Min() (key K, value V, ok bool) {
+	return t.view().Min()
+}
+
+// Max returns the largest key in the trie, and its value.
+func (t *PersistentTrie[K, V]) Max() (key K, value V, ok bool) {
+	return t.view().Max()
+}
+
+// Successor returns the smallest key in the trie which sorts after the key
+// argument, and its value.
+func (t *PersistentTrie[K, V]) Successor(key K) (next K, value V, ok bool) {
+	return t.view().Successor(key)
+}
+
+// Predecessor returns the largest key in the trie which sorts before the key
+// argument, and its value.
+func (t *PersistentTrie[K, V]) Predecessor(key K) (prev K, value V, ok bool) {
+	return t.view().Predecessor(key)
+}
+
+// LongestPrefix finds the longest key in the trie which is a prefix of the key
+// argument (inclusive.)
+func (t *PersistentTrie[K, V]) LongestPrefix(key K) (matchedKey K, value V, ok bool) {
+	return t.view().LongestPrefix(key)
+}
+
+// AllPrefixes runs callback against every key in the trie which is a prefix of
+// the key argument (inclusive,) shortest first.
+func (t *PersistentTrie[K, V]) AllPrefixes(key K, callback func(K, V)) {
+	t.view().AllPrefixes(key, callback)
+}
+
+// Cursor returns a new Cursor for the trie.  As the trie never changes the
+// cursor stays valid for as long as you like
+func (t *PersistentTrie[K, V]) Cursor() *Cursor[K, V] {
+	return newCursor[K, V](t.root)
+}
+
+// Log prints a "pretty" representation of the trie. See Trie.Log
+func (t *PersistentTrie[K, V]) Log() {
+	t.root.log(0)
+}
+
+// Count returns the number of keys in the trie.
+func (t *PersistentTrie[K, V]) Count() int {
+	return t.view().Count()
+}
+
+// Versions holds the current version of a PersistentTrie, for sharing it
+// between goroutines.  Readers take a Snapshot, which stays exactly as it is
+// for as long as they hold it however many versions are published after it,
+// and never wait for anything to get one.  Writers publish new versions with
+// Update, one at a time, so that no change is lost to another made at the same
+// moment.
+//
+//	config := trie.NewVersions(trie.NewPersistent[string, string]())
+//	config.Update(func(t *trie.PersistentTrie[string, string]) *trie.PersistentTrie[string, string] {
+//		return t.Set("mode", "fast")
+//	})
+//	config.Snapshot().Get("mode") // "fast", true
+//
+// The zero value holds an empty trie.
+type Versions[K Key, V any] struct {
+	// writer is held by whoever is making the next version
+	writer  sync.Mutex
+	current atomic.Pointer[PersistentTrie[K, V]]
+}
+
+// NewVersions returns a new Versions holding t as its current version
+func NewVersions[K Key, V any](t *PersistentTrie[K, V]) *Versions[K, V] {
+	v := &Versions[K, V]{}
+	v.current.Store(t)
+	return v
+}
+
+// Snapshot returns the current version of the trie
+func (v *Versions[K, V]) Snapshot() *PersistentTrie[K, V] {
+	if t := v.current.Load(); t != nil {
+		return t
+	}
+	return NewPersistent[K, V]()
+}
+
+// Update publishes the version fn makes from the current version, and returns
+// it.  Updates are made one at a time, so fn must not call Update itself
+func (v *Versions[K, V]) Update(fn func(*PersistentTrie[K, V]) *PersistentTrie[K, V]) *PersistentTrie[K, V] {
+	v.writer.Lock()
+	defer v.writer.Unlock()
+	next := fn(v.Snapshot())
+	v.current.Store(next)
+	return next
+}
@@ -1,6 +1,27 @@
 package trie
 
-import "testing"
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"testing/quick"
+	"unicode/utf8"
+)
 
 func TestBWTrie(t *testing.T) {
 	trie := NewBWTrie()
@@ -211,3 +232,2840 @@ func TestKVTrie(t *testing.T) {
 		t.Errorf("Expected key 'tea' to be nil, and return nil data")
 	}
 }
+
+func TestTypedKVTrie(t *testing.T) {
+	trie := NewKV[string, int]()
+	trie.Add("to", 1)
+	trie.Add("tea", 2)
+	trie.Add("ten", 3)
+
+	if v, ok := trie.Get("to"); !ok || v != 1 {
+		t.Errorf("Expected 'to' to exist and contain 1, got %d, %v", v, ok)
+	}
+	if v, ok := trie.Get("te"); ok || v != 0 {
+		t.Errorf("Expected 'te' to not exist and return the zero value, got %d, %v", v, ok)
+	}
+
+	trie.Add("to", 4)
+	if v, _ := trie.Get("to"); v != 1 {
+		t.Errorf("Expected Add to leave 'to' as 1, got %d", v)
+	}
+	trie.Set("to", 4)
+	if v, _ := trie.Get("to"); v != 4 {
+		t.Errorf("Expected Set to change 'to' to 4, got %d", v)
+	}
+
+	var sum int
+	trie.IterateFrom("te", func(key string, value int) {
+		sum += value
+	})
+	if sum != 5 {
+		t.Errorf("Expected values under 'te' to sum to 5, got %d", sum)
+	}
+
+	trie.Del("tea")
+	if trie.Exists("tea") {
+		t.Errorf("Expected 'tea' to be deleted")
+	}
+	trie.Drop("t")
+	if c := trie.Count(); c != 0 {
+		t.Errorf("Expected an empty trie after dropping 't', found %d keys", c)
+	}
+
+	bytesTrie := NewKV[[]byte, []string]()
+	bytesTrie.Set([]byte("key"), []string{"a", "b"})
+	if v, ok := bytesTrie.Get([]byte("key")); !ok || len(v) != 2 {
+		t.Errorf("Expected []byte keyed trie to return the stored slice, got %v, %v", v, ok)
+	}
+}
+
+func TestLongestPrefix(t *testing.T) {
+	for _, trie := range []*Trie{NewBWTrie(), NewKVTrie()} {
+		trie.Add("/", "root")
+		trie.Add("/api", "api")
+		trie.Add("/api/v1", "v1")
+		trie.Add("/apiary", "apiary")
+
+		if k, _, ok := trie.LongestPrefix("/api/v1/users"); !ok || string(k) != "/api/v1" {
+			t.Errorf("Expected longest prefix of '/api/v1/users' to be '/api/v1', got '%s', %v", k, ok)
+		}
+		if k, _, ok := trie.LongestPrefix("/api/v2"); !ok || string(k) != "/api" {
+			t.Errorf("Expected longest prefix of '/api/v2' to be '/api', got '%s', %v", k, ok)
+		}
+		if k, _, ok := trie.LongestPrefix("/ap"); !ok || string(k) != "/" {
+			t.Errorf("Expected longest prefix of '/ap' to be '/', got '%s', %v", k, ok)
+		}
+		if k, _, ok := trie.LongestPrefix("api"); ok {
+			t.Errorf("Expected no prefix of 'api', got '%s'", k)
+		}
+
+		var found []string
+		trie.AllPrefixes("/api/v1", func(k []byte, _ interface{}) {
+			found = append(found, string(k))
+		})
+		if len(found) != 3 || found[0] != "/" || found[1] != "/api" || found[2] != "/api/v1" {
+			t.Errorf("Expected prefixes of '/api/v1' to be [/ /api /api/v1], got %v", found)
+		}
+	}
+
+	kv := NewKV[string, string]()
+	kv.Set("example.com", "a")
+	kv.Set("example.com.au", "b")
+	if k, v, ok := kv.LongestPrefix("example.com.au/index"); !ok || k != "example.com.au" || v != "b" {
+		t.Errorf("Expected 'example.com.au' => 'b', got '%s' => '%s', %v", k, v, ok)
+	}
+}
+
+func TestOrderedNavigation(t *testing.T) {
+	var rng = rand.New(rand.NewSource(1))
+	for _, trie := range []*Trie{NewBWTrie(), NewKVTrie()} {
+		var keys = map[string]bool{}
+		for i := 0; i < 500; i++ {
+			var b = make([]byte, 1+rng.Intn(5))
+			for j := range b {
+				b[j] = "abc"[rng.Intn(3)]
+			}
+			keys[string(b)] = true
+			trie.Add(b, string(b))
+		}
+		var sorted = []string{}
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+
+		var iterated = []string{}
+		trie.Iterate(func(k []byte, _ interface{}) {
+			iterated = append(iterated, string(k))
+		})
+		if len(iterated) != len(sorted) {
+			t.Fatalf("Expected to iterate %d keys, got %d", len(sorted), len(iterated))
+		}
+		for i := range sorted {
+			if iterated[i] != sorted[i] {
+				t.Fatalf("Expected key %d to be '%s', got '%s'", i, sorted[i], iterated[i])
+			}
+		}
+
+		var branch = trie.GetBranch("ab")
+		var expected = []string{}
+		for _, k := range sorted {
+			if len(k) >= 2 && k[:2] == "ab" {
+				expected = append(expected, k)
+			}
+		}
+		if len(branch) != len(expected) {
+			t.Fatalf("Expected %d keys under 'ab', got %d", len(expected), len(branch))
+		}
+		for i := range expected {
+			if string(branch[i]) != expected[i] {
+				t.Errorf("Expected key %d under 'ab' to be '%s', got '%s'", i, expected[i], branch[i])
+			}
+		}
+
+		if k, _, ok := trie.Min(); !ok || string(k) != sorted[0] {
+			t.Errorf("Expected Min to be '%s', got '%s'", sorted[0], k)
+		}
+		if k, _, ok := trie.Max(); !ok || string(k) != sorted[len(sorted)-1] {
+			t.Errorf("Expected Max to be '%s', got '%s'", sorted[len(sorted)-1], k)
+		}
+
+		for _, probe := range []string{"", "a", "ab", "abcabc", "b", "bca", "c", "cccccc", "d"} {
+			i := sort.SearchStrings(sorted, probe)
+			j := i
+			if j < len(sorted) && sorted[j] == probe {
+				j++
+			}
+			k, _, ok := trie.Successor(probe)
+			if j < len(sorted) {
+				if !ok || string(k) != sorted[j] {
+					t.Errorf("Expected successor of '%s' to be '%s', got '%s'", probe, sorted[j], k)
+				}
+			} else if ok {
+				t.Errorf("Expected no successor of '%s', got '%s'", probe, k)
+			}
+			k, _, ok = trie.Predecessor(probe)
+			if i > 0 {
+				if !ok || string(k) != sorted[i-1] {
+					t.Errorf("Expected predecessor of '%s' to be '%s', got '%s'", probe, sorted[i-1], k)
+				}
+			} else if ok {
+				t.Errorf("Expected no predecessor of '%s', got '%s'", probe, k)
+			}
+		}
+	}
+
+	empty := NewKV[string, int]()
+	if _, _, ok := empty.Min(); ok {
+		t.Errorf("Expected Min of an empty trie to fail")
+	}
+	if _, _, ok := empty.Successor("a"); ok {
+		t.Errorf("Expected Successor in an empty trie to fail")
+	}
+}
+
+func TestRange(t *testing.T) {
+	var days = []string{}
+	for _, trie := range []*Trie{NewBWTrie(), NewKVTrie()} {
+		days = days[:0]
+		for d := 1; d <= 31; d++ {
+			day := fmt.Sprintf("events/2026-10-%02d", d)
+			days = append(days, day)
+			trie.Add(day)
+		}
+		trie.Add("events/2026-09-30")
+		trie.Add("events/2026-11-01")
+		trie.Add("logs/2026-10-05")
+
+		var check = func(name string, start, end interface{}, flags RangeFlag, expected []string) {
+			var found = []string{}
+			trie.Range(start, end, flags, func(k []byte, _ interface{}) {
+				found = append(found, string(k))
+			})
+			if len(found) != len(expected) {
+				t.Errorf("%s: expected %d keys, got %d: %v", name, len(expected), len(found), found)
+				return
+			}
+			for i := range expected {
+				if found[i] != expected[i] {
+					t.Errorf("%s: expected key %d to be '%s', got '%s'", name, i, expected[i], found[i])
+				}
+			}
+		}
+
+		check("half open", "events/2026-10-01", "events/2026-10-15", 0, days[0:14])
+		check("inclusive", "events/2026-10-01", "events/2026-10-15", IncludeEnd, days[0:15])
+		check("exclusive", "events/2026-10-01", "events/2026-10-15", ExcludeStart, days[1:14])
+		check("prefix bounds", "events/2026-10", "events/2026-10-2", 0, days[0:19])
+
+		var reversed = []string{}
+		for i := 14; i >= 0; i-- {
+			reversed = append(reversed, days[i])
+		}
+		check("reverse", "events/2026-10-01", "events/2026-10-15", IncludeEnd|Reverse, reversed)
+
+		check("open start", nil, "events/2026-10-01", 0, []string{"events/2026-09-30"})
+		check("open end", "events/2026-11", nil, 0, []string{"events/2026-11-01", "logs/2026-10-05"})
+		check("empty", "m", "a", 0, []string{})
+		check("invalid start", struct{}{}, "events/2026-10-15", 0, []string{})
+		check("invalid end", "events/2026-10-01", struct{}{}, 0, []string{})
+	}
+
+	kv := NewKV[string, int]()
+	for i, k := range []string{"a", "b", "c", "d"} {
+		kv.Set(k, i)
+	}
+	var sum int
+	kv.Range("b", "", Reverse, func(_ string, v int) { sum += v })
+	if sum != 6 {
+		t.Errorf("Expected values from 'b' onwards to sum to 6, got %d", sum)
+	}
+}
+
+func TestEarlyTermination(t *testing.T) {
+	trie := NewKVTrie()
+	for _, k := range []string{"user:1", "user:2", "user:3", "user:4", "group:1", "zed"} {
+		trie.Add(k, k)
+	}
+
+	var visited = 0
+	trie.WalkFrom("user:", func(_ []byte, _ interface{}) bool {
+		visited++
+		return visited < 2
+	})
+	if visited != 2 {
+		t.Errorf("Expected WalkFrom to stop after 2 keys, visited %d", visited)
+	}
+
+	visited = 0
+	trie.Walk(func(_ []byte, _ interface{}) bool {
+		visited++
+		return false
+	})
+	if visited != 1 {
+		t.Errorf("Expected Walk to stop after 1 key, visited %d", visited)
+	}
+
+	var found = []string{}
+	for k, v := range trie.WithPrefix("user:") {
+		if string(k) != v.(string) {
+			t.Errorf("Expected the value of '%s' to be the key, got '%v'", k, v)
+		}
+		found = append(found, string(k))
+		if len(found) == 3 {
+			break
+		}
+	}
+	if len(found) != 3 || found[0] != "user:1" || found[2] != "user:3" {
+		t.Errorf("Expected [user:1 user:2 user:3], got %v", found)
+	}
+
+	var count = 0
+	for range trie.All() {
+		count++
+	}
+	if count != 6 {
+		t.Errorf("Expected All to yield 6 keys, got %d", count)
+	}
+
+	kv := NewKV[string, int]()
+	for i, k := range []string{"a", "b", "c"} {
+		kv.Set(k, i)
+	}
+	var backward = ""
+	for k := range kv.Backward() {
+		backward += k
+	}
+	if backward != "cba" {
+		t.Errorf("Expected Backward to yield 'cba', got '%s'", backward)
+	}
+	for k, v := range kv.WithPrefix("b") {
+		if k != "b" || v != 1 {
+			t.Errorf("Expected only 'b' => 1 with prefix 'b', got '%s' => %d", k, v)
+		}
+	}
+}
+
+func TestCursor(t *testing.T) {
+	var rng = rand.New(rand.NewSource(2))
+	for _, trie := range []*Trie{NewBWTrie(), NewKVTrie()} {
+		var keys = map[string]bool{}
+		for i := 0; i < 300; i++ {
+			var b = make([]byte, 1+rng.Intn(4))
+			for j := range b {
+				b[j] = "xyz"[rng.Intn(3)]
+			}
+			keys[string(b)] = true
+			trie.Add(b)
+		}
+		var sorted = []string{}
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+
+		c := trie.Cursor()
+		if c.Valid() {
+			t.Errorf("Expected a new cursor to be invalid")
+		}
+		var i = 0
+		for ok := c.First(); ok; ok = c.Next() {
+			if string(c.Key()) != sorted[i] {
+				t.Fatalf("Expected key %d to be '%s', got '%s'", i, sorted[i], c.Key())
+			}
+			i++
+		}
+		if i != len(sorted) {
+			t.Errorf("Expected to visit %d keys going forward, visited %d", len(sorted), i)
+		}
+		i = len(sorted) - 1
+		for ok := c.Last(); ok; ok = c.Prev() {
+			if string(c.Key()) != sorted[i] {
+				t.Fatalf("Expected key %d to be '%s', got '%s'", i, sorted[i], c.Key())
+			}
+			i--
+		}
+		if i != -1 {
+			t.Errorf("Expected to visit every key going backward, stopped at %d", i)
+		}
+
+		for _, probe := range []string{"", "x", "xy", "xyzz", "y", "yzzzz", "z", "zzzzz"} {
+			j := sort.SearchStrings(sorted, probe)
+			ok := c.Seek([]byte(probe))
+			if j == len(sorted) {
+				if ok {
+					t.Errorf("Expected Seek('%s') to fail, got '%s'", probe, c.Key())
+				}
+				continue
+			}
+			if !ok || string(c.Key()) != sorted[j] {
+				t.Errorf("Expected Seek('%s') to find '%s', got '%s'", probe, sorted[j], c.Key())
+				continue
+			}
+			if j > 0 && (!c.Prev() || string(c.Key()) != sorted[j-1]) {
+				t.Errorf("Expected Prev after Seek('%s') to find '%s', got '%s'", probe, sorted[j-1], c.Key())
+			}
+		}
+	}
+
+	kv := NewKV[string, int]()
+	c := kv.Cursor()
+	if c.First() || c.Last() || c.Seek("a") {
+		t.Errorf("Expected a cursor on an empty trie to be invalid")
+	}
+	kv.Set("page:1", 1)
+	kv.Set("page:2", 2)
+	kv.Set("page:3", 3)
+	c = kv.Cursor()
+	if !c.Seek("page:2") || c.Key() != "page:2" || c.Value() != 2 {
+		t.Errorf("Expected Seek('page:2') to find page:2 => 2, got %s => %d", c.Key(), c.Value())
+	}
+	if !c.Next() || c.Value() != 3 || c.Next() {
+		t.Errorf("Expected page:3 to be the last key")
+	}
+}
+
+func TestConcurrentTrie(t *testing.T) {
+	for _, trie := range []*ConcurrentTrie{NewConcurrentBWTrie(), NewConcurrentKVTrie()} {
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 500; i++ {
+					key := fmt.Sprintf("w%d/%03d", w, i)
+					trie.Add(key, i)
+					switch i % 10 {
+					case 3:
+						trie.Del(key)
+					case 7:
+						trie.Drop(fmt.Sprintf("w%d/%02d", w, i/10))
+					}
+				}
+			}(w)
+		}
+		for r := 0; r < 4; r++ {
+			wg.Add(1)
+			go func(r int) {
+				defer wg.Done()
+				prefix := fmt.Sprintf("w%d/", r)
+				for i := 0; i < 200; i++ {
+					trie.IterateFrom(prefix, func(k []byte, _ interface{}) {
+						if string(k[:len(prefix)]) != prefix {
+							t.Errorf("Expected '%s' to have the prefix '%s'", k, prefix)
+						}
+					})
+					for range trie.WithPrefix(prefix) {
+						break
+					}
+					trie.Exists(prefix + "000")
+					trie.Count()
+				}
+			}(r)
+		}
+		wg.Wait()
+
+		// every group of ten keys is dropped once its 8th key has been added,
+		// leaving only the last two keys of each group of ten
+		if c := trie.Count(); c != 4*50*2 {
+			t.Errorf("Expected %d keys to survive, found %d", 4*50*2, c)
+		}
+	}
+}
+
+func TestConcurrentVersions(t *testing.T) {
+	var rng = rand.New(rand.NewSource(9))
+	for _, trie := range []*ConcurrentTrie{NewConcurrentKVTrie(), NewConcurrent(WithValues(), WithCaseInsensitive())} {
+		var versions []*Trie
+		var models []map[string]int
+		model := map[string]int{}
+		for i := 0; i < 2000; i++ {
+			// enough different bytes for nodes to be indexed, and runes which
+			// share their first byte for the Unicode trie to split on
+			var b []rune
+			for j := 1 + rng.Intn(3); j > 0; j-- {
+				b = append(b, []rune("abcdefghijklmnopqrstuvwxyzéèêë")[rng.Intn(30)])
+			}
+			key := string(b)
+			switch rng.Intn(5) {
+			case 0, 1:
+				trie.Set(key, i)
+				model[key] = i
+			case 2:
+				if _, ok := model[key]; !ok {
+					trie.Add(key, i)
+					model[key] = i
+				}
+			case 3:
+				trie.Del(key)
+				delete(model, key)
+			case 4:
+				prefix := string(b[:1])
+				if rng.Intn(4) == 0 {
+					trie.Drop(prefix)
+					for k := range model {
+						if strings.HasPrefix(k, prefix) {
+							delete(model, k)
+						}
+					}
+				}
+			}
+			if i%50 == 0 {
+				versions = append(versions, trie.load())
+				models = append(models, maps.Clone(model))
+			}
+		}
+		for i, version := range versions {
+			if c := version.Count(); c != len(models[i]) {
+				t.Fatalf("Expected version %d to have %d keys, found %d", i, len(models[i]), c)
+			}
+			for k, v := range models[i] {
+				if ok, got := version.Get(k); !ok || got != v {
+					t.Fatalf("Expected version %d to have '%s' => %d, got %v, %v", i, k, v, got, ok)
+				}
+			}
+		}
+	}
+}
+
+func TestConcurrentCallbacks(t *testing.T) {
+	trie := NewConcurrentKVTrie()
+	for _, k := range []string{"a", "b", "c"} {
+		trie.Add(k, 1)
+	}
+	c := trie.Cursor()
+	var seen []string
+	trie.Iterate(func(k []byte, _ interface{}) {
+		// changes made from a read callback are not seen by the iteration
+		seen = append(seen, string(k))
+		trie.Del(k)
+		trie.Add(string(k)+"!", 2)
+	})
+	if strings.Join(seen, " ") != "a b c" {
+		t.Errorf("Expected Iterate to see a b c, saw %v", seen)
+	}
+	if got := trie.GetBranch(""); len(got) != 3 || string(got[0]) != "a!" {
+		t.Errorf("Expected a! b! c!, got %q", got)
+	}
+	seen = nil
+	for ok := c.First(); ok; ok = c.Next() {
+		seen = append(seen, string(c.Key()))
+	}
+	if strings.Join(seen, " ") != "a b c" {
+		t.Errorf("Expected the cursor to keep the version it was made from, saw %v", seen)
+	}
+	trie.Upsert("a!", func(old interface{}, exists bool) interface{} {
+		if found, value := trie.Get("a!"); !found || value != old {
+			t.Errorf("Expected Upsert's callback to be able to read the trie")
+		}
+		return old.(int) + 1
+	})
+	if _, v := trie.Get("a!"); v != 3 {
+		t.Errorf("Expected Upsert to store 3, got %v", v)
+	}
+}
+
+func TestConcurrentSnapshots(t *testing.T) {
+	trie := NewConcurrentKVTrie()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			txn := trie.Txn()
+			txn.Set("x", i)
+			txn.Set("y", i)
+			txn.Commit()
+		}
+	}()
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				var values []interface{}
+				trie.Iterate(func(_ []byte, v interface{}) {
+					values = append(values, v)
+				})
+				if len(values) == 2 && values[0] != values[1] {
+					t.Errorf("Expected x and y to change together, saw %v", values)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPersistentTrie(t *testing.T) {
+	var rng = rand.New(rand.NewSource(3))
+	var versions = []*PersistentTrie[string, int]{NewPersistent[string, int]()}
+	var models = []map[string]int{{}}
+	for i := 0; i < 400; i++ {
+		var b = make([]byte, 1+rng.Intn(4))
+		for j := range b {
+			b[j] = "pqr"[rng.Intn(3)]
+		}
+		key := string(b)
+		cur, model := versions[len(versions)-1], map[string]int{}
+		for k, v := range models[len(models)-1] {
+			model[k] = v
+		}
+		switch rng.Intn(4) {
+		case 0, 1:
+			cur = cur.Set(key, i)
+			model[key] = i
+		case 2:
+			cur = cur.Del(key)
+			delete(model, key)
+		case 3:
+			prefix := key[:1+rng.Intn(len(key))]
+			cur = cur.Drop(prefix)
+			for k := range model {
+				if strings.HasPrefix(k, prefix) {
+					delete(model, k)
+				}
+			}
+		}
+		versions = append(versions, cur)
+		models = append(models, model)
+	}
+
+	for i, version := range versions {
+		if c := version.Count(); c != len(models[i]) {
+			t.Fatalf("Expected version %d to have %d keys, found %d", i, len(models[i]), c)
+		}
+		for k, v := range models[i] {
+			if got, ok := version.Get(k); !ok || got != v {
+				t.Fatalf("Expected version %d to have '%s' => %d, got %d, %v", i, k, v, got, ok)
+			}
+		}
+	}
+
+	base := NewPersistent[string, string]().Set("mode", "safe")
+	if base.Add("mode", "fast") != base {
+		t.Errorf("Expected Add of an existing key to return the same version")
+	}
+	if base.Del("missing") != base {
+		t.Errorf("Expected Del of a missing key to return the same version")
+	}
+	if base.Drop("").Count() != 0 {
+		t.Errorf("Expected Drop of the empty prefix to empty the trie")
+	}
+}
+
+func TestVersions(t *testing.T) {
+	var counters Versions[string, int]
+	if counters.Snapshot().Count() != 0 {
+		t.Errorf("Expected the zero Versions to hold an empty trie")
+	}
+	before := counters.Snapshot()
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				counters.Update(func(p *PersistentTrie[string, int]) *PersistentTrie[string, int] {
+					n, _ := p.Get("hits")
+					return p.Set("hits", n+1)
+				})
+				snapshot := counters.Snapshot()
+				if n, _ := snapshot.Get("hits"); n < 1 {
+					t.Errorf("Expected a snapshot to have at least one hit, got %d", n)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n, _ := counters.Snapshot().Get("hits"); n != 400 {
+		t.Errorf("Expected no update to be lost, got %d hits", n)
+	}
+	if before.Exists("hits") {
+		t.Errorf("Expected an old snapshot to stay as it was")
+	}
+	if v := NewVersions(NewPersistent[string, int]().Set("a", 1)); !v.Snapshot().Exists("a") {
+		t.Errorf("Expected NewVersions to hold the trie it was given")
+	}
+}
+
+func TestTxn(t *testing.T) {
+	trie := NewKVTrie()
+	trie.Set("config/mode", "safe")
+	trie.Set("config/level", 1)
+	trie.Set("other", true)
+
+	txn := trie.Txn()
+	txn.Drop("config/")
+	txn.Set("config/mode", "fast")
+	txn.Add("config/mode", "ignored")
+	txn.Add("config/extra", "added")
+	txn.Add("other", false)
+
+	if e, v := txn.Get("config/mode"); !e || v != "fast" {
+		t.Errorf("Expected the txn to see config/mode => fast, got %v, %v", e, v)
+	}
+	if txn.Exists("config/level") {
+		t.Errorf("Expected the txn to see config/level as dropped")
+	}
+	if e, v := txn.Get("config/extra"); !e || v != "added" {
+		t.Errorf("Expected the txn to see config/extra => added, got %v, %v", e, v)
+	}
+	if e, v := txn.Get("other"); !e || v != true {
+		t.Errorf("Expected Add in the txn not to replace other, got %v, %v", e, v)
+	}
+	if e, v := trie.Get("config/mode"); !e || v != "safe" {
+		t.Errorf("Expected the trie to be untouched before Commit, got %v, %v", e, v)
+	}
+
+	txn.Commit()
+	if txn.Len() != 0 {
+		t.Errorf("Expected the txn to be empty after Commit")
+	}
+	for _, k := range []string{"config/mode", "config/level", "config/extra", "other"} {
+		e1, v1 := trie.Get(k)
+		e2, v2 := txn.Get(k)
+		if e1 != e2 || v1 != v2 {
+			t.Errorf("Expected '%s' to be committed as %v, %v, got %v, %v", k, e2, v2, e1, v1)
+		}
+	}
+
+	txn.Del("other")
+	txn.Discard()
+	if !trie.Exists("other") {
+		t.Errorf("Expected a discarded Del to leave the trie alone")
+	}
+
+	concurrent := NewConcurrentBWTrie()
+	ctxn := concurrent.Txn()
+	ctxn.Add("a")
+	ctxn.Add("b")
+	if concurrent.Count() != 0 || !ctxn.Exists("b") {
+		t.Errorf("Expected the changes to only be visible in the txn")
+	}
+	ctxn.Commit()
+	if concurrent.Count() != 2 {
+		t.Errorf("Expected 2 keys after Commit, found %d", concurrent.Count())
+	}
+}
+
+func TestTxnView(t *testing.T) {
+	trie := NewKVTrie()
+	for i := 0; i < 40; i++ {
+		trie.Add(fmt.Sprintf("k%02d", i), i)
+	}
+	txn := trie.Txn()
+	txn.Drop("k1")
+	txn.Set("k15", "new")
+	txn.Del("k20")
+	if got := txn.GetBranch("k1"); len(got) != 1 || string(got[0]) != "k15" {
+		t.Errorf("Expected GetBranch to see the txn's changes, got %q", got)
+	}
+	var keys []string
+	for k, v := range txn.WithPrefix("k2") {
+		keys = append(keys, fmt.Sprintf("%s=%v", k, v))
+	}
+	if len(keys) != 9 || keys[0] != "k21=21" {
+		t.Errorf("Expected iteration to see the txn's changes, got %v", keys)
+	}
+	if txn.Count() != 30 || trie.Count() != 40 {
+		t.Errorf("Expected 30 keys in the txn and 40 in the trie, got %d and %d", txn.Count(), trie.Count())
+	}
+
+	// changes to the trie made meanwhile are not seen by the txn, and mean
+	// that Commit has to make the txn's changes again on top of them
+	trie.Set("k15", "meanwhile")
+	trie.Del("k30")
+	trie.Add("k40", 40)
+	if _, v := txn.Get("k15"); v != "new" || !txn.Exists("k30") || txn.Exists("k40") {
+		t.Errorf("Expected the txn not to see changes made to the trie")
+	}
+	txn.Commit()
+	if _, v := trie.Get("k15"); v != "new" || trie.Count() != 30 || trie.Exists("k30") || !trie.Exists("k40") {
+		t.Errorf("Expected both sets of changes to be kept, got %q", trie.GetBranch(""))
+	}
+	if trie.views != 0 {
+		t.Errorf("Expected the trie to stop copying nodes after Commit, %d views", trie.views)
+	}
+	txn.Set("k99", 99)
+	txn.Discard()
+	if trie.views != 0 || trie.Exists("k99") {
+		t.Errorf("Expected Discard to throw the view away")
+	}
+}
+
+type upperCodec struct{}
+
+func (upperCodec) Encode(value string) ([]byte, error) {
+	return []byte(strings.ToUpper(value)), nil
+}
+
+func (upperCodec) Decode(data []byte) (string, error) {
+	return string(data), nil
+}
+
+func TestSerialization(t *testing.T) {
+	for _, trie := range []*Trie{NewBWTrie(), NewKVTrie()} {
+		for i := 0; i < 200; i++ {
+			trie.Add(fmt.Sprintf("key %d", i), i)
+		}
+		trie.Add("no value")
+
+		var buf bytes.Buffer
+		if _, err := trie.WriteTo(&buf); err != nil {
+			t.Fatalf("Unexpected error writing trie: %s", err)
+		}
+		var data = buf.Bytes()
+
+		var loaded = NewBWTrie()
+		if n, err := loaded.ReadFrom(bytes.NewReader(data)); err != nil || n != int64(len(data)) {
+			t.Fatalf("Expected to read %d bytes without error, read %d: %v", len(data), n, err)
+		}
+		var expected = []string{}
+		trie.Iterate(func(k []byte, v interface{}) {
+			expected = append(expected, fmt.Sprintf("%s=%v", k, v))
+		})
+		var found = []string{}
+		loaded.Iterate(func(k []byte, v interface{}) {
+			found = append(found, fmt.Sprintf("%s=%v", k, v))
+		})
+		if strings.Join(found, ",") != strings.Join(expected, ",") {
+			t.Errorf("Expected the loaded trie to match the original\n%v\n%v", expected, found)
+		}
+
+		damaged := bytes.Clone(data)
+		damaged[len(damaged)/2] ^= 0xff
+		if err := loaded.UnmarshalBinary(damaged); err == nil {
+			t.Errorf("Expected an error reading a damaged trie")
+		}
+		if err := loaded.UnmarshalBinary(data[:len(data)-1]); err == nil {
+			t.Errorf("Expected an error reading a truncated trie")
+		}
+		if err := loaded.UnmarshalBinary([]byte("not a trie")); err != ErrInvalidEncoding {
+			t.Errorf("Expected ErrInvalidEncoding reading garbage, got %v", err)
+		}
+		if loaded.Count() != trie.Count() {
+			t.Errorf("Expected failed reads to leave the trie alone")
+		}
+	}
+
+	kv := NewKV[string, string]()
+	kv.SetCodec(upperCodec{})
+	kv.Set("greeting", "hello")
+	data, err := kv.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling trie: %s", err)
+	}
+	loaded := NewKV[string, string]()
+	loaded.SetCodec(upperCodec{})
+	if err := loaded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("Unexpected error unmarshaling trie: %s", err)
+	}
+	if v, _ := loaded.Get("greeting"); v != "HELLO" {
+		t.Errorf("Expected the codec to be used for values, got '%s'", v)
+	}
+	bw, _ := NewBWTrie().MarshalBinary()
+	if err := loaded.UnmarshalBinary(bw); err != ErrInvalidEncoding {
+		t.Errorf("Expected ErrInvalidEncoding reading a BW trie into a KVTrie, got %v", err)
+	}
+
+	// ReadFrom leaves whatever follows the trie in the stream
+	var stream bytes.Buffer
+	first, second := NewKVTrie(), NewBWTrie()
+	first.Set("one", 1)
+	second.Add("two")
+	first.WriteTo(&stream)
+	second.WriteTo(&stream)
+	stream.WriteString("rest")
+	r := bytes.NewReader(stream.Bytes())
+	first, second = NewKVTrie(), NewBWTrie()
+	if _, err := first.ReadFrom(r); err != nil || !first.Exists("one") {
+		t.Errorf("Expected to read the first trie, got %v %q", err, first.GetBranch(""))
+	}
+	if _, err := second.ReadFrom(r); err != nil || !second.Exists("two") {
+		t.Errorf("Expected to read the second trie, got %v %q", err, second.GetBranch(""))
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "rest" {
+		t.Errorf("Expected the rest of the stream to be left, got %q", rest)
+	}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonCodec) Decode(data []byte) (interface{}, error) {
+	var value interface{}
+	err := json.Unmarshal(data, &value)
+	return value, err
+}
+
+func TestConcurrentSerialization(t *testing.T) {
+	trie := NewConcurrentKVTrie()
+	trie.SetCodec(jsonCodec{})
+	for i := 0; i < 100; i++ {
+		trie.Add(fmt.Sprintf("key %03d", i), i)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 100; i < 200; i++ {
+			trie.Add(fmt.Sprintf("key %03d", i), i)
+		}
+	}()
+	var buf bytes.Buffer
+	if _, err := trie.WriteTo(&buf); err != nil {
+		t.Fatalf("Unexpected error writing trie: %s", err)
+	}
+	wg.Wait()
+
+	loaded := NewConcurrentKVTrie()
+	loaded.SetCodec(jsonCodec{})
+	if _, err := loaded.ReadFrom(&buf); err != nil {
+		t.Fatalf("Unexpected error reading trie: %s", err)
+	}
+	if c := loaded.Count(); c < 100 || c > 200 {
+		t.Errorf("Expected to read between 100 and 200 keys, read %d", c)
+	}
+	if _, v := loaded.Get("key 042"); v != 42.0 {
+		t.Errorf("Expected the codec to be used for values, got %#v", v)
+	}
+
+	data, err := trie.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling trie: %s", err)
+	}
+	if err := loaded.UnmarshalBinary(data); err != nil || loaded.Count() != 200 {
+		t.Errorf("Expected to unmarshal 200 keys, got %d: %v", loaded.Count(), err)
+	}
+	if err := loaded.UnmarshalBinary(data[:len(data)-1]); err == nil || loaded.Count() != 200 {
+		t.Errorf("Expected a truncated trie to fail and leave the trie alone")
+	}
+
+	buf.Reset()
+	if err := trie.WriteStatic(&buf); err != nil {
+		t.Fatalf("Unexpected error writing static trie: %s", err)
+	}
+	static, err := NewStatic(buf.Bytes())
+	if err != nil || static.Count() != 200 {
+		t.Fatalf("Expected a static trie of 200 keys, got %v", err)
+	}
+	if ok, data := static.Get([]byte("key 007")); !ok || string(data) != "7" {
+		t.Errorf("Expected key 007 => 7, got %q", data)
+	}
+}
+
+func TestSerializationSplits(t *testing.T) {
+	// Three hundred runes which all start with 0xe4 are siblings under the
+	// root of a Unicode trie
+	wide := New(WithUnicode(Unicode{}))
+	for r := rune(0x4e00); r < 0x4e00+300; r++ {
+		wide.Add(string(r))
+	}
+	data, err := wide.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling trie: %s", err)
+	}
+	loaded := New(WithUnicode(Unicode{}))
+	if err := loaded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("Unexpected error reading a wide trie: %s", err)
+	}
+	if loaded.Count() != 300 || !loaded.Exists("\u4e00") || !loaded.Exists(string(rune(0x4e00+299))) {
+		t.Errorf("Expected 300 keys to be read back, got %d", loaded.Count())
+	}
+
+	// Tries read in from one which split keys the other way are split again
+	var split = func(trie *Trie) (runeSplit, byteSplit bool) {
+		var walk func(n node[interface{}], isRoot bool)
+		walk = func(n node[interface{}], isRoot bool) {
+			for i := 0; i < n.numChildren(); i++ {
+				edge := n.child(i).edge()
+				if i > 0 && n.child(i - 1).edge()[0] == edge[0] {
+					runeSplit = true
+				}
+				if !isRoot && !utf8.RuneStart(edge[0]) {
+					byteSplit = true
+				}
+				walk(n.child(i), false)
+			}
+		}
+		walk(trie.root, true)
+		return
+	}
+	bytewise := New()
+	for _, k := range []string{"é", "è", "éa", "a"} {
+		bytewise.Add(k)
+	}
+	if _, byteSplit := split(bytewise); !byteSplit {
+		t.Fatalf("Expected é and è to be split part way through")
+	}
+	data, _ = bytewise.MarshalBinary()
+	loaded.UnmarshalBinary(data)
+	if _, byteSplit := split(loaded); byteSplit || loaded.Count() != 4 || !loaded.Exists("éa") {
+		t.Errorf("Expected a Unicode trie to split the keys it reads on runes, got %q", loaded.GetBranch(""))
+	}
+	data, _ = loaded.MarshalBinary()
+	bytewise.UnmarshalBinary(data)
+	if runeSplit, _ := split(bytewise); runeSplit || bytewise.Count() != 4 || !bytewise.Exists("è") {
+		t.Errorf("Expected a byte trie to split the keys it reads on bytes, got %q", bytewise.GetBranch(""))
+	}
+	kv := NewKV[string, interface{}]()
+	values := New(WithValues(), WithUnicode(Unicode{}))
+	values.Set("é", 1)
+	values.Set("è", 2)
+	data, _ = values.MarshalBinary()
+	if err := kv.UnmarshalBinary(data); err != nil || kv.Count() != 2 {
+		t.Errorf("Expected the KVTrie to read both keys, got %v %d", err, kv.Count())
+	} else if runeSplit, _ := split(&Trie{root: kv.root}); runeSplit {
+		t.Errorf("Expected the KVTrie to split the keys it reads on bytes")
+	} else if v, ok := kv.Get("è"); !ok || v != 2 {
+		t.Errorf("Expected è=2, got %v %v", v, ok)
+	}
+
+	// Spellings belong to the keys which were there before
+	spelled := New(WithCaseInsensitive())
+	spelled.Add("Hello")
+	other := New(WithCaseInsensitive())
+	other.Add("HELLO")
+	data, _ = other.MarshalBinary()
+	spelled.UnmarshalBinary(data)
+	if got := spelled.GetBranch(""); len(got) != 1 || string(got[0]) != "hello" {
+		t.Errorf("Expected the stored key without its old spelling, got %q", got)
+	}
+}
+
+func TestStaticTrie(t *testing.T) {
+	source := NewKVTrie()
+	for _, k := range []string{"a", "ab", "abc", "abd", "b", "ba", "banana", "band", "bandana", "c"} {
+		source.Add(k, k+"!")
+	}
+
+	path := filepath.Join(t.TempDir(), "static.trie")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := source.WriteStatic(f); err != nil {
+		t.Fatalf("Unexpected error writing static trie: %s", err)
+	}
+	f.Close()
+
+	static, err := OpenStatic(path)
+	if err != nil {
+		t.Fatalf("Unexpected error opening static trie: %s", err)
+	}
+	defer static.Close()
+
+	source.Iterate(func(k []byte, v interface{}) {
+		ok, data := static.Get(k)
+		if !ok {
+			t.Errorf("Expected '%s' to exist in the static trie", k)
+			return
+		}
+		decoded, _ := GobCodec[interface{}]{}.Decode(data)
+		if decoded != v {
+			t.Errorf("Expected '%s' => '%v', got '%v'", k, v, decoded)
+		}
+	})
+	for _, k := range []string{"", "aa", "abcd", "ban", "bandanas", "d"} {
+		if static.Exists(k) {
+			t.Errorf("Expected '%s' to not exist in the static trie", k)
+		}
+	}
+	if c := static.Count(); c != source.Count() {
+		t.Errorf("Expected %d keys in the static trie, found %d", source.Count(), c)
+	}
+	if branch := static.GetBranch("ban"); len(branch) != 3 || string(branch[0]) != "banana" || string(branch[2]) != "bandana" {
+		t.Errorf("Expected [banana band bandana] with prefix 'ban', got %q", branch)
+	}
+	if k, _, ok := static.LongestPrefix("bandanna"); !ok || string(k) != "band" {
+		t.Errorf("Expected the longest prefix of 'bandanna' to be 'band', got '%s'", k)
+	}
+
+	var buf bytes.Buffer
+	b := NewStaticBuilder(&buf)
+	for _, k := range []string{"", "x", "xyz", "y"} {
+		if err := b.Add([]byte(k), nil); err != nil {
+			t.Fatalf("Unexpected error adding '%s': %s", k, err)
+		}
+	}
+	if err := b.Add([]byte("x"), nil); err != ErrUnsorted {
+		t.Errorf("Expected ErrUnsorted adding a key out of order, got %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	built, err := NewStatic(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Unexpected error reading static trie: %s", err)
+	}
+	if !built.Exists("") || !built.Exists("xyz") || built.Exists("xy") || built.Count() != 4 {
+		t.Errorf("Expected the built trie to contain exactly '', 'x', 'xyz' and 'y'")
+	}
+	if _, err := NewStatic(buf.Bytes()[:buf.Len()-1]); err != ErrInvalidEncoding {
+		t.Errorf("Expected ErrInvalidEncoding for a truncated static trie, got %v", err)
+	}
+
+	// A root holding only "a" is flags, an empty key and one child, then the
+	// first byte and offset of the child.  Point the child back at the root
+	buf.Reset()
+	b = NewStaticBuilder(&buf)
+	b.Add([]byte("a"), nil)
+	b.Close()
+	damaged := buf.Bytes()
+	root := binary.LittleEndian.Uint64(damaged[len(damaged)-staticFooterSize:])
+	binary.LittleEndian.PutUint64(damaged[root+4:], root)
+	looped, err := NewStatic(damaged)
+	if err != nil {
+		t.Fatalf("Unexpected error reading static trie: %s", err)
+	}
+	if looped.Exists("a") || looped.Exists("aaaa") || looped.Count() != 0 {
+		t.Errorf("Expected a child which loops back to be ignored")
+	}
+
+	// A closed trie is empty
+	if err := static.Close(); err != nil {
+		t.Fatalf("Unexpected error closing static trie: %s", err)
+	}
+	if ok, _ := static.Get("banana"); ok || static.Exists("a") || static.Count() != 0 || len(static.GetBranch("")) != 0 {
+		t.Errorf("Expected a closed static trie to be empty")
+	}
+	if _, _, ok := static.LongestPrefix("bandanna"); ok {
+		t.Errorf("Expected a closed static trie to have no prefixes")
+	}
+	if err := static.Close(); err != nil {
+		t.Errorf("Expected closing a static trie twice to do nothing, got %s", err)
+	}
+}
+
+// editDistance is the textbook full table version of the distances used by
+// Fuzzy and FuzzyDamerau
+func editDistance(a, b string, damerau bool) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if damerau && i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+func TestFuzzy(t *testing.T) {
+	var rng = rand.New(rand.NewSource(4))
+	trie := NewKVTrie()
+	var words = []string{}
+	for i := 0; i < 300; i++ {
+		var b = make([]byte, 1+rng.Intn(6))
+		for j := range b {
+			b[j] = "abcd"[rng.Intn(4)]
+		}
+		if !trie.Exists(b) {
+			words = append(words, string(b))
+		}
+		trie.Add(b, i)
+	}
+
+	for _, damerau := range []bool{false, true} {
+		for _, probe := range []string{"abc", "dcba", "aaaa", "bd", "abcdab"} {
+			for max := 0; max <= 2; max++ {
+				var found = map[string]int{}
+				var callback = func(k []byte, _ interface{}, d int) {
+					found[string(k)] = d
+				}
+				if damerau {
+					trie.FuzzyDamerau(probe, max, callback)
+				} else {
+					trie.Fuzzy(probe, max, callback)
+				}
+				var expected = 0
+				for _, w := range words {
+					d := editDistance(w, probe, damerau)
+					if d > max {
+						continue
+					}
+					expected++
+					if got, ok := found[w]; !ok || got != d {
+						t.Errorf("Expected '%s' within %d of '%s' at distance %d, got %d, %v", w, max, probe, d, got, ok)
+					}
+				}
+				if len(found) != expected {
+					t.Errorf("Expected %d keys within %d of '%s', found %d", expected, max, probe, len(found))
+				}
+			}
+		}
+	}
+
+	kv := NewKV[string, int]()
+	kv.Set("receive", 1)
+	kv.Set("recipe", 2)
+	var got = map[string]int{}
+	kv.FuzzyDamerau("recieve", 1, func(k string, _ int, d int) { got[k] = d })
+	if len(got) != 1 || got["receive"] != 1 {
+		t.Errorf("Expected only 'receive' one transposition from 'recieve', got %v", got)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	var rng = rand.New(rand.NewSource(5))
+	trie := NewBWTrie()
+	var words = []string{}
+	for i := 0; i < 500; i++ {
+		var b = make([]byte, 1+rng.Intn(6))
+		for j := range b {
+			b[j] = "abcde"[rng.Intn(5)]
+		}
+		if !trie.Exists(b) {
+			words = append(words, string(b))
+		}
+		trie.Add(b)
+	}
+	for _, w := range []string{"café", "cafe", "cafés", "日本", "日本語"} {
+		trie.Add(w)
+		words = append(words, w)
+	}
+
+	for _, pattern := range []string{"a*", "*e", "a?c", "*b*d*", "[a-c]?", "[^a-c]*", "caf?", "caf?*", "日?", "??", "*", "", "abc", "[b]*[d-e]", "\\a*"} {
+		var found = []string{}
+		if err := trie.Match(pattern, func(k []byte, _ interface{}) {
+			found = append(found, string(k))
+		}); err != nil {
+			t.Errorf("Unexpected error matching '%s': %v", pattern, err)
+		}
+		var expected = []string{}
+		for _, w := range words {
+			if ok, _ := path.Match(pattern, w); ok {
+				expected = append(expected, w)
+			}
+		}
+		sort.Strings(expected)
+		if strings.Join(found, ",") != strings.Join(expected, ",") {
+			t.Errorf("Pattern '%s' expected %v, got %v", pattern, expected, found)
+		}
+	}
+
+	for _, pattern := range []string{"[abc", "ab\\", "[z-a]"} {
+		if err := trie.Match(pattern, func([]byte, interface{}) {}); err != ErrBadPattern {
+			t.Errorf("Expected ErrBadPattern for '%s', got %v", pattern, err)
+		}
+	}
+
+	kv := NewKV[string, int]()
+	kv.Set("cat", 1)
+	kv.Set("cot", 2)
+	kv.Set("coat", 3)
+	var got = []string{}
+	kv.Match("c?t", func(k string, _ int) { got = append(got, k) })
+	if strings.Join(got, ",") != "cat,cot" {
+		t.Errorf("Expected cat,cot to match 'c?t', got %v", got)
+	}
+}
+
+func TestRegexp(t *testing.T) {
+	var rng = rand.New(rand.NewSource(6))
+	trie := NewBWTrie()
+	var words = []string{}
+	for i := 0; i < 500; i++ {
+		var b = make([]byte, 1+rng.Intn(7))
+		for j := range b {
+			b[j] = "abc d\nE"[rng.Intn(7)]
+		}
+		if !trie.Exists(b) {
+			words = append(words, string(b))
+		}
+		trie.Add(b)
+	}
+	for _, w := range []string{"café", "cafe", "日本語", "\xffab"} {
+		trie.Add(w)
+		words = append(words, w)
+	}
+
+	for _, expr := range []string{"^ab", "ab", "^a.c$", "b$", "^$", "", "(?i)^e", "^(ab|cd)+$", "\\bd", "\\Bd", "(?m)^d", "(?m)c$", "^[^a-c]*$", "caf.$", "本", "^\\x{fffd}", "a{2,}", "x"} {
+		var found = []string{}
+		if err := trie.Regexp(expr, func(k []byte, _ interface{}) {
+			found = append(found, string(k))
+		}); err != nil {
+			t.Errorf("Unexpected error for '%s': %v", expr, err)
+		}
+		re := regexp.MustCompile(expr)
+		var expected = []string{}
+		for _, w := range words {
+			if re.MatchString(w) {
+				expected = append(expected, w)
+			}
+		}
+		sort.Strings(expected)
+		if strings.Join(found, ",") != strings.Join(expected, ",") {
+			t.Errorf("Regexp '%s' expected %q, got %q", expr, expected, found)
+		}
+	}
+
+	if err := trie.Regexp("a(b", func([]byte, interface{}) {}); err == nil {
+		t.Errorf("Expected an error for an invalid expression")
+	}
+
+	kv := NewKV[string, int]()
+	kv.Set("cat", 1)
+	kv.Set("cot", 2)
+	kv.Set("coat", 3)
+	var got = []string{}
+	kv.Regexp("^co+a?t$", func(k string, _ int) { got = append(got, k) })
+	if strings.Join(got, ",") != "coat,cot" {
+		t.Errorf("Expected coat,cot to match, got %v", got)
+	}
+}
+
+func TestTopK(t *testing.T) {
+	var rng = rand.New(rand.NewSource(7))
+	trie := NewKVTrie()
+	var weights = map[string]float64{}
+	for i := 0; i < 2000; i++ {
+		var b = make([]byte, 1+rng.Intn(6))
+		for j := range b {
+			b[j] = "abcd"[rng.Intn(4)]
+		}
+		trie.Set(b, i)
+		weights[string(b)] = 0
+	}
+	var check = func() {
+		t.Helper()
+		for _, prefix := range []string{"", "a", "ab", "dcb", "abcda", "x"} {
+			var expected = []Completion[[]byte, interface{}]{}
+			for k, w := range weights {
+				if strings.HasPrefix(k, prefix) {
+					expected = append(expected, Completion[[]byte, interface{}]{Key: []byte(k), Weight: w})
+				}
+			}
+			sort.Slice(expected, func(i, j int) bool {
+				if expected[i].Weight != expected[j].Weight {
+					return expected[i].Weight > expected[j].Weight
+				}
+				return bytes.Compare(expected[i].Key, expected[j].Key) < 0
+			})
+			for _, k := range []int{0, 1, 5, 50} {
+				got := trie.TopK(prefix, k)
+				want := expected[:min(k, len(expected))]
+				if len(got) != len(want) {
+					t.Fatalf("TopK('%s', %d) expected %d results, got %d", prefix, k, len(want), len(got))
+				}
+				for i := range got {
+					if !bytes.Equal(got[i].Key, want[i].Key) || got[i].Weight != want[i].Weight {
+						t.Errorf("TopK('%s', %d)[%d] expected %s (%v), got %s (%v)", prefix, k, i, want[i].Key, want[i].Weight, got[i].Key, got[i].Weight)
+					}
+					if _, v := trie.Get(got[i].Key); v != got[i].Value {
+						t.Errorf("TopK('%s', %d)[%d] expected value %v, got %v", prefix, k, i, v, got[i].Value)
+					}
+				}
+			}
+		}
+	}
+
+	for k := range weights {
+		w := float64(rng.Intn(100) - 20)
+		if !trie.SetWeight(k, w) {
+			t.Errorf("Expected SetWeight to find '%s'", k)
+		}
+		weights[k] = w
+	}
+	check()
+
+	// Lower and remove the heaviest keys so that the cached weights have to
+	// be worked out again
+	for i, c := range trie.TopK("", 30) {
+		if i%2 == 0 {
+			trie.Del(c.Key)
+			delete(weights, string(c.Key))
+		} else {
+			trie.SetWeight(c.Key, -50)
+			weights[string(c.Key)] = -50
+		}
+	}
+	trie.Drop("bb")
+	for k := range weights {
+		if strings.HasPrefix(k, "bb") {
+			delete(weights, k)
+		}
+	}
+	check()
+
+	if trie.SetWeight("zzz", 1) {
+		t.Errorf("Expected SetWeight to fail for a missing key")
+	}
+	if NewBWTrie().SetWeight("a", 1) {
+		t.Errorf("Expected SetWeight to fail for a BW trie")
+	}
+
+	kv := NewKV[string, string]()
+	kv.Set("apple", "a")
+	kv.Set("apricot", "b")
+	kv.Set("banana", "c")
+	kv.SetWeight("apple", 10)
+	kv.SetWeight("apricot", 20)
+	kv.SetWeight("banana", 30)
+	if got := kv.TopK("ap", 1); len(got) != 1 || got[0].Key != "apricot" || got[0].Value != "b" {
+		t.Errorf("Expected apricot as the top completion of 'ap', got %v", got)
+	}
+}
+
+func TestCounts(t *testing.T) {
+	var rng = rand.New(rand.NewSource(8))
+	for _, trie := range []*Trie{NewBWTrie(), NewKVTrie()} {
+		var model = map[string]bool{}
+		var p = NewPersistent[string, int]()
+		for i := 0; i < 3000; i++ {
+			var b = make([]byte, 1+rng.Intn(5))
+			for j := range b {
+				b[j] = "abc"[rng.Intn(3)]
+			}
+			switch rng.Intn(10) {
+			case 0:
+				trie.Del(b)
+				p = p.Del(string(b))
+				delete(model, string(b))
+			case 1:
+				trie.Drop(b)
+				p = p.Drop(string(b))
+				for k := range model {
+					if strings.HasPrefix(k, string(b)) {
+						delete(model, k)
+					}
+				}
+			case 2:
+				trie.Set(b, i)
+				p = p.Set(string(b), i)
+				model[string(b)] = true
+			default:
+				trie.Add(b, i)
+				p = p.Add(string(b), i)
+				model[string(b)] = true
+			}
+		}
+		var keys = []string{}
+		for k := range model {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		data, _ := trie.MarshalBinary()
+		var decoded = NewBWTrie()
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatalf("Unexpected error decoding: %v", err)
+		}
+		for _, tr := range []*Trie{trie, decoded} {
+			if tr.Count() != len(keys) || p.Count() != len(keys) {
+				t.Errorf("Expected %d keys, counted %d and %d", len(keys), tr.Count(), p.Count())
+			}
+			for _, prefix := range []string{"", "a", "ab", "abc", "cc", "bacab", "x"} {
+				expected := 0
+				for _, k := range keys {
+					if strings.HasPrefix(k, prefix) {
+						expected++
+					}
+				}
+				if got := tr.CountPrefix(prefix); got != expected {
+					t.Errorf("Expected %d keys with prefix '%s', counted %d", expected, prefix, got)
+				}
+				if got := p.CountPrefix(prefix); got != expected {
+					t.Errorf("Expected %d persistent keys with prefix '%s', counted %d", expected, prefix, got)
+				}
+			}
+			for _, probe := range []string{"", "a", "abca", "b", "bb", "c", "ccccc", "cccccc", "d"} {
+				expected := sort.SearchStrings(keys, probe)
+				if got := tr.Rank(probe); got != expected {
+					t.Errorf("Expected rank %d for '%s', got %d", expected, probe, got)
+				}
+			}
+			for i, k := range keys {
+				if got := tr.Rank(k); got != i {
+					t.Errorf("Expected rank %d for '%s', got %d", i, k, got)
+				}
+				if key, _, ok := tr.Select(i); !ok || string(key) != k {
+					t.Errorf("Expected Select(%d) to be '%s', got '%s' %v", i, k, key, ok)
+				}
+				if key, _, ok := p.Select(i); !ok || key != k {
+					t.Errorf("Expected persistent Select(%d) to be '%s', got '%s' %v", i, k, key, ok)
+				}
+			}
+			if _, _, ok := tr.Select(len(keys)); ok {
+				t.Errorf("Expected Select past the end to fail")
+			}
+			if _, _, ok := tr.Select(-1); ok {
+				t.Errorf("Expected Select(-1) to fail")
+			}
+		}
+	}
+}
+
+// composeAcute is a tiny stand in for NFC normalization, it only knows how to
+// compose a vowel followed by a combining acute accent
+func composeAcute(k []byte) []byte {
+	var r = strings.NewReplacer("a\u0301", "\u00e1", "e\u0301", "\u00e9", "i\u0301", "\u00ed", "o\u0301", "\u00f3", "u\u0301", "\u00fa")
+	return []byte(r.Replace(string(k)))
+}
+
+func checkRuneEdges(t *testing.T, n node[interface{}]) {
+	t.Helper()
+	for i := 0; i < n.numChildren(); i++ {
+		c := n.child(i)
+		if !utf8.Valid(c.edge()) {
+			t.Errorf("Expected every edge to be valid UTF-8, got %q", c.edge())
+		}
+		checkRuneEdges(t, c)
+	}
+}
+
+func TestUnicode(t *testing.T) {
+	var rng = rand.New(rand.NewSource(9))
+	var alphabet = []string{"a", "é", "è", "ç", "ü", "日", "本", "語", "😀", "😁"}
+	for _, trie := range []*Trie{NewBWTrie(), NewKVTrie()} {
+		trie.Add("Apple", 1)
+		trie.Add("apple", 2)
+		trie.SetUnicode(Unicode{Normalize: composeAcute, Fold: true})
+		if trie.Count() != 1 || !trie.Exists("APPLE") {
+			t.Errorf("Expected Apple and apple to become one key, got %v", trie.GetBranch(""))
+		}
+		trie.Del("apple")
+
+		var model = map[string]bool{}
+		for i := 0; i < 2000; i++ {
+			var b strings.Builder
+			for j := 1 + rng.Intn(4); j > 0; j-- {
+				b.WriteString(alphabet[rng.Intn(len(alphabet))])
+			}
+			k := b.String()
+			switch rng.Intn(8) {
+			case 0:
+				trie.Del(k)
+				delete(model, k)
+			case 1:
+				trie.Drop(k)
+				for m := range model {
+					if strings.HasPrefix(m, k) {
+						delete(model, m)
+					}
+				}
+			default:
+				trie.Add(k, i)
+				model[k] = true
+			}
+		}
+		checkRuneEdges(t, trie.root)
+
+		var keys = []string{}
+		for k := range model {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var got = []string{}
+		for _, k := range trie.GetBranch("") {
+			got = append(got, string(k))
+		}
+		if strings.Join(got, ",") != strings.Join(keys, ",") {
+			t.Errorf("Expected keys %v, got %v", keys, got)
+		}
+		for _, k := range keys {
+			if !trie.Exists(k) {
+				t.Errorf("Expected '%s' to exist", k)
+			}
+		}
+		for _, prefix := range alphabet {
+			var expected = 0
+			for _, k := range keys {
+				if strings.HasPrefix(k, prefix) {
+					expected++
+				}
+			}
+			if n := len(trie.GetBranch(prefix)); n != expected {
+				t.Errorf("Expected %d keys beginning with '%s', got %d", expected, prefix, n)
+			}
+			if n := trie.CountPrefix(prefix); n != expected {
+				t.Errorf("Expected to count %d keys beginning with '%s', got %d", expected, prefix, n)
+			}
+		}
+
+		data, err := trie.MarshalBinary()
+		if err != nil {
+			t.Fatalf("Unexpected error encoding: %v", err)
+		}
+		var decoded = NewBWTrie()
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Errorf("Unexpected error decoding a Unicode trie: %v", err)
+		} else if decoded.Count() != len(keys) {
+			t.Errorf("Expected %d decoded keys, got %d", len(keys), decoded.Count())
+		}
+	}
+
+	trie := NewKVTrie()
+	trie.SetUnicode(Unicode{Normalize: composeAcute, Fold: true})
+	trie.Set("Café", 1)
+	trie.Set("CAFÉS", 2)
+	trie.Set("cafe", 3)
+	if ok, v := trie.Get("café"); !ok || v != 1 {
+		t.Errorf("Expected a decomposed, upper cased lookup to find Café, got %v %v", ok, v)
+	}
+	if got := trie.GetBranch("CAFÉ"); len(got) != 2 || string(got[0]) != "café" || string(got[1]) != "cafés" {
+		t.Errorf("Expected café and cafés to be stored folded and composed, got %q", got)
+	}
+	var distances = map[string]int{}
+	trie.Fuzzy("cafe", 1, func(k []byte, _ interface{}, d int) { distances[string(k)] = d })
+	if len(distances) != 2 || distances["cafe"] != 0 || distances["café"] != 1 {
+		t.Errorf("Expected cafe and café within one rune of cafe, got %v", distances)
+	}
+	distances = map[string]int{}
+	trie.FuzzyDamerau("acfés", 1, func(k []byte, _ interface{}, d int) { distances[string(k)] = d })
+	if len(distances) != 1 || distances["cafés"] != 1 {
+		t.Errorf("Expected cafés one transposition from acfés, got %v", distances)
+	}
+	c := trie.Cursor()
+	if !c.Seek([]byte("CAFÉ")) || string(c.Key()) != "café" {
+		t.Errorf("Expected the cursor to seek to café")
+	}
+	if _, _, ok := trie.Successor("CAFÉ"); !ok {
+		t.Errorf("Expected a successor to CAFÉ")
+	}
+	trie.Drop("CAFÉ")
+	if trie.Count() != 1 {
+		t.Errorf("Expected only cafe to be left, got %q", trie.GetBranch(""))
+	}
+}
+
+func TestNormalization(t *testing.T) {
+	for _, c := range []struct{ in, nfc, nfkc string }{
+		{"plain", "plain", "plain"},
+		{"e\u0301", "\u00e9", "\u00e9"},
+		// combining marks are put in order before composing
+		{"a\u0302\u0323", "\u1ead", "\u1ead"},
+		{"\u1100\u1161\u11a8", "\uac01", "\uac01"},
+		// excluded from composition
+		{"\u0958", "\u0915\u093c", "\u0915\u093c"},
+		{"\ufb01\u2460", "\ufb01\u2460", "fi1"},
+		{"a\xffe\u0301", "a\xff\u00e9", "a\xff\u00e9"},
+	} {
+		if got := string(NFC([]byte(c.in))); got != c.nfc {
+			t.Errorf("Expected NFC of %+q to be %+q, got %+q", c.in, c.nfc, got)
+		}
+		if got := string(NFKC([]byte(c.in))); got != c.nfkc {
+			t.Errorf("Expected NFKC of %+q to be %+q, got %+q", c.in, c.nfkc, got)
+		}
+	}
+	trie := New(WithUnicode(Unicode{Normalize: NFC}))
+	trie.Add("cafe\u0301")
+	if !trie.Exists("caf\u00e9") || trie.Count() != 1 {
+		t.Errorf("Expected composed and decomposed é to be the same key")
+	}
+	// The full case folding of ᾼ is αι
+	folded := New(WithCaseInsensitive())
+	folded.Add("\u1fbc")
+	if !folded.Exists("\u03b1\u03b9") || !folded.Exists("\u0391\u0399") {
+		t.Errorf("Expected ᾼ to fold to αι")
+	}
+}
+
+func TestRuneSiblings(t *testing.T) {
+	// Keys which part ways in the middle of a rune can't be split there, so
+	// they end up as siblings which start with the same byte
+	for _, keys := range [][]interface{}{
+		{"a", "a\x80", "ab"},
+		{uint8(1), uint16(0x0180), uint16(0x0142)},
+		{"\xc3", "\xc3\xa9", "\xc3\xa8"},
+	} {
+		for _, trie := range []*Trie{New(WithUnicode(Unicode{})), New(WithValues(), WithUnicode(Unicode{}))} {
+			for i, key := range keys {
+				trie.Add(key, i)
+			}
+			for i, key := range keys {
+				if !trie.Exists(key) {
+					t.Errorf("Expected %#v to exist among %#v", key, keys)
+				}
+				k, _ := keyBytes(key)
+				if got, _, ok := trie.LongestPrefix(append(k, "zz"...)); !ok || !bytes.Equal(got, k) {
+					t.Errorf("Expected %q to be the longest prefix of itself, got %q", k, got)
+				}
+				var is = func(g []byte) bool { return bytes.Equal(g, k) }
+				if got := trie.GetBranch(key); !slices.ContainsFunc(got, is) {
+					t.Errorf("Expected the branch at %q to hold itself, got %q", k, got)
+				}
+				var top [][]byte
+				for _, c := range trie.TopK(key, len(keys)) {
+					top = append(top, c.Key)
+				}
+				if !slices.ContainsFunc(top, is) {
+					t.Errorf("Expected the top keys at %q to include itself, got %q", k, top)
+				}
+				if _, bw := trie.root.(*bwTrie); !bw && !trie.SetWeight(key, float64(i+1)) {
+					t.Errorf("Expected to be able to weigh %q", k)
+				}
+			}
+			for _, key := range keys {
+				if old, existed := trie.Del(key); !existed {
+					t.Errorf("Expected to delete %#v, got %v %v", key, old, existed)
+				}
+			}
+			if trie.Count() != 0 {
+				t.Errorf("Expected every key to be deleted, got %q", trie.GetBranch(""))
+			}
+		}
+	}
+}
+
+func TestRuneSiblingCounts(t *testing.T) {
+	// A prefix which ends inside a rune can reach into several siblings
+	for _, trie := range []*Trie{New(WithUnicode(Unicode{})), New(WithValues(), WithUnicode(Unicode{}))} {
+		trie.Add("日")
+		trie.Add("本")
+		if got := trie.CountPrefix("\xe6"); got != 2 {
+			t.Errorf("Expected 2 keys to begin with \\xe6, got %d", got)
+		}
+		if got := trie.TopK("\xe6", 10); len(got) != 2 {
+			t.Errorf("Expected 2 completions of \\xe6, got %v", got)
+		}
+		trie.Add("\xc3")
+		trie.Add("Àx")
+		trie.Add("é")
+		for i, key := range []string{"\xc3", "Àx", "é", "日", "本"} {
+			if got := trie.Rank(key); got != i {
+				t.Errorf("Expected %q to rank %d, got %d", key, i, got)
+			}
+			if got, _, ok := trie.Select(i); !ok || string(got) != key {
+				t.Errorf("Expected to select %q at %d, got %q %v", key, i, got, ok)
+			}
+		}
+		if got := trie.CountPrefix("\xc3"); got != 3 {
+			t.Errorf("Expected 3 keys to begin with \\xc3, got %d", got)
+		}
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	var rng = rand.New(rand.NewSource(18))
+	var alphabet = []string{"a", "A", "s", "S", "ß", "é", "É", "ǅ", "ǆ", "Ǆ", "ﬁ", "FI"}
+	var fold = func(s string) string {
+		return strings.NewReplacer("ß", "ss", "ﬁ", "fi").Replace(strings.ToLower(s))
+	}
+	var random = func() string {
+		var b strings.Builder
+		for j := 1 + rng.Intn(4); j > 0; j-- {
+			b.WriteString(alphabet[rng.Intn(len(alphabet))])
+		}
+		return b.String()
+	}
+	for _, trie := range []*Trie{NewCaseInsensitiveBWTrie(), NewCaseInsensitiveKVTrie()} {
+		// model maps folded keys to their first spelling
+		var model = map[string]string{}
+		for i := 0; i < 3000; i++ {
+			k := random()
+			switch rng.Intn(10) {
+			case 0:
+				trie.Del(k)
+				delete(model, fold(k))
+			case 1:
+				trie.Drop(k)
+				for m := range model {
+					if strings.HasPrefix(m, fold(k)) {
+						delete(model, m)
+					}
+				}
+			case 2:
+				txn := trie.Txn()
+				txn.Add(k)
+				txn.Del(strings.ToUpper(k))
+				txn.Set(strings.ToUpper(k))
+				txn.Commit()
+				delete(model, fold(k))
+				model[fold(k)] = strings.ToUpper(k)
+			default:
+				trie.Set(k, i)
+				if _, ok := model[fold(k)]; !ok {
+					model[fold(k)] = k
+				}
+			}
+		}
+		checkRuneEdges(t, trie.root)
+
+		var folded = []string{}
+		for k := range model {
+			folded = append(folded, k)
+		}
+		sort.Strings(folded)
+		var expected = []string{}
+		for _, k := range folded {
+			expected = append(expected, model[k])
+		}
+		var got = []string{}
+		trie.Iterate(func(k []byte, _ interface{}) { got = append(got, string(k)) })
+		if strings.Join(got, ",") != strings.Join(expected, ",") {
+			t.Errorf("Expected keys %q, got %q", expected, got)
+		}
+		for _, k := range folded {
+			if !trie.Exists(strings.ToUpper(k)) {
+				t.Errorf("Expected '%s' to exist", strings.ToUpper(k))
+			}
+		}
+		for i := 0; i < 50; i++ {
+			prefix := random()
+			var want = []string{}
+			for _, k := range folded {
+				if strings.HasPrefix(k, fold(prefix)) {
+					want = append(want, model[k])
+				}
+			}
+			var got = []string{}
+			trie.IterateFrom(prefix, func(k []byte, _ interface{}) { got = append(got, string(k)) })
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("Expected keys beginning with '%s' to be %q, got %q", prefix, want, got)
+			}
+		}
+		if len(expected) > 0 {
+			if k, _, _ := trie.Min(); string(k) != expected[0] {
+				t.Errorf("Expected Min to be '%s', got '%s'", expected[0], k)
+			}
+			if k, _, _ := trie.Select(len(expected) - 1); string(k) != expected[len(expected)-1] {
+				t.Errorf("Expected the last key to be '%s', got '%s'", expected[len(expected)-1], k)
+			}
+			c := trie.Cursor()
+			if !c.Seek([]byte(strings.ToUpper(folded[0]))) || string(c.Key()) != expected[0] {
+				t.Errorf("Expected the cursor to seek to '%s'", expected[0])
+			}
+		}
+	}
+
+	trie := NewCaseInsensitiveKVTrie()
+	trie.Set("Content-Type", "text/plain")
+	trie.Set("CONTENT-TYPE", "text/html")
+	trie.Add("Straße")
+	if ok, v := trie.Get("content-type"); !ok || v != "text/html" {
+		t.Errorf("Expected content-type to be text/html, got %v %v", ok, v)
+	}
+	if got := trie.GetBranch("CONTENT"); len(got) != 1 || string(got[0]) != "Content-Type" {
+		t.Errorf("Expected the first spelling of Content-Type, got %q", got)
+	}
+	if !trie.Exists("STRASSE") {
+		t.Errorf("Expected STRASSE to find Straße")
+	}
+	if k, _, ok := trie.LongestPrefix("strasse/1"); !ok || string(k) != "Straße" {
+		t.Errorf("Expected the longest prefix of strasse/1 to be Straße, got '%s'", k)
+	}
+	trie.Del("content-type")
+	trie.Set("content-TYPE", "text/csv")
+	if got := trie.GetBranch("c"); len(got) != 1 || string(got[0]) != "content-TYPE" {
+		t.Errorf("Expected a deleted key to lose its spelling, got %q", got)
+	}
+	trie.Drop("STR")
+	if n := trie.spellings.Count(); n != 1 {
+		t.Errorf("Expected dropped keys to lose their spellings, have %d", n)
+	}
+}
+
+func TestNewOptions(t *testing.T) {
+	var rng = rand.New(rand.NewSource(19))
+	var alphabet = []string{"a", "b", "c", "é", "è", "日", "本"}
+	var tries = map[string]*Trie{
+		"default":      New(),
+		"values":       New(WithValues()),
+		"search":       New(WithChildIndex(SearchChildren)),
+		"search kv":    New(WithValues(), WithChildIndex(SearchChildren)),
+		"search runes": New(WithValues(), WithChildIndex(SearchChildren), WithUnicode(Unicode{})),
+		"unsorted":     New(WithValues(), WithSortedChildren(false)),
+		"unsorted bw":  New(WithSortedChildren(false), WithChildIndex(SearchChildren)),
+	}
+	var model = map[string]bool{}
+	for i := 0; i < 3000; i++ {
+		var b strings.Builder
+		for j := 1 + rng.Intn(5); j > 0; j-- {
+			b.WriteString(alphabet[rng.Intn(len(alphabet))])
+		}
+		k := b.String()
+		del := rng.Intn(6) == 0
+		for _, trie := range tries {
+			if del {
+				trie.Del(k)
+			} else {
+				trie.Set(k, i)
+			}
+		}
+		model[k] = !del
+	}
+	var keys = []string{}
+	for k, exists := range model {
+		if exists {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for name, trie := range tries {
+		var got = []string{}
+		trie.Iterate(func(k []byte, _ interface{}) { got = append(got, string(k)) })
+		if !strings.HasPrefix(name, "unsorted") {
+			if strings.Join(got, ",") != strings.Join(keys, ",") {
+				t.Errorf("%s: expected keys %v, got %v", name, keys, got)
+			}
+		} else {
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(keys, ",") {
+				t.Errorf("%s: expected keys %v in any order, got %v", name, keys, got)
+			}
+		}
+		for k, exists := range model {
+			if trie.Exists(k) != exists {
+				t.Errorf("%s: expected Exists('%s') to be %v", name, k, exists)
+			}
+		}
+		// Written tries come out in order, even with unsorted children
+		data, err := trie.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: unexpected error encoding: %v", name, err)
+		}
+		decoded := NewBWTrie()
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Errorf("%s: unexpected error decoding: %v", name, err)
+		} else if n := decoded.Count(); n != len(keys) {
+			t.Errorf("%s: expected %d decoded keys, got %d", name, len(keys), n)
+		}
+		var buf bytes.Buffer
+		if err := trie.WriteStatic(&buf); err != nil {
+			t.Errorf("%s: unexpected error writing a static trie: %v", name, err)
+		}
+	}
+
+	trie := New(WithMaxKeyLength(4))
+	trie.Add("four")
+	if trie.Add("fives") {
+		t.Errorf("Expected Add to report a key which is too long as not added")
+	}
+	txn := trie.Txn()
+	txn.Set("sixsix")
+	txn.Commit()
+	if !trie.Exists("four") || trie.Exists("fives") || trie.Exists("sixsix") {
+		t.Errorf("Expected only keys of up to 4 bytes to be added, got %q", trie.GetBranch(""))
+	}
+	if _, ok := New(WithValues()).root.(*kvTrie[interface{}]); !ok {
+		t.Errorf("Expected WithValues to make a KV trie")
+	}
+}
+
+// checkIndex checks that every node which has an index has it right, and
+// counts the nodes with one
+func checkIndex[V any](t *testing.T, n node[V]) int {
+	t.Helper()
+	var x *childIndex
+	switch n := any(n).(type) {
+	case *bwTrie:
+		x = n.index
+	case *kvTrie[V]:
+		x = n.index
+	}
+	var indexed = 0
+	if x != nil {
+		indexed++
+		for b := 0; b < 256; b++ {
+			var first = -1
+			for i := 0; i < n.numChildren(); i++ {
+				if n.child(i).edge()[0] == byte(b) {
+					first = i
+					break
+				}
+			}
+			if x.get(byte(b))-1 != first {
+				t.Errorf("Expected byte %d to index child %d, got %d", b, first, x.get(byte(b))-1)
+			}
+		}
+	}
+	for i := 0; i < n.numChildren(); i++ {
+		indexed += checkIndex(t, n.child(i))
+	}
+	return indexed
+}
+
+func TestChildIndex(t *testing.T) {
+	var rng = rand.New(rand.NewSource(20))
+	var random = func(runes bool) string {
+		var b []byte
+		for j := 1 + rng.Intn(3); j > 0; j-- {
+			if runes {
+				// Latin-1 letters, which all begin with the same byte
+				b = utf8.AppendRune(b, rune(0xc0+rng.Intn(64)))
+			} else {
+				b = append(b, byte(rng.Intn(256)))
+			}
+		}
+		return string(b)
+	}
+	for _, runes := range []bool{false, true} {
+		var tries = map[string]*Trie{
+			"adaptive":    New(),
+			"adaptive kv": New(WithValues()),
+			"scan":        New(WithChildIndex(ScanChildren)),
+		}
+		if runes {
+			for _, trie := range tries {
+				trie.SetUnicode(Unicode{})
+			}
+		}
+		var p = NewPersistent[string, int]()
+		var model = map[string]bool{}
+		for i := 0; i < 5000; i++ {
+			k := random(runes)
+			prefix := k[:1]
+			if runes {
+				prefix = k[:2]
+			}
+			op := rng.Intn(10)
+			for _, trie := range tries {
+				switch op {
+				case 0:
+					trie.Del(k)
+				case 1:
+					trie.Drop(prefix)
+				default:
+					trie.Add(k, i)
+				}
+			}
+			switch op {
+			case 0:
+				p = p.Del(k)
+				delete(model, k)
+			case 1:
+				p = p.Drop(prefix)
+				for m := range model {
+					if strings.HasPrefix(m, prefix) {
+						delete(model, m)
+					}
+				}
+			default:
+				p = p.Add(k, i)
+				model[k] = true
+			}
+		}
+		var keys = []string{}
+		for k := range model {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		data, _ := tries["adaptive kv"].MarshalBinary()
+		decoded := New()
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatalf("Unexpected error decoding: %v", err)
+		}
+		tries["decoded"] = decoded
+		for name, trie := range tries {
+			var indexed = checkIndex(t, trie.root)
+			if name == "scan" && indexed != 0 {
+				t.Errorf("Expected a scanning trie to have no indexes, found %d", indexed)
+			} else if name != "scan" && indexed == 0 {
+				t.Errorf("%s: expected the busiest nodes to have indexes", name)
+			}
+			var got = []string{}
+			for _, k := range trie.GetBranch("") {
+				got = append(got, string(k))
+			}
+			if strings.Join(got, ",") != strings.Join(keys, ",") {
+				t.Errorf("%s: expected keys %q, got %q", name, keys, got)
+			}
+			for i := 0; i < 1000; i++ {
+				k := random(runes)
+				if trie.Exists(k) != model[k] {
+					t.Errorf("%s: expected Exists(%q) to be %v", name, k, model[k])
+				}
+				var expected = 0
+				for _, m := range keys {
+					if strings.HasPrefix(m, k) {
+						expected++
+					}
+				}
+				if n := len(trie.GetBranch(k)); n != expected {
+					t.Errorf("%s: expected %d keys beginning with %q, got %d", name, expected, k, n)
+				}
+			}
+		}
+		if checkIndex[int](t, p.root) == 0 {
+			t.Errorf("Expected the persistent trie to have indexes")
+		}
+		if n := p.Count(); n != len(keys) {
+			t.Errorf("Expected %d keys in the persistent trie, got %d", len(keys), n)
+		}
+	}
+
+	// More than 255 siblings, which start with the same byte, outgrow the
+	// narrow index
+	wide := New(WithUnicode(Unicode{}))
+	for i, r := range rng.Perm(400) {
+		wide.Add(string(rune(0x4e00 + r)))
+		if i%50 == 0 {
+			checkIndex(t, wide.root)
+		}
+	}
+	if x := wide.root.(*bwTrie).index; x == nil || x.wide == nil {
+		t.Fatalf("Expected the root to have a wide index")
+	}
+	for _, r := range rng.Perm(400)[:300] {
+		wide.Del(string(rune(0x4e00 + r)))
+	}
+	checkIndex(t, wide.root)
+	if n := wide.Drop("\u4e0f"); wide.Count() != 100-n {
+		t.Errorf("Expected %d keys left, got %d", 100-n, wide.Count())
+	}
+	if x := wide.root.(*bwTrie).index; x == nil || x.wide != nil {
+		t.Errorf("Expected the root to go back to a narrow index")
+	}
+	checkIndex(t, wide.root)
+}
+
+type textKey struct{ a, b string }
+
+func (k textKey) MarshalText() ([]byte, error) {
+	if k.a == "" {
+		return nil, errors.New("no a")
+	}
+	return []byte(k.a + "/" + k.b), nil
+}
+
+type stringKey int
+
+func (k stringKey) String() string {
+	return fmt.Sprintf("#%d", int(k))
+}
+
+func TestKeyTypes(t *testing.T) {
+	trie := NewKVTrie()
+	var ints = []int{-1 << 40, -300, -1, 0, 1, 255, 256, 1 << 40}
+	for _, i := range rand.Perm(len(ints)) {
+		trie.Set(ints[i], i)
+	}
+	var got = []int{}
+	trie.Iterate(func(k []byte, _ interface{}) {
+		got = append(got, int(int64(binary.BigEndian.Uint64(k)^1<<63)))
+	})
+	if fmt.Sprint(got) != fmt.Sprint(ints) {
+		t.Errorf("Expected int keys to sort numerically as %v, got %v", ints, got)
+	}
+	for _, key := range []interface{}{int8(-5), int16(-5), int32(-5), int64(-5), uint(5), uint8(5), uint16(5), uint32(5), uint64(5)} {
+		trie.Set(key, key)
+		if ok, v := trie.Get(key); !ok || v != key {
+			t.Errorf("Expected %T key to be stored, got %v %v", key, ok, v)
+		}
+	}
+	if ok, _ := trie.Get([]byte{0x7f, 0xfb}); !ok {
+		t.Errorf("Expected int16(-5) to be stored as 7ffb")
+	}
+	trie.Set(textKey{"users", "42"}, 1)
+	trie.Set(stringKey(7), 2)
+	if !trie.Exists("users/42") || !trie.Exists("#7") {
+		t.Errorf("Expected text and stringer keys to be stored as text, got %q", trie.GetBranch("#"))
+	}
+
+	strict := New(WithValues(), WithMaxKeyLength(8)).Strict()
+	if _, _, err := strict.Set(3.14, 1); !errors.Is(err, ErrKeyType) {
+		t.Errorf("Expected ErrKeyType for a float key, got %v", err)
+	}
+	if _, err := strict.Add("far too long", 1); !errors.Is(err, ErrKeyTooLong) {
+		t.Errorf("Expected ErrKeyTooLong, got %v", err)
+	}
+	if _, _, err := strict.Set(textKey{}, 1); err == nil || err.Error() != "trie: marshaling key: no a" {
+		t.Errorf("Expected the MarshalText error, got %v", err)
+	}
+	if _, existed, err := strict.Set("key", 1); existed || err != nil {
+		t.Errorf("Expected Set to add key, got %v %v", existed, err)
+	}
+	if old, existed, err := strict.Set("key", 2); old != 1 || !existed || err != nil {
+		t.Errorf("Expected Set to overwrite 1, got %v %v %v", old, existed, err)
+	}
+	if added, err := strict.Add("key", 3); added || err != nil {
+		t.Errorf("Expected Add to leave key alone, got %v %v", added, err)
+	}
+	if ok, v, err := strict.Get("key"); !ok || v != 2 || err != nil {
+		t.Errorf("Expected to get key back, got %v %v %v", ok, v, err)
+	}
+	if v, err := strict.Upsert("key", func(old interface{}, _ bool) interface{} { return old.(int) + 1 }); v != 3 || err != nil {
+		t.Errorf("Expected Upsert to store 3, got %v %v", v, err)
+	}
+	if _, err := strict.Upsert(1.5, func(interface{}, bool) interface{} { panic("called") }); !errors.Is(err, ErrKeyType) {
+		t.Errorf("Expected ErrKeyType from Upsert, got %v", err)
+	}
+	if swapped, err := strict.CompareAndSwap("key", 3, 4); !swapped || err != nil {
+		t.Errorf("Expected CompareAndSwap to swap 3 for 4, got %v %v", swapped, err)
+	}
+	if _, err := strict.CompareAndSwap(struct{}{}, 3, 4); !errors.Is(err, ErrKeyType) {
+		t.Errorf("Expected ErrKeyType from CompareAndSwap, got %v", err)
+	}
+	if actual, loaded, err := strict.GetOrInsert("key", 5); actual != 4 || !loaded || err != nil {
+		t.Errorf("Expected GetOrInsert to load 4, got %v %v %v", actual, loaded, err)
+	}
+	if _, _, err := strict.GetOrInsert("far too long", 5); !errors.Is(err, ErrKeyTooLong) {
+		t.Errorf("Expected ErrKeyTooLong from GetOrInsert, got %v", err)
+	}
+	if _, err := strict.Exists(struct{}{}); !errors.Is(err, ErrKeyType) {
+		t.Errorf("Expected ErrKeyType from Exists, got %v", err)
+	}
+	if _, _, err := strict.Get(nil); !errors.Is(err, ErrKeyType) {
+		t.Errorf("Expected ErrKeyType from Get, got %v", err)
+	}
+	if err := strict.IterateFrom(1.5, func([]byte, interface{}) {}); !errors.Is(err, ErrKeyType) {
+		t.Errorf("Expected ErrKeyType from IterateFrom, got %v", err)
+	}
+	if _, _, err := strict.Del(false); !errors.Is(err, ErrKeyType) {
+		t.Errorf("Expected ErrKeyType from Del, got %v", err)
+	}
+	strict.Set("kept", 1)
+	strict.Set("knot", 2)
+	if old, existed, err := strict.Del("knot"); old != 2 || !existed || err != nil {
+		t.Errorf("Expected Del to remove knot => 2, got %v %v %v", old, existed, err)
+	}
+	if _, err := strict.DropFunc(1.5, func([]byte, interface{}) { t.Errorf("Unexpected callback") }); !errors.Is(err, ErrKeyType) {
+		t.Errorf("Expected ErrKeyType from DropFunc, got %v", err)
+	}
+	var dropped []string
+	if n, err := strict.DropFunc("kep", func(k []byte, _ interface{}) { dropped = append(dropped, string(k)) }); n != 1 || len(dropped) != 1 || err != nil {
+		t.Errorf("Expected DropFunc to drop kept, got %d %q %v", n, dropped, err)
+	}
+	if n, err := strict.Drop("k"); n != 1 || err != nil {
+		t.Errorf("Expected Drop to drop key, got %d %v", n, err)
+	}
+	if keys, err := strict.GetBranch(""); len(keys) != 0 || err != nil {
+		t.Errorf("Expected Drop to empty the trie, got %q %v", keys, err)
+	}
+
+	concurrent := NewConcurrent(WithCaseInsensitive()).Strict()
+	if _, err := concurrent.Add("Key"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if keys, _ := concurrent.GetBranch("KEY"); len(keys) != 1 || string(keys[0]) != "Key" {
+		t.Errorf("Expected the strict view to keep the spelling of Key, got %q", keys)
+	}
+	concurrent.Add(uint16('A'))
+	if added, _ := concurrent.Add(uint16('a')); !added {
+		t.Errorf("Expected the strict view not to case fold integer keys")
+	}
+
+	folded := New(WithCaseInsensitive())
+	folded.Add(uint16('A'))
+	folded.Add(uint16('a'))
+	folded.Add(textKey{"USERS", "42"})
+	if folded.Count() != 3 || !folded.Exists(uint16('A')) || folded.Exists("users/42") {
+		t.Errorf("Expected only text keys to be case folded, got %q", folded.GetBranch(""))
+	}
+}
+
+// propOps is a random sequence of changes to make to a trie, for property
+// based tests.  Keys are drawn from a handful of bytes so that they often
+// share prefixes, and include the empty key, single bytes and the bytes at
+// either end of the range
+type propOps []propOp
+
+type propOp struct {
+	kind  int
+	key   []byte
+	value int
+}
+
+func (propOps) Generate(rng *rand.Rand, size int) reflect.Value {
+	var alphabet = []byte{0x00, 0x01, 'a', 'b', 0x7f, 0x80, 0xc3, 0xff}
+	var ops = make(propOps, rng.Intn(size*4+1))
+	for i := range ops {
+		var key []byte
+		switch n := rng.Intn(6); n {
+		case 0:
+			if rng.Intn(2) == 0 {
+				key = []byte{}
+			}
+		case 1:
+			key = []byte{byte(rng.Intn(256))}
+		default:
+			for j := 0; j < n; j++ {
+				key = append(key, alphabet[rng.Intn(len(alphabet))])
+			}
+		}
+		ops[i] = propOp{kind: rng.Intn(10), key: key, value: rng.Intn(100)}
+	}
+	return reflect.ValueOf(ops)
+}
+
+// runeOps is a random sequence of changes, like propOps, with keys built
+// from whole runes, stray continuation bytes and the first bytes of runes, so
+// that keys which are valid UTF-8 and keys which aren't share prefixes
+type runeOps struct{ propOps }
+
+func (runeOps) Generate(rng *rand.Rand, size int) reflect.Value {
+	var alphabet = []string{"a", "\x80", "\xc3", "\xe6", "é", "À", "日", "本"}
+	var ops = make(propOps, rng.Intn(size*4+1))
+	for i := range ops {
+		var key = []byte{}
+		for n := rng.Intn(5); n > 0; n-- {
+			key = append(key, alphabet[rng.Intn(len(alphabet))]...)
+		}
+		ops[i] = propOp{kind: rng.Intn(10), key: key, value: rng.Intn(100)}
+	}
+	return reflect.ValueOf(runeOps{ops})
+}
+
+// apply makes the changes to a Trie, and to a model of it
+func (ops propOps) apply(trie *Trie, model map[string]interface{}) {
+	for _, op := range ops {
+		switch op.kind {
+		case 0:
+			trie.Del(op.key)
+			delete(model, string(op.key))
+		case 1:
+			trie.Drop(op.key)
+			for k := range model {
+				if strings.HasPrefix(k, string(op.key)) {
+					delete(model, k)
+				}
+			}
+		case 2, 3:
+			// nil values are values too
+			trie.Set(op.key)
+			model[string(op.key)] = nil
+		case 4, 5, 6:
+			trie.Add(op.key, op.value)
+			if _, ok := model[string(op.key)]; !ok {
+				model[string(op.key)] = op.value
+			}
+		default:
+			trie.Set(op.key, op.value)
+			model[string(op.key)] = op.value
+		}
+	}
+}
+
+// checkModel compares every kind of lookup on trie against the model
+func checkModel(trie *Trie, model map[string]interface{}, values bool) error {
+	var keys = []string{}
+	for k := range model {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var value = func(k string) interface{} {
+		if !values {
+			return nil
+		}
+		return model[k]
+	}
+	if trie.Count() != len(keys) {
+		return fmt.Errorf("expected %d keys, counted %d", len(keys), trie.Count())
+	}
+	var i = 0
+	var err error
+	trie.Walk(func(k []byte, v interface{}) bool {
+		if i >= len(keys) || string(k) != keys[i] || v != value(keys[i]) {
+			err = fmt.Errorf("expected to iterate %q, got %q = %v at %d", keys, k, v, i)
+			return false
+		}
+		i++
+		return true
+	})
+	if err != nil || i != len(keys) {
+		return fmt.Errorf("iterated %d of %q: %v", i, keys, err)
+	}
+	var backward = []string{}
+	for k := range trie.Backward() {
+		backward = append([]string{string(k)}, backward...)
+	}
+	if strings.Join(backward, "|") != strings.Join(keys, "|") {
+		return fmt.Errorf("expected to iterate backwards through %q, got %q", keys, backward)
+	}
+	var probes = append([]string{"", "\x00", "\xff", "a", "ab"}, keys...)
+	for _, p := range probes {
+		exists, v := trie.Get(p)
+		if _, ok := model[p]; exists != ok || trie.Exists(p) != ok || (ok && v != value(p)) {
+			return fmt.Errorf("expected Get(%q) to be %v %v, got %v %v", p, ok, value(p), exists, v)
+		}
+		var branch = []string{}
+		for _, k := range keys {
+			if strings.HasPrefix(k, p) {
+				branch = append(branch, k)
+			}
+		}
+		var got = []string{}
+		for _, k := range trie.GetBranch(p) {
+			got = append(got, string(k))
+		}
+		if strings.Join(got, "|") != strings.Join(branch, "|") || trie.CountPrefix(p) != len(branch) {
+			return fmt.Errorf("expected the branch at %q to be %q, got %q counted %d", p, branch, got, trie.CountPrefix(p))
+		}
+		var prefixes = []string{}
+		for _, k := range keys {
+			if strings.HasPrefix(p, k) {
+				prefixes = append(prefixes, k)
+			}
+		}
+		got = []string{}
+		trie.AllPrefixes(p, func(k []byte, _ interface{}) { got = append(got, string(k)) })
+		if strings.Join(got, "|") != strings.Join(prefixes, "|") {
+			return fmt.Errorf("expected the prefixes of %q to be %q, got %q", p, prefixes, got)
+		}
+		rank := sort.SearchStrings(keys, p)
+		if r := trie.Rank(p); r != rank {
+			return fmt.Errorf("expected Rank(%q) to be %d, got %d", p, rank, r)
+		}
+		next, _, ok := trie.Successor(p)
+		if want := rank; want < len(keys) && keys[want] == p {
+			rank++
+		}
+		if (rank < len(keys)) != ok || (ok && string(next) != keys[rank]) {
+			return fmt.Errorf("expected a successor to %q at %d of %q, got %q %v", p, rank, keys, next, ok)
+		}
+		prev, _, ok := trie.Predecessor(p)
+		if want := sort.SearchStrings(keys, p) - 1; (want >= 0) != ok || (ok && string(prev) != keys[want]) {
+			return fmt.Errorf("expected a predecessor to %q at %d of %q, got %q %v", p, want, keys, prev, ok)
+		}
+		at := sort.SearchStrings(keys, p)
+		if c := trie.Cursor(); c.Seek([]byte(p)) != (at < len(keys)) || (at < len(keys) && string(c.Key()) != keys[at]) {
+			return fmt.Errorf("expected Seek(%q) to find %q, got %q", p, keys[at:], c.Key())
+		}
+		got = []string{}
+		trie.Range(p, "\xff\xff\xff\xff\xff\xff", 0, func(k []byte, _ interface{}) { got = append(got, string(k)) })
+		if strings.Join(got, "|") != strings.Join(keys[at:], "|") {
+			return fmt.Errorf("expected the range from %q to be %q, got %q", p, keys[at:], got)
+		}
+		upto := sort.Search(len(keys), func(i int) bool { return keys[i] > p })
+		if p == "" {
+			upto = len(keys)
+		}
+		got = []string{}
+		trie.Range("", p, IncludeEnd, func(k []byte, _ interface{}) { got = append(got, string(k)) })
+		if strings.Join(got, "|") != strings.Join(keys[:upto], "|") {
+			return fmt.Errorf("expected the range up to %q to be %q, got %q", p, keys[:upto], got)
+		}
+	}
+	for i, k := range keys {
+		if got, _, ok := trie.Select(i); !ok || string(got) != k {
+			return fmt.Errorf("expected Select(%d) to be %q, got %q", i, k, got)
+		}
+	}
+	c := trie.Cursor()
+	i = 0
+	for ok := c.First(); ok; ok = c.Next() {
+		if i >= len(keys) || string(c.Key()) != keys[i] {
+			return fmt.Errorf("expected the cursor to visit %q, got %q at %d", keys, c.Key(), i)
+		}
+		i++
+	}
+	if i != len(keys) {
+		return fmt.Errorf("expected the cursor to visit %d keys, visited %d", len(keys), i)
+	}
+	if min, _, ok := trie.Min(); ok != (len(keys) > 0) || (ok && string(min) != keys[0]) {
+		return fmt.Errorf("expected the smallest of %q, got %q", keys, min)
+	}
+	data, err := trie.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	decoded := NewBWTrie()
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		return fmt.Errorf("decoding: %v", err)
+	}
+	if decoded.Count() != len(keys) {
+		return fmt.Errorf("expected %d keys decoded, got %d", len(keys), decoded.Count())
+	}
+	var buf bytes.Buffer
+	if err := trie.WriteStatic(&buf); err != nil {
+		return err
+	}
+	static, err := NewStatic(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("reading static: %v", err)
+	}
+	for _, p := range probes {
+		if _, ok := model[p]; static.Exists(p) != ok {
+			return fmt.Errorf("expected the static trie to agree about %q", p)
+		}
+	}
+	return nil
+}
+
+func TestProperties(t *testing.T) {
+	var tries = map[string]func() *Trie{
+		"bw":       NewBWTrie,
+		"kv":       NewKVTrie,
+		"search":   func() *Trie { return New(WithValues(), WithChildIndex(SearchChildren)) },
+		"scanning": func() *Trie { return New(WithChildIndex(ScanChildren)) },
+	}
+	for name, newTrie := range tries {
+		values := name != "bw" && name != "scanning"
+		err := quick.Check(func(ops propOps) bool {
+			trie, model := newTrie(), map[string]interface{}{}
+			ops.apply(trie, model)
+			if err := checkModel(trie, model, values); err != nil {
+				t.Logf("%s: %v", name, err)
+				return false
+			}
+			// the same again through a transaction
+			trie, model = newTrie(), map[string]interface{}{}
+			txn := trie.Txn()
+			for _, op := range ops {
+				switch op.kind {
+				case 0:
+					txn.Del(op.key)
+				case 1:
+					txn.Drop(op.key)
+				case 2, 3:
+					txn.Set(op.key)
+				case 4, 5, 6:
+					txn.Add(op.key, op.value)
+				default:
+					txn.Set(op.key, op.value)
+				}
+			}
+			ops.apply(NewKVTrie(), model)
+			for k := range model {
+				if exists, v := txn.Get(k); !exists || (values && v != model[k]) {
+					t.Logf("%s: expected the txn to have %q = %v, got %v %v", name, k, model[k], exists, v)
+					return false
+				}
+			}
+			txn.Commit()
+			if err := checkModel(trie, model, values); err != nil {
+				t.Logf("%s txn: %v", name, err)
+				return false
+			}
+			return true
+		}, &quick.Config{MaxCount: 300, Rand: rand.New(rand.NewSource(22))})
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	err := quick.Check(func(ops propOps) bool {
+		var p = NewPersistent[string, int]()
+		var model = map[string]interface{}{}
+		for _, op := range ops {
+			switch op.kind {
+			case 0:
+				p = p.Del(string(op.key))
+			case 1:
+				p = p.Drop(string(op.key))
+			case 4, 5, 6:
+				p = p.Add(string(op.key), op.value)
+			default:
+				p = p.Set(string(op.key), op.value)
+			}
+		}
+		for _, op := range ops {
+			if op.kind == 2 || op.kind == 3 {
+				op.kind = 7
+			}
+			propOps{op}.apply(NewKVTrie(), model)
+		}
+		var got = map[string]interface{}{}
+		p.Iterate(func(k string, v int) { got[k] = v })
+		if fmt.Sprint(got) != fmt.Sprint(model) || p.Count() != len(model) {
+			t.Logf("expected the persistent trie to hold %v, got %v", model, got)
+			return false
+		}
+		return true
+	}, &quick.Config{MaxCount: 300, Rand: rand.New(rand.NewSource(22))})
+	if err != nil {
+		t.Errorf("persistent: %v", err)
+	}
+}
+
+func TestUnicodeProperties(t *testing.T) {
+	var tries = map[string]func() *Trie{
+		"bw":     func() *Trie { return New(WithUnicode(Unicode{})) },
+		"kv":     func() *Trie { return New(WithValues(), WithUnicode(Unicode{})) },
+		"search": func() *Trie { return New(WithValues(), WithUnicode(Unicode{}), WithChildIndex(SearchChildren)) },
+	}
+	for name, newTrie := range tries {
+		values := name != "bw"
+		err := quick.Check(func(ops runeOps) bool {
+			trie, model := newTrie(), map[string]interface{}{}
+			ops.apply(trie, model)
+			if err := checkModel(trie, model, values); err != nil {
+				t.Logf("%s: %v", name, err)
+				return false
+			}
+			return true
+		}, &quick.Config{MaxCount: 300, Rand: rand.New(rand.NewSource(17))})
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestKeyOwnership(t *testing.T) {
+	var words = []string{"romane", "romanus", "romulus", "rubens", "ruber", "rubicon", "rubicundus", ""}
+	var tries = map[string]*Trie{
+		"bw":    NewBWTrie(),
+		"kv":    NewKVTrie(),
+		"arena": New(WithValues(), WithKeyArena(16)),
+	}
+	for name, trie := range tries {
+		// one buffer for every key, overwritten as soon as each is added
+		buf := make([]byte, 0, 16)
+		for _, w := range words {
+			buf = append(buf[:0], w...)
+			trie.Add(buf, w)
+			for i := range buf {
+				buf[i] = 'x'
+			}
+		}
+		txn := trie.Txn()
+		buf = append(buf[:0], "rubric"...)
+		txn.Set(buf, "rubric")
+		buf[0] = 'x'
+		txn.Commit()
+		var want = append([]string{"rubric"}, words...)
+		sort.Strings(want)
+		var got = []string{}
+		var kept = [][]byte{}
+		trie.Walk(func(k []byte, _ interface{}) bool {
+			got = append(got, string(k))
+			kept = append(kept, k)
+			// modifying a key mustn't change the keys which follow it
+			for i := range k {
+				k[i] = 'x'
+			}
+			return true
+		})
+		if strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("%s: expected %q, got %q", name, want, got)
+		}
+		for i := range kept {
+			if string(kept[i]) != strings.Repeat("x", len(want[i])) {
+				t.Errorf("%s: expected the walk's keys to be kept as they were left, got %q", name, kept[i])
+			}
+		}
+		for _, w := range want {
+			if exists, v := trie.Get(w); !exists || (name != "bw" && v != w) {
+				t.Errorf("%s: expected %q to be %q, got %v %v", name, w, w, exists, v)
+			}
+		}
+	}
+
+	kv := NewKV[[]byte, int]()
+	p := NewPersistent[[]byte, int]()
+	for i, w := range words {
+		buf := []byte(w)
+		kv.Set(buf, i)
+		p = p.Set(buf, i)
+		clear(buf)
+	}
+	for i, w := range words {
+		if v, ok := kv.Get([]byte(w)); !ok || v != i {
+			t.Errorf("Expected KVTrie to have %q = %d, got %d %v", w, i, v, ok)
+		}
+		if v, ok := p.Get([]byte(w)); !ok || v != i {
+			t.Errorf("Expected PersistentTrie to have %q = %d, got %d %v", w, i, v, ok)
+		}
+	}
+	var kept [][]byte
+	for k := range kv.All() {
+		kept = append(kept, k)
+	}
+	sorted := slices.Clone(words)
+	sort.Strings(sorted)
+	for i := range kept {
+		if string(kept[i]) != sorted[i] {
+			t.Errorf("Expected the keys from KVTrie.All to be kept, got %q for %q", kept[i], sorted[i])
+		}
+	}
+
+	shared := New(WithSharedKeys(), WithCaseInsensitive())
+	for _, w := range words {
+		shared.Add(strings.ToUpper(w))
+	}
+	var got []string
+	shared.Iterate(func(k []byte, _ interface{}) {
+		got = append(got, string(k))
+	})
+	if want := strings.ToUpper(strings.Join(sorted, "|")); strings.Join(got, "|") != want {
+		t.Errorf("Expected to iterate %q with shared keys, got %q", want, got)
+	}
+	if branch := shared.GetBranch("rub"); len(branch) != 4 || string(branch[0]) != "RUBENS" {
+		t.Errorf("Expected GetBranch to copy shared keys, got %q", branch)
+	}
+}
+
+func TestUpdates(t *testing.T) {
+	count := func(old interface{}, exists bool) interface{} {
+		if !exists || old == nil {
+			return 1
+		}
+		return old.(int) + 1
+	}
+	for _, trie := range []*Trie{NewKVTrie(), NewBWTrie()} {
+		_, bw := trie.root.(*bwTrie)
+		value := func(v interface{}) interface{} {
+			if bw {
+				return nil
+			}
+			return v
+		}
+		if !trie.Add("romane", 1) || trie.Add("romane", 2) {
+			t.Errorf("Expected Add to report adding romane only the first time")
+		}
+		// the key of an existing node, which isn't yet a key of its own
+		trie.Add("romanus", 3)
+		if !trie.Add("roman", 4) {
+			t.Errorf("Expected Add to add roman")
+		}
+		if exists, v := trie.Get("roman"); !exists || v != value(4) {
+			t.Errorf("Expected roman to be added as 4, got %v %v", exists, v)
+		}
+		if old, existed := trie.Set("romane", 5); !existed || old != value(1) {
+			t.Errorf("Expected Set to replace 1, got %v %v", old, existed)
+		}
+		if old, existed := trie.Set("rom", 6); existed || old != nil {
+			t.Errorf("Expected Set to add rom, got %v %v", old, existed)
+		}
+		if old, existed := trie.Set("", 7); existed || old != nil {
+			t.Errorf("Expected Set to add the empty key, got %v %v", old, existed)
+		}
+		if old, existed := trie.Set("", 8); !existed || old != value(7) {
+			t.Errorf("Expected Set to replace the empty key, got %v %v", old, existed)
+		}
+		if trie.Count() != 5 {
+			t.Errorf("Expected 5 keys, counted %d", trie.Count())
+		}
+		for i := 0; i < 3; i++ {
+			trie.Upsert("rubicon", count)
+			trie.Upsert("ro", count)
+		}
+		if exists, v := trie.Get("rubicon"); !exists || v != value(3) {
+			t.Errorf("Expected rubicon to have been counted to 3, got %v %v", exists, v)
+		}
+		if exists, v := trie.Get("ro"); !exists || v != value(3) {
+			t.Errorf("Expected ro to have been counted to 3, got %v %v", exists, v)
+		}
+		if !bw && (trie.CompareAndSwap("rubicon", 2, 10) || !trie.CompareAndSwap("rubicon", 3, 10)) {
+			t.Errorf("Expected CompareAndSwap to only swap 3")
+		}
+		if trie.CompareAndSwap("rubens", nil, 10) || trie.Exists("rubens") {
+			t.Errorf("Expected CompareAndSwap to leave missing keys missing")
+		}
+		if actual, loaded := trie.GetOrInsert("rubens", 11); loaded || actual != value(11) {
+			t.Errorf("Expected GetOrInsert to insert rubens, got %v %v", actual, loaded)
+		}
+		if actual, loaded := trie.GetOrInsert("rubens", 12); !loaded || actual != value(11) {
+			t.Errorf("Expected GetOrInsert to get rubens, got %v %v", actual, loaded)
+		}
+		if trie.Count() != 8 || trie.CountPrefix("rub") != 2 {
+			t.Errorf("Expected 8 keys, 2 beginning rub, counted %d and %d", trie.Count(), trie.CountPrefix("rub"))
+		}
+	}
+
+	// Set, Upsert and CompareAndSwap keep weights, deleting a key loses it
+	trie := NewKVTrie()
+	trie.Set("apple", 1)
+	trie.Set("apricot", 1)
+	trie.SetWeight("apple", 5)
+	trie.SetWeight("apricot", 10)
+	trie.Upsert("apricot", func(old interface{}, _ bool) interface{} { return old.(int) + 1 })
+	trie.CompareAndSwap("apricot", 2, 3)
+	if top := trie.TopK("ap", 1); len(top) != 1 || string(top[0].Key) != "apricot" || top[0].Value != 3 {
+		t.Errorf("Expected apricot to keep its weight, got %v", top)
+	}
+	trie.Set("apricot", 4)
+	if top := trie.TopK("ap", 1); len(top) != 1 || string(top[0].Key) != "apricot" || top[0].Weight != 10 {
+		t.Errorf("Expected Set to keep the weight of apricot, got %v", top)
+	}
+	trie.Del("apricot")
+	trie.Set("apricot", 5)
+	if top := trie.TopK("ap", 1); len(top) != 1 || string(top[0].Key) != "apple" {
+		t.Errorf("Expected deleting apricot to lose its weight, got %v", top)
+	}
+
+	kv := NewKV[string, []int]()
+	if !kv.Add("a", []int{1}) || kv.Add("a", nil) {
+		t.Errorf("Expected Add to report adding a only the first time")
+	}
+	if old, existed := kv.Set("a", []int{2}); !existed || old[0] != 1 {
+		t.Errorf("Expected Set to replace [1], got %v %v", old, existed)
+	}
+	if v := kv.Upsert("a", func(old []int, _ bool) []int { return append(old, 3) }); len(v) != 2 {
+		t.Errorf("Expected Upsert to append to a, got %v", v)
+	}
+	if actual, loaded := kv.GetOrInsert("b", []int{4}); loaded || actual[0] != 4 {
+		t.Errorf("Expected GetOrInsert to insert b, got %v %v", actual, loaded)
+	}
+	counts := NewKV[string, int]()
+	counts.Set("n", 1)
+	if counts.CompareAndSwap("n", 2, 3) || !counts.CompareAndSwap("n", 1, 3) {
+		t.Errorf("Expected CompareAndSwap to only swap 1")
+	}
+	if v, _ := counts.Get("n"); v != 3 {
+		t.Errorf("Expected n to be 3, got %d", v)
+	}
+
+	c := NewConcurrentKVTrie()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Upsert("hits", count)
+			}
+		}()
+	}
+	wg.Wait()
+	if exists, v := c.Get("hits"); !exists || v != 800 {
+		t.Errorf("Expected 800 hits, got %v", v)
+	}
+}
+
+func TestRemovals(t *testing.T) {
+	var words = []string{"romane", "romanus", "romulus", "rubens", "ruber", "rubicon", "rubicundus"}
+	for _, trie := range []*Trie{NewKVTrie(), NewBWTrie(), NewCaseInsensitiveKVTrie()} {
+		_, bw := trie.root.(*bwTrie)
+		for i, w := range words {
+			if trie.spellings != nil {
+				w = strings.ToUpper(w[:1]) + w[1:]
+			}
+			trie.Add(w, i)
+		}
+		if old, existed := trie.Del("romulus"); !existed || (!bw && old != 2) {
+			t.Errorf("Expected Del to remove romulus, 2, got %v %v", old, existed)
+		}
+		if old, existed := trie.Del("romulus"); existed || old != nil {
+			t.Errorf("Expected Del to find romulus gone, got %v %v", old, existed)
+		}
+		if old, existed := trie.Del("rom"); existed || old != nil {
+			t.Errorf("Expected Del to find no rom, got %v %v", old, existed)
+		}
+		if n := trie.Drop("romulus"); n != 0 {
+			t.Errorf("Expected Drop to find nothing to remove, removed %d", n)
+		}
+		var dropped = []string{}
+		var values = []interface{}{}
+		n := trie.DropFunc("rubic", func(k []byte, v interface{}) {
+			dropped = append(dropped, string(k))
+			values = append(values, v)
+		})
+		if n != 2 || fmt.Sprint(dropped) != "[Rubicon Rubicundus]" && fmt.Sprint(dropped) != "[rubicon rubicundus]" {
+			t.Errorf("Expected DropFunc to remove rubicon and rubicundus, removed %d %q", n, dropped)
+		}
+		if !bw && fmt.Sprint(values) != "[5 6]" {
+			t.Errorf("Expected DropFunc to pass the values 5 and 6, got %v", values)
+		}
+		if n := trie.Drop("rom"); n != 2 || trie.Count() != 2 {
+			t.Errorf("Expected Drop to remove 2 keys, leaving 2, removed %d leaving %d", n, trie.Count())
+		}
+		trie.Add("")
+		if n := trie.Drop(""); n != 3 || trie.Count() != 0 {
+			t.Errorf("Expected Drop to remove every key, removed %d leaving %d", n, trie.Count())
+		}
+	}
+
+	kv := NewKV[string, int]()
+	for i, w := range words {
+		kv.Set(w, i)
+	}
+	if old, existed := kv.Del("rubens"); !existed || old != 3 {
+		t.Errorf("Expected Del to remove rubens, 3, got %v %v", old, existed)
+	}
+	var sum int
+	if n := kv.DropFunc("rub", func(_ string, v int) { sum += v }); n != 3 || sum != 15 {
+		t.Errorf("Expected DropFunc to remove 3 keys adding up to 15, got %d adding up to %d", n, sum)
+	}
+	if n := kv.Drop("ro"); n != 3 || kv.Count() != 0 {
+		t.Errorf("Expected Drop to remove the last 3 keys, removed %d", n)
+	}
+
+	c := NewConcurrentBWTrie()
+	c.Add("apple")
+	c.Add("apricot")
+	if _, existed := c.Del("apple"); !existed {
+		t.Errorf("Expected Del to remove apple")
+	}
+	if n := c.DropFunc("ap", func([]byte, interface{}) {}); n != 1 {
+		t.Errorf("Expected DropFunc to remove apricot, removed %d", n)
+	}
+}
@@ -0,0 +1,156 @@
+package trie
+
+// rank counts the keys which sort before key.  Going down the path to key,
+// every sibling to the left of the path holds only smaller keys, and so do
+// the nodes on the path itself, so only their counts are needed
+func rank[V any](root node[V], key []byte) int {
+	n, r := root, 0
+	for {
+		if len(key) == 0 {
+			// everything left is key itself, or beneath it
+			return r
+		}
+		if n.isEndpoint() {
+			r++
+		}
+		var next node[V]
+		for i := 0; i < n.numChildren(); i++ {
+			c := n.child(i)
+			lcp := longestCommonPrefix(key, c.edge())
+			if lcp == len(c.edge()) {
+				next = c
+				key = key[lcp:]
+				break
+			}
+			if lcp == len(key) || c.edge()[lcp] > key[lcp] {
+				// this child, and every one after it, sorts after key
+				return r
+			}
+			r += c.size()
+		}
+		if next == nil {
+			return r
+		}
+		n = next
+	}
+}
+
+// nth finds the i'th key in order, counting from 0, by skipping over whole
+// children until it finds the one holding it
+func nth[V any](root node[V], i int) ([]byte, V, bool) {
+	var zero V
+	if i < 0 || i >= root.size() {
+		return nil, zero, false
+	}
+	n, path := root, []byte{}
+	for {
+		if n.isEndpoint() {
+			if i == 0 {
+				return path, n.val(), true
+			}
+			i--
+		}
+		var next node[V]
+		for j := 0; j < n.numChildren(); j++ {
+			c := n.child(j)
+			if i < c.size() {
+				next = c
+				break
+			}
+			i -= c.size()
+		}
+		if next == nil {
+			// the counts don't add up
+			return nil, zero, false
+		}
+		n = next
+		path = append(path, n.edge()...)
+	}
+}
+
+// countPrefix adds up the keys in every branch which begins with prefix
+func countPrefix[V any](root node[V], prefix []byte) int {
+	count := 0
+	branches(root, []byte{}, prefix, func(n node[V], _ []byte) { count += n.size() })
+	return count
+}
+
+// CountPrefix returns the number of keys which begin with prefix.  It takes as
+// long as finding prefix in the trie does, no matter how many keys there are
+func (t *Trie) CountPrefix(prefix interface{}) int {
+	p, ok := t.keyOf(prefix)
+	if !ok {
+		return 0
+	}
+	return countPrefix(t.root, p)
+}
+
+// Rank returns the number of keys in the trie which sort before key, whether
+// or not key is itself in the trie.  If it is, then Rank is its position in
+// the trie, and Select(Rank(key)) will find it again
+func (t *Trie) Rank(key interface{}) int {
+	k, ok := t.keyOf(key)
+	if !ok {
+		return 0
+	}
+	return rank(t.root, k)
+}
+
+// Select returns the i'th key in the trie, in order and counting from 0, and
+// its value.  If there are not that many keys then ok is false
+func (t *Trie) Select(i int) (key []byte, value interface{}, ok bool) {
+	key, value, ok = nth(t.root, i)
+	return t.spell(key), value, ok
+}
+
+// CountPrefix returns the number of keys which begin with prefix.  See
+// Trie.CountPrefix
+func (t *KVTrie[K, V]) CountPrefix(prefix K) int {
+	return countPrefix[V](t.root, []byte(prefix))
+}
+
+// Rank returns the number of keys in the trie which sort before key.  See
+// Trie.Rank
+func (t *KVTrie[K, V]) Rank(key K) int {
+	return rank[V](t.root, []byte(key))
+}
+
+// Select returns the i'th key in the trie, in order and counting from 0, and
+// its value.  If there are not that many keys then ok is false
+func (t *KVTrie[K, V]) Select(i int) (key K, value V, ok bool) {
+	k, v, ok := nth[V](t.root, i)
+	return K(k), v, ok
+}
+
+// CountPrefix returns the number of keys which begin with prefix.  See
+// Trie.CountPrefix
+func (t *PersistentTrie[K, V]) CountPrefix(prefix K) int {
+	return t.view().CountPrefix(prefix)
+}
+
+// Rank returns the number of keys in the trie which sort before key.  See
+// Trie.Rank
+func (t *PersistentTrie[K, V]) Rank(key K) int {
+	return t.view().Rank(key)
+}
+
+// Select returns the i'th key in the trie, in order and counting from 0, and
+// its value.  If there are not that many keys then ok is false
+func (t *PersistentTrie[K, V]) Select(i int) (key K, value V, ok bool) {
+	return t.view().Select(i)
+}
+
+// CountPrefix is the concurrency safe version of Trie.CountPrefix
+func (t *ConcurrentTrie) CountPrefix(prefix interface{}) int {
+	return t.load().CountPrefix(prefix)
+}
+
+// Rank is the concurrency safe version of Trie.Rank
+func (t *ConcurrentTrie) Rank(key interface{}) int {
+	return t.load().Rank(key)
+}
+
+// Select is the concurrency safe version of Trie.Select
+func (t *ConcurrentTrie) Select(i int) (key []byte, value interface{}, ok bool) {
+	return t.load().Select(i)
+}
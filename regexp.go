@@ -0,0 +1,168 @@
+package trie
+
+import "regexp/syntax"
+
+// reAutomaton runs a compiled regular expression program as an NFA, one rune
+// at a time.  Empty width assertions such as $ and \b depend on the rune after
+// them, which isn't known until the next step, so the threads in a state are
+// kept as they were before following anything which doesn't consume a rune
+type reAutomaton struct {
+	prog *syntax.Prog
+	// anchored is set when every match must start at the beginning of the
+	// key, when it isn't a new thread is started at every rune
+	anchored bool
+}
+
+type reState struct {
+	pcs     []uint32
+	prev    rune
+	matched bool
+}
+
+func compileRegexp(expr string) (*reAutomaton, error) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return nil, err
+	}
+	return &reAutomaton{
+		prog:     prog,
+		anchored: prog.StartCond()&syntax.EmptyBeginText != 0,
+	}, nil
+}
+
+// closure follows every thread from pcs as far as it can go without consuming
+// a rune, given which empty width assertions hold.  It returns the threads
+// which are waiting on a rune, and whether any of them reached a match
+func (a *reAutomaton) closure(pcs []uint32, flag syntax.EmptyOp) ([]uint32, bool) {
+	var seen = make([]bool, len(a.prog.Inst))
+	var out []uint32
+	var matched bool
+	var visit func(pc uint32)
+	visit = func(pc uint32) {
+		if seen[pc] {
+			return
+		}
+		seen[pc] = true
+		inst := &a.prog.Inst[pc]
+		switch inst.Op {
+		case syntax.InstAlt, syntax.InstAltMatch:
+			visit(inst.Out)
+			visit(inst.Arg)
+		case syntax.InstCapture, syntax.InstNop:
+			visit(inst.Out)
+		case syntax.InstEmptyWidth:
+			if syntax.EmptyOp(inst.Arg)&^flag == 0 {
+				visit(inst.Out)
+			}
+		case syntax.InstMatch:
+			matched = true
+		case syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+			out = append(out, pc)
+		}
+	}
+	for _, pc := range pcs {
+		visit(pc)
+	}
+	return out, matched
+}
+
+func (a *reAutomaton) start() reState {
+	return reState{pcs: []uint32{uint32(a.prog.Start)}, prev: -1}
+}
+
+func (a *reAutomaton) step(state reState, r rune) reState {
+	if state.matched {
+		return state
+	}
+	threads, matched := a.closure(state.pcs, syntax.EmptyOpContext(state.prev, r))
+	if matched {
+		return reState{matched: true}
+	}
+	next := reState{prev: r}
+	for _, pc := range threads {
+		inst := &a.prog.Inst[pc]
+		var ok bool
+		switch inst.Op {
+		case syntax.InstRune1:
+			ok = r == inst.Rune[0]
+		case syntax.InstRuneAny:
+			ok = true
+		case syntax.InstRuneAnyNotNL:
+			ok = r != '\n'
+		default:
+			ok = inst.MatchRune(r)
+		}
+		if ok {
+			next.pcs = append(next.pcs, inst.Out)
+		}
+	}
+	if !a.anchored {
+		next.pcs = append(next.pcs, uint32(a.prog.Start))
+	}
+	return next
+}
+
+func (a *reAutomaton) dead(state reState) bool {
+	return !state.matched && len(state.pcs) == 0
+}
+
+func (a *reAutomaton) accepts(state reState) bool {
+	if state.matched {
+		return true
+	}
+	_, matched := a.closure(state.pcs, syntax.EmptyOpContext(state.prev, -1))
+	return matched
+}
+
+func (a *reAutomaton) acceptsAll(state reState) bool {
+	if state.matched {
+		return true
+	}
+	// Only assertions about what came before can be relied on, whatever
+	// follows them
+	flag := syntax.EmptyOpContext(state.prev, -1) & (syntax.EmptyBeginLine | syntax.EmptyBeginText)
+	_, matched := a.closure(state.pcs, flag)
+	return matched
+}
+
+// Regexp runs callback against every key in the trie which the regular
+// expression matches, in order.  The expression uses the same syntax as the
+// regexp package and matches the same keys as regexp.Match would, so it can
+// match anywhere in a key unless it is anchored with ^ and $.  Rather than
+// trying every key the expression is run down the branches of the trie, and a
+// branch is skipped as soon as no key in it can match, which works best for
+// expressions anchored at the start.  The error is from parsing expr
+func (t *Trie) Regexp(expr string, callback IterFunc) error {
+	a, err := compileRegexp(expr)
+	if err != nil {
+		return err
+	}
+	automatonWalk[interface{}, reState](t.root, a, func(k []byte, v interface{}, _ reState) bool {
+		callback(t.spell(k), v)
+		return true
+	})
+	return nil
+}
+
+// Regexp runs callback against every key in the trie which the regular
+// expression matches, in order.  See Trie.Regexp
+func (t *KVTrie[K, V]) Regexp(expr string, callback func(K, V)) error {
+	a, err := compileRegexp(expr)
+	if err != nil {
+		return err
+	}
+	automatonWalk[V, reState](t.root, a, func(k []byte, v V, _ reState) bool {
+		callback(K(k), v)
+		return true
+	})
+	return nil
+}
+
+// Regexp is the concurrency safe version of Trie.Regexp
+func (t *ConcurrentTrie) Regexp(expr string, callback IterFunc) error {
+	return t.load().Regexp(expr, callback)
+}
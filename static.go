@@ -0,0 +1,492 @@
+package trie
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+)
+
+// A static trie is laid out on disk so that it can be queried right where it
+// sits, without being loaded into memory first.  The file is
+//
+//	magic   "QTRM"
+//	version 1 byte
+//	nodes   ...
+//	root    8 bytes, little endian offset of the root node
+//	magic   "QTRM"
+//
+// where each node is
+//
+//	flags    1 byte, staticEndpoint | staticValue
+//	key      uvarint length, then the bytes of the key
+//	value    uvarint length, then the bytes of the value (if staticValue)
+//	children uvarint count, then the first byte of the key of each child in
+//	         order, then the 8 byte little endian offset of each child
+//
+// Nodes are written children first, so a parent always knows the offsets of
+// its children, and the file can be written in a single pass over the keys.
+const (
+	staticMagic   = "QTRM"
+	staticVersion = 1
+
+	staticEndpoint = 1 << 0
+	staticValue    = 1 << 1
+
+	staticHeaderSize = len(staticMagic) + 1
+	staticFooterSize = 8 + len(staticMagic)
+)
+
+var (
+	// ErrUnsorted is returned by StaticBuilder.Add when keys are not added in
+	// strictly increasing order
+	ErrUnsorted = errors.New("trie: keys must be added in strictly increasing order")
+	// ErrClosed is returned when using a StaticBuilder after it has been
+	// closed
+	ErrClosed = errors.New("trie: builder is closed")
+)
+
+// StaticTrie is a read only trie which is queried directly from its on disk
+// form.  Opening one with OpenStatic memory maps the file, so it is all but
+// instant no matter how large the trie is, and the memory is shared with any
+// other process which has the same file open.
+//
+// Static tries are built with a StaticBuilder, or from an existing trie with
+// Trie.WriteStatic or KVTrie.WriteStatic.  Values are stored as raw bytes.
+//
+// A StaticTrie is safe to use from many goroutines at once.  Keys and values
+// handed out by a StaticTrie are only valid until it is closed.
+type StaticTrie struct {
+	data  []byte
+	root  uint64
+	close func() error
+}
+
+type staticNode struct {
+	offset   uint64
+	flags    byte
+	key      []byte
+	value    []byte
+	first    []byte
+	children []byte
+}
+
+// OpenStatic memory maps the static trie at path.  On platforms without
+// memory mapping the file is read into memory instead.  The StaticTrie must
+// be closed when you are done with it
+func OpenStatic(path string) (*StaticTrie, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, unmap, err := mmapFile(f)
+	if err != nil {
+		return nil, err
+	}
+	t, err := NewStatic(data)
+	if err != nil {
+		unmap()
+		return nil, err
+	}
+	t.close = unmap
+	return t, nil
+}
+
+// NewStatic returns a StaticTrie which reads from data, which must hold a
+// static trie.  This is useful for static tries which have been embedded in
+// the binary.  data must not be modified while the trie is in use
+func NewStatic(data []byte) (*StaticTrie, error) {
+	if len(data) < staticHeaderSize+staticFooterSize ||
+		string(data[:len(staticMagic)]) != staticMagic ||
+		string(data[len(data)-len(staticMagic):]) != staticMagic {
+		return nil, ErrInvalidEncoding
+	}
+	if data[len(staticMagic)] != staticVersion {
+		return nil, ErrUnsupportedVersion
+	}
+	t := &StaticTrie{
+		data: data,
+		root: binary.LittleEndian.Uint64(data[len(data)-staticFooterSize:]),
+	}
+	if _, ok := t.node(t.root); !ok {
+		return nil, ErrInvalidEncoding
+	}
+	return t, nil
+}
+
+// Close releases the memory mapping behind the trie.  Nothing read from the
+// trie may be used after it has been closed, and once closed the trie is
+// empty
+func (t *StaticTrie) Close() error {
+	closer := t.close
+	t.data, t.close = nil, nil
+	if closer == nil {
+		return nil
+	}
+	return closer()
+}
+
+// node decodes the node at offset.  Damaged files must not cause panics, so
+// anything out of bounds results in ok being false
+func (t *StaticTrie) node(offset uint64) (n staticNode, ok bool) {
+	if t.data == nil {
+		// the trie has been closed
+		return n, false
+	}
+	end := uint64(len(t.data) - staticFooterSize)
+	if offset < uint64(staticHeaderSize) || offset >= end {
+		return n, false
+	}
+	p := t.data[offset:end]
+	n.offset = offset
+	n.flags, p = p[0], p[1:]
+	if n.key, p, ok = staticBytes(p); !ok {
+		return n, false
+	}
+	if n.flags&staticValue != 0 {
+		if n.value, p, ok = staticBytes(p); !ok {
+			return n, false
+		}
+	}
+	count, l := binary.Uvarint(p)
+	if l <= 0 || count > 256 || uint64(len(p)-l) < count*9 {
+		return n, false
+	}
+	p = p[l:]
+	n.first, n.children = p[:count], p[count:count*9]
+	return n, true
+}
+
+func staticBytes(p []byte) ([]byte, []byte, bool) {
+	length, l := binary.Uvarint(p)
+	if l <= 0 || uint64(len(p)-l) < length {
+		return nil, nil, false
+	}
+	return p[l : l+int(length)], p[l+int(length):], true
+}
+
+// child finds the child of n whose key starts with b
+func (t *StaticTrie) child(n staticNode, b byte) (staticNode, bool) {
+	i := sort.Search(len(n.first), func(i int) bool { return n.first[i] >= b })
+	if i == len(n.first) || n.first[i] != b {
+		return staticNode{}, false
+	}
+	return t.childAt(n, i)
+}
+
+// childAt decodes the i'th child of n.  Children are written before their
+// parents, so a child which isn't earlier in the file than its parent, which
+// could send a damaged file round in circles, is as bad as one out of bounds.
+// So is a child whose key doesn't start with the byte n has for it, or which
+// is empty, as only the root has an empty key
+func (t *StaticTrie) childAt(n staticNode, i int) (staticNode, bool) {
+	offset := binary.LittleEndian.Uint64(n.children[i*8:])
+	if offset >= n.offset {
+		return staticNode{}, false
+	}
+	c, ok := t.node(offset)
+	if !ok || len(c.key) == 0 || c.key[0] != n.first[i] {
+		return staticNode{}, false
+	}
+	return c, true
+}
+
+// Get fetches a key from the trie, and its value.  The value is nil if none
+// was stored with the key
+func (t *StaticTrie) Get(key interface{}) (bool, []byte) {
+	k, ok := keyBytes(key)
+	if !ok {
+		return false, nil
+	}
+	n, ok := t.node(t.root)
+	for ok && len(k) > 0 {
+		if n, ok = t.child(n, k[0]); !ok || !bytes.HasPrefix(k, n.key) {
+			return false, nil
+		}
+		k = k[len(n.key):]
+	}
+	if !ok || n.flags&staticEndpoint == 0 {
+		return false, nil
+	}
+	return true, n.value
+}
+
+// Exists reports whether key is in the trie
+func (t *StaticTrie) Exists(key interface{}) bool {
+	ok, _ := t.Get(key)
+	return ok
+}
+
+// LongestPrefix finds the longest key in the trie which is a prefix of the key
+// argument (inclusive.)  See Trie.LongestPrefix
+func (t *StaticTrie) LongestPrefix(key interface{}) (matchedKey []byte, value []byte, ok bool) {
+	k, valid := keyBytes(key)
+	if !valid {
+		return nil, nil, false
+	}
+	n, found := t.node(t.root)
+	for depth := 0; found; {
+		if n.flags&staticEndpoint != 0 {
+			matchedKey, value, ok = k[:depth], n.value, true
+		}
+		if depth == len(k) {
+			break
+		}
+		if n, found = t.child(n, k[depth]); found && bytes.HasPrefix(k[depth:], n.key) {
+			depth += len(n.key)
+		} else {
+			break
+		}
+	}
+	return
+}
+
+// Iterate runs callback against every key, and its value, in the trie, in
+// order
+func (t *StaticTrie) Iterate(callback func(key, value []byte)) {
+	t.IterateFrom([]byte{}, callback)
+}
+
+// IterateFrom runs callback against every key, and its value, which has the
+// prefix argument as a prefix (inclusive,) in order
+func (t *StaticTrie) IterateFrom(prefix interface{}, callback func(key, value []byte)) {
+	p, ok := keyBytes(prefix)
+	if !ok {
+		return
+	}
+	var path []byte
+	n, ok := t.node(t.root)
+	for ok && len(p) > 0 {
+		if n, ok = t.child(n, p[0]); !ok {
+			return
+		}
+		lcp := longestCommonPrefix(p, n.key)
+		if lcp < len(p) && lcp < len(n.key) {
+			return
+		}
+		path = append(path, n.key...)
+		p = p[lcp:]
+	}
+	if ok {
+		t.iterate(n, path, callback)
+	}
+}
+
+func (t *StaticTrie) iterate(n staticNode, path []byte, callback func(key, value []byte)) {
+	if n.flags&staticEndpoint != 0 {
+		callback(path, n.value)
+	}
+	for i := range n.first {
+		if child, ok := t.childAt(n, i); ok {
+			t.iterate(child, append(path[:len(path):len(path)], child.key...), callback)
+		}
+	}
+}
+
+// GetBranch returns all of the keys which have a prefix of the prefix argument
+// (inclusive,) in order
+func (t *StaticTrie) GetBranch(prefix interface{}) [][]byte {
+	var rval = [][]byte{}
+	t.IterateFrom(prefix, func(key, _ []byte) {
+		rval = append(rval, key)
+	})
+	return rval
+}
+
+// Count returns the number of keys in the trie.  Internally it uses the
+// Iterate function to do this
+func (t *StaticTrie) Count() int {
+	n := 0
+	t.Iterate(func(_, _ []byte) { n++ })
+	return n
+}
+
+type staticPending struct {
+	depth    int
+	flags    byte
+	value    []byte
+	first    []byte
+	children []uint64
+}
+
+// StaticBuilder writes a static trie, see StaticTrie.  Keys must be added in
+// strictly increasing order, which lets the builder write the trie out as it
+// goes, holding only the nodes along the path to the last key in memory.
+//
+//	f, _ := os.Create("words.trie")
+//	b := trie.NewStaticBuilder(f)
+//	for _, word := range sortedWords {
+//		b.Add([]byte(word), nil)
+//	}
+//	b.Close()
+//	f.Close()
+type StaticBuilder struct {
+	w      *bufio.Writer
+	offset uint64
+	stack  []*staticPending
+	prev   []byte
+	count  int
+	err    error
+	closed bool
+}
+
+// NewStaticBuilder returns a StaticBuilder which writes to w.
+func NewStaticBuilder(w io.Writer) *StaticBuilder {
+	b := &StaticBuilder{
+		w:     bufio.NewWriter(w),
+		stack: []*staticPending{{}},
+	}
+	b.write([]byte(staticMagic))
+	b.write([]byte{staticVersion})
+	return b
+}
+
+func (b *StaticBuilder) write(p []byte) {
+	if b.err != nil {
+		return
+	}
+	n, err := b.w.Write(p)
+	b.offset += uint64(n)
+	b.err = err
+}
+
+func (b *StaticBuilder) writeUvarint(v uint64) {
+	b.write(binary.AppendUvarint(nil, v))
+}
+
+// Add adds a key, and its value, to the trie.  Pass a nil value for keys which
+// have no value.  Keys must be added in strictly increasing order
+func (b *StaticBuilder) Add(key, value []byte) error {
+	if b.closed {
+		return ErrClosed
+	}
+	if b.err != nil {
+		return b.err
+	}
+	if b.count > 0 && bytes.Compare(key, b.prev) <= 0 {
+		return ErrUnsorted
+	}
+	b.count++
+
+	// Everything deeper than the part of the key shared with the previous key
+	// is finished and can be written out
+	lcp := longestCommonPrefix(b.prev, key)
+	b.flush(lcp)
+
+	pending := &staticPending{depth: len(key), flags: staticEndpoint}
+	if value != nil {
+		pending.flags |= staticValue
+		pending.value = bytes.Clone(value)
+	}
+	if len(key) == lcp {
+		// Only possible for an empty first key, which belongs to the root
+		b.stack[0].flags, b.stack[0].value = pending.flags, pending.value
+	} else {
+		b.stack = append(b.stack, pending)
+	}
+	b.prev = append(b.prev[:0], key...)
+	return b.err
+}
+
+// flush writes out every pending node deeper than depth
+func (b *StaticBuilder) flush(depth int) {
+	for b.stack[len(b.stack)-1].depth > depth {
+		n := b.stack[len(b.stack)-1]
+		b.stack = b.stack[:len(b.stack)-1]
+		parent := b.stack[len(b.stack)-1]
+		if parent.depth < depth {
+			// The new key branches off part way along this node's key, so it
+			// needs a new parent where they part ways
+			parent = &staticPending{depth: depth}
+			b.stack = append(b.stack, parent)
+		}
+		b.writeNode(n, b.prev[parent.depth:n.depth], parent)
+	}
+}
+
+func (b *StaticBuilder) writeNode(n *staticPending, key []byte, parent *staticPending) {
+	offset := b.offset
+	b.write([]byte{n.flags})
+	b.writeUvarint(uint64(len(key)))
+	b.write(key)
+	if n.flags&staticValue != 0 {
+		b.writeUvarint(uint64(len(n.value)))
+		b.write(n.value)
+	}
+	b.writeUvarint(uint64(len(n.children)))
+	b.write(n.first)
+	for _, child := range n.children {
+		b.write(binary.LittleEndian.AppendUint64(nil, child))
+	}
+	if parent != nil {
+		parent.first = append(parent.first, key[0])
+		parent.children = append(parent.children, offset)
+	}
+}
+
+// Close writes out the rest of the trie.  It does not close the underlying
+// writer
+func (b *StaticBuilder) Close() error {
+	if b.closed {
+		return ErrClosed
+	}
+	b.closed = true
+	b.flush(0)
+	root := b.offset
+	b.writeNode(b.stack[0], nil, nil)
+	b.write(binary.LittleEndian.AppendUint64(nil, root))
+	b.write([]byte(staticMagic))
+	if b.err == nil {
+		b.err = b.w.Flush()
+	}
+	return b.err
+}
+
+// WriteStatic writes the trie to w as a static trie, see StaticTrie.  Values
+// stored in KV tries are encoded with the trie's Codec.  Weights (see
+// SetWeight) are not written
+func (t *Trie) WriteStatic(w io.Writer) error {
+	var codec Codec[interface{}]
+	if _, bw := t.root.(*bwTrie); !bw {
+		codec = t.valueCodec()
+	}
+	return writeStatic(w, t.root, codec)
+}
+
+// WriteStatic is the concurrency safe version of Trie.WriteStatic, see
+// ConcurrentTrie.WriteTo
+func (t *ConcurrentTrie) WriteStatic(w io.Writer) error {
+	return t.load().WriteStatic(w)
+}
+
+// WriteStatic writes the trie to w as a static trie, see StaticTrie.  Values
+// are encoded with the trie's Codec
+func (t *KVTrie[K, V]) WriteStatic(w io.Writer) error {
+	return writeStatic[V](w, t.root, t.valueCodec())
+}
+
+func writeStatic[V any](w io.Writer, root node[V], codec Codec[V]) error {
+	b := NewStaticBuilder(w)
+	var err error
+	iterateInOrder(root, []byte{}, func(key []byte, value V) bool {
+		var data []byte
+		if codec != nil {
+			if data, err = codec.Encode(value); err != nil {
+				return false
+			}
+			if data == nil {
+				data = []byte{}
+			}
+		}
+		err = b.Add(key, data)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	return b.Close()
+}
@@ -0,0 +1,195 @@
+package trie
+
+import "fmt"
+
+// Strict is a view of a Trie which reports keys it can't use as errors.  The
+// methods of Trie itself quietly ignore keys of an unsupported type (Set and
+// Add do nothing, Exists is false) which makes a mistake like passing an int
+// where a string was meant easy to miss.  The methods of Strict do the same
+// things as the Trie methods of the same name, but return ErrKeyType for keys
+// of the wrong type, ErrKeyTooLong for keys longer than WithMaxKeyLength
+// allows, and whatever error MarshalText returns for an
+// encoding.TextMarshaler.
+//
+//	if _, _, err := t.Strict().Set(key, value); err != nil {
+//		return err
+//	}
+type Strict struct {
+	trie *Trie
+	// concurrent is the ConcurrentTrie the view is of, if it is of one, in
+	// which case trie is unused
+	concurrent *ConcurrentTrie
+}
+
+// Strict returns a strict view of the trie
+func (t *Trie) Strict() *Strict {
+	return &Strict{trie: t}
+}
+
+// Strict returns a strict view of the trie, which reads and changes it the
+// same way the ConcurrentTrie does
+func (t *ConcurrentTrie) Strict() *Strict {
+	return &Strict{concurrent: t}
+}
+
+// check returns the error the Trie methods would quietly ignore key for, if
+// there is one.  Once it has passed key goes to the Trie method as it is, so
+// that it is encoded and normalized the same way as it would have been
+func (s *Strict) check(t *Trie, key interface{}, adding bool) error {
+	k, err := t.encodeKey(key)
+	if err != nil {
+		return err
+	}
+	if adding && t.tooLong(k) {
+		return fmt.Errorf("%w: %d bytes", ErrKeyTooLong, len(k))
+	}
+	return nil
+}
+
+// read returns the trie to read from, the current version of it for a
+// ConcurrentTrie
+func (s *Strict) read() *Trie {
+	if s.concurrent != nil {
+		return s.concurrent.load()
+	}
+	return s.trie
+}
+
+// write runs fn against the trie to be changed, see ConcurrentTrie.write
+func (s *Strict) write(fn func(*Trie)) {
+	if s.concurrent != nil {
+		s.concurrent.write(fn)
+	} else {
+		fn(s.trie)
+	}
+}
+
+// Set is Trie.Set, returning an error for a bad key
+func (s *Strict) Set(key interface{}, data ...interface{}) (old interface{}, existed bool, err error) {
+	s.write(func(t *Trie) {
+		if err = s.check(t, key, true); err == nil {
+			old, existed = t.Set(key, data...)
+		}
+	})
+	return old, existed, err
+}
+
+// Add is Trie.Add, returning an error for a bad key
+func (s *Strict) Add(key interface{}, data ...interface{}) (added bool, err error) {
+	s.write(func(t *Trie) {
+		if err = s.check(t, key, true); err == nil {
+			added = t.Add(key, data...)
+		}
+	})
+	return added, err
+}
+
+// Upsert is Trie.Upsert, returning an error for a bad key.  fn is not called
+// for a bad key
+func (s *Strict) Upsert(key interface{}, fn func(old interface{}, exists bool) interface{}) (value interface{}, err error) {
+	s.write(func(t *Trie) {
+		if err = s.check(t, key, true); err == nil {
+			value = t.Upsert(key, fn)
+		}
+	})
+	return value, err
+}
+
+// CompareAndSwap is Trie.CompareAndSwap, returning an error for a bad key
+func (s *Strict) CompareAndSwap(key, old, new interface{}) (swapped bool, err error) {
+	s.write(func(t *Trie) {
+		if err = s.check(t, key, false); err == nil {
+			swapped = t.CompareAndSwap(key, old, new)
+		}
+	})
+	return swapped, err
+}
+
+// GetOrInsert is Trie.GetOrInsert, returning an error for a bad key
+func (s *Strict) GetOrInsert(key, value interface{}) (actual interface{}, loaded bool, err error) {
+	s.write(func(t *Trie) {
+		if err = s.check(t, key, true); err == nil {
+			actual, loaded = t.GetOrInsert(key, value)
+		}
+	})
+	return actual, loaded, err
+}
+
+// Del is Trie.Del, returning an error for a bad key
+func (s *Strict) Del(key interface{}) (old interface{}, existed bool, err error) {
+	s.write(func(t *Trie) {
+		if err = s.check(t, key, false); err == nil {
+			old, existed = t.Del(key)
+		}
+	})
+	return old, existed, err
+}
+
+// Drop is Trie.Drop, returning an error for a bad key
+func (s *Strict) Drop(key interface{}) (dropped int, err error) {
+	s.write(func(t *Trie) {
+		if err = s.check(t, key, false); err == nil {
+			dropped = t.Drop(key)
+		}
+	})
+	return dropped, err
+}
+
+// DropFunc is Trie.DropFunc, returning an error for a bad prefix.  callback is
+// not called for a bad prefix
+func (s *Strict) DropFunc(prefix interface{}, callback IterFunc) (dropped int, err error) {
+	s.write(func(t *Trie) {
+		if err = s.check(t, prefix, false); err == nil {
+			dropped = t.DropFunc(prefix, callback)
+		}
+	})
+	return dropped, err
+}
+
+// Exists is Trie.Exists, returning an error for a bad key
+func (s *Strict) Exists(key interface{}) (bool, error) {
+	t := s.read()
+	if err := s.check(t, key, false); err != nil {
+		return false, err
+	}
+	return t.Exists(key), nil
+}
+
+// Get is Trie.Get, returning an error for a bad key
+func (s *Strict) Get(key interface{}) (bool, interface{}, error) {
+	t := s.read()
+	if err := s.check(t, key, false); err != nil {
+		return false, nil, err
+	}
+	exists, value := t.Get(key)
+	return exists, value, nil
+}
+
+// GetBranch is Trie.GetBranch, returning an error for a bad prefix
+func (s *Strict) GetBranch(prefix interface{}) ([][]byte, error) {
+	t := s.read()
+	if err := s.check(t, prefix, false); err != nil {
+		return nil, err
+	}
+	return t.GetBranch(prefix), nil
+}
+
+// IterateFrom is Trie.IterateFrom, returning an error for a bad prefix
+func (s *Strict) IterateFrom(prefix interface{}, callback IterFunc) error {
+	t := s.read()
+	if err := s.check(t, prefix, false); err != nil {
+		return err
+	}
+	t.IterateFrom(prefix, callback)
+	return nil
+}
+
+// WalkFrom is Trie.WalkFrom, returning an error for a bad prefix
+func (s *Strict) WalkFrom(prefix interface{}, callback WalkFunc) error {
+	t := s.read()
+	if err := s.check(t, prefix, false); err != nil {
+		return err
+	}
+	t.WalkFrom(prefix, callback)
+	return nil
+}
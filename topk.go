@@ -0,0 +1,174 @@
+package trie
+
+import (
+	"bytes"
+	"container/heap"
+)
+
+// Completion is one of the keys found by TopK, along with its value and weight
+type Completion[K Key, V any] struct {
+	Key    K
+	Value  V
+	Weight float64
+}
+
+// topKItem is either a key waiting to be returned, or a node which hasn't been
+// looked into yet, in which case weight is the best weight beneath it
+type topKItem[V any] struct {
+	n      node[V]
+	path   []byte
+	weight float64
+	key    bool
+}
+
+// topKQueue is a max heap ordered by weight, then by key so that ties come out
+// in order.  A node sorts no later than anything beneath it in both respects,
+// so by the time a key comes out of the queue nothing left can beat it
+type topKQueue[V any] []topKItem[V]
+
+func (q topKQueue[V]) Len() int { return len(q) }
+
+func (q topKQueue[V]) Less(i, j int) bool {
+	if q[i].weight != q[j].weight {
+		return q[i].weight > q[j].weight
+	}
+	if c := bytes.Compare(q[i].path, q[j].path); c != 0 {
+		return c < 0
+	}
+	return q[i].key && !q[j].key
+}
+
+func (q topKQueue[V]) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *topKQueue[V]) Push(x any) { *q = append(*q, x.(topKItem[V])) }
+
+func (q *topKQueue[V]) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// branches calls fn with every node holding the keys which start with prefix,
+// and the path to it, which can be longer than prefix.  Usually there is just
+// the one, but in a Unicode trie a prefix which ends inside a rune can lead
+// into several siblings which all start with that much of it
+func branches[V any](n node[V], path, prefix []byte, fn func(node[V], []byte)) {
+	if len(prefix) == 0 {
+		fn(n, path)
+		return
+	}
+	for i := 0; i < n.numChildren(); i++ {
+		c := n.child(i)
+		lcp := longestCommonPrefix(prefix, c.edge())
+		switch {
+		case lcp == len(prefix):
+			fn(c, append(path[:len(path):len(path)], c.edge()...))
+		case lcp == len(c.edge()):
+			branches(c, append(path[:len(path):len(path)], c.edge()...), prefix[lcp:], fn)
+		}
+	}
+}
+
+// topK does a best first search for the k heaviest keys beneath prefix.  Each
+// node knows the heaviest key beneath it, so branches are only opened up when
+// they could still hold one of the k, and the search stops as soon as it has
+// k keys
+func topK[V any](root node[V], prefix []byte, k int, callback func([]byte, V, float64)) {
+	if k <= 0 {
+		return
+	}
+	q := &topKQueue[V]{}
+	branches(root, []byte{}, prefix, func(n node[V], path []byte) {
+		*q = append(*q, topKItem[V]{n: n, path: path, weight: n.maxWeight()})
+	})
+	heap.Init(q)
+	for q.Len() > 0 && k > 0 {
+		item := heap.Pop(q).(topKItem[V])
+		if item.key {
+			callback(item.path, item.n.val(), item.weight)
+			k--
+			continue
+		}
+		if item.n.isEndpoint() {
+			heap.Push(q, topKItem[V]{n: item.n, path: item.path, weight: item.n.weight(), key: true})
+		}
+		for i := 0; i < item.n.numChildren(); i++ {
+			c := item.n.child(i)
+			heap.Push(q, topKItem[V]{
+				n:      c,
+				path:   append(item.path[:len(item.path):len(item.path)], c.edge()...),
+				weight: c.maxWeight(),
+			})
+		}
+	}
+}
+
+// SetWeight sets the weight of a key which is already in the trie, for TopK,
+// and reports whether the key was there to be weighed.  Keys start out with a
+// weight of 0, keep their weight when their value is changed by Set, Upsert or
+// CompareAndSwap, and only lose it when they are deleted.  Only KV tries keep
+// weights, in a BW trie every key weighs 0 and SetWeight always returns false.
+// Weights are not saved by WriteTo or WriteStatic, so a trie read back in has
+// every key weighing 0 again
+func (t *Trie) SetWeight(key interface{}, weight float64) bool {
+	if _, bw := t.root.(*bwTrie); bw {
+		return false
+	}
+	k, ok := t.keyOf(key)
+	if !ok {
+		return false
+	}
+	t.thaw(k)
+	return t.root.(*kvTrie[interface{}]).setWeight(k, weight)
+}
+
+// TopK returns the k heaviest keys which begin with prefix, heaviest first.
+// Keys of equal weight come out in order.  Rather than looking at every key
+// beginning with prefix, TopK only looks into the branches of the trie which
+// could hold one of the k heaviest keys, which is what makes it suitable for
+// autocomplete
+//
+//	t.Set("apple", 1)
+//	t.SetWeight("apple", 10)
+//	t.Set("apricot", 2)
+//	t.SetWeight("apricot", 20)
+//	t.TopK("ap", 1) // apricot
+func (t *Trie) TopK(prefix interface{}, k int) []Completion[[]byte, interface{}] {
+	p, ok := t.keyOf(prefix)
+	if !ok {
+		return nil
+	}
+	var rval []Completion[[]byte, interface{}]
+	topK(t.root, p, k, func(key []byte, value interface{}, weight float64) {
+		rval = append(rval, Completion[[]byte, interface{}]{t.spell(key), value, weight})
+	})
+	return rval
+}
+
+// SetWeight sets the weight of a key which is already in the trie, for TopK.
+// See Trie.SetWeight
+func (t *KVTrie[K, V]) SetWeight(key K, weight float64) bool {
+	return t.root.setWeight([]byte(key), weight)
+}
+
+// TopK returns the k heaviest keys which begin with prefix, heaviest first.
+// See Trie.TopK
+func (t *KVTrie[K, V]) TopK(prefix K, k int) []Completion[K, V] {
+	var rval []Completion[K, V]
+	topK(t.root, []byte(prefix), k, func(key []byte, value V, weight float64) {
+		rval = append(rval, Completion[K, V]{K(key), value, weight})
+	})
+	return rval
+}
+
+// SetWeight is the concurrency safe version of Trie.SetWeight
+func (t *ConcurrentTrie) SetWeight(key interface{}, weight float64) (ok bool) {
+	t.write(func(next *Trie) { ok = next.SetWeight(key, weight) })
+	return ok
+}
+
+// TopK is the concurrency safe version of Trie.TopK
+func (t *ConcurrentTrie) TopK(prefix interface{}, k int) []Completion[[]byte, interface{}] {
+	return t.load().TopK(prefix, k)
+}
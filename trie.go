@@ -10,8 +10,14 @@ value in the trie attached to the trie.  Because the value is stored
 seperately from the existence of the key you can store nil values in the trie
 and be able to tell that apart from a key that does not exist.
 
+If all of the values you store in a KV trie are of the same type you can use
+NewKV to get a KVTrie instead.  A KVTrie is the same key-value trie but with
+its keys and values typed, so Get hands you back a V and not an interface{}.
+
 The data structures inside this package are NOT synchronized, you'll want to
-add a sync.Mutex or sync.RWMutex to your code if it needs to be thread safe.
+add a sync.Mutex or sync.RWMutex to your code if it needs to be thread safe,
+or use a ConcurrentTrie (see NewConcurrentBWTrie and NewConcurrentKVTrie)
+which does that for you.
 At this point in time I do consider the structures to be *mostly* safe to use
 concurrently without locking as long as you're willing to end up in a part of
 the trie that existed when you started making your call but not by the time
@@ -50,25 +56,100 @@ Example BW Trie usage
 */
 package trie
 
+import "iter"
+
+// RangeFlag changes the behavior of Range.  By default Range visits the keys
+// from start (inclusive) to end (exclusive) in ascending order.  Flags can be
+// combined with |
+type RangeFlag uint8
+
+const (
+	// ExcludeStart leaves the start key out of the range
+	ExcludeStart RangeFlag = 1 << iota
+	// IncludeEnd includes the end key in the range
+	IncludeEnd
+	// Reverse visits the range in descending order, from end to start
+	Reverse
+)
+
 // IterFunc describes the function signature that it required for the callback
-// portion of the Iterate function
+// portion of the Iterate function.  The key it is passed belongs to it, and
+// may be kept or modified, unless the trie was made WithSharedKeys
 type IterFunc func([]byte, interface{})
 
-type node interface {
-	get([]byte) (bool, interface{})
-	add([]byte, ...interface{})
-	set([]byte, ...interface{})
-	del([]byte)
+// WalkFunc is the callback used by Walk and WalkFrom.  Returning false from a
+// WalkFunc stops the walk, nothing more in the trie will be visited.  Keys are
+// passed the same way as to an IterFunc
+type WalkFunc func([]byte, interface{}) bool
+
+type node[V any] interface {
+	get([]byte, layout) (bool, V)
+	add([]byte, layout, ...V) bool
+	set([]byte, layout, ...V) (V, bool)
+	update([]byte, layout, func(V, bool) (V, bool)) (V, bool)
+	del([]byte) (V, bool)
 	drop([]byte)
-	iterate([]byte, IterFunc)
-	iterateFrom([]byte, IterFunc)
+	// thaw returns a copy of the node which can be changed along the path to
+	// a key without changing the node, see Trie.shared
+	thaw([]byte) node[V]
+	iterate([]byte, func([]byte, V) bool) bool
+	iterateFrom([]byte, []byte, func([]byte, V) bool) bool
+	min([]byte) ([]byte, V, bool)
+	max([]byte) ([]byte, V, bool)
+	successor([]byte, []byte) ([]byte, V, bool)
+	predecessor([]byte, []byte) ([]byte, V, bool)
+	prefixesOf([]byte, int, func([]byte, V))
+	rangeScan([]byte, keyRange, bool, func([]byte, V) bool) bool
+	edge() []byte
+	isEndpoint() bool
+	val() V
+	weight() float64
+	maxWeight() float64
+	size() int
+	numChildren() int
+	child(int) node[V]
 	log(...int)
 }
 
 // Trie is the itnerface to your requested trie. This is the interface you'll
 // use whether you requested a BW trie or a KV trie.
+//
+// Keys can be strings or byte slices, or integers, which are stored big endian
+// so that they sort in numeric order (signed integers with their sign bit
+// flipped, so that negative numbers sort first, and int and uint as 8 bytes.)
+// Anything else which implements encoding.TextMarshaler or fmt.Stringer is
+// stored as its text.  Keys of any other type are quietly ignored, see Strict
+// for methods which return an error instead.
+//
+// The empty key (an empty string or a nil or empty byte slice) is a key like
+// any other.  It sorts before every other key, and since it is a prefix of
+// every key Drop("") empties the trie.  A nil value is a value like any other
+// too, a key set with a nil value exists.
+//
+// The trie keeps its own copy of every key added to it, so the slice a key was
+// passed in may be reused as soon as Set or Add returns.  Keys handed back by
+// the trie are copies too, see WithSharedKeys for iterating without them.
 type Trie struct {
-	root node
+	root    node[interface{}]
+	codec   Codec[interface{}]
+	unicode *Unicode
+	layout  layout
+	// maxKeyLength is the longest key Set and Add accept, 0 for no limit
+	maxKeyLength int
+	// sharedKeys hands iteration callbacks keys from a reused buffer rather
+	// than copies, see WithSharedKeys
+	sharedKeys bool
+	// spellings holds the spelling each key was first added with, for the
+	// keys where that differs from the key, see Unicode.KeepSpelling.  It is
+	// persistent so that the versions of a ConcurrentTrie can share it
+	spellings *PersistentTrie[[]byte, []byte]
+	// shared is set when the nodes of the trie may be shared with other
+	// versions of it, see ConcurrentTrie.  The path to a key is then thawed
+	// before the key is changed, so that the other versions don't see it
+	shared bool
+	// views is the number of transactions with changes waiting to be
+	// committed, whose views share nodes with the trie the same way, see Txn
+	views int
 }
 
 // NewTrie is a convenience function, it merely calls NewBWTrie. Please see the
@@ -82,21 +163,15 @@ func NewTrie() *Trie {
 // it.  The existence is the data. This kind of trie is useful for simple
 // "exists" stype lookups.
 func NewBWTrie() *Trie {
-	return &Trie{
-		root: &bwTrie{
-			children: []*bwTrie{},
-		},
-	}
+	return New()
 }
 
 // NewKVTrie returns a new Key/Value trie.  This is essentially a black and
 // white radix trie where each node has arbitrary data associated with it.
+// If you know the type of your data ahead of time you probably want NewKV
+// instead, which avoids the type assertions on every Get.
 func NewKVTrie() *Trie {
-	return &Trie{
-		root: &kvTrie{
-			children: []*kvTrie{},
-		},
-	}
+	return New(WithValues())
 }
 
 // Set allows you to set a key in your trie.  For BW tries the data argument
@@ -107,14 +182,17 @@ func NewKVTrie() *Trie {
 // with your key then you should pass that, not depend on the variadic.  The
 // difference between Set and Add is that Set will overwrite the existing value
 // in the trie. This is not useful for BW tries, but helps reduce boilerplate
-// code when using KV tries
-func (t *Trie) Set(key interface{}, data ...interface{}) {
-	switch key := key.(type) {
-	case []byte:
-		t.root.set(key, data...)
-	case string:
-		t.root.set([]byte(key), data...)
+// code when using KV tries.  Set returns the value it overwrote, and whether
+// the key existed, the value is always nil for BW tries.  Keys which are too
+// long for WithMaxKeyLength are silently ignored, see Strict
+func (t *Trie) Set(key interface{}, data ...interface{}) (old interface{}, existed bool) {
+	k, ok := t.keyOf(key)
+	if !ok || t.tooLong(k) {
+		return nil, false
 	}
+	t.remember(k, orig(key))
+	t.thaw(k)
+	return t.root.set(k, t.layout, data...)
 }
 
 // Add allows you to add a key to your trie.  For BW tries the data argument
@@ -122,37 +200,71 @@ func (t *Trie) Set(key interface{}, data ...interface{}) {
 // you wish, and it will be stored along with your key.  If you choose to
 // ommit the data value for a KV trie then the stored data will be nil. Only
 // the first data argument is recognized, so if you wish to store an array or
-// slice with your key you should pass that, not depend on the variadic
-func (t *Trie) Add(key interface{}, data ...interface{}) {
-	switch key := key.(type) {
-	case []byte:
-		t.root.add(key, data...)
-	case string:
-		t.root.add([]byte(key), data...)
+// slice with your key you should pass that, not depend on the variadic.  Add
+// reports whether it added the key, it is false if the key was already there,
+// or is too long for WithMaxKeyLength
+func (t *Trie) Add(key interface{}, data ...interface{}) bool {
+	k, ok := t.keyOf(key)
+	if !ok || t.tooLong(k) {
+		return false
 	}
+	t.remember(k, orig(key))
+	t.thaw(k)
+	return t.root.add(k, t.layout, data...)
 }
 
 // Drop allows you to cut an enitre branch off of your trie.  This means that
 // every existing key of which the passed key is a prefix string (inclusive)
-// will be removed from the trie.
-func (t *Trie) Drop(key interface{}) {
-	switch key := key.(type) {
-	case []byte:
-		t.root.drop(key)
-	case string:
-		t.root.drop([]byte(key))
+// will be removed from the trie.  Drop returns how many keys it removed, which
+// takes no extra work since every node keeps count of the keys beneath it
+func (t *Trie) Drop(key interface{}) int {
+	k, ok := t.keyOf(key)
+	if !ok {
+		return 0
+	}
+	return t.drop(k)
+}
+
+// DropFunc works the same as Drop except that callback is run against every
+// key, and its value, before they are removed, in order.  This saves looking
+// the keys up with GetBranch first when they need acting on, say to evict them
+// from a cache or to log them.  callback must not modify the trie
+func (t *Trie) DropFunc(prefix interface{}, callback IterFunc) int {
+	k, ok := t.keyOf(prefix)
+	if !ok {
+		return 0
 	}
+	t.root.iterateFrom([]byte{}, k, t.emit(keepGoing(callback)))
+	return t.drop(k)
+}
+
+func (t *Trie) drop(k []byte) int {
+	t.forget(k, true)
+	t.thaw(k)
+	before := t.root.size()
+	t.root.drop(k)
+	return before - t.root.size()
 }
 
 // Del allows you to remove a single key from the trie. Del will only delete
 // the exactly matching key, unlike drop, and is therefor considerably safer
-// unless you know why you would want to drop an entire prefix from your trie
-func (t *Trie) Del(key interface{}) {
-	switch key := key.(type) {
-	case []byte:
-		t.root.del(key)
-	case string:
-		t.root.del([]byte(key))
+// unless you know why you would want to drop an entire prefix from your trie.
+// Del returns the value the key had, and whether it existed
+func (t *Trie) Del(key interface{}) (old interface{}, existed bool) {
+	k, ok := t.keyOf(key)
+	if !ok {
+		return nil, false
+	}
+	t.forget(k, false)
+	t.thaw(k)
+	return t.root.del(k)
+}
+
+// thaw makes the nodes along the path to k safe to change, when they might be
+// shared with other versions of the trie
+func (t *Trie) thaw(k []byte) {
+	if t.shared || t.views > 0 {
+		t.root = t.root.thaw(k)
 	}
 }
 
@@ -160,16 +272,12 @@ func (t *Trie) Del(key interface{}) {
 // only returns asingle boolean value it's convenient to use inside of if
 // statements
 func (t *Trie) Exists(key interface{}) bool {
-	switch key := key.(type) {
-	case []byte:
-		k, _ := t.root.get(key)
-		return k
-	case string:
-		k, _ := t.root.get([]byte(key))
-		return k
-	default:
+	k, ok := t.keyOf(key)
+	if !ok {
 		return false
 	}
+	exists, _ := t.root.get(k, t.layout)
+	return exists
 }
 
 // Get allows you to fetch a key from the trie.  If the trie is a BW trie then
@@ -177,30 +285,36 @@ func (t *Trie) Exists(key interface{}) bool {
 // the trie and nil for the data.  KV tries will return the data passed to add
 // as the second return value
 func (t *Trie) Get(key interface{}) (bool, interface{}) {
-	switch key := key.(type) {
-	case []byte:
-		return t.root.get(key)
-	case string:
-		return t.root.get([]byte(key))
-	default:
+	k, ok := t.keyOf(key)
+	if !ok {
 		return false, nil
 	}
+	return t.root.get(k, t.layout)
 }
 
 // GetBranch returns all of the keys which have a prefix of the prefix argument
-// (inclusive.)  Under the hood this simply uses IterateFrom
+// (inclusive,) in order.  Under the hood this simply walks the same branch as
+// IterateFrom
 func (t *Trie) GetBranch(prefix interface{}) [][]byte {
 	var rval = [][]byte{}
-	t.IterateFrom(prefix, func(key []byte, _ interface{}) {
-		rval = append(rval, key)
+	k, ok := t.keyOf(prefix)
+	if !ok {
+		return rval
+	}
+	// the keys are kept, so they're copied even for WithSharedKeys
+	t.root.iterateFrom([]byte{}, k, func(key []byte, _ interface{}) bool {
+		rval = append(rval, t.own(key))
+		return true
 	})
 	return rval
 }
 
 // Iterate allows you to run a function against every key inserted into the
-// trie.
+// trie.  Keys are always visited in byte-wise lexicographical order, which is
+// also the order used by IterateFrom, GetBranch, Min, Max, Successor and
+// Predecessor
 func (t *Trie) Iterate(callback IterFunc) {
-	t.root.iterate([]byte{}, callback)
+	t.root.iterate([]byte{}, t.emit(keepGoing(callback)))
 }
 
 // IterateFrom works the same as Iterate except that it only iterates on keys
@@ -209,12 +323,147 @@ func (t *Trie) Iterate(callback IterFunc) {
 // specific subset of keys because it traverses the trie before starting the
 // callback iteration
 func (t *Trie) IterateFrom(prefix interface{}, callback IterFunc) {
-	switch prefix := prefix.(type) {
-	case []byte:
-		t.root.iterateFrom(prefix, callback)
-	case string:
-		t.root.iterateFrom([]byte(prefix), callback)
+	k, ok := t.keyOf(prefix)
+	if !ok {
+		return
+	}
+	t.root.iterateFrom([]byte{}, k, t.emit(keepGoing(callback)))
+}
+
+// Walk works the same as Iterate except that the walk stops as soon as
+// callback returns false
+func (t *Trie) Walk(callback WalkFunc) {
+	t.root.iterate([]byte{}, t.emit(callback))
+}
+
+// WalkFrom works the same as IterateFrom except that the walk stops as soon as
+// callback returns false.  This is handy for things like autocomplete where you
+// only want the first few keys with a given prefix
+func (t *Trie) WalkFrom(prefix interface{}, callback WalkFunc) {
+	k, ok := t.keyOf(prefix)
+	if !ok {
+		return
+	}
+	t.root.iterateFrom([]byte{}, k, t.emit(callback))
+}
+
+// All returns an iterator over every key and value in the trie, in order.
+//
+//	for key, value := range trie.All() {
+//		...
+//	}
+func (t *Trie) All() iter.Seq2[[]byte, interface{}] {
+	return func(yield func([]byte, interface{}) bool) {
+		t.root.iterate([]byte{}, t.emit(yield))
+	}
+}
+
+// WithPrefix returns an iterator over every key, and value, for which prefix
+// is a prefix (inclusive,) in order.
+func (t *Trie) WithPrefix(prefix interface{}) iter.Seq2[[]byte, interface{}] {
+	return func(yield func([]byte, interface{}) bool) {
+		t.WalkFrom(prefix, yield)
+	}
+}
+
+// Backward returns an iterator over every key and value in the trie in
+// reverse order.
+func (t *Trie) Backward() iter.Seq2[[]byte, interface{}] {
+	return func(yield func([]byte, interface{}) bool) {
+		t.root.rangeScan([]byte{}, keyRange{}, true, t.emit(yield))
+	}
+}
+
+// Range runs callback against every key in the trie between start and end, in
+// order.  By default start is inclusive and end is exclusive, see RangeFlag for
+// how to change that, or to iterate in reverse.  A nil or empty start or end
+// leaves that side of the range open.  Branches of the trie which fall entirely
+// outside of the range are never visited.  If start or end is not a valid key
+// then callback is never called
+//
+//	trie.Range("events/2026-10-01", "events/2026-10-15", trie.IncludeEnd, callback)
+func (t *Trie) Range(start, end interface{}, flags RangeFlag, callback IterFunc) {
+	var s, e []byte
+	var ok bool
+	if start != nil {
+		if s, ok = t.keyOf(start); !ok {
+			return
+		}
+	}
+	if end != nil {
+		if e, ok = t.keyOf(end); !ok {
+			return
+		}
+	}
+	t.root.rangeScan([]byte{}, newKeyRange(s, e, flags), flags&Reverse != 0, t.emit(keepGoing(callback)))
+}
+
+// Min returns the smallest key in the trie, and its value.  If the trie is
+// empty then ok is false
+func (t *Trie) Min() (key []byte, value interface{}, ok bool) {
+	key, value, ok = t.root.min([]byte{})
+	return t.spell(key), value, ok
+}
+
+// Max returns the largest key in the trie, and its value.  If the trie is
+// empty then ok is false
+func (t *Trie) Max() (key []byte, value interface{}, ok bool) {
+	key, value, ok = t.root.max([]byte{})
+	return t.spell(key), value, ok
+}
+
+// Successor returns the smallest key in the trie which sorts after the key
+// argument, and its value.  The key argument does not need to exist in the
+// trie.  If there is no such key then ok is false
+func (t *Trie) Successor(key interface{}) (next []byte, value interface{}, ok bool) {
+	k, ok := t.keyOf(key)
+	if !ok {
+		return nil, nil, false
 	}
+	next, value, ok = t.root.successor([]byte{}, k)
+	return t.spell(next), value, ok
+}
+
+// Predecessor returns the largest key in the trie which sorts before the key
+// argument, and its value.  The key argument does not need to exist in the
+// trie.  If there is no such key then ok is false
+func (t *Trie) Predecessor(key interface{}) (prev []byte, value interface{}, ok bool) {
+	k, ok := t.keyOf(key)
+	if !ok {
+		return nil, nil, false
+	}
+	prev, value, ok = t.root.predecessor([]byte{}, k)
+	return t.spell(prev), value, ok
+}
+
+// LongestPrefix finds the longest key in the trie which is a prefix of the key
+// argument (inclusive.)  This is the kind of lookup you want when routing
+// things like URL paths or hostnames through the trie.  The matched key which
+// is returned is a slice of the key as the trie sees it, which is the key
+// argument itself or, for a Unicode trie, its normalized form.  A trie which
+// keeps spellings (see Unicode.KeepSpelling) returns it spelled as it was
+// added instead.  For BW tries the value is always nil.  If no key in the
+// trie is a prefix of key then ok is false
+func (t *Trie) LongestPrefix(key interface{}) (matchedKey []byte, value interface{}, ok bool) {
+	t.AllPrefixes(key, func(k []byte, v interface{}) {
+		matchedKey, value, ok = k, v, true
+	})
+	return
+}
+
+// AllPrefixes runs callback against every key in the trie which is a prefix of
+// the key argument (inclusive,) shortest first.  The trie is only descended
+// once no matter how many prefixes are found.  The keys passed to callback are
+// slices of the key, normalized or spelled as they were added, the same as for
+// LongestPrefix
+func (t *Trie) AllPrefixes(key interface{}, callback IterFunc) {
+	k, ok := t.keyOf(key)
+	if !ok {
+		return
+	}
+	t.root.prefixesOf(k, 0, func(k []byte, v interface{}) {
+		callback(t.spell(k), v)
+	})
 }
 
 // Log prints a "pretty" representation of the trie. This is mainly useful for
@@ -224,10 +473,8 @@ func (t *Trie) Log() {
 	t.root.log(0)
 }
 
-// Count returns the number of keys in the trie.  Internally it uses the
-// Iterate function to do this
+// Count returns the number of keys in the trie.  Every node keeps count of
+// the keys beneath it so this takes no time at all
 func (t *Trie) Count() int {
-	n := 0
-	t.Iterate(func(_ []byte, _ interface{}) { n++ })
-	return n
+	return t.root.size()
 }
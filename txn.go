@@ -0,0 +1,271 @@
+package trie
+
+import (
+	"bytes"
+	"iter"
+)
+
+type txnOpKind uint8
+
+const (
+	txnSet txnOpKind = iota
+	txnAdd
+	txnDel
+	txnDrop
+)
+
+type txnOp struct {
+	kind  txnOpKind
+	key   []byte
+	value interface{}
+	// spelling is the key as it was given, see Unicode.KeepSpelling
+	spelling []byte
+}
+
+// Txn is a transaction against a Trie.  Changes made through a Txn do not
+// touch the trie until Commit is called, at which point they are all applied
+// at once.  Reads made through the Txn see the changes made in the Txn, on top
+// of the trie as it was when the Txn made its first change.
+//
+//	txn := t.Txn()
+//	txn.Drop("config/")
+//	txn.Set("config/mode", "fast")
+//	txn.Get("config/mode") // true, "fast"
+//	t.Get("config/mode")   // whatever it was before
+//	txn.Commit()
+//
+// The changes are made straight away to a view of the trie which shares every
+// node it can with the trie, the same way the versions of a ConcurrentTrie
+// do, so reading through the Txn costs the same as reading from the trie.
+// While a Txn has changes waiting to be committed the trie copies the nodes it
+// changes too, rather than changing them under the view, so a Txn should be
+// committed or discarded once it is finished with.
+//
+// A transaction on a ConcurrentTrie is committed as a single new version of
+// the trie, so no reader ever sees part of it.  A Txn itself is not safe to
+// use from more than one goroutine at a time.
+type Txn struct {
+	trie *Trie
+	// concurrent is the ConcurrentTrie the transaction is against, if it is
+	// against one, in which case trie is unused
+	concurrent *ConcurrentTrie
+	// view is the trie with the changes made, once there are any, and root
+	// and spellings are what the trie had when view was made from it
+	view      *Trie
+	root      node[interface{}]
+	spellings *PersistentTrie[[]byte, []byte]
+	ops       []txnOp
+}
+
+// Txn starts a new transaction against the trie
+func (t *Trie) Txn() *Txn {
+	return &Txn{trie: t}
+}
+
+// Txn starts a new transaction against the trie
+func (t *ConcurrentTrie) Txn() *Txn {
+	return &Txn{concurrent: t}
+}
+
+// base returns the trie the transaction is against, the current version of it
+// for a ConcurrentTrie
+func (x *Txn) base() *Trie {
+	if x.concurrent != nil {
+		return x.concurrent.load()
+	}
+	return x.trie
+}
+
+// read returns the trie to read from, which is the view once there are
+// changes
+func (x *Txn) read() *Trie {
+	if x.view != nil {
+		return x.view
+	}
+	return x.base()
+}
+
+// begin makes the view the changes are made to
+func (x *Txn) begin() {
+	base := x.base()
+	view := *base
+	view.shared, view.views = true, 0
+	// the trie may be adding keys to the arena at the same time
+	view.layout.arena = nil
+	x.view, x.root, x.spellings = &view, base.root, base.spellings
+	if x.concurrent == nil {
+		x.trie.views++
+	}
+}
+
+func (x *Txn) push(kind txnOpKind, key interface{}, data []interface{}) {
+	t := x.read()
+	k, ok := t.keyOf(key)
+	if !ok || ((kind == txnSet || kind == txnAdd) && t.tooLong(k)) {
+		return
+	}
+	op := txnOp{kind: kind, key: bytes.Clone(k)}
+	if op.key == nil {
+		op.key = []byte{}
+	}
+	if t.spellings != nil && (kind == txnSet || kind == txnAdd) {
+		op.spelling = bytes.Clone(orig(key))
+	}
+	if _, bw := t.root.(*bwTrie); !bw && len(data) > 0 {
+		// BW tries ignore their data, so reads from the txn should too
+		op.value = data[0]
+	}
+	if x.view == nil {
+		x.begin()
+	}
+	x.ops = append(x.ops, op)
+	op.apply(x.view)
+}
+
+// Set makes a Trie.Set part of the transaction
+func (x *Txn) Set(key interface{}, data ...interface{}) {
+	x.push(txnSet, key, data)
+}
+
+// Add makes a Trie.Add part of the transaction
+func (x *Txn) Add(key interface{}, data ...interface{}) {
+	x.push(txnAdd, key, data)
+}
+
+// Del makes a Trie.Del part of the transaction
+func (x *Txn) Del(key interface{}) {
+	x.push(txnDel, key, nil)
+}
+
+// Drop makes a Trie.Drop part of the transaction
+func (x *Txn) Drop(key interface{}) {
+	x.push(txnDrop, key, nil)
+}
+
+// Get works the same as Trie.Get, but includes the changes made in the
+// transaction
+func (x *Txn) Get(key interface{}) (bool, interface{}) {
+	return x.read().Get(key)
+}
+
+// Exists works the same as Trie.Exists, but includes the changes made in the
+// transaction
+func (x *Txn) Exists(key interface{}) bool {
+	return x.read().Exists(key)
+}
+
+// GetBranch works the same as Trie.GetBranch, but includes the changes made in
+// the transaction
+func (x *Txn) GetBranch(prefix interface{}) [][]byte {
+	return x.read().GetBranch(prefix)
+}
+
+// Iterate works the same as Trie.Iterate, but includes the changes made in
+// the transaction.  callback must not change the transaction
+func (x *Txn) Iterate(callback IterFunc) {
+	x.read().Iterate(callback)
+}
+
+// IterateFrom works the same as Trie.IterateFrom, but includes the changes
+// made in the transaction.  callback must not change the transaction
+func (x *Txn) IterateFrom(prefix interface{}, callback IterFunc) {
+	x.read().IterateFrom(prefix, callback)
+}
+
+// Walk works the same as Trie.Walk, but includes the changes made in the
+// transaction.  callback must not change the transaction
+func (x *Txn) Walk(callback WalkFunc) {
+	x.read().Walk(callback)
+}
+
+// WalkFrom works the same as Trie.WalkFrom, but includes the changes made in
+// the transaction.  callback must not change the transaction
+func (x *Txn) WalkFrom(prefix interface{}, callback WalkFunc) {
+	x.read().WalkFrom(prefix, callback)
+}
+
+// All works the same as Trie.All, but includes the changes made in the
+// transaction
+func (x *Txn) All() iter.Seq2[[]byte, interface{}] {
+	return func(yield func([]byte, interface{}) bool) {
+		x.Walk(yield)
+	}
+}
+
+// WithPrefix works the same as Trie.WithPrefix, but includes the changes made
+// in the transaction
+func (x *Txn) WithPrefix(prefix interface{}) iter.Seq2[[]byte, interface{}] {
+	return func(yield func([]byte, interface{}) bool) {
+		x.WalkFrom(prefix, yield)
+	}
+}
+
+// Count works the same as Trie.Count, but includes the changes made in the
+// transaction
+func (x *Txn) Count() int {
+	return x.read().Count()
+}
+
+// Len returns the number of changes made in the transaction
+func (x *Txn) Len() int {
+	return len(x.ops)
+}
+
+// Commit applies all of the changes to the trie, in the order they were made.
+// When the trie hasn't been changed since the transaction began that is just a
+// matter of handing the view over to it.  Afterwards the Txn is empty and can
+// be used again
+func (x *Txn) Commit() {
+	if x.concurrent != nil {
+		x.concurrent.write(x.commit)
+	} else {
+		x.commit(x.trie)
+	}
+	x.Discard()
+}
+
+func (x *Txn) commit(t *Trie) {
+	if x.view == nil {
+		return
+	}
+	if t.root == x.root && t.spellings == x.spellings {
+		// While there is a view every change to the trie gives it a new
+		// root, see Trie.views, so nothing has happened to it since
+		t.root, t.spellings = x.view.root, x.view.spellings
+		return
+	}
+	for _, op := range x.ops {
+		op.apply(t)
+	}
+}
+
+// Discard throws away all of the changes without applying them.  Afterwards
+// the Txn is empty and can be used again
+func (x *Txn) Discard() {
+	if x.view != nil && x.concurrent == nil {
+		x.trie.views--
+	}
+	x.view, x.root, x.spellings = nil, nil, nil
+	x.ops = x.ops[:0]
+}
+
+func (op txnOp) apply(t *Trie) {
+	switch op.kind {
+	case txnSet:
+		t.remember(op.key, op.spelling)
+		t.thaw(op.key)
+		t.root.set(op.key, t.layout, op.value)
+	case txnAdd:
+		t.remember(op.key, op.spelling)
+		t.thaw(op.key)
+		t.root.add(op.key, t.layout, op.value)
+	case txnDel:
+		t.forget(op.key, false)
+		t.thaw(op.key)
+		t.root.del(op.key)
+	case txnDrop:
+		t.forget(op.key, true)
+		t.thaw(op.key)
+		t.root.drop(op.key)
+	}
+}
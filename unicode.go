@@ -0,0 +1,249 @@
+package trie
+
+import (
+	"bytes"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Unicode configures a trie to treat its keys as UTF-8 text rather than as
+// raw bytes.  It applies to string and []byte keys, the other key types are
+// stored as they encode.  See Trie.SetUnicode
+type Unicode struct {
+	// Normalize, if set, is applied to every key.  The usual choice is NFC
+	//
+	//	t.SetUnicode(trie.Unicode{Normalize: trie.NFC})
+	//
+	// so that, for instance, a precomposed "é" and an "e" followed by a
+	// combining acute accent are the same key.  NFKC goes further and also
+	// folds compatibility characters such as "ﬁ" into "fi".  The forms from
+	// golang.org/x/text/unicode/norm, such as norm.NFC.Bytes, work too
+	Normalize func([]byte) []byte
+	// Fold case folds every key, so that keys which only differ in case are
+	// the same key.  Keys are stored, and iterated, folded.  Folding follows
+	// the same rules as strings.EqualFold, along with the full case foldings
+	// which turn one rune into several, so that "STRASSE" and "straße" are the
+	// same key too
+	Fold bool
+	// KeepSpelling hands keys back spelled the way they were when they were
+	// first added, rather than normalized and folded.  Looking keys up still
+	// ignores the differences, so with Fold the trie is case insensitive but
+	// case preserving.  Keys which are added again with another spelling keep
+	// their first one.  Spellings are not saved by WriteTo or WriteStatic
+	KeepSpelling bool
+}
+
+// key applies the normalization and case folding to k
+func (u *Unicode) key(k []byte) []byte {
+	if u.Fold {
+		k = foldKey(k)
+	}
+	if u.Normalize != nil {
+		k = u.Normalize(k)
+	}
+	return k
+}
+
+// foldKey returns a copy of k with every rune case folded.  Invalid UTF-8 is
+// copied over untouched
+func foldKey(k []byte) []byte {
+	folded := make([]byte, 0, len(k))
+	for len(k) > 0 {
+		r, size := utf8.DecodeRune(k)
+		if r == utf8.RuneError && size == 1 {
+			folded = append(folded, k[0])
+		} else if full, ok := fullFolds[r]; ok {
+			// The full foldings are given in terms of simple folding's
+			// choices, which aren't always foldRune's, so fold them again
+			for _, f := range full {
+				folded = utf8.AppendRune(folded, foldRune(f))
+			}
+		} else {
+			folded = utf8.AppendRune(folded, foldRune(r))
+		}
+		k = k[size:]
+	}
+	return folded
+}
+
+// foldRune picks one rune to stand for every rune which is equal to r under
+// simple case folding.  It is the lower case form of the smallest of them,
+// which is the one people expect for everything outside of a few oddities
+// like the Kelvin sign
+func foldRune(r rune) rune {
+	if unicode.SimpleFold(r) == r {
+		// r has no other cases
+		return r
+	}
+	least := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		least = min(least, f)
+	}
+	return unicode.ToLower(least)
+}
+
+// keyOf converts a key argument into the bytes stored in the trie, applying
+// the Unicode settings if there are any
+func (t *Trie) keyOf(key interface{}) ([]byte, bool) {
+	k, err := t.encodeKey(key)
+	return k, err == nil
+}
+
+// encodeKey is keyOf for the strict API, which wants to know what went wrong
+func (t *Trie) encodeKey(key interface{}) ([]byte, error) {
+	k, err := encodeKey(key)
+	if err != nil || t.unicode == nil {
+		return k, err
+	}
+	switch key.(type) {
+	case []byte, string:
+		// Only text is normalized and folded.  The other key types are
+		// stored as they encode, so that the integers 0x41 and 0x61 stay
+		// different keys
+		k = t.unicode.key(k)
+	}
+	return k, nil
+}
+
+// spelling looks up the spelling k was first added with in spellings, which
+// is nil for a trie which doesn't keep them
+func spelling(spellings *PersistentTrie[[]byte, []byte], k []byte) ([]byte, bool) {
+	if spellings == nil {
+		return nil, false
+	}
+	ok, s := spellings.root.get(k, layout{})
+	return s, ok
+}
+
+// spell returns a copy of the spelling k was first added with, when the trie
+// keeps them, or else k itself
+func (t *Trie) spell(k []byte) []byte {
+	if s, ok := spelling(t.spellings, k); ok {
+		return bytes.Clone(s)
+	}
+	return k
+}
+
+// own is spell for keys which are only borrowed from the trie, it always
+// returns a copy
+func (t *Trie) own(k []byte) []byte {
+	if s, ok := spelling(t.spellings, k); ok {
+		return bytes.Clone(s)
+	}
+	return bytes.Clone(k)
+}
+
+// emit wraps an iteration callback so that it is passed keys as they were
+// spelled.  The nodes iterate with a single buffer, so the keys are copied for
+// callback as well, unless the trie was made WithSharedKeys
+func (t *Trie) emit(callback func([]byte, interface{}) bool) func([]byte, interface{}) bool {
+	if !t.sharedKeys {
+		return func(k []byte, v interface{}) bool {
+			return callback(t.own(k), v)
+		}
+	}
+	if t.spellings == nil {
+		return callback
+	}
+	return func(k []byte, v interface{}) bool {
+		return callback(t.spell(k), v)
+	}
+}
+
+// remember records orig as the spelling of the key k, which is about to be
+// added, unless k is already in the trie and so already has a spelling
+func (t *Trie) remember(k, orig []byte) {
+	if t.spellings == nil || len(k) == 0 || bytes.Equal(k, orig) {
+		return
+	}
+	if exists, _ := t.root.get(k, t.layout); !exists {
+		t.spellings = t.spellings.Set(k, bytes.Clone(orig))
+	}
+}
+
+// forget throws away the spelling of k, which is about to be deleted, or
+// every spelling under k when it is a prefix about to be dropped
+func (t *Trie) forget(k []byte, prefix bool) {
+	if t.spellings == nil || t.spellings.Count() == 0 {
+		return
+	}
+	if prefix {
+		t.spellings = t.spellings.Drop(k)
+	} else {
+		t.spellings = t.spellings.Del(k)
+	}
+}
+
+// NewCaseInsensitiveBWTrie returns a new BW trie which ignores case, see
+// NewCaseInsensitiveKVTrie
+func NewCaseInsensitiveBWTrie() *Trie {
+	return New(WithCaseInsensitive())
+}
+
+// NewCaseInsensitiveKVTrie returns a new KV trie which ignores case.  Keys
+// which only differ in case are the same key, so Get, Drop, IterateFrom and
+// the rest all find keys whatever case they are given in, but keys are handed
+// back spelled the way they were first added.
+//
+//	t := trie.NewCaseInsensitiveKVTrie()
+//	t.Set("Content-Type", "text/plain")
+//	t.Get("content-type") // true, "text/plain"
+//	t.Set("CONTENT-TYPE", "text/html")
+//	t.GetBranch("content") // "Content-Type"
+//
+// It is the same as calling SetUnicode with Fold and KeepSpelling on a new KV
+// trie, so it also uses full Unicode case folding
+func NewCaseInsensitiveKVTrie() *Trie {
+	return New(WithValues(), WithCaseInsensitive())
+}
+
+// SetUnicode switches the trie into treating its keys as UTF-8 text.  Every
+// key passed to the trie from then on is normalized and case folded according
+// to u before it is used, whether it is being added, looked up or used as a
+// prefix.  The trie also stops splitting keys between nodes part way through
+// a rune, so every node holds valid UTF-8 (Log output stays readable) and
+// Fuzzy measures distances in runes rather than in bytes.
+//
+// Keys already in the trie are added again under the new rules.  If two of
+// them become the same key the value of the one which sorted first is kept.
+//
+// Glob and regular expression searches (Match and Regexp) see the keys as
+// they are stored, so a pattern for a case folded trie should be written in
+// lower case
+func (t *Trie) SetUnicode(u Unicode) {
+	t.unicode = &u
+	t.layout.split = runeBoundary
+	old, spellings := t.root, t.spellings
+	t.root = emptyLike(old)
+	t.spellings = nil
+	if u.KeepSpelling {
+		t.spellings = NewPersistent[[]byte, []byte]()
+	}
+	t.rebuild(old, spellings, []byte{})
+}
+
+func (t *Trie) rebuild(n node[interface{}], spellings *PersistentTrie[[]byte, []byte], path []byte) {
+	if n.isEndpoint() {
+		s, ok := spelling(spellings, path)
+		if !ok {
+			s = path
+		}
+		key := t.unicode.key(s)
+		if exists, _ := t.root.get(key, t.layout); !exists {
+			t.remember(key, s)
+			t.root.add(key, t.layout, n.val())
+			if root, ok := t.root.(*kvTrie[interface{}]); ok && n.weight() != 0 {
+				root.setWeight(key, n.weight())
+			}
+		}
+	}
+	for i := 0; i < n.numChildren(); i++ {
+		c := n.child(i)
+		t.rebuild(c, spellings, append(path[:len(path):len(path)], c.edge()...))
+	}
+}
+
+// SetUnicode is the concurrency safe version of Trie.SetUnicode
+func (t *ConcurrentTrie) SetUnicode(u Unicode) {
+	t.write(func(next *Trie) { next.SetUnicode(u) })
+}
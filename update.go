@@ -0,0 +1,123 @@
+package trie
+
+// Upsert sets the value of key to whatever fn returns.  fn is passed the value
+// key has now, and whether it exists at all, so that the new value can be
+// worked out from the old one in a single trip down the trie.
+//
+//	t.Upsert("hits", func(old interface{}, exists bool) interface{} {
+//		if !exists {
+//			return 1
+//		}
+//		return old.(int) + 1
+//	})
+//
+// Upsert returns the value it stored.  BW tries have no values, so for them
+// Upsert just adds the key, and returns nil
+func (t *Trie) Upsert(key interface{}, fn func(old interface{}, exists bool) interface{}) interface{} {
+	k, ok := t.keyOf(key)
+	if !ok || t.tooLong(k) {
+		return nil
+	}
+	t.remember(k, orig(key))
+	t.thaw(k)
+	var value interface{}
+	t.root.update(k, t.layout, func(old interface{}, exists bool) (interface{}, bool) {
+		value = fn(old, exists)
+		return value, true
+	})
+	if _, bw := t.root.(*bwTrie); bw {
+		return nil
+	}
+	return value
+}
+
+// CompareAndSwap stores new under key, but only if key exists and its value is
+// old, and reports whether it did.  As with sync.Map the old value must be of
+// a comparable type
+func (t *Trie) CompareAndSwap(key, old, new interface{}) (swapped bool) {
+	k, ok := t.keyOf(key)
+	if !ok {
+		return false
+	}
+	t.thaw(k)
+	t.root.update(k, t.layout, func(current interface{}, exists bool) (interface{}, bool) {
+		swapped = exists && current == old
+		return new, swapped
+	})
+	return swapped
+}
+
+// GetOrInsert returns the value of key if it exists, otherwise it adds key with
+// value and returns that.  loaded is true if the key already existed.  It is
+// Get and Add rolled into one, without the chance of another Add sneaking in
+// between them on a ConcurrentTrie
+func (t *Trie) GetOrInsert(key, value interface{}) (actual interface{}, loaded bool) {
+	k, ok := t.keyOf(key)
+	if !ok || t.tooLong(k) {
+		return nil, false
+	}
+	t.remember(k, orig(key))
+	t.thaw(k)
+	actual, loaded = t.root.update(k, t.layout, func(_ interface{}, exists bool) (interface{}, bool) {
+		return value, !exists
+	})
+	if _, bw := t.root.(*bwTrie); !loaded && !bw {
+		actual = value
+	}
+	return actual, loaded
+}
+
+// Upsert sets the value of key to whatever fn returns, which is passed the
+// value key has now and whether it exists.  It returns the value it stored.
+// See Trie.Upsert
+func (t *KVTrie[K, V]) Upsert(key K, fn func(old V, exists bool) V) V {
+	var value V
+	t.root.update([]byte(key), layout{}, func(old V, exists bool) (V, bool) {
+		value = fn(old, exists)
+		return value, true
+	})
+	return value
+}
+
+// CompareAndSwap stores new under key, but only if key exists and its value is
+// old, and reports whether it did.  V must be a comparable type, or at least
+// the values being compared must be, see Trie.CompareAndSwap
+func (t *KVTrie[K, V]) CompareAndSwap(key K, old, new V) (swapped bool) {
+	t.root.update([]byte(key), layout{}, func(current V, exists bool) (V, bool) {
+		swapped = exists && any(current) == any(old)
+		return new, swapped
+	})
+	return swapped
+}
+
+// GetOrInsert returns the value of key if it exists, otherwise it adds key with
+// value and returns that.  loaded is true if the key already existed
+func (t *KVTrie[K, V]) GetOrInsert(key K, value V) (actual V, loaded bool) {
+	actual, loaded = t.root.update([]byte(key), layout{}, func(_ V, exists bool) (V, bool) {
+		return value, !exists
+	})
+	if !loaded {
+		actual = value
+	}
+	return actual, loaded
+}
+
+// Upsert is the concurrency safe version of Trie.Upsert.  fn is called while
+// the writer's lock is held, so it may read from the trie but must not change
+// it
+func (t *ConcurrentTrie) Upsert(key interface{}, fn func(old interface{}, exists bool) interface{}) (value interface{}) {
+	t.write(func(next *Trie) { value = next.Upsert(key, fn) })
+	return value
+}
+
+// CompareAndSwap is the concurrency safe version of Trie.CompareAndSwap
+func (t *ConcurrentTrie) CompareAndSwap(key, old, new interface{}) (swapped bool) {
+	t.write(func(next *Trie) { swapped = next.CompareAndSwap(key, old, new) })
+	return swapped
+}
+
+// GetOrInsert is the concurrency safe version of Trie.GetOrInsert
+func (t *ConcurrentTrie) GetOrInsert(key, value interface{}) (actual interface{}, loaded bool) {
+	t.write(func(next *Trie) { actual, loaded = next.GetOrInsert(key, value) })
+	return actual, loaded
+}